@@ -0,0 +1,18 @@
+//go:build !js
+// +build !js
+
+/*
+   The report server as a single binary - the templates and static files
+   are built in.
+
+       go build -o tidepoolreport ./cmd/tidepoolreport
+       ./tidepoolreport            serve on localhost:3000
+       ./tidepoolreport -desktop   just for this computer, in the browser
+*/
+package main
+
+import tidepoolreport "github.com/edrobinson/TidepoolReport"
+
+func main() {
+	tidepoolreport.Run()
+}
@@ -0,0 +1,12 @@
+//Tell a desktop mode server the page is still open - see tidepoolDesktop.go.
+//The server answers 404 when it isn't in desktop mode and the pings stop.
+(function () {
+    function alive() {
+        fetch("/desktop/alive", {method: "POST"}).then(function (resp) {
+            if (resp.ok) {
+                setTimeout(alive, 30000);
+            }
+        }).catch(function () {});
+    }
+    alive();
+})();
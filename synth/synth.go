@@ -0,0 +1,324 @@
+/*
+   Package synth makes up Tidepool records - a pump and CGM user with a
+   meter - for demos, screenshots and benchmarks. The records are the
+   json Tidepool's data api sends, so anything that reads a Tidepool
+   download reads them.
+
+   Start from Default and change what's wanted:
+
+   	p := synth.Default()
+   	p.Start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+   	p.End = p.Start.AddDate(1, 0, 0)
+   	p.Mean = 160
+   	p.SensorGaps = 0.5
+   	data := synth.Generate(p)
+
+   Write streams the records instead, for datasets too big to hold.
+   Each device has an upload record naming its maker and model. The same
+   parameters always give the same records.
+*/
+package synth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+//Params - the kind of data to make
+type Params struct {
+	//The days covered, from midnight UTC on Start to the end of End
+	Start time.Time
+	End   time.Time
+
+	//Glucose in mg/dl away from meals and lows
+	Mean float64
+
+	//How far glucose wanders on its own - the spread of the 5 minute
+	//random walk in mg/dl. 0 for smooth curves.
+	Variability float64
+
+	//How far days differ from each other in mg/dl
+	DayToDay float64
+
+	//Rise in mg/dl per gram of carbs at the peak an hour after a meal
+	MealSpike float64
+
+	//Chance a day has a snack logged, a low (with the pump suspending)
+	//and a 2-3 hour CGM sensor gap - 0 to 1
+	Snacks     float64
+	Lows       float64
+	SensorGaps float64
+
+	//Minutes between CGM readings
+	CGMInterval int
+
+	//Meter readings are off from the CGM by this fraction at random
+	MeterError float64
+
+	//Seeds the random numbers - 0 to seed from Start
+	Seed int64
+}
+
+//Default - parameters for a fairly well managed adult over the last two weeks
+func Default() Params {
+	end := time.Now().UTC().Truncate(24 * time.Hour)
+	return Params{
+		Start:       end.AddDate(0, 0, -13),
+		End:         end,
+		Mean:        125,
+		Variability: 6,
+		DayToDay:    15,
+		MealSpike:   2,
+		Snacks:      1.0 / 3,
+		Lows:        0.25,
+		SensorGaps:  0.1,
+		CGMInterval: 5,
+		MeterError:  0.04,
+	}
+}
+
+//mg/dl in one mmol/L - Tidepool stores mmol/L
+const mmolFactor = 18.01559
+
+//Tidepool's device time layout
+const deviceTimeLayout = "2006-01-02T15:04:05"
+
+//The devices the records come from
+const (
+	Meter = "DemoMeter DM-0001"
+	CGM   = "DemoCGM DC-0001"
+	Pump  = "DemoPump DP-0001"
+)
+
+//What the upload records say about each device - the manufacturer and model
+var devices = []struct {
+	id, manufacturer, model string
+}{
+	{Meter, "Demo Medical", "Meter One"},
+	{CGM, "Demo Medical", "Sensor 5"},
+	{Pump, "Demo Medical", "Pump 2"},
+}
+
+//One day's plan - when the meals and lows are
+type dayPlan struct {
+	meals    []meal
+	offset   float64   //Some days just run higher or lower
+	lowAt    time.Time //Zero for a day without one
+	gapStart time.Time //Zero for a day without a sensor gap
+	gapEnd   time.Time
+}
+
+//A meal with its carbs
+type meal struct {
+	at    time.Time
+	carbs float64
+	snack bool //Logged as food without a bolus
+}
+
+//Writes the records
+type generator struct {
+	p      Params
+	rnd    *rand.Rand
+	enc    *json.Encoder
+	out    *bufio.Writer
+	nextID int
+	err    error
+}
+
+//Generate - the records as a json array
+func Generate(p Params) []byte {
+	var buf bytes.Buffer
+	Write(&buf, p) //Writes to a buffer don't fail
+	return buf.Bytes()
+}
+
+//Write - the records as a json array written to w a day at a time
+func Write(w io.Writer, p Params) error {
+	if p.CGMInterval <= 0 {
+		p.CGMInterval = 5
+	}
+	seed := p.Seed
+	if seed == 0 {
+		seed = p.Start.Unix()
+	}
+	out := bufio.NewWriter(w)
+	g := &generator{p: p, rnd: rand.New(rand.NewSource(seed)), out: out, enc: json.NewEncoder(out)}
+
+	out.WriteString("[")
+	start := p.Start.UTC().Truncate(24 * time.Hour)
+	//An upload record for each device, dated at the start so it's in the range
+	for _, d := range devices {
+		g.add("upload", d.id, start, map[string]interface{}{
+			"deviceManufacturers": []string{d.manufacturer},
+			"deviceModel":         d.model,
+			"deviceSerialNumber":  d.id[strings.LastIndex(d.id, " ")+1:],
+		})
+	}
+	noise := 0.0
+	for day := start; !day.After(p.End) && g.err == nil; day = day.AddDate(0, 0, 1) {
+		plan := g.planDay(day)
+		step := time.Duration(p.CGMInterval) * time.Minute
+		for t := day; t.Before(day.AddDate(0, 0, 1)); t = t.Add(step) {
+			noise = 0.95*noise + g.rnd.NormFloat64()*p.Variability
+			mgdl := g.glucoseAt(t, plan) + plan.offset + noise
+			if plan.gapStart.IsZero() || t.Before(plan.gapStart) || !t.Before(plan.gapEnd) {
+				g.glucose("cbg", CGM, t, mgdl)
+			}
+		}
+		g.dayEvents(day, plan)
+	}
+	out.WriteString("]")
+	if g.err != nil {
+		return g.err
+	}
+	return out.Flush()
+}
+
+//Pick the day's meals, any low and any sensor gap
+func (g *generator) planDay(day time.Time) dayPlan {
+	plan := dayPlan{offset: g.rnd.NormFloat64() * g.p.DayToDay}
+	at := func(hour, minute int) time.Time {
+		jitter := time.Duration(g.rnd.Intn(61)-30) * time.Minute
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + jitter)
+	}
+	plan.meals = []meal{
+		{at: at(7, 30), carbs: 30 + float64(g.rnd.Intn(30))},
+		{at: at(12, 30), carbs: 40 + float64(g.rnd.Intn(40))},
+		{at: at(18, 30), carbs: 50 + float64(g.rnd.Intn(40))},
+	}
+	if g.rnd.Float64() < g.p.Snacks {
+		plan.meals = append(plan.meals, meal{at: at(15, 30), carbs: 15 + float64(g.rnd.Intn(15)), snack: true})
+	}
+	if g.rnd.Float64() < g.p.Lows {
+		hour := 3
+		if g.rnd.Intn(2) == 0 {
+			hour = 16
+		}
+		plan.lowAt = at(hour, 0)
+	}
+	if g.rnd.Float64() < g.p.SensorGaps {
+		plan.gapStart = at(10, 0)
+		plan.gapEnd = plan.gapStart.Add(time.Duration(120+g.rnd.Intn(60)) * time.Minute)
+	}
+	return plan
+}
+
+//The glucose the plan gives at a time before the random part, in mg/dl
+func (g *generator) glucoseAt(t time.Time, plan dayPlan) float64 {
+	mgdl := g.p.Mean
+
+	//A rise before waking
+	hours := float64(t.Hour()) + float64(t.Minute())/60
+	if hours >= 3 && hours < 9 {
+		mgdl += 25 * math.Sin((hours-3)/6*math.Pi)
+	}
+
+	//Meals peak an hour in and wear off over the next couple
+	for _, m := range plan.meals {
+		since := t.Sub(m.at).Minutes()
+		switch {
+		case since < 0:
+		case since < 60:
+			mgdl += m.carbs * g.p.MealSpike * since / 60
+		default:
+			mgdl += m.carbs * g.p.MealSpike * math.Exp(-(since-60)/70)
+		}
+	}
+
+	//A low over about an hour
+	if !plan.lowAt.IsZero() {
+		since := t.Sub(plan.lowAt).Minutes()
+		if since > -30 && since < 60 {
+			mgdl -= 95 * math.Cos(since/90*math.Pi)
+		}
+	}
+	return mgdl
+}
+
+//A meter reading - a few percent off
+func (g *generator) meter(t time.Time, plan dayPlan) float64 {
+	return (g.glucoseAt(t, plan) + plan.offset) * (1 + g.rnd.NormFloat64()*g.p.MeterError)
+}
+
+//The day's finger sticks, boluses, snacks and pump events
+func (g *generator) dayEvents(day time.Time, plan dayPlan) {
+	for _, m := range plan.meals {
+		if m.snack {
+			g.add("food", Pump, m.at, map[string]interface{}{
+				"nutrition": map[string]interface{}{"carbohydrate": map[string]interface{}{"net": m.carbs, "units": "grams"}},
+			})
+			continue
+		}
+		//A finger stick before the meal
+		before := m.at.Add(-10 * time.Minute)
+		g.glucose("smbg", Meter, before, g.meter(before, plan))
+
+		units := math.Round(m.carbs/10/0.05) * 0.05
+		g.add("wizard", Pump, m.at, map[string]interface{}{"carbInput": m.carbs, "units": "mg/dL"})
+		g.add("bolus", Pump, m.at, map[string]interface{}{"subType": "normal", "normal": units})
+	}
+
+	bedtime := day.Add(22*time.Hour + time.Duration(g.rnd.Intn(60))*time.Minute)
+	g.glucose("smbg", Meter, bedtime, g.meter(bedtime, plan))
+
+	//The scheduled basal - a little more in the evening
+	for _, seg := range []struct {
+		from, to int
+		rate     float64
+	}{{0, 12, 0.8}, {12, 24, 0.95}} {
+		g.add("basal", Pump, day.Add(time.Duration(seg.from)*time.Hour), map[string]interface{}{
+			"deliveryType": "scheduled",
+			"rate":         seg.rate,
+			"duration":     int(time.Duration(seg.to-seg.from) * time.Hour / time.Millisecond),
+		})
+	}
+
+	//The pump stops for half an hour at a low
+	if !plan.lowAt.IsZero() {
+		g.add("basal", Pump, plan.lowAt.Add(-15*time.Minute), map[string]interface{}{
+			"deliveryType": "suspend",
+			"duration":     int((30 * time.Minute) / time.Millisecond),
+		})
+	}
+	if day.YearDay()%3 == 0 {
+		g.add("deviceEvent", Pump, day.Add(9*time.Hour), map[string]interface{}{"subType": "reservoirChange"})
+	}
+}
+
+//Add a glucose reading
+func (g *generator) glucose(datatype, device string, t time.Time, mgdl float64) {
+	mgdl = math.Max(40, math.Min(400, mgdl))
+	g.add(datatype, device, t, map[string]interface{}{"units": "mmol/L", "value": mgdl / mmolFactor})
+}
+
+//Add a record with the fields all records have. Everything is in UTC so
+//the device time is the same as the time.
+func (g *generator) add(datatype, device string, t time.Time, fields map[string]interface{}) {
+	if g.err != nil {
+		return
+	}
+	rec := map[string]interface{}{
+		"id":             fmt.Sprintf("demo%08d", g.nextID+1),
+		"uploadId":       "upid_" + strings.ToLower(device[:strings.Index(device, " ")]),
+		"deviceId":       device,
+		"type":           datatype,
+		"time":           t.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"deviceTime":     t.UTC().Format(deviceTimeLayout),
+		"timezoneOffset": 0,
+	}
+	for k, v := range fields {
+		rec[k] = v
+	}
+	if g.nextID > 0 {
+		g.out.WriteString(",")
+	}
+	g.nextID++
+	g.err = g.enc.Encode(rec)
+}
@@ -0,0 +1,229 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"time"
+)
+
+/*
+   Ambulatory glucose profile.
+
+   The AGP report (agp=on, or the "agp" section) lays a CGM period over
+   one modal day: every reading goes into the 15 minute slot of the day
+   it was taken in, and the chart draws the median of each slot with the
+   25th to 75th and 10th to 90th percentiles shaded around it, so the
+   shape of a typical day and how much it varies show at a glance. Above
+   the chart is the AGP statistics block - the period, how much of it
+   the CGM was active, mean glucose, GMI, CV and the time in each of the
+   five consensus ranges. The daily thumbnails follow as on the printed
+   AGP. CGM data only.
+*/
+
+//An AGP report's sections when none are declared
+var agpSections = []string{sectionAGP, sectionDaily}
+
+//Slots in the modal day
+const (
+	agpSlot  = 15 * time.Minute
+	agpSlots = int(24 * time.Hour / agpSlot)
+)
+
+//Size of the AGP chart image - pixels
+const (
+	agpChartW = 900
+	agpChartH = 400
+)
+
+//The consensus ranges in the statistics block - mg/dl
+const (
+	agpVeryLow  = 54.0
+	agpVeryHigh = 250.0
+)
+
+//The statistics block labels for the ranges, very high down to very low
+var (
+	agpRangesMgdl = [5]string{"over 250 mg/dl", "181-250 mg/dl", "70-180 mg/dl", "54-69 mg/dl", "under 54 mg/dl"}
+	agpRangesMmol = [5]string{"over 13.9 mmol/L", "10.1-13.9 mmol/L", "3.9-10.0 mmol/L", "3.0-3.8 mmol/L", "under 3.0 mmol/L"}
+)
+
+//The percentiles of one slot of the modal day - mg/dl
+type agpPercentiles struct {
+	P10 float64 `json:"p10"`
+	P25 float64 `json:"p25"`
+	P50 float64 `json:"p50"`
+	P75 float64 `json:"p75"`
+	P90 float64 `json:"p90"`
+}
+
+//The AGP - the statistics block and the modal day
+type agpSummary struct {
+	Stats   [][]string       `json:"stats"`   //Name and value rows
+	Profile []agpPercentiles `json:"profile"` //A slot every 15 minutes from midnight
+}
+
+//The percentile of sorted values, interpolating between neighbours
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	pos := p / 100 * float64(len(sorted)-1)
+	i := int(pos)
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (pos-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+//The modal day of the readings - false when a slot has no readings to go on.
+//Each slot takes in its neighbours too so the bands come out smooth.
+func agpProfile(readings []Reading) ([]agpPercentiles, bool) {
+	bySlot := make([][]float64, agpSlots)
+	for _, rd := range readings {
+		midnight := startOfDay(rd.Time)
+		slot := int(rd.Time.Sub(midnight) / agpSlot)
+		if slot >= 0 && slot < agpSlots {
+			bySlot[slot] = append(bySlot[slot], rd.MgDL())
+		}
+	}
+
+	profile := make([]agpPercentiles, agpSlots)
+	for i := range profile {
+		var values []float64
+		for _, j := range []int{i - 1, i, i + 1} {
+			values = append(values, bySlot[(j+agpSlots)%agpSlots]...)
+		}
+		if len(values) == 0 {
+			return nil, false
+		}
+		sort.Float64s(values)
+		profile[i] = agpPercentiles{
+			P10: percentile(values, 10),
+			P25: percentile(values, 25),
+			P50: percentile(values, 50),
+			P75: percentile(values, 75),
+			P90: percentile(values, 90),
+		}
+	}
+	return profile, true
+}
+
+//The AGP statistics block for the period - yyyy-mm-dd dates
+func agpStats(readings []Reading, start, end string, u Units) [][]string {
+	st := computeStats(readings)
+	var veryLow, low, inRange, high, veryHigh int
+	for _, rd := range readings {
+		switch v := rd.MgDL(); {
+		case v < agpVeryLow:
+			veryLow++
+		case v < targetLow:
+			low++
+		case v <= targetHigh:
+			inRange++
+		case v <= agpVeryHigh:
+			high++
+		default:
+			veryHigh++
+		}
+	}
+
+	rows := [][]string{{"Period", start + " to " + end}}
+	from, ferr := time.Parse("2006-01-02", start)
+	to, terr := time.Parse("2006-01-02", end)
+	if ferr == nil && terr == nil {
+		rows = append(rows, []string{"Days", fmt.Sprint(int(to.Sub(from).Hours()/24) + 1)})
+		if pct, ok := cgmActive(readings, from, to); ok {
+			rows = append(rows, []string{"Time CGM active", fmt.Sprintf("%.1f%%", pct)})
+		}
+	}
+	pct := func(n int) string { return fmt.Sprintf("%.0f%%", percentOf(n, len(readings))) }
+	//The consensus ranges as they're usually written in each unit
+	ranges := agpRangesMgdl
+	if u == MmolL {
+		ranges = agpRangesMmol
+	}
+	return append(rows,
+		[]string{"Mean glucose", u.withName(st.mean)},
+		[]string{"GMI", fmt.Sprintf("%.1f%%", st.gmi)},
+		[]string{"Glucose variability (CV)", fmt.Sprintf("%.1f%%", st.cv)},
+		[]string{"Very high (" + ranges[0] + ")", pct(veryHigh)},
+		[]string{"High (" + ranges[1] + ")", pct(high)},
+		[]string{"In range (" + ranges[2] + ")", pct(inRange)},
+		[]string{"Low (" + ranges[3] + ")", pct(low)},
+		[]string{"Very low (" + ranges[4] + ")", pct(veryLow)},
+	)
+}
+
+/*
+   The modal day chart. Midnight to midnight across with the target
+   range shaded, the 10th to 90th percentiles in a light band, the
+   25th to 75th in a darker one and the median as a line.
+*/
+func agpChart(profile []agpPercentiles, pal chartPalette, w, h int) ([]byte, error) {
+	c := newChartCanvas(pal, w, h, 0, 24*3600, chartGlucoseMin, pal.ymax)
+	c.bands()
+	c.glucoseGridY()
+	for hour := 0; hour < 24; hour += 3 {
+		c.gridX(float64(hour*3600), fmt.Sprintf("%02d:00", hour))
+	}
+
+	outer, inner := color.RGBA{170, 200, 235, 255}, color.RGBA{90, 140, 210, 255}
+	if pal.gray {
+		outer, inner = color.RGBA{200, 200, 200, 255}, color.RGBA{140, 140, 140, 255}
+	}
+
+	//The percentiles at a time of day - slots are centered on their middle
+	at := func(secs float64) agpPercentiles {
+		pos := secs/agpSlot.Seconds() - 0.5
+		i := int(pos + float64(agpSlots)) //Stay positive before the first middle
+		f := pos + float64(agpSlots) - float64(i)
+		a, b := profile[i%agpSlots], profile[(i+1)%agpSlots]
+		mix := func(x, y float64) float64 { return x + f*(y-x) }
+		return agpPercentiles{mix(a.P10, b.P10), mix(a.P25, b.P25), mix(a.P50, b.P50), mix(a.P75, b.P75), mix(a.P90, b.P90)}
+	}
+
+	//The bands a pixel column at a time
+	for x := c.plot.Min.X; x <= c.plot.Max.X; x++ {
+		secs := float64(x-c.plot.Min.X) / float64(c.plot.Dx()) * 24 * 3600
+		p := at(secs)
+		_, y10 := c.px(0, p.P10)
+		_, y90 := c.px(0, p.P90)
+		_, y25 := c.px(0, p.P25)
+		_, y75 := c.px(0, p.P75)
+		c.pixelLine(x, y90, x, y10, outer)
+		c.pixelLine(x, y75, x, y25, inner)
+	}
+	var prev agpPercentiles
+	for x := c.plot.Min.X; x <= c.plot.Max.X; x++ {
+		secs := float64(x-c.plot.Min.X) / float64(c.plot.Dx()) * 24 * 3600
+		p := at(secs)
+		if x > c.plot.Min.X {
+			_, y0 := c.px(0, prev.P50)
+			_, y1 := c.px(0, p.P50)
+			c.pixelLine(x-1, y0, x, y1, pal.line)
+			c.pixelLine(x-1, y0+1, x, y1+1, pal.line)
+		}
+		prev = p
+	}
+	c.frame()
+	return c.png()
+}
+
+//The AGP when asked for - only in a CGM report with readings all day round
+func agpStep(b *reportBuilder) {
+	rep := b.report
+	if b.opts.Sections == nil || !b.opts.wants(sectionAGP) || len(rep.Readings) == 0 {
+		return
+	}
+	if rep.DataType != "cbg" {
+		rep.Warnings = append(rep.Warnings, "The ambulatory glucose profile needs CGM readings - pick Continuous Blood Glucoses.")
+		return
+	}
+	profile, ok := agpProfile(rep.Readings)
+	if !ok {
+		rep.Warnings = append(rep.Warnings, "There aren't readings at every time of day, so the ambulatory glucose profile is left out.")
+		return
+	}
+	rep.AGP = &agpSummary{Stats: agpStats(rep.Readings, rep.Start, rep.End, rep.Units), Profile: profile}
+}
@@ -0,0 +1,102 @@
+package tidepoolreport
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+   Meter vs CGM accuracy.
+
+   Each meter (smbg) reading is paired with the closest CGM (cbg) value
+   inside the pairing window. The meter is treated as the reference.
+   From the pairs we compute the mean absolute relative difference (MARD)
+   and count the pairs falling in each Clarke error grid zone.
+*/
+
+//A CGM reading must be within this much of a meter reading to pair with it
+const pairingWindow = 5 * time.Minute
+
+//A meter reading and the CGM value paired with it
+type glucosePair struct {
+	meter Reading
+	cgm   Reading
+	zone  string //Clarke zone A - E
+}
+
+//The results of the comparison
+type accuracySummary struct {
+	window time.Duration
+	meters int //Meter readings considered
+	pairs  []glucosePair
+	mard   float64 //Percent
+	zones  map[string]int
+}
+
+//Pair the meter readings with the CGM readings and summarize.
+//Both slices must be in time order.
+func compareMeterToCGM(meter, cgm []Reading, window time.Duration) *accuracySummary {
+	summary := &accuracySummary{
+		window: window,
+		meters: len(meter),
+		zones:  map[string]int{"A": 0, "B": 0, "C": 0, "D": 0, "E": 0},
+	}
+
+	var relDiffs float64
+	for _, m := range meter {
+		c, ok := nearestPoint(cgm, m.Time, window)
+		if !ok || m.MgDL() <= 0 {
+			continue
+		}
+		zone := clarkeZone(m.MgDL(), c.MgDL())
+		summary.pairs = append(summary.pairs, glucosePair{meter: m, cgm: c, zone: zone})
+		summary.zones[zone]++
+		relDiffs += math.Abs(c.MgDL()-m.MgDL()) / m.MgDL()
+	}
+
+	if len(summary.pairs) > 0 {
+		summary.mard = relDiffs / float64(len(summary.pairs)) * 100
+	}
+	return summary
+}
+
+//Find the point closest to t within the window
+func nearestPoint(points []Reading, t time.Time, window time.Duration) (Reading, bool) {
+	//First point at or after t
+	i := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(t) })
+
+	var best Reading
+	var found bool
+	var bestGap time.Duration
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(points) {
+			continue
+		}
+		gap := points[j].Time.Sub(t)
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap <= window && (!found || gap < bestGap) {
+			best, bestGap, found = points[j], gap, true
+		}
+	}
+	return best, found
+}
+
+//Clarke error grid zone for a reference and estimated value in mg/dl.
+//A and B are clinically acceptable, C - E are increasingly dangerous.
+func clarkeZone(ref, est float64) string {
+	switch {
+	case (ref <= 70 && est <= 70) || (est <= 1.2*ref && est >= 0.8*ref):
+		return "A"
+	case (ref >= 180 && est <= 70) || (ref <= 70 && est >= 180):
+		return "E"
+	case (ref >= 70 && ref <= 290 && est >= ref+110) || (ref >= 130 && ref <= 180 && est <= 7.0/5.0*ref-182):
+		return "C"
+	case (ref >= 240 && est >= 70 && est <= 180) || (ref <= 175.0/3.0 && est <= 180 && est >= 70) ||
+		(ref >= 175.0/3.0 && ref <= 70 && est >= 6.0/5.0*ref):
+		return "D"
+	}
+	return "B"
+}
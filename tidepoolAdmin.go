@@ -0,0 +1,138 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"crypto/subtle"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+   Admin settings page - /admin.
+
+   Lets whoever runs the server change the global settings - the Tidepool
+   server, value coloring thresholds, download link lifetime, the memory
+   budget, the report time limit, the Tidepool call rate, the mail server,
+   the Pushover app token and the report branding - from the browser. They
+   are saved to config.json, which is read on every request, so changes
+   apply without a restart.
+
+   The page is off unless an admin password is set in the
+   TIDEPOOLREPORT_ADMIN_PASSWORD environment variable. The browser asks
+   for it with HTTP basic auth (any user name).
+*/
+
+//Environment variable holding the admin password
+const adminPasswordEnv = "TIDEPOOLREPORT_ADMIN_PASSWORD"
+
+//The Tidepool servers to choose from
+var tidepoolServers = []struct {
+	Name string
+	URL  string
+}{
+	{"Integration (development)", "https://int-api.tidepool.org"},
+	{"Production", "https://api.tidepool.org"},
+}
+
+//The values the admin page template uses
+type adminPage struct {
+	Config  Config
+	Server  string
+	Servers interface{}
+	Saved   bool
+
+	Clinicians string //One per line
+}
+
+//Check the admin password. Asks the browser for it when it's missing or wrong.
+func adminAllowed(w http.ResponseWriter, r *http.Request) bool {
+	want := os.Getenv(adminPasswordEnv)
+	if want == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	_, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="TidepoolReport admin"`)
+		http.Error(w, "The admin password is required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+//The browser sends basic auth on its own so only take changes posted from our own page.
+//Browsers send Origin on a form POST, so a request with neither it nor a
+//Referer can't show where it came from and is turned away too.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := neturl.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+//Admin page handler - show the settings, or save them on a POST
+func admin(w http.ResponseWriter, r *http.Request) {
+	if !adminAllowed(w, r) {
+		return
+	}
+
+	cfg := loadConfig(configFile)
+	var saved bool
+	if r.Method == http.MethodPost {
+		if !sameOrigin(r) {
+			http.Error(w, "Settings can only be changed from the admin page", http.StatusForbidden)
+			return
+		}
+		r.ParseForm()
+		cfg.TidepoolServer = strings.TrimSpace(r.PostFormValue("tidepoolserver"))
+		cfg.Thresholds.Low = formFloat(r, "thresholdlow")
+		cfg.Thresholds.High = formFloat(r, "thresholdhigh")
+		cfg.Thresholds.LowColor = r.PostFormValue("thresholdlowcolor")
+		cfg.Thresholds.HighColor = r.PostFormValue("thresholdhighcolor")
+		cfg.DownloadMinutes = int(formFloat(r, "downloadminutes"))
+		cfg.MemoryBudgetMB = int(formFloat(r, "memorybudget"))
+		cfg.ReportTimeoutSeconds = int(formFloat(r, "reporttimeout"))
+		cfg.RequestsPerMinute = int(formFloat(r, "requestsperminute"))
+		cfg.SMTP.Host = strings.TrimSpace(r.PostFormValue("smtphost"))
+		cfg.SMTP.Port = int(formFloat(r, "smtpport"))
+		cfg.SMTP.Username = r.PostFormValue("smtpusername")
+		if r.PostFormValue("smtppassword") != "" { //Blank keeps the saved password
+			cfg.SMTP.Password = r.PostFormValue("smtppassword")
+		}
+		cfg.SMTP.From = r.PostFormValue("smtpfrom")
+		cfg.PushoverToken = strings.TrimSpace(r.PostFormValue("pushovertoken"))
+		cfg.Header = r.PostFormValue("header")
+		cfg.Footer = r.PostFormValue("footer")
+		cfg.Watermark = r.PostFormValue("watermark")
+		cfg.Clinicians = strings.Fields(strings.ToLower(r.PostFormValue("clinicians")))
+
+		if err := saveConfig(configFile, cfg); err != nil {
+			DisplayMessageScreen(w, "Unable to save the settings: "+err.Error())
+			return
+		}
+		saved = true
+	}
+
+	page := adminPage{Config: cfg, Server: cfg.TidepoolServer, Servers: tidepoolServers, Saved: saved,
+		Clinicians: strings.Join(cfg.Clinicians, "\n")}
+	if page.Server == "" {
+		page.Server = tidepoolAPI
+	}
+	render(w, "templates/Admin.html", page)
+}
+
+//A number from the form - 0 when blank or bad
+func formFloat(r *http.Request, name string) float64 {
+	v, _ := strconv.ParseFloat(strings.TrimSpace(r.PostFormValue(name)), 64)
+	return v
+}
@@ -0,0 +1,35 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//Settings changes only from a page on this server
+func TestSameOrigin(t *testing.T) {
+	for _, c := range []struct {
+		origin, referer string
+		want            bool
+	}{
+		{"http://example.com", "", true},
+		{"", "http://example.com/admin", true},
+		{"http://evil.example", "", false},
+		{"", "http://evil.example/admin", false},
+		{"", "", false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "http://example.com/admin", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.referer != "" {
+			r.Header.Set("Referer", c.referer)
+		}
+		if got := sameOrigin(r); got != c.want {
+			t.Errorf("sameOrigin(origin %q, referer %q) = %v", c.origin, c.referer, got)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+   Daily alerts.
+
+   A profile can turn on a daily check of the last 24 hours. At the chosen
+   hour (in the profile's time zone) the data is fetched, the alert rules
+   are run over it and anything they find is sent through the profile's
+   notification channels. Nothing found, nothing sent. Alert rules
+   written in the rule language (tidepoolRules.go) are run too.
+
+   There is nobody at the keyboard so the check can't log in - the account
+   owner issues a read only Tidepool restricted token for it instead of
+   handing over a password.
+*/
+
+//How often the scheduler looks for checks that are due
+const alertPollInterval = 10 * time.Minute
+
+//AlertSettings - a profile's daily check
+type AlertSettings struct {
+	Enabled  bool   `json:"enabled"`
+	Hour     int    `json:"hour"`     //Hour of the day to run, 0-23
+	UserID   string `json:"userid"`   //Tidepool user id for the token
+	Token    string `json:"token"`    //Restricted token
+	DataType string `json:"dataType"` //smbg or cbg - smbg when empty
+
+	//The rules - zero turns one off
+	MaxLows   int     `json:"maxLows"`   //Alert on more separate lows than this
+	MeanAbove float64 `json:"meanAbove"` //Alert when the mean is over this, mg/dl
+	NoData    bool    `json:"noData"`    //Alert when nothing was uploaded
+}
+
+//An alert rule - returns what it found or "" for nothing
+type alertRule func(readings []Reading, a AlertSettings) string
+
+//The rules run by the daily check
+var alertRules = []alertRule{
+	noDataRule,
+	lowsRule,
+	highMeanRule,
+}
+
+//Nothing uploaded in the last day
+func noDataRule(readings []Reading, a AlertSettings) string {
+	if a.NoData && len(readings) == 0 {
+		return "No readings have been uploaded in the last 24 hours."
+	}
+	return ""
+}
+
+//Too many lows
+func lowsRule(readings []Reading, a AlertSettings) string {
+	if a.MaxLows <= 0 {
+		return ""
+	}
+	if st := computeStats(readings); st.hypos > a.MaxLows {
+		return fmt.Sprintf("%d separate lows in the last 24 hours.", st.hypos)
+	}
+	return ""
+}
+
+//Running high
+func highMeanRule(readings []Reading, a AlertSettings) string {
+	if a.MeanAbove <= 0 || len(readings) == 0 {
+		return ""
+	}
+	if st := computeStats(readings); st.mean > a.MeanAbove {
+		return fmt.Sprintf("Mean glucose was %.0f mg/dl over the last 24 hours.", st.mean)
+	}
+	return ""
+}
+
+//The glucose type the check looks at
+func (a AlertSettings) dataType() string {
+	if a.DataType == "" {
+		return "smbg"
+	}
+	return a.DataType
+}
+
+//Fetch the 24 hours before now with the profile's restricted token
+func (a AlertSettings) lastDay(now time.Time) ([]Reading, error) {
+	if a.UserID == "" || a.Token == "" {
+		return nil, errors.New("no Tidepool user id and restricted token are set up")
+	}
+	if !validUserID(a.UserID) {
+		return nil, fmt.Errorf("%q isn't a Tidepool user id", a.UserID)
+	}
+	since := now.Add(-24 * time.Hour)
+	fetcher := newRestrictedFetcher(a.UserID, a.Token)
+	data, _, err := fetcher.fetchRange(a.dataType(), since.UTC().Format("2006-01-02"), now.UTC().AddDate(0, 0, 1).Format("2006-01-02"))
+	if errors.Is(err, ErrAuthFailed) {
+		return nil, fmt.Errorf("%w - the restricted token may have expired", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records tpMeasurement
+	if err = json.Unmarshal(data, &records); err != nil {
+		return nil, errors.New("Tidepool appears to have returned an error response")
+	}
+	//The window is in real time, not device time
+	var recent tpMeasurement
+	for _, rec := range records {
+		if rec.Time.After(since) && !rec.Time.After(now) {
+			recent = append(recent, rec)
+		}
+	}
+	return readingsFrom(recent, a.dataType()), nil
+}
+
+//Run a profile's check and notify anything found.
+//Returns the findings so the caller can show them.
+func checkAlerts(profile string, pr Preferences, now time.Time) ([]string, error) {
+	readings, err := pr.Alerts.lastDay(now)
+	if err != nil {
+		//Tell them - a check that silently stops is worse than none
+		notifyProfile(profile, Notification{
+			Title: "TidepoolReport daily check failed",
+			Body:  "The daily check for " + profile + " couldn't get data from Tidepool: " + err.Error(),
+		})
+		return nil, err
+	}
+
+	var found []string
+	for _, rule := range alertRules {
+		if msg := rule(readings, pr.Alerts); msg != "" {
+			found = append(found, msg)
+		}
+	}
+
+	//Plus the alert rules from the config and the profile
+	cfg := loadConfig(configFile)
+	pr.apply(&cfg, profile)
+	found = append(found, evalRules(parseRules(cfg.Rules...), "alert", readings)...)
+	if len(found) == 0 {
+		return nil, nil
+	}
+	return found, notifyProfile(profile, Notification{
+		Title: "TidepoolReport alert for " + profile,
+		Body:  strings.Join(found, "\n"),
+	})
+}
+
+//The profile's local time - the server's when the time zone is unset or unknown
+func (pr Preferences) localTime(t time.Time) time.Time {
+	if pr.Timezone != "" {
+		if loc, err := time.LoadLocation(pr.Timezone); err == nil {
+			return t.In(loc)
+		}
+	}
+	return t
+}
+
+//Run the daily checks as they come due. Started by main.
+func dailyAlerts() {
+	lastRun := map[string]string{} //Local date of each profile's last check
+	for {
+		now := time.Now()
+		for profile, pr := range prefs.all() {
+			if !pr.Alerts.Enabled {
+				continue
+			}
+			local := pr.localTime(now)
+			today := local.Format("2006-01-02")
+			if local.Hour() != pr.Alerts.Hour || lastRun[profile] == today {
+				continue
+			}
+			lastRun[profile] = today
+			if _, err := checkAlerts(profile, pr, now); err != nil {
+				log.Printf("Daily check for %s: %v", profile, err)
+			}
+		}
+		time.Sleep(alertPollInterval)
+	}
+}
+
+//Run the session profile's check now - /prefs/checkalerts
+func checkAlertsNow(w http.ResponseWriter, r *http.Request) {
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" || r.Method != http.MethodPost {
+		http.Redirect(w, r, "/prefs", http.StatusSeeOther)
+		return
+	}
+	found, err := checkAlerts(sess.profile, prefs.get(sess.profile), time.Now())
+	switch {
+	case err != nil:
+		DisplayMessageScreen(w, "The check failed: "+err.Error())
+	case len(found) == 0:
+		DisplayMessageScreen(w, "The check found nothing to report.")
+	default:
+		DisplayMessageScreen(w, "Alert sent: "+strings.Join(found, " "))
+	}
+}
@@ -0,0 +1,73 @@
+package tidepoolreport
+
+import "fmt"
+
+/*
+   Anonymized reports.
+
+   "Anonymize" on the form (anonymize=on to the api) makes a report that
+   can be shared for a support request or research without saying whose
+   it is. Times and values are left as they are. Replaced are:
+
+       the patient name          the account email, or config.json's
+       record and upload ids     record-1, upload-1, ...
+       device ids                device-1, ... - they hold serial numbers
+       Tidepool note text        notes are free text so could say anything
+
+   The same id always gets the same stand in within a report, so readings
+   can still be grouped by upload or device, but nothing leads back to
+   the Tidepool account. Sections added by a SectionProvider are left out
+   as there's no knowing what's in them.
+*/
+
+//The name on an anonymized report
+const anonymousName = "Anonymous"
+
+//Stand ins for the ids in one report
+type pseudonyms struct {
+	kind string
+	ids  map[string]string
+}
+
+//The stand in for an id - "" stays ""
+func (p *pseudonyms) of(id string) string {
+	if id == "" {
+		return ""
+	}
+	if s, ok := p.ids[id]; ok {
+		return s
+	}
+	s := fmt.Sprintf("%s-%d", p.kind, len(p.ids)+1)
+	p.ids[id] = s
+	return s
+}
+
+//Strip what identifies the patient from the report
+func anonymizeStep(b *reportBuilder) {
+	if !b.opts.Anonymize {
+		return
+	}
+	rep := b.report
+	rep.PatientName = anonymousName
+
+	records := &pseudonyms{kind: "record", ids: map[string]string{}}
+	uploads := &pseudonyms{kind: "upload", ids: map[string]string{}}
+	devices := &pseudonyms{kind: "device", ids: map[string]string{}}
+	for i := range rep.Readings {
+		rd := &rep.Readings[i]
+		rd.ID = records.of(rd.ID)
+		rd.UploadID = uploads.of(rd.UploadID)
+		//A source that's just the device id has the serial number too
+		if rd.Source == rd.DeviceID {
+			rd.Source = devices.of(rd.DeviceID)
+		}
+		rd.DeviceID = devices.of(rd.DeviceID)
+	}
+
+	for i := range rep.Events {
+		if rep.Events[i].Kind == "note" {
+			rep.Events[i].Text = "Note"
+		}
+	}
+	rep.Extras = nil
+}
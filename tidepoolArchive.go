@@ -0,0 +1,197 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+   Reading archive.
+
+   With "Keep an archive of my readings" on the preferences page each
+   report adds the readings it fetched to the profile's archive, a file
+   in the archive folder with a line per reading that is only ever added
+   to. Readings already there are skipped so overlapping reports don't
+   count twice. Nothing is thrown away when Tidepool's data moves on, and
+   the year in review (/archive/year) is built from it - see tidepoolYear.go.
+*/
+
+//Folder for the archives, one file per account
+const archiveDir = "archive"
+
+//A line in the archive - the values are kept in mg/dl
+type archivedReading struct {
+	Time time.Time `json:"time"` //Device local clock time
+	Type string    `json:"type"`
+	MgDL float64   `json:"mgdl"`
+}
+
+//One archive write at a time
+var archiveMu sync.Mutex
+
+//The archive file for a profile
+func archiveFile(profile string) string {
+	return profileFile(archiveDir, profile, ".jsonl")
+}
+
+//Read a profile's archive - empty when there isn't one
+func loadArchive(profile string) ([]Reading, error) {
+	file, err := os.Open(archiveFile(profile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var readings []Reading
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var ar archivedReading
+		if err := json.Unmarshal(scanner.Bytes(), &ar); err != nil {
+			continue //A line cut short by a crash - the rest are fine
+		}
+		readings = append(readings, Reading{Time: ar.Time, Value: ar.MgDL, Units: MgDL, Type: ar.Type})
+	}
+	sort.SliceStable(readings, func(i, j int) bool { return readings[i].Time.Before(readings[j].Time) })
+	return readings, scanner.Err()
+}
+
+//Add the readings not already in the profile's archive. Returns how many were added.
+func archiveReadings(profile string, readings []Reading) (int, error) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	archived, err := loadArchive(profile)
+	if err != nil {
+		return 0, err
+	}
+	have := make(map[string]bool, len(archived))
+	for _, rd := range archived {
+		have[readingKey(rd)] = true
+	}
+
+	if err = os.MkdirAll(archiveDir, 0700); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(archiveFile(profile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	added := 0
+	for _, rd := range readings {
+		key := readingKey(rd)
+		if have[key] {
+			continue
+		}
+		have[key] = true
+		if err = enc.Encode(archivedReading{Time: rd.Time, Type: rd.Type, MgDL: rd.MgDL()}); err != nil {
+			break
+		}
+		added++
+	}
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return added, err
+}
+
+//Add a report's readings to the profile's archive when it keeps one
+func archiveReport(profile string, rep *Report) {
+	if profile == "" || !prefs.get(profile).Archive {
+		return
+	}
+	added, err := archiveReadings(profile, rep.Readings)
+	if err != nil {
+		log.Println("Error adding to the archive for", profile, err)
+		return
+	}
+	log.Printf("Archived %d new readings for %s", added, profile)
+}
+
+//The year in review from the session profile's archive - /archive/year.
+//year picks the year (this one when blank) and format the output.
+func yearInReview(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know whose archive to use.")
+		return
+	}
+	rd, ok := negotiateRenderer(r)
+	if !ok {
+		DisplayMessageScreen(w, "Sorry, that report format is not available.")
+		return
+	}
+	year := time.Now().Year()
+	if y := r.FormValue("year"); y != "" {
+		var err error
+		if year, err = strconv.Atoi(y); err != nil {
+			DisplayMessageScreen(w, "The year should be a number, e.g. 2025.")
+			return
+		}
+	}
+
+	readings, err := loadArchive(sess.profile)
+	if err != nil {
+		DisplayMessageScreen(w, "Unable to read your archive: "+err.Error())
+		return
+	}
+	if len(readings) == 0 {
+		DisplayMessageScreen(w, "Your archive is empty. Turn on \"Keep an archive of my readings\" in your preferences and run a report.")
+		return
+	}
+
+	cfg := loadConfig(configFile)
+	pr := prefs.get(sess.profile)
+	pr.apply(&cfg, sess.profile)
+	opts := ReportOptions{DataType: r.FormValue("datatype"), GapThreshold: gapThreshold(pr.GapHours), Units: pr.Units}
+	if opts.DataType == "" {
+		opts.DataType = archiveDataType(readings)
+	}
+	opts.Metrics = cfg.Metrics
+	opts.Target, opts.Goals, opts.Caregiver = cfg.targets()
+	opts.Chart = cfg.Chart
+
+	rep, err := BuildYearReport(readings, year, opts)
+	if err != nil {
+		DisplayMessageScreen(w, "Nothing in your archive for "+strconv.Itoa(year)+".")
+		return
+	}
+
+	ws, err := NewWorkspace()
+	if err != nil {
+		DisplayMessageScreen(w, "Unable to create a work folder: "+err.Error())
+		return
+	}
+	defer ws.Close()
+	ws.session = sess
+	w.Header().Set("Vary", "Accept")
+	rd.render(w, r, ws, cfg, rep)
+}
+
+//The data type a year in review uses by default - CGM when the archive has any
+func archiveDataType(readings []Reading) string {
+	for _, rd := range readings {
+		if rd.Type == "cbg" {
+			return "cbg"
+		}
+	}
+	return "smbg"
+}
@@ -0,0 +1,32 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+)
+
+/*
+   The templates and static files are built into the binary so it runs
+   from any folder - the desktop mode changes to the user data folder
+   and a patient's download is just the one file.
+*/
+
+//go:embed templates static
+var appFiles embed.FS
+
+//Parse one of the templates, e.g. "templates/Report.html"
+func parseTemplate(filename string) (*template.Template, error) {
+	return template.ParseFS(appFiles, filename)
+}
+
+//A handler for the files in the static folder
+func staticFiles() http.Handler {
+	static, err := fs.Sub(appFiles, "static")
+	check(err, "Error finding the static files")
+	return http.FileServer(http.FS(static))
+}
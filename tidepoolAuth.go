@@ -0,0 +1,253 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   Tidepool authorization with a token cache.
+
+   A login gets a session token (in the x-tidepool-session-token header)
+   and the account's internal user id. Tokens are good for a while so they
+   are cached per account and reused until shortly before they expire.
+   The cache is saved to a file so it survives restarts.
+
+   The cache key is an HMAC of the email AND password so a cached token is
+   never handed to someone who only knows the email address. The HMAC
+   secret is random, made on first use and kept in its own file, so the
+   keys in the cache file are no help to someone guessing passwords
+   offline without it too.
+*/
+
+//The default Tidepool api server - the integration (development) server
+const tidepoolAPI = "https://int-api.tidepool.org"
+
+//Token cache file - holds live tokens so keep it private
+const tokenCacheFile = "tokencache.json"
+
+//The secret for the cache keys - keep it private too
+const tokenSecretFile = "tokencache.key"
+
+//Tokens are dropped this long before they actually expire
+const tokenExpiryMargin = time.Minute
+
+//Token lifetime assumed when the token doesn't say
+const defaultTokenLife = time.Hour
+
+//A logged in Tidepool session
+type tpSession struct {
+	Token   string    `json:"token"`
+	UserID  string    `json:"userid"`
+	Expires time.Time `json:"expires"`
+}
+
+//Sessions by account key, saved to a file
+type tokenCache struct {
+	mu         sync.Mutex
+	filename   string
+	secretFile string
+	secret     []byte
+	sessions   map[string]tpSession
+}
+
+//The cache used by the web handlers
+var tokens = &tokenCache{filename: tokenCacheFile, secretFile: tokenSecretFile}
+
+//Cache key for an account's credentials
+func accountKey(email string, password string) string {
+	return tokens.key(email, password)
+}
+
+//The HMAC of the credentials with the cache's secret
+func (c *tokenCache) key(email string, password string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(strings.ToLower(email) + "\x00" + password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+   Read the secret, making it the first time. A new secret means any
+   keys in the cache file were made without it - unsalted hashes from an
+   older version or another secret - so the file is removed. Returns
+   false then. Call with the lock held.
+*/
+func (c *tokenCache) loadSecret() bool {
+	if secret, err := ioutil.ReadFile(c.secretFile); err == nil && len(secret) >= 32 {
+		c.secret = secret
+		return true
+	}
+	c.secret = make([]byte, 32)
+	_, err := rand.Read(c.secret)
+	check(err, "Error creating the token cache secret")
+	if err = ioutil.WriteFile(c.secretFile, c.secret, 0600); err != nil {
+		//Still fine for this run - the cache just won't outlast it
+		log.Println("Error saving the token cache secret", err)
+	}
+	os.Remove(c.filename)
+	return false
+}
+
+//Load the cache file the first time the cache is used. Call with the lock held.
+func (c *tokenCache) load() {
+	if c.sessions != nil {
+		return
+	}
+	c.sessions = map[string]tpSession{}
+	if !c.loadSecret() {
+		return
+	}
+	file, err := ioutil.ReadFile(c.filename)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(file, &c.sessions); err != nil {
+		log.Println("Ignoring the token cache file", c.filename, err)
+		c.sessions = map[string]tpSession{}
+	}
+}
+
+//Save the cache file, dropping expired sessions. Call with the lock held.
+func (c *tokenCache) save() {
+	for key, s := range c.sessions {
+		if time.Now().After(s.Expires) {
+			delete(c.sessions, key)
+		}
+	}
+	data, err := json.Marshal(c.sessions)
+	if err == nil {
+		err = ioutil.WriteFile(c.filename, data, 0600)
+	}
+	if err != nil {
+		log.Println("Error saving the token cache", err)
+	}
+}
+
+//A cached session that is still good
+func (c *tokenCache) get(key string) (tpSession, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	s, ok := c.sessions[key]
+	if !ok || time.Now().Add(tokenExpiryMargin).After(s.Expires) {
+		return tpSession{}, false
+	}
+	return s, true
+}
+
+//Cache a session
+func (c *tokenCache) put(key string, s tpSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	c.sessions[key] = s
+	c.save()
+}
+
+//Forget a session - Tidepool no longer accepts it
+func (c *tokenCache) drop(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	if _, ok := c.sessions[key]; ok {
+		delete(c.sessions, key)
+		c.save()
+	}
+}
+
+/*
+   Log in to Tidepool with the users email and password.
+   On a failed login the Tidepool response body is returned
+   along with the error so it can be shown to the user.
+   The login is given up when ctx is done - a hung Tidepool
+   mustn't hold the request forever.
+*/
+func tidepoolLogin(ctx context.Context, email string, password string) (tpSession, []byte, error) {
+	//Create a POST request to the Tidepool authorization api
+	req, err := http.NewRequestWithContext(ctx, "POST", tidepoolServer()+"/auth/login", nil)
+	if err != nil {
+		return tpSession{}, nil, &TidepoolError{Kind: ErrTidepoolUnavailable, Err: err}
+	}
+
+	//Use basic uid/pwd authentication
+	req.SetBasicAuth(email, password)
+
+	//Send the request
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return tpSession{}, nil, &TidepoolError{Kind: ErrTidepoolUnavailable, Err: err}
+	}
+	defer resp.Body.Close()
+
+	//Read the response body - the user id or an error response
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tpSession{}, nil, &TidepoolError{Kind: ErrTidepoolUnavailable, Status: resp.StatusCode, Err: err}
+	}
+
+	//Not OK response?
+	if resp.StatusCode != http.StatusOK {
+		return tpSession{}, body, statusError(resp.StatusCode, body)
+	}
+
+	//Get the Tidepool user account id from the json response body
+	var result map[string]interface{}
+	json.Unmarshal(body, &result)
+
+	//Get the Tidepool token header from the response headers
+	token := resp.Header.Get("x-tidepool-session-token")
+	return tpSession{
+		Token:   token,
+		UserID:  fmt.Sprintf("%v", result["userid"]),
+		Expires: tokenExpiry(token),
+	}, nil, nil
+}
+
+//A session for the account - from the cache or a fresh login
+func sessionFor(ctx context.Context, email string, password string) (tpSession, []byte, error) {
+	key := accountKey(email, password)
+	if s, ok := tokens.get(key); ok {
+		return s, nil, nil
+	}
+
+	s, body, err := tidepoolLogin(ctx, email, password)
+	if err != nil {
+		return s, body, err
+	}
+	tokens.put(key, s)
+	return s, nil, nil
+}
+
+//Tidepool tokens are JWTs - use the exp claim for the expiry when it's there
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		var claims struct {
+			Exp int64 `json:"exp"`
+		}
+		if err == nil && json.Unmarshal(payload, &claims) == nil && claims.Exp > 0 {
+			return time.Unix(claims.Exp, 0)
+		}
+	}
+	return time.Now().Add(defaultTokenLife)
+}
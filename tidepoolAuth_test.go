@@ -0,0 +1,72 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//A token cache in a folder of its own
+func testTokenCache(dir string) *tokenCache {
+	return &tokenCache{filename: filepath.Join(dir, "tokencache.json"), secretFile: filepath.Join(dir, "tokencache.key")}
+}
+
+//The cache file's keys can't be checked against a password without the secret
+func TestAccountKeySecret(t *testing.T) {
+	dir := t.TempDir()
+	c := testTokenCache(dir)
+	key := c.key("A@example.com", "hunter2")
+	c.put(key, tpSession{Token: "t", UserID: "abc123", Expires: time.Now().Add(time.Hour)})
+
+	unsalted := sha256.Sum256([]byte("a@example.com\x00hunter2"))
+	file, err := ioutil.ReadFile(c.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(file), hex.EncodeToString(unsalted[:])) {
+		t.Error("the cache file has the unsalted hash of the credentials")
+	}
+	if c.key("a@example.com", "hunter2") != key || c.key("a@example.com", "hunter3") == key {
+		t.Error("keys don't follow the credentials")
+	}
+
+	//The same install finds the token again after a restart
+	again := testTokenCache(dir)
+	if s, ok := again.get(again.key("a@example.com", "hunter2")); !ok || s.Token != "t" {
+		t.Errorf("restarted cache gave %+v, %v", s, ok)
+	}
+
+	//Another install's keys are different
+	other := testTokenCache(t.TempDir())
+	if other.key("a@example.com", "hunter2") == key {
+		t.Error("two secrets gave the same key")
+	}
+}
+
+//A cache file from before the secret is dropped, not trusted
+func TestTokenCacheNewSecret(t *testing.T) {
+	dir := t.TempDir()
+	c := testTokenCache(dir)
+	unsalted := sha256.Sum256([]byte("a@example.com\x00hunter2"))
+	old := `{"` + hex.EncodeToString(unsalted[:]) + `": {"token": "t", "userid": "abc123", "expires": "2999-01-01T00:00:00Z"}}`
+	if err := ioutil.WriteFile(c.filename, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.get(hex.EncodeToString(unsalted[:])); ok {
+		t.Error("an old cache entry was used")
+	}
+	if _, err := os.Stat(c.filename); !os.IsNotExist(err) {
+		t.Errorf("old cache file kept: %v", err)
+	}
+	if fi, err := os.Stat(c.secretFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("secret file %v, %v", fi, err)
+	}
+}
@@ -0,0 +1,103 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+   Basal insulin.
+
+   The "basal" section (Basal Insulin among the data types on the form)
+   adds up the basal records a day at a time - the units delivered at the
+   scheduled and temporary rates, how many temp basals were set and how
+   long delivery was suspended. A record counts on the day it started.
+*/
+
+//A day's basal
+type basalDay struct {
+	Day       string        `json:"day"` //yyyy-mm-dd
+	Units     float64       `json:"units"`
+	Temps     int           `json:"temps"`
+	Suspended time.Duration `json:"suspended"`
+}
+
+//The basal days in the records in date order
+func basalDaysFrom(records tpMeasurement) []basalDay {
+	byDay := map[string]*basalDay{}
+	var days []string
+	for i := range records {
+		rec := &records[i]
+		if rec.Type != "basal" || rec.Duration <= 0 {
+			continue
+		}
+		day := deviceLocalTime(rec.Devicetime, rec.Time, rec.Timezoneoffset).Format("2006-01-02")
+		bd, ok := byDay[day]
+		if !ok {
+			bd = &basalDay{Day: day}
+			byDay[day] = bd
+			days = append(days, day)
+		}
+		duration := time.Duration(rec.Duration) * time.Millisecond
+		switch rec.Deliverytype {
+		case "suspend":
+			bd.Suspended += duration
+			continue
+		case "temp":
+			bd.Temps++
+		}
+		bd.Units += rec.Rate * duration.Hours()
+	}
+
+	sort.Strings(days)
+	result := make([]basalDay, 0, len(days))
+	for _, day := range days {
+		result = append(result, *byDay[day])
+	}
+	return result
+}
+
+//The totals line for the section, e.g. "14.2 U a day over 14 days, 3 temp basals, suspended 1h 30m"
+func basalTotals(days []basalDay) string {
+	var units float64
+	var temps int
+	var suspended time.Duration
+	for _, d := range days {
+		units += d.Units
+		temps += d.Temps
+		suspended += d.Suspended
+	}
+	line := fmt.Sprintf("%.1f U a day over %s", units/float64(len(days)), countOf(len(days), "day"))
+	line += ", " + countOf(temps, "temp basal")
+	if suspended > 0 {
+		line += ", suspended " + formatDuration(suspended)
+	}
+	return line
+}
+
+//The basal table rows - date, units, temp basals and time suspended
+func basalRows(days []basalDay) [][]string {
+	rows := make([][]string, 0, len(days))
+	for _, d := range days {
+		suspended := ""
+		if d.Suspended > 0 {
+			suspended = formatDuration(d.Suspended)
+		}
+		rows = append(rows, []string{d.Day, fmt.Sprintf("%.2f", d.Units), fmt.Sprint(d.Temps), suspended})
+	}
+	return rows
+}
+
+//The basal days in the report's period
+func basalStep(b *reportBuilder) {
+	if !b.opts.Basal {
+		return
+	}
+	rep := b.report
+	for _, d := range basalDaysFrom(b.records) {
+		if (rep.Start == "" || d.Day >= rep.Start) && (rep.End == "" || d.Day <= rep.End) {
+			rep.Basal = append(rep.Basal, d)
+		}
+	}
+}
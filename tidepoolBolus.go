@@ -0,0 +1,128 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+   Insulin boluses.
+
+   The "boluses" section (the Insulin Boluses box on the form) fetches the
+   bolus records along with the glucose and lists each one - the time,
+   the units given straight away (normal) and over time (extended), how
+   long an extended bolus ran and its kind - with the totals for the
+   period. A bolus stopped part way says so; the amounts are what was
+   actually given.
+*/
+
+//One bolus
+type bolusDose struct {
+	Time     time.Time     `json:"time"`
+	Kind     string        `json:"kind"` //normal, square or dual wave
+	Normal   float64       `json:"normal"`
+	Extended float64       `json:"extended"`
+	Duration time.Duration `json:"duration"` //Of the extended part
+
+	//Stopped before all of it was given
+	Interrupted bool `json:"interrupted"`
+}
+
+//Units given
+func (d bolusDose) Total() float64 {
+	return d.Normal + d.Extended
+}
+
+//Tidepool's bolus sub types as shown
+var bolusKinds = map[string]string{
+	"normal":      "Normal",
+	"square":      "Extended",
+	"dual/square": "Dual wave",
+}
+
+//The kind as shown
+func (d bolusDose) KindName() string {
+	if name, ok := bolusKinds[d.Kind]; ok {
+		return name
+	}
+	return d.Kind
+}
+
+//The boluses in the records in time order
+func bolusesFrom(records tpMeasurement) []bolusDose {
+	var doses []bolusDose
+	for i := range records {
+		rec := &records[i]
+		if rec.Type != "bolus" {
+			continue
+		}
+		doses = append(doses, bolusDose{
+			Time:        deviceLocalTime(rec.Devicetime, rec.Time, rec.Timezoneoffset),
+			Kind:        rec.Subtype,
+			Normal:      rec.Normal,
+			Extended:    rec.Extended,
+			Duration:    time.Duration(rec.Duration) * time.Millisecond,
+			Interrupted: rec.Expectednormal > rec.Normal || rec.Expectedextended > rec.Extended,
+		})
+	}
+	sort.Slice(doses, func(i, j int) bool { return doses[i].Time.Before(doses[j].Time) })
+	return doses
+}
+
+//The totals line for the section, e.g. "42 boluses, 123.4 U - 8.8 U a day"
+func bolusTotals(doses []bolusDose, start, end string) string {
+	var total float64
+	for _, d := range doses {
+		total += d.Total()
+	}
+	line := fmt.Sprintf("%d boluses, %.1f U", len(doses), total)
+	if len(doses) == 1 {
+		line = fmt.Sprintf("1 bolus, %.1f U", total)
+	}
+	if days := periodDays(start, end); days > 0 {
+		line += fmt.Sprintf(" - %.1f U a day", total/float64(days))
+	}
+	return line
+}
+
+//The bolus table rows - time, normal, extended, duration and kind
+func bolusRows(doses []bolusDose) [][]string {
+	rows := make([][]string, 0, len(doses))
+	for _, d := range doses {
+		extended, duration := "", ""
+		if d.Extended > 0 || d.Duration > 0 {
+			extended, duration = fmt.Sprintf("%.2f", d.Extended), formatDuration(d.Duration)
+		}
+		kind := d.KindName()
+		if d.Interrupted {
+			kind += " (stopped)"
+		}
+		rows = append(rows, []string{d.Time.Format("2006-01-02 15:04"), fmt.Sprintf("%.2f", d.Normal), extended, duration, kind})
+	}
+	return rows
+}
+
+//The number of days from start to end, both yyyy-mm-dd - 0 when either won't parse
+func periodDays(start, end string) int {
+	s, err1 := time.Parse("2006-01-02", start)
+	e, err2 := time.Parse("2006-01-02", end)
+	if err1 != nil || err2 != nil || e.Before(s) {
+		return 0
+	}
+	return int(e.Sub(s).Hours()/24) + 1
+}
+
+//The boluses in the report's period
+func bolusStep(b *reportBuilder) {
+	if !b.opts.Boluses {
+		return
+	}
+	rep := b.report
+	for _, d := range bolusesFrom(b.records) {
+		day := d.Time.Format("2006-01-02")
+		if (rep.Start == "" || day >= rep.Start) && (rep.End == "" || day <= rep.End) {
+			rep.Boluses = append(rep.Boluses, d)
+		}
+	}
+}
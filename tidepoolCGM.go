@@ -0,0 +1,57 @@
+package tidepoolreport
+
+import "time"
+
+/*
+   CGM readings tables.
+
+   A CGM sends a reading every 5 minutes - 288 a day, over 26,000 in three
+   months - which is hundreds of pages as a table. The readings tables in
+   the PDF, web page, Word and markdown outputs show a CGM period of more
+   than a day as hourly averages instead. A day report keeps every
+   reading, and the csv, json and xlsx exports always have them all.
+   "cgmTable": "all" in config.json puts every reading in the tables too.
+*/
+
+//The cgmTable setting for every reading
+const cgmTableAll = "all"
+
+//The readings for a readings table and a note to show above it when
+//they aren't the readings as taken
+func (rep *Report) tableReadings() ([]Reading, string) {
+	return rep.tableFor(rep.shown(rep.Readings, rep.Excluded), rep.DataType)
+}
+
+//The same for readings of the data type
+func (rep *Report) tableFor(readings []Reading, datatype string) ([]Reading, string) {
+	if datatype != "cbg" || rep.FullCGMTable || rep.Start == rep.End {
+		return readings, ""
+	}
+	return hourlyAverages(readings), "CGM readings are shown as hourly averages - the csv, json and xlsx exports have every reading."
+}
+
+//The mean of the readings in each clock hour, timed at the start of the
+//hour. The readings must be in time order.
+func hourlyAverages(readings []Reading) []Reading {
+	var hours []Reading
+	var sum float64
+	var n int
+	flush := func() {
+		if n > 0 {
+			last := &hours[len(hours)-1]
+			last.Value = sum / float64(n)
+		}
+	}
+	for _, rd := range readings {
+		hour := rd.Time.Truncate(time.Hour)
+		if len(hours) == 0 || !hours[len(hours)-1].Time.Equal(hour) {
+			flush()
+			hours = append(hours, Reading{Time: hour, Units: MgDL, Type: rd.Type, Source: rd.Source, Excluded: rd.Excluded})
+			sum, n = 0, 0
+		}
+		sum += rd.MgDL()
+		n++
+	}
+	flush()
+	return hours
+}
@@ -0,0 +1,59 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+/*
+   CSV output - format=csv, or /export/csv with the report parameters.
+   One row per reading for loading into a spreadsheet or script, with
+   the Tidepool record, upload and device ids for tracing it back.
+*/
+
+//The readings as CSV whatever the format or Accept header says - for
+//curl or R's read.csv(url) without remembering format=csv
+func exportCSV(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	r.Form.Set("format", "csv")
+	apiReport(w, r)
+}
+
+//Write the readings to the browser as a CSV download
+func renderCSV(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report) {
+	w.Header().Set("Content-type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="tidepool-readings.csv"`)
+
+	out := csv.NewWriter(w)
+	header := []string{"date", "time", "glucose_mgdl", "type", "id", "upload_id", "device_id"}
+	//The device names go last so scripts reading by position aren't upset
+	if rep.Sources {
+		header = append(header, "source")
+	}
+	out.Write(header)
+	//Both glucose types when the report has two - the type column tells them apart
+	for _, rd := range append(append([]Reading(nil), rep.Readings...), rep.OtherReadings...) {
+		row := []string{
+			rd.Time.Format("2006-01-02"),
+			rd.Time.Format("15:04:05"),
+			strconv.Itoa(int(rd.MgDL())),
+			rd.Type,
+			rd.ID,
+			rd.UploadID,
+			rd.DeviceID,
+		}
+		if rep.Sources {
+			row = append(row, rd.Source)
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Println("Error writing the CSV", err)
+	}
+}
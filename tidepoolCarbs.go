@@ -0,0 +1,146 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+   Carbs.
+
+   The "carbs" section (Carbs And Meal Boluses on the form) fetches the
+   bolus calculator (wizard) and food records and lists each carb entry
+   with what was going on around it - the glucose reading nearest the
+   entry and the insulin given around it - so a high after a meal can be
+   read against what was eaten and dosed.
+*/
+
+//How far from an entry a reading or bolus can be and still go with it
+const carbWindow = 15 * time.Minute
+
+//One carb entry
+type carbEntry struct {
+	Time   time.Time `json:"time"`
+	Grams  float64   `json:"grams"`
+	Source string    `json:"source"` //wizard or food
+
+	//Context - 0 when there wasn't any in the window
+	MgDL  float64 `json:"mgdl"`  //The nearest glucose reading
+	Bolus float64 `json:"bolus"` //Units given
+}
+
+//The source as shown
+func (c carbEntry) SourceName() string {
+	if c.Source == "wizard" {
+		return "Bolus calculator"
+	}
+	return "Food"
+}
+
+//The carb entries in the records in time order
+func carbsFrom(records tpMeasurement) []carbEntry {
+	var entries []carbEntry
+	for i := range records {
+		rec := &records[i]
+		var grams float64
+		switch rec.Type {
+		case "wizard":
+			grams = rec.Carbinput
+		case "food":
+			if rec.Nutrition != nil {
+				grams = rec.Nutrition.Carbohydrate.Net
+			}
+		}
+		if grams <= 0 {
+			continue
+		}
+		entries = append(entries, carbEntry{
+			Time:   deviceLocalTime(rec.Devicetime, rec.Time, rec.Timezoneoffset),
+			Grams:  grams,
+			Source: rec.Type,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries
+}
+
+//Fill in the reading and insulin around each entry. Both lists must be in time order.
+func withMealContext(entries []carbEntry, readings []Reading, doses []bolusDose) {
+	for i := range entries {
+		e := &entries[i]
+		//The nearest reading in the window
+		j := sort.Search(len(readings), func(k int) bool { return !readings[k].Time.Before(e.Time) })
+		best := carbWindow + 1
+		for _, k := range []int{j - 1, j} {
+			if k < 0 || k >= len(readings) {
+				continue
+			}
+			d := readings[k].Time.Sub(e.Time)
+			if d < 0 {
+				d = -d
+			}
+			if d <= carbWindow && d < best {
+				best, e.MgDL = d, readings[k].MgDL()
+			}
+		}
+		//Boluses in the window
+		for _, dose := range doses {
+			d := dose.Time.Sub(e.Time)
+			if d >= -carbWindow && d <= carbWindow {
+				e.Bolus += dose.Total()
+			}
+		}
+	}
+}
+
+//The totals line for the section, e.g. "42 carb entries, 1830 g - 131 g a day"
+func carbTotals(entries []carbEntry, start, end string) string {
+	var total float64
+	for _, e := range entries {
+		total += e.Grams
+	}
+	line := fmt.Sprintf("%d carb entries, %.0f g", len(entries), total)
+	if len(entries) == 1 {
+		line = fmt.Sprintf("1 carb entry, %.0f g", total)
+	}
+	if days := periodDays(start, end); days > 0 {
+		line += fmt.Sprintf(" - %.0f g a day", total/float64(days))
+	}
+	return line
+}
+
+//The carb table rows - time, grams, glucose, insulin and source
+func carbRows(entries []carbEntry, u Units) [][]string {
+	rows := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		glucose, bolus := "", ""
+		if e.MgDL > 0 {
+			glucose = u.format(e.MgDL)
+		}
+		if e.Bolus > 0 {
+			bolus = fmt.Sprintf("%.2f", e.Bolus)
+		}
+		rows = append(rows, []string{e.Time.Format("2006-01-02 15:04"), fmt.Sprintf("%.0f", e.Grams), glucose, bolus, e.SourceName()})
+	}
+	return rows
+}
+
+//The carb entries in the report's period
+func carbsStep(b *reportBuilder) {
+	if !b.opts.Carbs {
+		return
+	}
+	rep := b.report
+	for _, e := range carbsFrom(b.records) {
+		day := e.Time.Format("2006-01-02")
+		if (rep.Start == "" || day >= rep.Start) && (rep.End == "" || day <= rep.End) {
+			rep.Carbs = append(rep.Carbs, e)
+		}
+	}
+	doses := rep.Boluses
+	if doses == nil {
+		doses = bolusesFrom(b.records)
+	}
+	withMealContext(rep.Carbs, rep.Readings, doses)
+}
@@ -0,0 +1,166 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+   What changed since the last run.
+
+   With "What's new" on the form (changes=on to the api, or "changes" in
+   the sections) the report starts with what's different from the last
+   run for the same account: readings that weren't in it, events - flags,
+   data gaps and pump suspend days - that weren't there before, and how
+   the main numbers moved. A snapshot of each such run is kept for the
+   next one to compare with - see tidepoolHistory.go.
+*/
+
+//What a run is remembered by for the next comparison
+type reportSnapshot struct {
+	Taken    time.Time `json:"taken"`
+	Start    string    `json:"start"`
+	End      string    `json:"end"`
+	Readings []string  `json:"readings"` //Time and type of each reading
+	Events   []string  `json:"events"`
+
+	//The main numbers
+	Count   int     `json:"count"`
+	Mean    float64 `json:"mean"`
+	InRange float64 `json:"inRange"`
+	Below   float64 `json:"below"`
+	GMI     float64 `json:"gmi"`
+	CV      float64 `json:"cv"`
+}
+
+//The changes section
+type changeSummary struct {
+	Since       time.Time     `json:"since"` //When the previous run was - zero when there wasn't one
+	NewReadings int           `json:"newReadings"`
+	NewEvents   []string      `json:"newEvents"`
+	Deltas      []metricDelta `json:"deltas"`
+}
+
+//A number then and now
+type metricDelta struct {
+	Name   string `json:"name"`
+	Before string `json:"before"`
+	Now    string `json:"now"`
+	Change string `json:"change"` //e.g. "+5 mg/dl"
+}
+
+//A reading's key - the ids change if a report was anonymized so it's the time and type
+func readingKey(rd Reading) string {
+	return rd.Time.Format(time.RFC3339) + " " + rd.Type
+}
+
+//The events in the report as text, to be matched against the last run's
+func reportEvents(rep *Report) []string {
+	events := append([]string(nil), rep.Flags...)
+	for _, g := range rep.Gaps {
+		events = append(events, fmt.Sprintf("Data gap %s to %s", g.start.Format("2006-01-02 15:04"), g.end.Format("2006-01-02 15:04")))
+	}
+	for _, d := range rep.Suspends {
+		events = append(events, fmt.Sprintf("Pump suspended %s on %s", formatDuration(d.total), d.day))
+	}
+	return events
+}
+
+//The snapshot of a built report
+func snapshotOf(rep *Report, taken time.Time) reportSnapshot {
+	snap := reportSnapshot{
+		Taken:   taken,
+		Start:   rep.Start,
+		End:     rep.End,
+		Events:  reportEvents(rep),
+		Count:   rep.Stats.count,
+		Mean:    rep.Stats.mean,
+		InRange: rep.Stats.inRange,
+		Below:   rep.Stats.below,
+		GMI:     rep.Stats.gmi,
+		CV:      rep.Stats.cv,
+	}
+	snap.Readings = make([]string, len(rep.Readings))
+	for i, rd := range rep.Readings {
+		snap.Readings[i] = readingKey(rd)
+	}
+	return snap
+}
+
+//Compare the report with the previous run's snapshot - nil when there wasn't one
+func compareWithSnapshot(rep *Report, prev *reportSnapshot) *changeSummary {
+	ch := &changeSummary{}
+	if prev == nil {
+		return ch
+	}
+	ch.Since = prev.Taken
+
+	seen := make(map[string]bool, len(prev.Readings))
+	for _, k := range prev.Readings {
+		seen[k] = true
+	}
+	for _, rd := range rep.Readings {
+		if !seen[readingKey(rd)] {
+			ch.NewReadings++
+		}
+	}
+
+	seen = make(map[string]bool, len(prev.Events))
+	for _, e := range prev.Events {
+		seen[e] = true
+	}
+	for _, e := range reportEvents(rep) {
+		if !seen[e] {
+			ch.NewEvents = append(ch.NewEvents, e)
+		}
+	}
+
+	delta := func(name string, before, now float64, format string, units string) {
+		d := metricDelta{Name: name, Before: fmt.Sprintf(format, before) + units, Now: fmt.Sprintf(format, now) + units}
+		if d.Before == d.Now {
+			d.Change = "no change"
+		} else {
+			d.Change = fmt.Sprintf("%+"+format[1:], now-before) + units
+		}
+		ch.Deltas = append(ch.Deltas, d)
+	}
+	st := rep.Stats
+	delta("Readings", float64(prev.Count), float64(st.count), "%.0f", "")
+	if st.count > 0 && prev.Count > 0 {
+		if rep.Units == MmolL {
+			delta("Mean glucose", prev.Mean/mmolToMgdl, st.mean/mmolToMgdl, "%.1f", " mmol/L")
+		} else {
+			delta("Mean glucose", prev.Mean, st.mean, "%.0f", " mg/dl")
+		}
+		delta("Time in range", prev.InRange, st.inRange, "%.1f", "%")
+		delta("Below range", prev.Below, st.below, "%.1f", "%")
+		delta("GMI", prev.GMI, st.gmi, "%.1f", "%")
+		delta("Variability (CV)", prev.CV, st.cv, "%.1f", "%")
+	}
+	return ch
+}
+
+//The section as lines of text
+func (ch *changeSummary) lines() []string {
+	if ch.Since.IsZero() {
+		return []string{"No earlier run to compare with - the next report will show what's new since this one."}
+	}
+	lines := []string{fmt.Sprintf("Since the last run on %s: %s.", ch.Since.Format("2006-01-02 15:04"), countOf(ch.NewReadings, "new reading"))}
+	if len(ch.NewEvents) == 0 {
+		lines = append(lines, "No new flags, data gaps or pump suspends.")
+	}
+	for _, e := range ch.NewEvents {
+		lines = append(lines, "New: "+e)
+	}
+	for _, d := range ch.Deltas {
+		lines = append(lines, fmt.Sprintf("%s: %s, was %s (%s)", d.Name, d.Now, d.Before, d.Change))
+	}
+	return lines
+}
+
+//The comparison with the last run
+func changesStep(b *reportBuilder) {
+	if b.opts.Changes {
+		b.report.Changes = compareWithSnapshot(b.report, b.opts.Previous)
+	}
+}
@@ -0,0 +1,430 @@
+package tidepoolreport
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   A small charting layer that draws to PNG using only the standard library.
+
+   A chartCanvas maps data coordinates (x and y ranges chosen by the caller)
+   onto a plot area inside the image. The axis labels are drawn with a tiny
+   built in bitmap font since the standard library has no text rendering.
+   Colors, the top of the glucose axis and the grid spacing come from a
+   palette built from the config's chart theme.
+*/
+
+//ChartTheme - chart settings from config.json and the form. Colors are #rrggbb.
+type ChartTheme struct {
+	Style       string  `json:"style"`       //color, or grayscale for black and white printers
+	YMax        float64 `json:"yMax"`        //Top of the glucose axis, mg/dl - 400 when not set
+	GridStep    float64 `json:"gridStep"`    //mg/dl between grid lines - 50 when not set
+	BucketWidth float64 `json:"bucketWidth"` //mg/dl per histogram bar - 10 when not set
+	Low         string  `json:"low"`         //Band below the target range - none when not set
+	Target      string  `json:"target"`      //Band for the target range
+	High        string  `json:"high"`        //Band above the target range - none when not set
+	Line        string  `json:"line"`        //The readings
+	Grid        string  `json:"grid"`
+}
+
+//The colors and axis the charts are drawn with
+type chartPalette struct {
+	background color.RGBA
+	axis       color.RGBA
+	grid       color.RGBA
+	low        color.RGBA //Zero alpha for no band
+	target     color.RGBA
+	high       color.RGBA
+	line       color.RGBA
+	ymax       float64
+	gridStep   float64
+	gray       bool
+	rng        TargetRange //The target band
+	units      Units       //What the glucose axis is labeled in - it's drawn in mg/dl
+}
+
+//Glucose axis bottom for the charts - mg/dl
+const chartGlucoseMin = 0.0
+
+//The palette when the config doesn't change anything
+func defaultPalette() chartPalette {
+	return chartPalette{
+		background: color.RGBA{255, 255, 255, 255},
+		axis:       color.RGBA{0, 0, 0, 255},
+		grid:       color.RGBA{220, 220, 220, 255},
+		target:     color.RGBA{220, 240, 220, 255},
+		line:       color.RGBA{30, 90, 200, 255},
+		ymax:       400,
+		gridStep:   50,
+		rng:        defaultTargetRange,
+	}
+}
+
+//The palette for the theme. Bad colors are logged and come out black.
+func (t ChartTheme) palette() chartPalette {
+	p := defaultPalette()
+	if t.Style == "grayscale" {
+		p.gray = true
+		p.target = color.RGBA{225, 225, 225, 255}
+		p.line = color.RGBA{0, 0, 0, 255}
+		p.grid = color.RGBA{190, 190, 190, 255}
+	}
+	if t.YMax > targetHigh {
+		p.ymax = t.YMax
+	}
+	if t.GridStep > 0 && p.ymax/t.GridStep <= 40 {
+		p.gridStep = t.GridStep
+	}
+	for _, c := range []struct {
+		hex string
+		col *color.RGBA
+	}{{t.Low, &p.low}, {t.Target, &p.target}, {t.High, &p.high}, {t.Line, &p.line}, {t.Grid, &p.grid}} {
+		if c.hex != "" {
+			r, g, b := layoutColor(c.hex)
+			*c.col = color.RGBA{uint8(r), uint8(g), uint8(b), 255}
+		}
+	}
+	return p
+}
+
+//The palette with the target band for a range
+func (p chartPalette) withRange(rng TargetRange) chartPalette {
+	p.rng = rng
+	return p
+}
+
+//The palette with the glucose axis labeled in the units. The usual grid
+//step becomes 2 mmol/L so the labels come out whole.
+func (p chartPalette) withUnits(u Units) chartPalette {
+	p.units = u
+	if u == MmolL && p.gridStep == defaultPalette().gridStep {
+		p.gridStep = 2 * mmolToMgdl
+	}
+	return p
+}
+
+//Parse a #rrggbb color. Bad colors are black.
+func layoutColor(hex string) (int, int, int) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(hex, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(hex, "#")) != 6 {
+		log.Println("Layout: bad color", hex)
+		return 0, 0, 0
+	}
+	return int(v >> 16), int(v >> 8 & 0xff), int(v & 0xff)
+}
+
+//A color as the palette draws it - gray for a grayscale palette
+func (p chartPalette) shade(c color.RGBA) color.RGBA {
+	if !p.gray {
+		return c
+	}
+	y := uint8((299*int(c.R) + 587*int(c.G) + 114*int(c.B)) / 1000)
+	return color.RGBA{y, y, y, c.A}
+}
+
+//Size of the trend chart image - pixels
+const (
+	trendChartW = 900
+	trendChartH = 300
+)
+
+//An image with a plot area mapped to data coordinates
+type chartCanvas struct {
+	pal        chartPalette
+	img        *image.RGBA
+	plot       image.Rectangle
+	xmin, xmax float64
+	ymin, ymax float64
+}
+
+//Create a canvas w x h pixels with room around the plot area for the labels
+func newChartCanvas(pal chartPalette, w, h int, xmin, xmax, ymin, ymax float64) *chartCanvas {
+	c := &chartCanvas{
+		pal:  pal,
+		img:  image.NewRGBA(image.Rect(0, 0, w, h)),
+		plot: image.Rect(40, 10, w-10, h-25),
+		xmin: xmin, xmax: xmax,
+		ymin: ymin, ymax: ymax,
+	}
+	draw.Draw(c.img, c.img.Bounds(), &image.Uniform{pal.background}, image.Point{}, draw.Src)
+	return c
+}
+
+//Data coordinates to pixels
+func (c *chartCanvas) px(x, y float64) (int, int) {
+	fx := (x - c.xmin) / (c.xmax - c.xmin)
+	fy := (y - c.ymin) / (c.ymax - c.ymin)
+	return c.plot.Min.X + int(fx*float64(c.plot.Dx())), c.plot.Max.Y - int(fy*float64(c.plot.Dy()))
+}
+
+//Fill the area between two data points, clipped to the plot area
+func (c *chartCanvas) fillRect(x0, y0, x1, y1 float64, col color.Color) {
+	ax, ay := c.px(x0, y0)
+	bx, by := c.px(x1, y1)
+	r := image.Rect(ax, ay, bx, by).Canon().Intersect(c.plot)
+	draw.Draw(c.img, r, &image.Uniform{col}, image.Point{}, draw.Over)
+}
+
+//Shade the low, target and high bands across the plot
+func (c *chartCanvas) bands() {
+	low, high := c.pal.rng.Low, c.pal.rng.High
+	if c.pal.low.A > 0 {
+		c.fillRect(c.xmin, c.ymin, c.xmax, low, c.pal.shade(c.pal.low))
+	}
+	c.fillRect(c.xmin, low, c.xmax, high, c.pal.shade(c.pal.target))
+	if c.pal.high.A > 0 {
+		c.fillRect(c.xmin, high, c.xmax, c.ymax, c.pal.shade(c.pal.high))
+	}
+	//Grays can come out too close to tell apart so edge the target range
+	if c.pal.gray {
+		c.line(c.xmin, low, c.xmax, low, c.pal.axis)
+		c.line(c.xmin, high, c.xmax, high, c.pal.axis)
+	}
+}
+
+//Draw a line between two data points
+func (c *chartCanvas) line(x0, y0, x1, y1 float64, col color.Color) {
+	ax, ay := c.px(x0, y0)
+	bx, by := c.px(x1, y1)
+	c.pixelLine(ax, ay, bx, by, col)
+}
+
+//Bresenham line in pixel coordinates, clipped to the plot area
+func (c *chartCanvas) pixelLine(x0, y0, x1, y1 int, col color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		if (image.Point{x0, y0}).In(c.plot.Inset(-1)) {
+			c.img.Set(x0, y0, col)
+		}
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+//Draw a small square at a data point
+func (c *chartCanvas) dot(x, y float64, col color.Color) {
+	px, py := c.px(x, y)
+	r := image.Rect(px-2, py-2, px+3, py+3).Intersect(c.plot)
+	draw.Draw(c.img, r, &image.Uniform{col}, image.Point{}, draw.Src)
+}
+
+//Horizontal grid lines every step with labels on the left
+func (c *chartCanvas) gridY(step float64) {
+	for y := c.ymin; y <= c.ymax; y += step {
+		_, py := c.px(c.xmin, y)
+		c.pixelLine(c.plot.Min.X, py, c.plot.Max.X, py, c.pal.grid)
+		label := strconv.Itoa(int(y))
+		c.text(c.plot.Min.X-4-textWidth(label), py-5, label, c.pal.axis)
+	}
+}
+
+//Glucose grid lines every grid step, labeled in the palette's units
+func (c *chartCanvas) glucoseGridY() {
+	for y := c.ymin; y <= c.ymax; y += c.pal.gridStep {
+		_, py := c.px(c.xmin, y)
+		c.pixelLine(c.plot.Min.X, py, c.plot.Max.X, py, c.pal.grid)
+		label := c.pal.units.axisLabel(y)
+		c.text(c.plot.Min.X-4-textWidth(label), py-5, label, c.pal.axis)
+	}
+}
+
+//Vertical grid line at x with a label below the plot
+func (c *chartCanvas) gridX(x float64, label string) {
+	px, _ := c.px(x, c.ymin)
+	c.pixelLine(px, c.plot.Min.Y, px, c.plot.Max.Y, c.pal.grid)
+	c.text(px-textWidth(label)/2, c.plot.Max.Y+6, label, c.pal.axis)
+}
+
+//Outline the plot area
+func (c *chartCanvas) frame() {
+	p := c.plot
+	c.pixelLine(p.Min.X, p.Min.Y, p.Max.X, p.Min.Y, c.pal.axis)
+	c.pixelLine(p.Min.X, p.Max.Y, p.Max.X, p.Max.Y, c.pal.axis)
+	c.pixelLine(p.Min.X, p.Min.Y, p.Min.X, p.Max.Y, c.pal.axis)
+	c.pixelLine(p.Max.X, p.Min.Y, p.Max.X, p.Max.Y, c.pal.axis)
+}
+
+//Encode the chart as a PNG
+func (c *chartCanvas) png() ([]byte, error) {
+	var b bytes.Buffer
+	err := png.Encode(&b, c.img)
+	return b.Bytes(), err
+}
+
+/*
+   Chart of all the readings in the period.
+   The target range is shaded, CGM readings are joined with a line
+   and meter readings are drawn as dots.
+*/
+func glucoseTrendChart(points []Reading, pal chartPalette, w, h int) ([]byte, error) {
+	if len(points) == 0 {
+		return newChartCanvas(pal, w, h, 0, 1, chartGlucoseMin, pal.ymax).png()
+	}
+
+	//Whole days from the first to the last reading
+	first := startOfDay(points[0].Time)
+	last := startOfDay(points[len(points)-1].Time).AddDate(0, 0, 1)
+	c := newChartCanvas(pal, w, h, float64(first.Unix()), float64(last.Unix()), chartGlucoseMin, pal.ymax)
+
+	c.bands()
+	c.glucoseGridY()
+
+	//Label about 7 days across the chart
+	days := int(last.Sub(first).Hours()/24 + 0.5)
+	every := days/7 + 1
+	for d := 0; d <= days; d += every {
+		t := first.AddDate(0, 0, d)
+		c.gridX(float64(t.Unix()), t.Format("01-02"))
+	}
+
+	plotGlucose(c, points, func(t time.Time) float64 { return float64(t.Unix()) })
+	c.frame()
+	return c.png()
+}
+
+//Excluded days' readings - see tidepoolExclude.go
+var excludedGray = color.RGBA{180, 180, 180, 255}
+
+//Plot readings on the canvas. Readings closer than the CGM joining gap are joined by lines.
+//Readings on excluded days are gray.
+func plotGlucose(c *chartCanvas, points []Reading, x func(time.Time) float64) {
+	const joinGap = 15 * time.Minute
+	for i, p := range points {
+		col := c.pal.line
+		if p.Excluded {
+			col = excludedGray
+		}
+		if i > 0 && p.Time.Sub(points[i-1].Time) <= joinGap && x(p.Time) >= x(points[i-1].Time) {
+			c.line(x(points[i-1].Time), points[i-1].MgDL(), x(p.Time), p.MgDL(), col)
+			continue
+		}
+		c.dot(x(p.Time), p.MgDL(), col)
+	}
+}
+
+//Midnight at the start of t's day
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+/*
+   Tiny 3x5 bitmap font for the axis labels, drawn at 2x.
+   Each glyph is 5 rows of 3 bits, high bit on the left.
+*/
+var chartGlyphs = map[rune][5]uint8{
+	'0': {7, 5, 5, 5, 7}, '1': {2, 6, 2, 2, 7}, '2': {7, 1, 7, 4, 7}, '3': {7, 1, 7, 1, 7},
+	'4': {5, 5, 7, 1, 1}, '5': {7, 4, 7, 1, 7}, '6': {7, 4, 7, 5, 7}, '7': {7, 1, 1, 1, 1},
+	'8': {7, 5, 7, 5, 7}, '9': {7, 5, 7, 1, 7}, '-': {0, 0, 7, 0, 0}, ':': {0, 2, 0, 2, 0},
+	'.': {0, 0, 0, 0, 2}, '/': {1, 1, 2, 4, 4}, '%': {5, 1, 2, 4, 5}, ' ': {0, 0, 0, 0, 0},
+}
+
+const glyphScale = 2
+
+//Width in pixels of a label
+func textWidth(s string) int {
+	return len(s) * 4 * glyphScale
+}
+
+//Draw a label with its top left corner at x, y. Unknown characters are skipped.
+func (c *chartCanvas) text(x, y int, s string, col color.Color) {
+	for _, r := range s {
+		g := chartGlyphs[r]
+		for row := 0; row < 5; row++ {
+			for bit := 0; bit < 3; bit++ {
+				if g[row]&(4>>uint(bit)) == 0 {
+					continue
+				}
+				px, py := x+bit*glyphScale, y+row*glyphScale
+				draw.Draw(c.img, image.Rect(px, py, px+glyphScale, py+glyphScale), &image.Uniform{col}, image.Point{}, draw.Src)
+			}
+		}
+		x += 4 * glyphScale
+	}
+}
+
+//Size of the daily thumbnails image - 2 rows of 7 days
+const (
+	dailyChartW = 1400
+	dailyChartH = 440
+	dailyDays   = 14
+)
+
+//Most daily thumbnail images in a report - 14 days each, about 6 months
+const dailyChartsMax = 13
+
+//Name of the daily thumbnails image k fortnights before the last one
+func dailyChartName(k int) string {
+	if k == 0 {
+		return "daily.png"
+	}
+	return fmt.Sprintf("daily-%d.png", k)
+}
+
+/*
+   Thumbnails of the last 14 days of the period, 2 rows of 7, as on the
+   consensus AGP report. Each day runs midnight to midnight with the
+   target range shaded and a line at noon. Days with no readings are
+   left blank so they stand out.
+*/
+func dailyThumbnailsChart(points []Reading, lastDay time.Time, pal chartPalette, w, h int) ([]byte, error) {
+	c := newChartCanvas(pal, w, h, 0, 24*3600, chartGlucoseMin, pal.ymax)
+	cellW, cellH := w/7, h/2
+
+	first := lastDay.AddDate(0, 0, 1-dailyDays)
+	byDay := map[string][]Reading{}
+	for _, p := range points {
+		day := p.Time.Format("2006-01-02")
+		byDay[day] = append(byDay[day], p)
+	}
+
+	for i := 0; i < dailyDays; i++ {
+		day := first.AddDate(0, 0, i)
+		x0, y0 := (i%7)*cellW, (i/7)*cellH
+		c.plot = image.Rect(x0+6, y0+20, x0+cellW-6, y0+cellH-6)
+		c.text(c.plot.Min.X, y0+6, day.Format("01-02"), c.pal.axis)
+
+		c.bands()
+		noon, _ := c.px(12*3600, 0)
+		c.pixelLine(noon, c.plot.Min.Y, noon, c.plot.Max.Y, c.pal.grid)
+		midnight := startOfDay(day)
+		plotGlucose(c, byDay[day.Format("2006-01-02")], func(t time.Time) float64 {
+			return t.Sub(midnight).Seconds()
+		})
+		c.frame()
+	}
+	return c.png()
+}
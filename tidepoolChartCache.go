@@ -0,0 +1,84 @@
+package tidepoolreport
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+)
+
+/*
+   Chart image cache.
+
+   Drawing the charts is most of the work for a long report, and the same
+   charts come up again when a report is run in another format or
+   downloaded again. Each chart is kept under a hash of everything it is
+   drawn from - the kind of chart, the palette, the size and the readings -
+   so an identical chart comes straight from memory. The oldest charts
+   are dropped once the cache passes its size.
+*/
+
+//Most bytes of chart images kept
+const chartCacheBytes = 32 << 20
+
+//Charts by key, oldest first in order
+type chartCache struct {
+	mu     sync.Mutex
+	charts map[string][]byte
+	order  []string
+	size   int
+}
+
+//The cache used by the report builder
+var charts = &chartCache{charts: map[string][]byte{}}
+
+//The cache key for a chart - the chart kind, the palette, anything
+//else it's drawn from (size, day, ...) and the readings
+func chartKey(kind string, pal chartPalette, readings []Reading, extra ...interface{}) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%v\x00%v\x00", kind, pal, extra)
+	var b [8]byte
+	for _, rd := range readings {
+		binary.LittleEndian.PutUint64(b[:], uint64(rd.Time.UnixNano()))
+		h.Write(b[:])
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(rd.MgDL()))
+		h.Write(b[:])
+		h.Write([]byte(rd.Type))
+		if rd.Excluded {
+			h.Write([]byte{1})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//The chart for the key, drawing it when it isn't cached. Failures aren't cached.
+func (cc *chartCache) get(key string, draw func() ([]byte, error)) ([]byte, error) {
+	cc.mu.Lock()
+	chart, ok := cc.charts[key]
+	cc.mu.Unlock()
+	if ok {
+		return chart, nil
+	}
+
+	chart, err := draw()
+	if err != nil {
+		return nil, err
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if _, ok := cc.charts[key]; !ok && len(chart) <= chartCacheBytes {
+		cc.charts[key] = chart
+		cc.order = append(cc.order, key)
+		cc.size += len(chart)
+		for cc.size > chartCacheBytes {
+			oldest := cc.order[0]
+			cc.order = cc.order[1:]
+			cc.size -= len(cc.charts[oldest])
+			delete(cc.charts, oldest)
+		}
+	}
+	return chart, nil
+}
@@ -0,0 +1,232 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+   Device clocks that were wrong.
+
+   Readings are shown at the device's own clock time (deviceTime) so they
+   line up with what the person saw on the meter. Tidepool also works out
+   the true time of each record (time, with the timezone offset), so the
+   difference between the two is how far off the device clock was when
+   that upload was made. A meter that never had its clock set, or missed a
+   daylight saving change, shows up as a steady difference in its uploads.
+
+   Each device's uploads that were off by more than clockSkewLimit get a
+   note. With "Correct Device Clocks" on the form (fixclocks=on) the
+   readings from those uploads are moved by the difference instead, which
+   puts them at the time they were really taken.
+
+   Device Time Corrections on the form (clockshifts=) move a device's
+   readings by a set amount instead - a line each of the device id and
+   a Go duration, e.g. "DemoMeter DM-0001 +1h" for a meter that never
+   went back after daylight saving. The device id is everything before
+   the last space. A device corrected this way is left out of the
+   automatic notes and correction.
+*/
+
+//A device and one of its uploads
+type uploadKey struct {
+	device string
+	upload string
+}
+
+//Record how far the device clock was off for a glucose record
+func (d *dataIssues) sampleClock(devicetime string, utc time.Time, offset int, device string, upload string) {
+	if len(devicetime) < 19 || utc.IsZero() {
+		return
+	}
+	t, err := time.Parse(deviceTimeLayout, devicetime[:19])
+	if err != nil {
+		return
+	}
+	if d.clocks == nil {
+		d.clocks = map[uploadKey][]time.Duration{}
+	}
+	key := uploadKey{device, upload}
+	d.clocks[key] = append(d.clocks[key], t.Sub(utc.Add(time.Duration(offset)*time.Minute).UTC()))
+}
+
+//Parse the device time corrections - a device id and a duration a line.
+//Lines that don't end in a duration are skipped.
+func parseClockShifts(s string) map[string]time.Duration {
+	var shifts map[string]time.Duration
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			continue
+		}
+		shift, err := time.ParseDuration(line[i+1:])
+		device := strings.TrimSpace(line[:i])
+		if err != nil || device == "" || shift == 0 {
+			continue
+		}
+		if shifts == nil {
+			shifts = map[string]time.Duration{}
+		}
+		shifts[device] = shift
+	}
+	return shifts
+}
+
+//The uploads whose device clock was off by more than the limit and by
+//how much - the median of the upload's records, to the minute.
+//Positive is a clock that was fast. Devices with a set correction are
+//left out.
+func (d dataIssues) clockDrifts(shifts map[string]time.Duration) map[uploadKey]time.Duration {
+	drifts := map[uploadKey]time.Duration{}
+	for key, samples := range d.clocks {
+		if _, set := shifts[key.device]; set {
+			continue
+		}
+		sorted := append([]time.Duration(nil), samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		drift := sorted[len(sorted)/2].Round(time.Minute)
+		if drift > clockSkewLimit || drift < -clockSkewLimit {
+			drifts[key] = drift
+		}
+	}
+	return drifts
+}
+
+//A note for each device with clocks that were off, e.g.
+//"The clock on Contour Next One 1234 was 62 minutes slow in 2 of 5 uploads",
+//and for each set correction
+func (d dataIssues) clockNotes(fixed bool, shifts map[string]time.Duration) []string {
+	var notes []string
+	devices := make([]string, 0, len(shifts))
+	for device := range shifts {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	seen := map[string]bool{}
+	for key := range d.clocks {
+		seen[key.device] = true
+	}
+	for _, device := range devices {
+		if !seen[device] {
+			notes = append(notes, fmt.Sprintf("No readings came from %s, so its Device Time Correction wasn't used.", device))
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("The readings from %s have been moved by %s as set in Device Time Corrections.", device, shiftWords(shifts[device])))
+	}
+
+	drifts := d.clockDrifts(shifts)
+	if len(drifts) == 0 {
+		return notes
+	}
+
+	//Per device - the uploads, the ones off and the biggest difference
+	type device struct {
+		uploads, off int
+		worst        time.Duration
+	}
+	byDevice := map[string]*device{}
+	for key := range d.clocks {
+		if byDevice[key.device] == nil {
+			byDevice[key.device] = &device{}
+		}
+		dv := byDevice[key.device]
+		dv.uploads++
+		if drift, ok := drifts[key]; ok {
+			dv.off++
+			if absDuration(drift) > absDuration(dv.worst) {
+				dv.worst = drift
+			}
+		}
+	}
+	names := make([]string, 0, len(byDevice))
+	for name, dv := range byDevice {
+		if dv.off > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		dv := byDevice[name]
+		if name == "" {
+			name = "a device"
+		}
+		way := "fast"
+		if dv.worst < 0 {
+			way = "slow"
+		}
+		note := fmt.Sprintf("The clock on %s was %s %s", name, durationWords(absDuration(dv.worst)), way)
+		if dv.off > 1 {
+			note = fmt.Sprintf("The clock on %s was up to %s %s", name, durationWords(absDuration(dv.worst)), way)
+		}
+		if dv.uploads > 1 {
+			note += fmt.Sprintf(" in %d of %d uploads", dv.off, dv.uploads)
+		}
+		if fixed {
+			note += " - those readings have been moved to the time they were taken."
+		} else {
+			note += ", so the times of its readings may be wrong. Correct Device Clocks moves them to the time they were taken."
+		}
+		notes = append(notes, note)
+	}
+	return notes
+}
+
+//Move the readings from uploads with a wrong clock to the time they were
+//taken, and those from devices with a set correction by that much.
+//Returns the readings in time order - copied when any were moved.
+func correctClocks(readings []Reading, drifts map[uploadKey]time.Duration, shifts map[string]time.Duration) []Reading {
+	if len(drifts) == 0 && len(shifts) == 0 {
+		return readings
+	}
+	var moved []Reading
+	for i, rd := range readings {
+		by, ok := shifts[rd.DeviceID]
+		if !ok {
+			var drift time.Duration
+			if drift, ok = drifts[uploadKey{rd.DeviceID, rd.UploadID}]; !ok {
+				continue
+			}
+			by = -drift
+		}
+		if moved == nil {
+			moved = append([]Reading(nil), readings...)
+		}
+		moved[i].Time = rd.Time.Add(by)
+	}
+	if moved == nil {
+		return readings
+	}
+	sort.SliceStable(moved, func(i, j int) bool { return moved[i].Time.Before(moved[j].Time) })
+	return moved
+}
+
+//How far off a clock was - minutes up to two hours, then hours and minutes
+func durationWords(d time.Duration) string {
+	if d < 2*time.Hour {
+		return countOf(int(d.Minutes()), "minute")
+	}
+	return formatDuration(d)
+}
+
+//A set correction, e.g. "+1 hour" or "-30 minutes"
+func shiftWords(d time.Duration) string {
+	sign := "+"
+	if d < 0 {
+		sign = "-"
+	}
+	if d%time.Hour == 0 {
+		return sign + countOf(int(absDuration(d).Hours()), "hour")
+	}
+	return sign + durationWords(absDuration(d))
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,177 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+/*
+   Optional configuration read from config.json in the working folder.
+   Anything left out of the file keeps its default. The file is read on
+   each request so changes show up without restarting the server.
+*/
+
+//Name of the configuration file
+const configFile = "config.json"
+
+//Config - the settings read from config.json
+type Config struct {
+	//Page header and footer templates. Placeholders are
+	//{{.PatientName}}, {{.Range}}, {{.Title}}, {{.Page}} and {{.Pages}}
+	Header string `json:"header"`
+	Footer string `json:"footer"`
+
+	//Name shown in the header. Defaults to the Tidepool account email.
+	PatientName string `json:"patientName"`
+
+	//Diagonal watermark across every page, e.g. DRAFT or CONFIDENTIAL.
+	//Opacity is 0 - 1. No text means no watermark.
+	Watermark        string  `json:"watermark"`
+	WatermarkOpacity float64 `json:"watermarkOpacity"`
+
+	//Summary metrics to turn on or off by name, e.g. {"Hypos": false}
+	Metrics map[string]bool `json:"metrics"`
+
+	//Report sections in order, e.g. ["summary", "chart", "readings"].
+	//Left out for each output's usual layout. The form can override it.
+	Sections []string `json:"sections"`
+
+	//Flag and alert rules, one per entry - see tidepoolRules.go
+	Rules []string `json:"rules"`
+
+	//Target range and goals for a group of people, e.g. "pregnancy" - see tidepoolPresets.go
+	Preset string `json:"preset"`
+
+	//Target range in mg/dl - 0 for the preset's
+	TargetRange TargetRange `json:"targetRange"`
+
+	//Goals for the targets section - see tidepoolTargets.go
+	Goals ClinicalGoals `json:"goals"`
+
+	//A custom PDF layout file - see tidepoolLayout.go
+	Layout string `json:"layout"`
+
+	//Chart colors, glucose axis and grid - see ChartTheme in tidepoolChart.go
+	Chart ChartTheme `json:"chart"`
+
+	//"all" for every CGM reading in the readings tables instead of
+	//hourly averages - see tidepoolCGM.go
+	CGMTable string `json:"cgmTable"`
+
+	//Value coloring for the readings table when the layout doesn't set any.
+	//Red under 70 and orange over 180 unless set - 0 turns one off.
+	Thresholds LayoutThresholds `json:"thresholds"`
+
+	//The Tidepool api server. Defaults to the integration server.
+	TidepoolServer string `json:"tidepoolServer"`
+
+	//How many minutes a report download link lasts
+	DownloadMinutes int `json:"downloadMinutes"`
+
+	//Mail server for sending reports
+	SMTP SMTPConfig `json:"smtp"`
+
+	//Pushover application token for Pushover notifications
+	PushoverToken string `json:"pushoverToken"`
+
+	//Fetches estimated to need more memory than this are
+	//fetched and processed a chunk at a time - see tidepoolStream.go
+	MemoryBudgetMB int `json:"memoryBudgetMB"`
+
+	//Reports still fetching after this many seconds are stopped - see tidepoolTimeout.go
+	ReportTimeoutSeconds int `json:"reportTimeoutSeconds"`
+
+	//Most Tidepool calls a minute for one account - see tidepoolThrottle.go
+	RequestsPerMinute int `json:"requestsPerMinute"`
+
+	//"lenient" (the default) or "strict" - see tidepoolDecode.go
+	Decoding string `json:"decoding"`
+
+	//Tidepool account emails with the clinician role - see tidepoolReview.go
+	Clinicians []string `json:"clinicians"`
+
+	//The loaded layout
+	layout Layout
+}
+
+//SMTPConfig - the mail server settings
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+//The settings used when there is no config file
+func defaultConfig() Config {
+	cfg := Config{
+		Header:               "{{.Title}}",
+		Footer:               "Page {{.Page}} /{{.Pages}}",
+		WatermarkOpacity:     0.15,
+		DownloadMinutes:      10,
+		MemoryBudgetMB:       defaultMemoryBudgetMB,
+		ReportTimeoutSeconds: defaultReportTimeoutSeconds,
+		RequestsPerMinute:    defaultRequestsPerMinute,
+		Thresholds:           defaultThresholds,
+	}
+	cfg.useLayout(cfg.Layout)
+	return cfg
+}
+
+//Use a layout file, or the standard layout for none. A layout
+//without value coloring gets the config's.
+func (cfg *Config) useLayout(filename string) {
+	cfg.layout = loadLayout(filename)
+	if cfg.layout.Thresholds == (LayoutThresholds{}) {
+		cfg.layout.Thresholds = cfg.Thresholds
+	}
+}
+
+//Load the config file over the defaults.
+//A missing file is fine, a bad one is logged and ignored.
+func loadConfig(filename string) Config {
+	cfg := defaultConfig()
+
+	file, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return cfg
+	}
+	if err == nil {
+		err = json.Unmarshal(file, &cfg)
+	}
+	if err != nil {
+		log.Println("Ignoring the config file", filename, err)
+		return defaultConfig()
+	}
+	cfg.useLayout(cfg.Layout)
+	return cfg
+}
+
+//Save the settings to the config file. It can hold passwords so keep it private.
+func saveConfig(filename string, cfg Config) error {
+	data, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+//The Tidepool api server to use
+func tidepoolServer() string {
+	if server := loadConfig(configFile).TidepoolServer; server != "" {
+		return strings.TrimRight(server, "/")
+	}
+	return tidepoolAPI
+}
+
+//The target range, goals and wording for a report - see tidepoolPresets.go
+func (cfg Config) targets() (TargetRange, ClinicalGoals, bool) {
+	return presetTargets(cfg.Preset, cfg.TargetRange, cfg.Goals)
+}
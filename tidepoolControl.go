@@ -0,0 +1,56 @@
+package tidepoolreport
+
+import "strings"
+
+/*
+   Control solution tests.
+
+   A meter user checks the meter now and then with control solution -
+   a liquid of known glucose that's tested like blood. Those readings
+   aren't the person's glucose and a few of them badly skew a meter
+   user's mean, so they're left out of the report by default and the
+   notes say how many. "Count control solution tests" on the form
+   (keepcontrol=on) keeps them.
+
+   Only readings the meter marked go - Tidepool keeps the mark as the
+   smbg record's subType or an annotation code. Guessing from the values
+   isn't safe: control solution reads in the normal to high range where
+   plenty of real readings are.
+*/
+
+//Whether the glucose record is a meter's control solution test
+func controlSolution(records tpMeasurement, i int) bool {
+	if records[i].Type != "smbg" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(records[i].Subtype), "control") {
+		return true
+	}
+	for _, a := range records[i].Annotations {
+		if strings.Contains(strings.ToLower(a.Code), "control") {
+			return true
+		}
+	}
+	return false
+}
+
+//The readings that aren't control solution tests
+func withoutControl(readings []Reading) []Reading {
+	n := 0
+	for _, rd := range readings {
+		if rd.Control {
+			n++
+		}
+	}
+	//Only copy when there's something to leave out
+	if n == 0 {
+		return readings
+	}
+	kept := make([]Reading, 0, len(readings)-n)
+	for _, rd := range readings {
+		if !rd.Control {
+			kept = append(kept, rd)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,246 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"time"
+)
+
+/*
+   Dawn phenomenon.
+
+   The "dawn" section (Dawn Phenomenon on the form) looks at 3am to 8am,
+   when hormones released before waking can push glucose up with nothing
+   eaten. Each night's rise is the 7am to 8am average less the 3am to 4am
+   one, so a night needs readings in both hours - in practice that's CGM
+   data or a meter user testing in the night.
+
+   A night with a low between 3am and 5am is left out. A rise after a low
+   is the rebound from it (or from treating it), not the dawn phenomenon,
+   and the two are handled differently.
+
+   When the rise is over 20 mg/dl on more than half the nights, and at
+   least insightMinDays of them, the section calls it a probable dawn
+   phenomenon. The chart draws each night's readings in gray with the
+   average across the nights on top.
+*/
+
+//The window looked at - hours of the day
+const (
+	dawnStart = 3
+	dawnEnd   = 8
+)
+
+//A rise over this is a dawn rise - mg/dl
+const dawnThreshold = 20.0
+
+//Size of the dawn chart image - pixels
+const (
+	dawnChartW = 900
+	dawnChartH = 300
+)
+
+//Averaging slot for the chart's average line
+const dawnSlot = 15 * time.Minute
+
+//The nights' readings behind the chart
+var dawnNightGray = color.RGBA{190, 190, 190, 255}
+
+//One night's rise
+type dawnNight struct {
+	Day   string  `json:"day"`   //yyyy-mm-dd
+	Early float64 `json:"early"` //3am to 4am average, mg/dl
+	Late  float64 `json:"late"`  //7am to 8am average, mg/dl
+	Rise  float64 `json:"rise"`  //Late less early, mg/dl
+}
+
+//The nights in the period
+type dawnSummary struct {
+	Nights   []dawnNight `json:"nights"`
+	Rise     float64     `json:"rise"`     //Average rise over the nights, mg/dl
+	Rising   int         `json:"rising"`   //Nights that rose more than the threshold
+	Lows     int         `json:"lows"`     //Nights left out for a low between 3am and 5am
+	Probable bool        `json:"probable"` //A probable dawn phenomenon
+	target   TargetRange
+}
+
+//Work out each night's rise in the readings
+func findDawn(readings []Reading, rng TargetRange) *dawnSummary {
+	s := &dawnSummary{target: rng}
+	early := readingsByDay(readings, dawnStart, dawnStart+1)
+	late := readingsByDay(readings, dawnEnd-1, dawnEnd)
+	lows := map[string]bool{}
+	for day, night := range readingsByDay(readings, dawnStart, dawnStart+2) {
+		for _, rd := range night {
+			if rd.MgDL() < rng.Low {
+				lows[day] = true
+				break
+			}
+		}
+	}
+
+	for day, e := range early {
+		l, ok := late[day]
+		if !ok {
+			continue
+		}
+		if lows[day] {
+			s.Lows++
+			continue
+		}
+		night := dawnNight{Day: day, Early: meanOf(e), Late: meanOf(l)}
+		night.Rise = night.Late - night.Early
+		s.Nights = append(s.Nights, night)
+		s.Rise += night.Rise
+		if night.Rise > dawnThreshold {
+			s.Rising++
+		}
+	}
+	sort.Slice(s.Nights, func(i, j int) bool { return s.Nights[i].Day < s.Nights[j].Day })
+	if len(s.Nights) > 0 {
+		s.Rise /= float64(len(s.Nights))
+	}
+	s.Probable = s.Rising >= insightMinDays && s.Rising*2 > len(s.Nights)
+	return s
+}
+
+//The summary lines - the average rise, how many nights rose and what it adds up to
+func (s *dawnSummary) lines(u Units) []string {
+	var lines []string
+	if len(s.Nights) == 0 {
+		lines = append(lines, "No nights with readings between both 3am and 4am and 7am and 8am in the period.")
+	} else {
+		lines = append(lines,
+			fmt.Sprintf("Over %s glucose went from %s between 3am and 4am to %s between 7am and 8am on average, a rise of %s.",
+				countOf(len(s.Nights), "night"), u.withName(s.early()), u.withName(s.late()), u.withName(s.Rise)),
+			fmt.Sprintf("It rose more than %s on %d of the %d (%.0f%%).", u.withName(dawnThreshold), s.Rising, len(s.Nights),
+				percentOf(s.Rising, len(s.Nights))))
+		switch {
+		case s.Probable:
+			lines = append(lines, "A probable dawn phenomenon - glucose climbs before waking on most nights.")
+		case len(s.Nights) < insightMinDays:
+			lines = append(lines, fmt.Sprintf("Too few nights to say whether there's a dawn phenomenon - it takes %d.", insightMinDays))
+		default:
+			lines = append(lines, "Not enough of the nights rose that much to suggest a dawn phenomenon.")
+		}
+	}
+	if s.Lows > 0 {
+		lines = append(lines, fmt.Sprintf("%s with a low between 3am and 5am left out - a rise after a low is a rebound.", countOf(s.Lows, "night")))
+	}
+	return lines
+}
+
+//The averages of the nights' early and late hours
+func (s *dawnSummary) early() float64 {
+	var sum float64
+	for _, n := range s.Nights {
+		sum += n.Early
+	}
+	return sum / float64(len(s.Nights))
+}
+
+func (s *dawnSummary) late() float64 {
+	var sum float64
+	for _, n := range s.Nights {
+		sum += n.Late
+	}
+	return sum / float64(len(s.Nights))
+}
+
+//The table rows - day, the two averages and the rise
+func (s *dawnSummary) rows(u Units) [][]string {
+	rows := make([][]string, 0, len(s.Nights))
+	for _, n := range s.Nights {
+		rise := u.format(n.Rise)
+		if n.Rise > 0 {
+			rise = "+" + rise
+		}
+		rows = append(rows, []string{n.Day, u.format(n.Early), u.format(n.Late), rise})
+	}
+	return rows
+}
+
+//The table column headings
+func dawnHeader(u Units) []string {
+	return []string{"Day", "3-4am " + u.name(), "7-8am " + u.name(), "Rise " + u.name()}
+}
+
+/*
+   Chart of 3am to 8am. Each night's readings are a gray line and the
+   average of the nights every 15 minutes is drawn over them.
+*/
+func dawnChart(readings []Reading, s *dawnSummary, pal chartPalette, w, h int) ([]byte, error) {
+	const window = (dawnEnd - dawnStart) * 3600
+	c := newChartCanvas(pal, w, h, 0, window, chartGlucoseMin, pal.ymax)
+	c.bands()
+	c.glucoseGridY()
+	for hour := dawnStart; hour < dawnEnd; hour++ {
+		c.gridX(float64((hour-dawnStart)*3600), fmt.Sprintf("%02d:00", hour))
+	}
+
+	shown := map[string]bool{}
+	for _, n := range s.Nights {
+		shown[n.Day] = true
+	}
+	secs := func(t time.Time) float64 {
+		return float64((t.Hour()-dawnStart)*3600 + t.Minute()*60 + t.Second())
+	}
+
+	//Each night in gray, summing the slots for the average as it goes
+	slots := int(window / dawnSlot.Seconds())
+	sums, counts := make([]float64, slots), make([]int, slots)
+	var night []Reading
+	flush := func() {
+		plotNight(c, night, secs)
+		night = night[:0]
+	}
+	for _, rd := range readings {
+		if h := rd.Time.Hour(); h < dawnStart || h >= dawnEnd || !shown[rd.Time.Format("2006-01-02")] {
+			continue
+		}
+		if len(night) > 0 && rd.Time.Format("2006-01-02") != night[0].Time.Format("2006-01-02") {
+			flush()
+		}
+		night = append(night, rd)
+		slot := int(secs(rd.Time) / dawnSlot.Seconds())
+		sums[slot] += rd.MgDL()
+		counts[slot]++
+	}
+	flush()
+
+	//The average, two pixels thick so it stands out
+	prevX, prevY, have := 0, 0, false
+	for i := range sums {
+		if counts[i] == 0 {
+			continue
+		}
+		x, y := c.px((float64(i)+0.5)*dawnSlot.Seconds(), sums[i]/float64(counts[i]))
+		if have {
+			c.pixelLine(prevX, prevY, x, y, pal.line)
+			c.pixelLine(prevX, prevY+1, x, y+1, pal.line)
+		}
+		prevX, prevY, have = x, y, true
+	}
+	c.frame()
+	return c.png()
+}
+
+//One night's readings in gray, joined like the trend chart's
+func plotNight(c *chartCanvas, night []Reading, x func(time.Time) float64) {
+	const joinGap = 15 * time.Minute
+	for i, rd := range night {
+		if i > 0 && rd.Time.Sub(night[i-1].Time) <= joinGap {
+			c.line(x(night[i-1].Time), night[i-1].MgDL(), x(rd.Time), rd.MgDL(), dawnNightGray)
+			continue
+		}
+		c.dot(x(rd.Time), rd.MgDL(), dawnNightGray)
+	}
+}
+
+//Each night's rise from 3am to 8am
+func dawnStep(b *reportBuilder) {
+	if b.opts.Dawn {
+		b.report.Dawn = findDawn(b.report.Readings, b.report.Target)
+	}
+}
@@ -0,0 +1,215 @@
+package tidepoolreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"log"
+	"sort"
+	"time"
+)
+
+/*
+   Single day deep dive - the "day" form field.
+
+   Picking a day turns the report into a debrief of that one day: the
+   full resolution glucose trace with every bolus, carb entry, activity,
+   device event and Tidepool note marked on a timeline, and a list of
+   them underneath. The timeline section only works in a day report.
+*/
+
+//Extra Tidepool types fetched for the timeline
+const timelineTypes = "bolus,wizard,food,physicalActivity,deviceEvent"
+
+//A day report's sections when none are declared
+var daySections = []string{sectionSummary, sectionTimeline, sectionReadings}
+
+//Size of the day chart image - pixels
+const (
+	dayChartW = 900
+	dayChartH = 360
+)
+
+//Timeline marker colors by event kind
+var timelineColors = map[string]color.RGBA{
+	"bolus":    {30, 90, 200, 255},
+	"carbs":    {230, 140, 20, 255},
+	"activity": {40, 160, 60, 255},
+	"device":   {120, 120, 120, 255},
+	"note":     {160, 40, 160, 255},
+}
+
+//One thing that happened during the day
+type timelineEvent struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"` //bolus, carbs, activity, device or note
+	Text string    `json:"text"`
+}
+
+//The fields of a Tidepool record the timeline uses.
+//Decoded one record at a time so an odd record is just skipped.
+type tpEvent struct {
+	Type           string    `json:"type"`
+	Subtype        string    `json:"subType"`
+	Time           time.Time `json:"time"`
+	Devicetime     string    `json:"deviceTime"`
+	Timezoneoffset int       `json:"timezoneOffset"`
+
+	//Bolus units
+	Normal   float64 `json:"normal"`
+	Extended float64 `json:"extended"`
+
+	//Carbs - from the bolus calculator or a food entry
+	CarbInput float64 `json:"carbInput"`
+	Nutrition struct {
+		Carbohydrate struct {
+			Net float64 `json:"net"`
+		} `json:"carbohydrate"`
+	} `json:"nutrition"`
+
+	//Activity
+	Name     string          `json:"name"`
+	Duration json.RawMessage `json:"duration"` //Milliseconds, or a value and units for activity
+
+	//Device events
+	Status    string `json:"status"`
+	AlarmType string `json:"alarmType"`
+}
+
+//The dates to fetch. A day report takes the days either side too so
+//time zones don't clip it.
+func (opts ReportOptions) fetchDates() (string, string) {
+	day, err := time.Parse("2006-01-02", opts.Day)
+	if err != nil {
+		return opts.StartDate, opts.EndDate
+	}
+	return day.AddDate(0, 0, -1).Format("2006-01-02"), day.AddDate(0, 0, 2).Format("2006-01-02")
+}
+
+//The record as a timeline event. false for records that aren't events.
+func (e tpEvent) event() (timelineEvent, bool) {
+	ev := timelineEvent{Time: deviceLocalTime(e.Devicetime, e.Time, e.Timezoneoffset)}
+	switch e.Type {
+	case "bolus":
+		ev.Kind = "bolus"
+		ev.Text = fmt.Sprintf("%.2f U bolus", e.Normal+e.Extended)
+		if e.Subtype != "" && e.Subtype != "normal" {
+			ev.Text += " (" + e.Subtype + ")"
+		}
+	case "wizard":
+		if e.CarbInput <= 0 {
+			return ev, false
+		}
+		ev.Kind = "carbs"
+		ev.Text = fmt.Sprintf("%.0f g carbs (bolus calculator)", e.CarbInput)
+	case "food":
+		if e.Nutrition.Carbohydrate.Net <= 0 {
+			return ev, false
+		}
+		ev.Kind = "carbs"
+		ev.Text = fmt.Sprintf("%.0f g carbs", e.Nutrition.Carbohydrate.Net)
+	case "physicalActivity":
+		ev.Kind = "activity"
+		ev.Text = "Activity"
+		if e.Name != "" {
+			ev.Text += ": " + e.Name
+		}
+		var d struct {
+			Value float64 `json:"value"`
+			Units string  `json:"units"`
+		}
+		if json.Unmarshal(e.Duration, &d) == nil && d.Value > 0 {
+			ev.Text += fmt.Sprintf(" (%.0f %s)", d.Value, d.Units)
+		}
+	case "deviceEvent":
+		ev.Kind = "device"
+		switch e.Subtype {
+		case "status":
+			ev.Text = "Pump " + e.Status
+		case "reservoirChange":
+			ev.Text = "Reservoir change"
+		case "prime":
+			ev.Text = "Prime"
+		case "alarm":
+			ev.Text = "Alarm: " + e.AlarmType
+		case "calibration":
+			ev.Text = "CGM calibration"
+		case "timeChange":
+			ev.Text = "Device time change"
+		default:
+			ev.Text = "Device event: " + e.Subtype
+		}
+	default:
+		return ev, false
+	}
+	return ev, true
+}
+
+//The events on the day from the Tidepool data and notes. notes is nil
+//when Tidepool had none.
+func timelineFrom(data []byte, notesData []byte, day string) []timelineEvent {
+	var events []timelineEvent
+	var offset int //Minutes from UTC, for the notes
+
+	var raw []json.RawMessage
+	json.Unmarshal(data, &raw)
+	for _, rec := range raw {
+		var e tpEvent
+		if json.Unmarshal(rec, &e) != nil {
+			continue
+		}
+		if e.Timezoneoffset != 0 {
+			offset = e.Timezoneoffset
+		}
+		if ev, ok := e.event(); ok && ev.Time.Format("2006-01-02") == day {
+			events = append(events, ev)
+		}
+	}
+
+	if notesData != nil {
+		var notes struct {
+			Messages []struct {
+				Timestamp   time.Time `json:"timestamp"`
+				Messagetext string    `json:"messagetext"`
+			} `json:"messages"`
+		}
+		if err := json.Unmarshal(notesData, &notes); err != nil {
+			log.Println("Ignoring the Tidepool notes", err)
+		}
+		for _, n := range notes.Messages {
+			t := n.Timestamp.Add(time.Duration(offset) * time.Minute).UTC()
+			if t.Format("2006-01-02") == day {
+				events = append(events, timelineEvent{Time: t, Kind: "note", Text: n.Messagetext})
+			}
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+//Chart of the day - the glucose trace with the events marked along the bottom
+func dayChart(points []Reading, events []timelineEvent, day time.Time, pal chartPalette, w, h int) ([]byte, error) {
+	c := newChartCanvas(pal, w, h, 0, 24*3600, chartGlucoseMin, pal.ymax)
+	c.bands()
+	c.glucoseGridY()
+	for hr := 0; hr < 24; hr += 3 {
+		c.gridX(float64(hr*3600), fmt.Sprintf("%02d:00", hr))
+	}
+
+	midnight := startOfDay(day)
+	secs := func(t time.Time) float64 { return t.Sub(midnight).Seconds() }
+	plotGlucose(c, points, secs)
+
+	//A tick per event, each kind at its own height
+	rows := map[string]int{"bolus": 0, "carbs": 1, "activity": 2, "device": 3, "note": 4}
+	for _, ev := range events {
+		px, _ := c.px(secs(ev.Time), 0)
+		y := c.plot.Max.Y - 4 - rows[ev.Kind]*10
+		for dx := -1; dx <= 1; dx++ {
+			c.pixelLine(px+dx, y-6, px+dx, y, pal.shade(timelineColors[ev.Kind]))
+		}
+	}
+	c.frame()
+	return c.png()
+}
@@ -0,0 +1,96 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"math"
+)
+
+/*
+   The PDF readings tables by day.
+
+   A flat table of weeks of readings is hard to find a day in, so the PDF
+   puts each day's readings under a heading with the day's average, the
+   number of readings and the lowest and highest, e.g.
+
+       Tue 2026-03-04 - average 142 mg/dl, 8 readings, 88 to 210
+
+   The day's numbers come from the readings as taken, so a CGM day shown
+   as hourly averages still counts every reading. Excluded days shown in
+   gray say so in the heading.
+*/
+
+//A day of a readings table
+type readingDay struct {
+	Day      string    //yyyy-mm-dd
+	Weekday  string    //Mon, Tue, ...
+	Rows     []Reading //The table rows for the day
+	Count    int       //Readings taken that day
+	Mean     float64   //mg/dl
+	Min      float64
+	Max      float64
+	Excluded bool
+}
+
+//The heading line for the day
+func (d readingDay) heading(u Units) string {
+	s := fmt.Sprintf("%s %s - average %s, %s, %s to %s", d.Weekday, d.Day, u.withName(d.Mean),
+		countOf(d.Count, "reading"), u.format(d.Min), u.format(d.Max))
+	if d.Excluded {
+		s += " - excluded from the statistics"
+	}
+	return s
+}
+
+//Group the table rows by day with each day's numbers from the readings as
+//taken. Both must be in time order.
+func groupByDay(rows []Reading, taken []Reading) []readingDay {
+	var days []readingDay
+	for _, rd := range rows {
+		day := rd.Time.Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Day != day {
+			days = append(days, readingDay{Day: day, Weekday: rd.Time.Format("Mon"), Min: math.Inf(1), Max: math.Inf(-1), Excluded: rd.Excluded})
+		}
+		d := &days[len(days)-1]
+		d.Rows = append(d.Rows, rd)
+	}
+
+	//The numbers - both lists are in time order so a walk through each does it
+	i := 0
+	for _, rd := range taken {
+		day := rd.Time.Format("2006-01-02")
+		for i < len(days) && days[i].Day < day {
+			i++
+		}
+		if i == len(days) {
+			break
+		}
+		if days[i].Day != day {
+			continue
+		}
+		d := &days[i]
+		d.Count++
+		d.Mean += rd.MgDL()
+		d.Min = math.Min(d.Min, rd.MgDL())
+		d.Max = math.Max(d.Max, rd.MgDL())
+	}
+	for i := range days {
+		if days[i].Count == 0 {
+			days[i].Min, days[i].Max = 0, 0
+			continue
+		}
+		days[i].Mean /= float64(days[i].Count)
+	}
+	return days
+}
+
+//The readings table by day, and the note to show above it
+func (rep *Report) tableDays() ([]readingDay, string) {
+	rows, note := rep.tableReadings()
+	return groupByDay(rows, rep.shown(rep.Readings, rep.Excluded)), note
+}
+
+//The same for the other glucose type
+func (rep *Report) otherTableDays() ([]readingDay, string) {
+	rows, note := rep.otherTableReadings()
+	return groupByDay(rows, rep.shown(rep.OtherReadings, rep.excludedOther)), note
+}
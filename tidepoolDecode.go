@@ -0,0 +1,107 @@
+package tidepoolreport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+   Strict and lenient decoding.
+
+   Lenient decoding (the default) is for people making reports - a record
+   that doesn't fit is skipped and the report notes how many. Strict
+   decoding is for developers checking the report against a new version
+   of the Tidepool api - every record has to decode with no unknown
+   fields, and any that don't fail the report with a DecodeError listing
+   the record, its type and id, and the field at fault. Glucose in units
+   other than mmol/L or mg/dL fails it too, where lenient decoding leaves
+   those readings out with a note.
+
+   "decoding" in config.json sets the mode, and the form or api can pick
+   one for a single report with decoding=strict or decoding=lenient.
+*/
+
+//The decoding modes
+const (
+	decodeLenient = "lenient"
+	decodeStrict  = "strict"
+)
+
+//Most problems shown in a DecodeError's message. They are all in Problems.
+const maxDecodeProblems = 10
+
+//DecodeError - the records strict decoding turned down, one line each
+type DecodeError struct {
+	Problems []string
+}
+
+func (e *DecodeError) Error() string {
+	shown := e.Problems
+	if len(shown) > maxDecodeProblems {
+		shown = shown[:maxDecodeProblems]
+	}
+	msg := fmt.Sprintf("%v - %s: %s", ErrBadRecords, countOf(len(e.Problems), "problem"), strings.Join(shown, "; "))
+	if len(shown) < len(e.Problems) {
+		msg += fmt.Sprintf("; and %d more", len(e.Problems)-len(shown))
+	}
+	return msg
+}
+
+//Is matches ErrBadRecords
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrBadRecords
+}
+
+//Decode every record insisting on known fields of the expected types
+func decodeRecordsStrict(raw []json.RawMessage) (tpMeasurement, error) {
+	result := make(tpMeasurement, 0, len(raw))
+	var problems []string
+	for i, rec := range raw {
+		one := make(tpMeasurement, 1)
+		dec := json.NewDecoder(bytes.NewReader(rec))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&one[0]); err != nil {
+			problems = append(problems, recordProblem(i, rec, err))
+			continue
+		}
+		if p := unitsProblem(i, one[0].Type, one[0].ID, one[0].Units); p != "" {
+			problems = append(problems, p)
+			continue
+		}
+		result = append(result, one[0])
+	}
+	if problems != nil {
+		return nil, &DecodeError{Problems: problems}
+	}
+	return result, nil
+}
+
+//A glucose record in units that can't be converted - "" when it's fine
+func unitsProblem(i int, datatype string, id string, units string) string {
+	if datatype != "smbg" && datatype != "cbg" {
+		return ""
+	}
+	if _, ok := glucoseMgDL(0, units); ok {
+		return ""
+	}
+	return fmt.Sprintf("record %d (%s %s): glucose units %q aren't mmol/L or mg/dL", i, datatype, id, units)
+}
+
+//What's wrong with a record - where it is, what it is and the field at fault
+func recordProblem(i int, rec json.RawMessage, err error) string {
+	var id struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	json.Unmarshal(rec, &id)
+	where := fmt.Sprintf("record %d (%s %s)", i, id.Type, id.ID)
+
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return fmt.Sprintf("%s: field %q is a json %s, expected %v", where, te.Field, te.Value, te.Type)
+	}
+	return fmt.Sprintf("%s: %s", where, strings.TrimPrefix(err.Error(), "json: "))
+}
@@ -0,0 +1,68 @@
+package tidepoolreport
+
+import (
+	"time"
+
+	"github.com/edrobinson/TidepoolReport/synth"
+)
+
+/*
+   Demo data.
+
+   "Try it with demo data" on the home form (or demo=on to the api) builds
+   the report from made up records instead of a Tidepool account, so a new
+   user can see every section without signing in and screenshots don't
+   show anyone's real numbers. The records look like a pump and CGM user
+   with a meter: cbg every 5 minutes with the odd sensor gap, finger
+   sticks before meals and at bedtime, meal boluses from the bolus
+   calculator, snacks, a few lows with the pump suspending and reservoir
+   changes. The synth package makes them and can be used on its own for
+   other data sets.
+
+   The same dates always give the same data.
+*/
+
+//The name on a demo report
+const demoPatientName = "Demo Patient"
+
+//Longest demo range - a year of cbg is about 100,000 records
+const demoMaxDays = 366
+
+//Demo ranges without dates cover the last two weeks
+const demoDefaultDays = 14
+
+//The dates for a demo report - the options' dates, or the last two weeks
+func demoDates(opts ReportOptions, now time.Time) (time.Time, time.Time) {
+	sdate, edate := opts.fetchDates()
+	end, err := time.Parse("2006-01-02", edate)
+	if err != nil {
+		end = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	start, err := time.Parse("2006-01-02", sdate)
+	if err != nil {
+		start = end.AddDate(0, 0, -demoDefaultDays+1)
+	}
+	if end.Sub(start) > demoMaxDays*24*time.Hour {
+		start = end.AddDate(0, 0, -demoMaxDays+1)
+	}
+	return start, end
+}
+
+//Made up Tidepool records for the days from start to end, as the json
+//Tidepool would send - see the synth package
+func demoRecords(start, end time.Time) []byte {
+	p := synth.Default()
+	p.Start, p.End = start, end
+	return synth.Generate(p)
+}
+
+//BuildDemoReport - build a report from demo data for the options' dates,
+//or the last two weeks without them
+func BuildDemoReport(opts ReportOptions) (*Report, error) {
+	opts.PatientName = demoPatientName
+	start, end := demoDates(opts, time.Now())
+	if opts.Day == "" {
+		opts.StartDate, opts.EndDate = start.Format("2006-01-02"), end.Format("2006-01-02")
+	}
+	return BuildReportFromData(demoRecords(start, end), nil, opts)
+}
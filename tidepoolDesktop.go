@@ -0,0 +1,166 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+/*
+   Desktop mode - "tidepoolreport -desktop".
+
+   For a patient running the report on their own computer rather than a
+   server. It:
+
+       listens on a random port on 127.0.0.1 only, so nothing else on the
+       network can reach it and nothing clashes with port 3000
+       opens the default browser at the home page
+       keeps config.json, prefs.json, the token cache, layouts and the
+       report work folders in the user data folder - see desktopDataDir
+       stops when the browser session ends: on logout, or once no page
+       has been open for desktopIdle
+
+   The pages ping /desktop/alive while they're open - see static/js/desktop.js.
+   A PDF being read doesn't ping so the idle time is kept generous.
+*/
+
+//How long without a request before desktop mode stops
+const desktopIdle = 5 * time.Minute
+
+//Set when running in desktop mode
+var desktop *desktopServer
+
+//The desktop mode server
+type desktopServer struct {
+	mu       sync.Mutex
+	lastSeen time.Time
+	stop     chan struct{}
+	once     sync.Once
+}
+
+//The folder the desktop mode keeps its files in:
+//
+//	Windows   %LocalAppData%\TidepoolReport
+//	macOS     ~/Library/Application Support/TidepoolReport
+//	others    $XDG_DATA_HOME/TidepoolReport or ~/.local/share/TidepoolReport
+func desktopDataDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("LocalAppData"); dir != "" {
+			return filepath.Join(dir, "TidepoolReport"), nil
+		}
+	case "darwin":
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "TidepoolReport"), nil
+	default:
+		if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+			return filepath.Join(dir, "TidepoolReport"), nil
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "AppData", "Local", "TidepoolReport"), nil
+	}
+	return filepath.Join(home, ".local", "share", "TidepoolReport"), nil
+}
+
+//Open a url in the default browser
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	case "darwin":
+		return exec.Command("open", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
+
+//Work in the user data folder. Called before anything loads its files.
+func useDataDir() {
+	dir, err := desktopDataDir()
+	check(err, "Can't find the user data folder")
+	check(os.MkdirAll(filepath.Join(dir, "work"), 0700), "Can't create the data folder")
+	check(os.Chdir(dir), "Can't change to the data folder")
+	workspaceRoot = filepath.Join(dir, "work")
+	log.Println("Keeping files in", dir)
+}
+
+//Serve the routes set up by main for one person on this computer
+func runDesktop() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	check(err, "Error on server start")
+	url := "http://" + ln.Addr().String() + "/"
+
+	desktop = &desktopServer{lastSeen: time.Now(), stop: make(chan struct{})}
+	srv := &http.Server{Handler: desktop.track(http.DefaultServeMux)}
+	go desktop.watch(srv)
+
+	log.Println("Listening... Go to", url)
+	if err := openBrowser(url); err != nil {
+		log.Println("Couldn't open the browser - go to", url, err)
+	}
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		check(err, "Error on server start")
+	}
+	log.Println("Browser session ended - stopped")
+}
+
+//Note every request as the browser still being there
+func (d *desktopServer) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		d.lastSeen = time.Now()
+		d.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Ask the server to stop once the current response is sent
+func (d *desktopServer) end() {
+	d.once.Do(func() { close(d.stop) })
+}
+
+//Stop the server when asked or when the browser has gone quiet
+func (d *desktopServer) watch(srv *http.Server) {
+	tick := time.NewTicker(30 * time.Second)
+	defer tick.Stop()
+	for quiet := false; !quiet; {
+		select {
+		case <-d.stop:
+			quiet = true
+		case <-tick.C:
+			d.mu.Lock()
+			quiet = time.Since(d.lastSeen) >= desktopIdle
+			d.mu.Unlock()
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
+
+//The pages' ping - only answered in desktop mode
+func desktopAlive(w http.ResponseWriter, r *http.Request) {
+	if desktop == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
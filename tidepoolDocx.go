@@ -0,0 +1,375 @@
+package tidepoolreport
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+   Word document output - format=docx.
+
+   Some clinics want a report they can annotate and merge into their own
+   documentation. A .docx file is a zip of XML parts so a minimal writer
+   is built here on archive/zip: paragraphs, tables and PNG images.
+*/
+
+//XML namespaces used by the document part
+const (
+	docxNsW   = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+	docxNsR   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	docxNsWp  = "http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing"
+	docxNsA   = "http://schemas.openxmlformats.org/drawingml/2006/main"
+	docxNsPic = "http://schemas.openxmlformats.org/drawingml/2006/picture"
+)
+
+//The .docx media type
+const docxContentType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+//English metric units per inch - the docx measure for images
+const emuPerInch = 914400
+
+//An image stored in the word/media folder
+type docxImage struct {
+	name string
+	data []byte
+}
+
+//Builds up the document body
+type docxWriter struct {
+	body   bytes.Buffer
+	images []docxImage
+}
+
+//XML escape a string
+func docxEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+//A run of text, optionally bold at a half-point size (0 for the default)
+func docxRun(text string, bold bool, size int) string {
+	var props string
+	if bold {
+		props += "<w:b/>"
+	}
+	if size > 0 {
+		props += fmt.Sprintf(`<w:sz w:val="%d"/>`, size)
+	}
+	if props != "" {
+		props = "<w:rPr>" + props + "</w:rPr>"
+	}
+	return `<w:r>` + props + `<w:t xml:space="preserve">` + docxEscape(text) + `</w:t></w:r>`
+}
+
+//A heading - level 1 or 2
+func (d *docxWriter) heading(text string, level int) {
+	size := 32
+	if level > 1 {
+		size = 26
+	}
+	d.body.WriteString("<w:p>" + docxRun(text, true, size) + "</w:p>")
+}
+
+//A plain paragraph
+func (d *docxWriter) paragraph(text string) {
+	d.body.WriteString("<w:p>" + docxRun(text, false, 0) + "</w:p>")
+}
+
+//A bordered table. The first row is the header and is bold.
+func (d *docxWriter) table(rows [][]string) {
+	d.body.WriteString(`<w:tbl><w:tblPr><w:tblBorders>`)
+	for _, side := range []string{"top", "left", "bottom", "right", "insideH", "insideV"} {
+		fmt.Fprintf(&d.body, `<w:%s w:val="single" w:sz="4" w:space="0" w:color="000000"/>`, side)
+	}
+	d.body.WriteString(`</w:tblBorders></w:tblPr>`)
+	for i, row := range rows {
+		d.body.WriteString("<w:tr>")
+		for _, cell := range row {
+			d.body.WriteString("<w:tc><w:p>" + docxRun(cell, i == 0, 0) + "</w:p></w:tc>")
+		}
+		d.body.WriteString("</w:tr>")
+	}
+	d.body.WriteString("</w:tbl><w:p/>")
+}
+
+//A PNG image scaled to widthInches keeping the pixel aspect ratio
+func (d *docxWriter) image(name string, png []byte, wPx, hPx int, widthInches float64) {
+	d.images = append(d.images, docxImage{name: name, data: png})
+	id := len(d.images)
+	cx := int(widthInches * emuPerInch)
+	cy := cx * hPx / wPx
+
+	fmt.Fprintf(&d.body, `<w:p><w:r><w:drawing><wp:inline><wp:extent cx="%d" cy="%d"/>`+
+		`<wp:docPr id="%d" name="%s"/><a:graphic><a:graphicData uri="%s"><pic:pic>`+
+		`<pic:nvPicPr><pic:cNvPr id="%d" name="%s"/><pic:cNvPicPr/></pic:nvPicPr>`+
+		`<pic:blipFill><a:blip r:embed="rIdImg%d"/><a:stretch><a:fillRect/></a:stretch></pic:blipFill>`+
+		`<pic:spPr><a:xfrm><a:off x="0" y="0"/><a:ext cx="%d" cy="%d"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></pic:spPr>`+
+		`</pic:pic></a:graphicData></a:graphic></wp:inline></w:drawing></w:r></w:p>`,
+		cx, cy, id, docxEscape(name), docxNsPic, id, docxEscape(name), id, cx, cy)
+}
+
+//Write the .docx package
+func (d *docxWriter) write(w io.Writer) error {
+	z := zip.NewWriter(w)
+	parts := map[string]string{
+		"[Content_Types].xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Default Extension="png" ContentType="image/png"/>` +
+			`<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>` +
+			`</Types>`,
+		"_rels/.rels": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>` +
+			`</Relationships>`,
+		"word/document.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<w:document xmlns:w="` + docxNsW + `" xmlns:r="` + docxNsR + `" xmlns:wp="` + docxNsWp +
+			`" xmlns:a="` + docxNsA + `" xmlns:pic="` + docxNsPic + `"><w:body>` + d.body.String() + `</w:body></w:document>`,
+	}
+
+	//Relationships from the document to its images
+	var rels strings.Builder
+	rels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i, img := range d.images {
+		fmt.Fprintf(&rels, `<Relationship Id="rIdImg%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/%s"/>`,
+			i+1, img.name)
+	}
+	rels.WriteString(`</Relationships>`)
+	parts["word/_rels/document.xml.rels"] = rels.String()
+
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "word/document.xml", "word/_rels/document.xml.rels"} {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(f, parts[name]); err != nil {
+			return err
+		}
+	}
+	for _, img := range d.images {
+		f, err := z.Create("word/media/" + img.name)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(img.data); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+//Build the Word report - the same content as the Markdown report
+func docxReport(rep *Report) *docxWriter {
+	d := &docxWriter{}
+
+	d.heading("Glucose Report", 1)
+	d.paragraph("Period: " + rep.Range())
+
+	if len(rep.Warnings) > 0 {
+		d.heading("Notes about this report", 2)
+		for _, s := range rep.Warnings {
+			d.paragraph(s)
+		}
+	}
+
+	for _, section := range rep.sectionsOr(documentSections) {
+		switch section {
+		case sectionSummary:
+			d.heading("Summary", 2)
+			rows := [][]string{{"Metric", "Value"}}
+			for _, m := range rep.Metrics {
+				rows = append(rows, []string{m.Name, m.Value})
+			}
+			d.table(rows)
+
+		case sectionTIR:
+			if tir, ok := rep.Stats.timeInRange(); ok {
+				d.heading(tir.Headline(), 2)
+				d.paragraph(tir.Breakdown())
+			}
+
+		case sectionAGP:
+			if chart, ok := rep.Charts["agp.png"]; ok && rep.AGP != nil {
+				d.heading("Ambulatory glucose profile", 2)
+				d.table(append([][]string{{"Statistic", "Value"}}, rep.AGP.Stats...))
+				d.image("agp.png", chart, agpChartW, agpChartH, 6.5)
+			}
+
+		case sectionStats:
+			if rep.Statistics != nil {
+				d.heading("Statistics", 2)
+				d.table(append([][]string{{"Statistic", "Value"}}, rep.Statistics.rows()...))
+			}
+
+		case sectionTargets:
+			if len(rep.Targets) > 0 {
+				d.heading("Clinical targets", 2)
+				rows := [][]string{{"Goal", "Target", "Value", ""}}
+				for _, t := range rep.Targets {
+					rows = append(rows, []string{t.Name, t.Goal, t.Value, t.Status()})
+				}
+				d.table(rows)
+			}
+
+		case sectionChanges:
+			if rep.Changes != nil {
+				d.heading("What's new", 2)
+				for _, line := range rep.Changes.lines() {
+					d.paragraph(line)
+				}
+			}
+
+		case sectionInsights:
+			if len(rep.Insights) > 0 {
+				d.heading("Insights", 2)
+				for _, s := range rep.Insights {
+					d.paragraph(s)
+				}
+			}
+
+		case sectionRanges:
+			if len(rep.Ranges) > 0 {
+				d.heading("Date ranges", 2)
+				for _, s := range rangeLines(rep.Ranges) {
+					d.paragraph(s)
+				}
+			}
+
+		case sectionStreaks:
+			if len(rep.Streaks) > 0 {
+				d.heading("Streaks", 2)
+				for _, s := range rep.Streaks {
+					d.paragraph(s)
+				}
+			}
+
+		case sectionFlags:
+			if len(rep.Flags) > 0 {
+				d.heading("Flags", 2)
+				for _, f := range rep.Flags {
+					d.paragraph(f)
+				}
+			}
+
+		case sectionGaps:
+			if len(rep.Gaps) > 0 {
+				d.heading("Data gaps", 2)
+				for _, g := range rep.Gaps {
+					d.paragraph(fmt.Sprintf("%s to %s (%s)", g.start.Format("2006-01-02 15:04"),
+						g.end.Format("2006-01-02 15:04"), formatDuration(g.end.Sub(g.start))))
+				}
+			}
+
+		case sectionChart:
+			if chart, ok := rep.Charts["glucose.png"]; ok {
+				d.heading("Trend", 2)
+				d.image("glucose.png", chart, trendChartW, trendChartH, 6.5)
+			}
+
+		case sectionHistogram:
+			if chart, ok := rep.Charts["histogram.png"]; ok {
+				d.heading("Glucose histogram", 2)
+				d.image("histogram.png", chart, histogramChartW, histogramChartH, 6.5)
+			}
+
+		case sectionDaily:
+			if _, ok := rep.Charts["daily.png"]; ok {
+				d.heading("Daily profiles", 2)
+				for k := dailyChartsMax - 1; k >= 0; k-- {
+					if chart, ok := rep.Charts[dailyChartName(k)]; ok {
+						d.image(dailyChartName(k), chart, dailyChartW, dailyChartH, 6.5)
+					}
+				}
+			}
+
+		case sectionReadings:
+			d.heading("Readings", 2)
+			table, note := rep.tableReadings()
+			if note != "" {
+				d.paragraph(note)
+			}
+			rows := [][]string{readingsHeader(rep.Units, rep.Sources)}
+			for _, s := range smbgRows(table, rep.Units) {
+				rows = append(rows, s.cells(rep.Sources))
+			}
+			d.table(rows)
+
+		case sectionOtherReadings:
+			if len(rep.OtherReadings) > 0 {
+				d.heading(readingsTitle(rep.OtherType), 2)
+				table, note := rep.otherTableReadings()
+				if note != "" {
+					d.paragraph(note)
+				}
+				rows := [][]string{readingsHeader(rep.Units, rep.Sources)}
+				for _, s := range smbgRows(table, rep.Units) {
+					rows = append(rows, s.cells(rep.Sources))
+				}
+				d.table(rows)
+			}
+
+		case sectionBoluses:
+			if len(rep.Boluses) > 0 {
+				d.heading("Insulin boluses", 2)
+				d.paragraph(bolusTotals(rep.Boluses, rep.Start, rep.End))
+				d.table(append([][]string{{"Time", "Normal U", "Extended U", "Duration", "Kind"}}, bolusRows(rep.Boluses)...))
+			}
+
+		case sectionCarbs:
+			if len(rep.Carbs) > 0 {
+				d.heading("Carbs", 2)
+				d.paragraph(carbTotals(rep.Carbs, rep.Start, rep.End) + " - with the nearest reading and the insulin given within 15 minutes")
+				d.table(append([][]string{{"Time", "Carbs g", "Glucose " + rep.Units.name(), "Bolus U", "From"}}, carbRows(rep.Carbs, rep.Units)...))
+			}
+
+		case sectionRecovery:
+			if rep.Recovery != nil {
+				d.heading("Hypo recovery", 2)
+				for _, line := range rep.Recovery.lines(rep.Units) {
+					d.paragraph(line)
+				}
+				if len(rep.Recovery.Lows) > 0 {
+					d.table(append([][]string{recoveryHeader(rep.Units)}, rep.Recovery.rows(rep.Units)...))
+				}
+			}
+
+		case sectionDawn:
+			if rep.Dawn != nil {
+				d.heading("Dawn phenomenon", 2)
+				for _, line := range rep.Dawn.lines(rep.Units) {
+					d.paragraph(line)
+				}
+				if chart, ok := rep.Charts["dawn.png"]; ok {
+					d.image("dawn.png", chart, dawnChartW, dawnChartH, 6.5)
+				}
+				if len(rep.Dawn.Nights) > 0 {
+					d.table(append([][]string{dawnHeader(rep.Units)}, rep.Dawn.rows(rep.Units)...))
+				}
+			}
+
+		case sectionBasal:
+			if len(rep.Basal) > 0 {
+				d.heading("Basal insulin", 2)
+				d.paragraph(basalTotals(rep.Basal))
+				d.table(append([][]string{{"Date", "Basal U", "Temp basals", "Suspended"}}, basalRows(rep.Basal)...))
+			}
+
+		default:
+			if s, ok := rep.extra(section); ok && len(s.Lines) > 0 {
+				d.heading(s.Title, 2)
+				for _, line := range s.Lines {
+					d.paragraph(line)
+				}
+			}
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,178 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   One-time download links.
+
+   A report made from the web page is stored and the browser is sent to
+   /download/<token> to fetch it. The token is random, tied to the session
+   that made the report and good for one download, so a link can never
+   hand one person's health data to another. Only a GET that sends the
+   whole file uses the token up - a HEAD, a 304, a range request resuming
+   a download or a download dropped part way leave the link working.
+   Unused reports are deleted when their token expires.
+*/
+
+//How long a download link lasts - the downloadMinutes setting
+func downloadLife() time.Duration {
+	minutes := loadConfig(configFile).DownloadMinutes
+	if minutes <= 0 {
+		minutes = defaultConfig().DownloadMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+//A stored report waiting to be downloaded
+type storedDownload struct {
+	sessionID   string
+	filename    string
+	contentType string
+	name        string //The file name the browser sees
+	attachment  bool
+	expires     time.Time
+}
+
+//Stored reports by token
+type downloadStore struct {
+	mu        sync.Mutex
+	ws        *Workspace //Holds the stored files - made on first use
+	downloads map[string]*storedDownload
+}
+
+//The store used by the web handlers
+var downloads = &downloadStore{downloads: map[string]*storedDownload{}}
+
+//Delete expired downloads. Call with the lock held.
+func (st *downloadStore) sweep() {
+	for token, d := range st.downloads {
+		if time.Now().After(d.expires) {
+			os.Remove(d.filename)
+			delete(st.downloads, token)
+		}
+	}
+}
+
+//Move a finished report into the store and return its download token
+func (st *downloadStore) add(sessionID string, filename string, contentType string, name string, attachment bool) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sweep()
+
+	if st.ws == nil {
+		ws, err := NewWorkspace()
+		if err != nil {
+			return "", err
+		}
+		st.ws = ws
+	}
+	token := newSessionID()
+	stored := st.ws.Path(token)
+	if err := os.Rename(filename, stored); err != nil {
+		return "", err
+	}
+	st.downloads[token] = &storedDownload{
+		sessionID:   sessionID,
+		filename:    stored,
+		contentType: contentType,
+		name:        name,
+		attachment:  attachment,
+		expires:     time.Now().Add(downloadLife()),
+	}
+	return token, nil
+}
+
+//The download for a token if the session owns it
+func (st *downloadStore) get(token string, sessionID string) (*storedDownload, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sweep()
+	d, ok := st.downloads[token]
+	if !ok || d.sessionID != sessionID {
+		return nil, false
+	}
+	return d, true
+}
+
+//Use up a token and delete its file
+func (st *downloadStore) remove(token string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if d, ok := st.downloads[token]; ok {
+		os.Remove(d.filename)
+		delete(st.downloads, token)
+	}
+}
+
+//Delete all the downloads of a session
+func (st *downloadStore) dropSession(sessionID string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for token, d := range st.downloads {
+		if d.sessionID == sessionID {
+			os.Remove(d.filename)
+			delete(st.downloads, token)
+		}
+	}
+}
+
+//Download handler - /download/<token>
+func download(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/download/")
+	sess := appSessions.lookup(r)
+	if sess == nil {
+		http.Error(w, "This download link has expired", http.StatusNotFound)
+		return
+	}
+	d, ok := downloads.get(token, sess.id)
+	if !ok {
+		http.Error(w, "This download link has expired", http.StatusNotFound)
+		return
+	}
+
+	info, err := os.Stat(d.filename)
+	cw := &countingWriter{ResponseWriter: w}
+	if err == nil {
+		err = serveFile(cw, r, d.filename, d.contentType, d.name, d.attachment)
+	}
+	if err != nil {
+		log.Println("Error sending a download", err)
+		http.Error(w, "Sorry, the report could not be sent", http.StatusInternalServerError)
+		return
+	}
+	//A complete download uses up the link
+	if r.Method == http.MethodGet && cw.status == http.StatusOK && cw.written == info.Size() {
+		downloads.remove(token)
+	}
+}
+
+//Counts what a response sends so only a complete download uses up its link
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,76 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+//Only a complete download uses up the link
+func TestDownloadTokenUse(t *testing.T) {
+	inTempDir(t)
+	sess := &appSession{id: newSessionID()}
+	appSessions.save(sess)
+	cookie := &http.Cookie{Name: sessionCookie, Value: sess.id}
+
+	report := []byte("%PDF- the report")
+	stored := func() string {
+		file := filepath.Join(t.TempDir(), "report.pdf")
+		if err := ioutil.WriteFile(file, report, 0600); err != nil {
+			t.Fatal(err)
+		}
+		token, err := downloads.add(sess.id, file, "application/pdf", "report.pdf", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	fetch := func(method string, token string, w http.ResponseWriter, header ...string) {
+		r := httptest.NewRequest(method, "/download/"+token, nil)
+		r.AddCookie(cookie)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		download(w, r)
+	}
+	live := func(token string) bool {
+		_, ok := downloads.get(token, sess.id)
+		return ok
+	}
+
+	token := stored()
+	fetch(http.MethodHead, token, httptest.NewRecorder())
+	if !live(token) {
+		t.Error("a HEAD used up the link")
+	}
+	fetch(http.MethodGet, token, dropped())
+	if !live(token) {
+		t.Error("a dropped download used up the link")
+	}
+	fetch(http.MethodGet, token, httptest.NewRecorder(), "Range", "bytes=0-3")
+	if !live(token) {
+		t.Error("a range request used up the link")
+	}
+	w := httptest.NewRecorder()
+	fetch(http.MethodGet, token, w)
+	if w.Code != http.StatusOK || w.Body.String() != string(report) {
+		t.Fatalf("download %d %q", w.Code, w.Body.String())
+	}
+	if live(token) {
+		t.Error("a complete download left the link working")
+	}
+
+	//A browser that already has it gets a 304 and keeps the link
+	token = stored()
+	etag := w.Header().Get("ETag")
+	w = httptest.NewRecorder()
+	fetch(http.MethodGet, token, w, "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || !live(token) {
+		t.Errorf("304: status %d, link kept %v", w.Code, live(token))
+	}
+}
@@ -0,0 +1,49 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+)
+
+/*
+   Emailing the report.
+
+   "Email The PDF To" on the form (emailto=) sends the report as a PDF
+   attachment to that address - the clinic, say - through the mail server
+   on the admin page, and the page says where it went instead of showing
+   the report. "Remember These Choices" keeps the address for next time.
+*/
+
+//Email the report as a PDF
+func emailReport(ws *Workspace, cfg Config, rep *Report, to string) error {
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("%q isn't an email address", to)
+	}
+	if cfg.SMTP.Host == "" || cfg.SMTP.From == "" {
+		return errors.New("the mail server isn't set up - it's on the admin page")
+	}
+
+	if err = CreatePDF(nil, ws.Path("tidepool.pdf"), cfg, rep); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(ws.Path("tidepool.pdf"))
+	if err != nil {
+		return err
+	}
+
+	name := rep.PatientName
+	if cfg.PatientName != "" {
+		name = cfg.PatientName
+	}
+	return emailNotifier{server: cfg.SMTP, to: addr.Address}.Notify(Notification{
+		Title:      "Glucose report " + rep.Range(),
+		Body:       fmt.Sprintf("The glucose report for %s, %s, is attached.", name, rep.Range()),
+		Attachment: &Attachment{Name: "tidepool-report.pdf", ContentType: "application/pdf", Data: data},
+	})
+}
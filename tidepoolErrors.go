@@ -0,0 +1,64 @@
+package tidepoolreport
+
+import (
+	"errors"
+	"strconv"
+)
+
+/*
+   Why things fail.
+
+   The Tidepool client and the report pipeline return errors that match
+   one of these with errors.Is, so the web handlers - and code using the
+   package - can branch on the cause. Failed Tidepool calls are a
+   *TidepoolError that errors.As gives the http status and response body.
+*/
+
+var (
+	//ErrAuthFailed - Tidepool turned down the email and password or token
+	ErrAuthFailed = errors.New("Tidepool sign in failed")
+
+	//ErrNoData - no readings or events for the period
+	ErrNoData = errors.New("No readings were found for the period")
+
+	//ErrRateLimited - Tidepool is still answering 429 after the retries
+	ErrRateLimited = errors.New("Tidepool is rate limiting the account")
+
+	//ErrTidepoolUnavailable - Tidepool couldn't be reached or sent something unexpected
+	ErrTidepoolUnavailable = errors.New("Tidepool is unavailable")
+
+	//ErrBadDateRange - a date isn't yyyy-mm-dd or the end is before the start
+	ErrBadDateRange = errors.New("Bad date range")
+
+	//ErrBadRecords - strict decoding found records that don't match - see DecodeError
+	ErrBadRecords = errors.New("Tidepool records don't match the expected format")
+)
+
+//TidepoolError - a failed Tidepool call
+type TidepoolError struct {
+	Kind   error  //One of the Err values above
+	Status int    //The http status - 0 when there was no response
+	Body   []byte //The response body when there was one
+	Err    error  //What went wrong underneath, e.g. a network error
+}
+
+func (e *TidepoolError) Error() string {
+	msg := e.Kind.Error()
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	if e.Status != 0 {
+		return msg + ": http " + strconv.Itoa(e.Status)
+	}
+	return msg
+}
+
+//Is matches the kind of failure
+func (e *TidepoolError) Is(target error) bool {
+	return target == e.Kind
+}
+
+//Unwrap gives the error underneath
+func (e *TidepoolError) Unwrap() error {
+	return e.Err
+}
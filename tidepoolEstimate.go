@@ -0,0 +1,217 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   Report estimates.
+
+   The Just Estimate button on the form (estimate=on), or /api/v1/estimate with the
+   report parameters, says how big a report will be before it's run:
+   about how many readings, PDF pages and seconds. Tidepool has no count
+   query so one day of the account's data - the last of the period - is
+   fetched as a sample and scaled up to the whole period. When that day
+   has nothing the typical numbers for each type are used instead, as
+   they are for demo data.
+*/
+
+//Readings table rows on a PDF page, and the pages ahead of the table
+const (
+	estimateRowsPerPage = 28
+	estimateFirstPages  = 2
+)
+
+//Records a second decoded and built into a report - rough
+const estimateRecordsPerSecond = 20000
+
+//What a report for the options would come to
+type reportEstimate struct {
+	Start    string         `json:"start"`
+	End      string         `json:"end"`
+	Days     int            `json:"days"`
+	Records  map[string]int `json:"records"` //By data type
+	Readings int            `json:"readings"`
+	Pages    int            `json:"pages"`
+	Seconds  int            `json:"seconds"`
+	Sampled  bool           `json:"sampled"` //Scaled from a day of the account's data rather than typical numbers
+}
+
+//Estimate the report for the options. A nil fetcher uses the typical numbers.
+func estimateReport(f *tpFetcher, opts ReportOptions) (reportEstimate, error) {
+	sdate, edate := opts.fetchDates()
+	start, serr := time.Parse("2006-01-02", sdate)
+	end, eerr := time.Parse("2006-01-02", edate)
+	if serr != nil || eerr != nil || end.Before(start) {
+		return reportEstimate{}, fmt.Errorf("%w: an estimate needs both a start and an end date", ErrBadDateRange)
+	}
+	est := reportEstimate{Start: sdate, End: edate, Days: int(end.Sub(start).Hours()/24) + 1, Records: map[string]int{}}
+	if len(opts.Ranges) > 0 {
+		//Just the days in the ranges
+		est.Days = 0
+		for _, dr := range opts.Ranges {
+			from, _ := time.Parse("2006-01-02", dr.Start)
+			to, _ := time.Parse("2006-01-02", dr.End)
+			est.Days += int(to.Sub(from).Hours()/24) + 1
+		}
+	}
+	types := strings.Split(opts.dataTypes(), ",")
+
+	//A day of the account's data
+	perDay := map[string]int{}
+	var sample time.Duration
+	if f != nil {
+		began := time.Now()
+		url := f.dataURL(opts.dataTypes()) + checkDateRanges(end.AddDate(0, 0, -1).Format("2006-01-02"), edate)
+		data, status, err := f.get(url)
+		if err != nil {
+			return est, err
+		}
+		if status != http.StatusOK {
+			return est, statusError(status, data)
+		}
+		sample = time.Since(began)
+		var records []struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(data, &records)
+		for _, rec := range records {
+			perDay[rec.Type]++
+		}
+		est.Sampled = len(records) > 0
+	}
+	if !est.Sampled {
+		for _, t := range types {
+			if n, ok := recordsPerDay[t]; ok {
+				perDay[t] = n
+			} else {
+				perDay[t] = otherRecordsPerDay
+			}
+		}
+	}
+
+	var total int
+	for _, t := range types {
+		est.Records[t] = perDay[t] * est.Days
+		total += est.Records[t]
+	}
+	est.Readings = est.Records[opts.DataType]
+	if opts.OtherType != "" {
+		est.Readings += est.Records[opts.OtherType]
+	}
+
+	//CGM tables are hourly averages unless every reading is asked for
+	rows := func(t string) int {
+		if t == "cbg" && !opts.FullCGMTable && est.Records[t] > 24*est.Days {
+			return 24 * est.Days
+		}
+		return est.Records[t]
+	}
+	var tableRows int
+	if opts.wants(sectionReadings) {
+		tableRows += rows(opts.DataType)
+	}
+	if opts.OtherType != "" && opts.wants(sectionOtherReadings) {
+		tableRows += rows(opts.OtherType)
+	}
+	est.Pages = estimateFirstPages + int(math.Ceil(float64(tableRows)/estimateRowsPerPage))
+
+	//A request a chunk, each about as long as the sample, then the build
+	requests := 1
+	if est.Days > fetchChunkDays {
+		requests = int(math.Ceil(float64(est.Days) / fetchChunkDays))
+	}
+	seconds := float64(requests)*sample.Seconds() + float64(total)/estimateRecordsPerSecond
+	est.Seconds = int(math.Ceil(seconds))
+	if est.Seconds < 1 {
+		est.Seconds = 1
+	}
+	return est, nil
+}
+
+//The estimate as a sentence, e.g. "About 42,000 CGM readings over 146 days, ..."
+func (est reportEstimate) String() string {
+	var readings []string
+	for _, t := range []string{"cbg", "smbg"} {
+		if n, ok := est.Records[t]; ok {
+			readings = append(readings, "about "+withCommas(n)+" "+readingsTitle(t))
+		}
+	}
+	what := strings.Join(readings, " and ")
+	if what == "" {
+		var total int
+		for _, n := range est.Records {
+			total += n
+		}
+		what = "about " + withCommas(total) + " records"
+	}
+	s := fmt.Sprintf("Estimate for %s to %s (%d days): %s, around %d PDF pages and %d seconds to fetch and build.",
+		est.Start, est.End, est.Days, what, est.Pages, est.Seconds)
+	if !est.Sampled {
+		s += " These are typical numbers for the data types rather than the account's own."
+	}
+	return s
+}
+
+//A whole number with thousands separators
+func withCommas(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+//The options and sign in for an estimate request - nil fetcher for demo data
+func estimateForRequest(r *http.Request) (reportEstimate, *requestError) {
+	ctx, cancel := context.WithTimeout(context.Background(), loadConfig(configFile).reportTimeout())
+	defer cancel()
+	var fetcher *tpFetcher
+	if r.FormValue("demo") != "on" {
+		var rerr *requestError
+		if fetcher, _, rerr = fetcherForRequest(ctx, r); rerr != nil {
+			return reportEstimate{}, rerr
+		}
+	}
+	opts := reportOptionsFromForm(r)
+	if err := opts.validate(); err != nil {
+		return reportEstimate{}, requestErrorFor(err)
+	}
+	est, err := estimateReport(fetcher, opts)
+	if err != nil {
+		return est, requestErrorFor(err)
+	}
+	return est, nil
+}
+
+//Show the estimate for the form instead of the report
+func showEstimate(w http.ResponseWriter, r *http.Request) {
+	est, rerr := estimateForRequest(r)
+	if rerr != nil {
+		DisplayMessageScreen(w, rerr.message)
+		return
+	}
+	DisplayMessageScreen(w, est.String())
+}
+
+//Api estimate endpoint - the report parameters, the estimate as json
+func apiEstimate(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	est, rerr := estimateForRequest(r)
+	if rerr != nil {
+		writeJSONError(w, rerr)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(est)
+}
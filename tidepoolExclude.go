@@ -0,0 +1,143 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+   Days left out of the statistics.
+
+   Sick days, sensor warmups and travel days can skew a report. The
+   Exclude Days box on the form (excludedays= to the api) takes yyyy-mm-dd
+   dates separated by commas, spaces or lines, and a span of days as
+   "2026-03-01 to 2026-03-03". Readings on those days don't count in the
+   statistics, metrics, insights, AGP or streaks and the notes say which
+   days were left out. Gaps are looked for between the days that are
+   left, and metrics over the whole period, like CGM active, are left
+   out of the summary as they are for several date ranges.
+
+   With "Show excluded days" (showexcluded=on) the readings tables and the
+   trend and daily charts still show those days, in gray - marked
+   "(excluded)" in the markdown and Word tables. The csv, json and xlsx
+   exports have just the readings counted.
+*/
+
+//Parse the days to exclude. A span "from to through" is each day in it.
+//The dates are checked by validate.
+func parseExcludeDays(s string) []string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	var days []string
+	for i := 0; i < len(fields); i++ {
+		if i+2 < len(fields) && strings.EqualFold(fields[i+1], "to") {
+			days = append(days, daysThrough(fields[i], fields[i+2])...)
+			i += 2
+			continue
+		}
+		days = append(days, fields[i])
+	}
+	return days
+}
+
+//The days from start through end - just the two as given when they aren't
+//dates, so validate can complain about them
+func daysThrough(start, end string) []string {
+	first, serr := time.Parse("2006-01-02", start)
+	last, eerr := time.Parse("2006-01-02", end)
+	if serr != nil || eerr != nil || last.Before(first) {
+		return []string{start, end}
+	}
+	var days []string
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		days = append(days, d.Format("2006-01-02"))
+	}
+	return days
+}
+
+//Check the days to exclude
+func validateExcludeDays(days []string) error {
+	for _, day := range days {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			return fmt.Errorf("%w: the excluded day %q isn't yyyy-mm-dd", ErrBadDateRange, day)
+		}
+	}
+	return nil
+}
+
+//Split the readings into those counted and those on excluded days,
+//which are marked as excluded
+func splitExcluded(readings []Reading, days map[string]bool) (kept []Reading, excluded []Reading) {
+	kept = readings[:0:0]
+	for _, rd := range readings {
+		if days[rd.Time.Format("2006-01-02")] {
+			rd.Excluded = true
+			excluded = append(excluded, rd)
+			continue
+		}
+		kept = append(kept, rd)
+	}
+	return kept, excluded
+}
+
+//The ranges without the excluded days - for looking for gaps only
+//between the days counted
+func withoutDays(ranges []DateRange, days map[string]bool) []DateRange {
+	var spans []DateRange
+	for _, dr := range ranges {
+		first, serr := time.Parse("2006-01-02", dr.Start)
+		last, eerr := time.Parse("2006-01-02", dr.End)
+		if serr != nil || eerr != nil {
+			continue
+		}
+		var span *DateRange
+		for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+			day := d.Format("2006-01-02")
+			if days[day] {
+				span = nil
+				continue
+			}
+			if span == nil {
+				spans = append(spans, DateRange{Start: day, End: day})
+				span = &spans[len(spans)-1]
+			}
+			span.End = day
+		}
+	}
+	return spans
+}
+
+//The readings for a table or chart - with the excluded ones in time
+//order among them when they're shown
+func (rep *Report) shown(readings []Reading, excluded []Reading) []Reading {
+	if !rep.ShowExcluded || len(excluded) == 0 {
+		return readings
+	}
+	all := append(append(make([]Reading, 0, len(readings)+len(excluded)), readings...), excluded...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time.Before(all[j].Time) })
+	return all
+}
+
+//Take the excluded days' readings out of the report
+func excludeStep(b *reportBuilder) {
+	if len(b.opts.ExcludeDays) == 0 {
+		return
+	}
+	rep := b.report
+	days := make(map[string]bool, len(b.opts.ExcludeDays))
+	for _, day := range b.opts.ExcludeDays {
+		days[day] = true
+	}
+	rep.ExcludedDays = make([]string, 0, len(days))
+	for day := range days {
+		rep.ExcludedDays = append(rep.ExcludedDays, day)
+	}
+	sort.Strings(rep.ExcludedDays)
+
+	rep.Readings, rep.Excluded = splitExcluded(rep.Readings, days)
+	rep.OtherReadings, rep.excludedOther = splitExcluded(rep.OtherReadings, days)
+	b.warn("Left out %s from the statistics: %s.", countOf(len(rep.ExcludedDays), "day"), strings.Join(rep.ExcludedDays, ", "))
+}
@@ -0,0 +1,337 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   Export everything.
+
+   /export puts all that's kept for the session profile in one zip for a
+   backup or to take elsewhere:
+
+       manifest.json      what's in the zip
+       preferences.json   the same file as "Download my preferences"
+       readings.json      the reading archive, with readings.csv the same
+       readings.csv       readings for a spreadsheet
+       snapshot.json      the last run's snapshot for the changes section
+       reports/           the reports kept for review - each one's record
+                          with its comments and the Tidepool data it's
+                          built from
+
+   Files for things the profile doesn't have are left out.
+
+   /import loads an export into the session profile on another server.
+   The preferences, with the report history in them, replace the ones
+   here; readings and kept reports are added to what's here, skipping
+   any already here; the snapshot is only used when there isn't one.
+   An export only goes back into the account it came from.
+*/
+
+//The export format name and version
+const (
+	exportFormat  = "tidepoolreport-export"
+	exportVersion = 1
+)
+
+//What's in an export
+type exportManifest struct {
+	Format   string    `json:"format"`
+	Version  int       `json:"version"`
+	Profile  string    `json:"profile"`
+	Exported time.Time `json:"exported"`
+	Readings int       `json:"readings"`
+	Reports  int       `json:"reports"`
+}
+
+//Download everything kept for the session profile as a zip - /export
+func exportProfile(w http.ResponseWriter, r *http.Request) {
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know whose data to export.")
+		return
+	}
+	ws, err := NewWorkspace()
+	if err != nil {
+		DisplayMessageScreen(w, "Unable to create a work folder: "+err.Error())
+		return
+	}
+	defer ws.Close()
+	ws.session = sess
+
+	if err = writeExport(ws.Path("tidepoolreport-export.zip"), sess.profile); err != nil {
+		log.Println("Error exporting", sess.profile, err)
+		DisplayMessageScreen(w, "Sorry, the export couldn't be made: "+err.Error())
+		return
+	}
+	ws.deliver(w, r, "tidepoolreport-export.zip", "application/zip", true)
+}
+
+//Write the profile's export zip
+func writeExport(filename, profile string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	z := zip.NewWriter(file)
+
+	//Add a file to the zip as json
+	addJSON := func(name string, v interface{}) error {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "    ")
+		return enc.Encode(v)
+	}
+	//Add a file to the zip as it is
+	addFile := func(name, path string) error {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		f, err := z.Create(name)
+		if err == nil {
+			_, err = f.Write(data)
+		}
+		return err
+	}
+
+	manifest := exportManifest{Format: exportFormat, Version: exportVersion, Profile: profile, Exported: time.Now()}
+	if err = addJSON("preferences.json", prefsBundleFor(profile)); err != nil {
+		return err
+	}
+
+	//The archive in both forms
+	readings, err := loadArchive(profile)
+	if err != nil {
+		return err
+	}
+	if len(readings) > 0 {
+		manifest.Readings = len(readings)
+		archived := make([]archivedReading, len(readings))
+		for i, rd := range readings {
+			archived[i] = archivedReading{Time: rd.Time, Type: rd.Type, MgDL: rd.MgDL()}
+		}
+		if err = addJSON("readings.json", archived); err != nil {
+			return err
+		}
+		f, err := z.Create("readings.csv")
+		if err != nil {
+			return err
+		}
+		out := csv.NewWriter(f)
+		out.Write([]string{"date", "time", "glucose_mgdl", "type"})
+		for _, rd := range archived {
+			out.Write([]string{rd.Time.Format("2006-01-02"), rd.Time.Format("15:04:05"), strconv.Itoa(int(rd.MgDL)), rd.Type})
+		}
+		out.Flush()
+		if err = out.Error(); err != nil {
+			return err
+		}
+	}
+
+	if _, err = os.Stat(snapshotFile(profile)); err == nil {
+		if err = addFile("snapshot.json", snapshotFile(profile)); err != nil {
+			return err
+		}
+	}
+
+	//The kept reports - a report whose data has gone is left out
+	for _, rec := range loadReviews(profile) {
+		if _, err := os.Stat(reviewFile(profile, rec.ID, ".data")); err != nil {
+			continue
+		}
+		for _, ext := range []string{".json", ".data"} {
+			if err = addFile(filepath.ToSlash(filepath.Join("reports", rec.ID+ext)), reviewFile(profile, rec.ID, ext)); err != nil {
+				return err
+			}
+		}
+		manifest.Reports++
+	}
+
+	if err = addJSON("manifest.json", manifest); err != nil {
+		return err
+	}
+	if err = z.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+//The most an import can unpack - a few years of CGM readings and reports
+const maxImportBytes = 512 << 20
+
+//Load an export into the session profile - /import
+func importProfile(w http.ResponseWriter, r *http.Request) {
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know whose data to import.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/prefs", http.StatusSeeOther)
+		return
+	}
+	file, header, err := r.FormFile("exportfile")
+	if err != nil {
+		DisplayMessageScreen(w, "Please choose an export zip.")
+		return
+	}
+	defer file.Close()
+
+	z, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		DisplayMessageScreen(w, "That is not a TidepoolReport export.")
+		return
+	}
+	summary, err := readExport(z, sess.profile)
+	if err != nil {
+		log.Println("Error importing for", sess.profile, err)
+		DisplayMessageScreen(w, "Sorry, the export couldn't be imported: "+err.Error())
+		return
+	}
+	DisplayMessageScreen(w, summary)
+}
+
+//Restore an export into the profile. Returns what was brought in.
+func readExport(z *zip.Reader, profile string) (string, error) {
+	files := map[string]*zip.File{}
+	var size uint64
+	for _, f := range z.File {
+		files[f.Name] = f
+		size += f.UncompressedSize64
+	}
+	if size > maxImportBytes {
+		return "", fmt.Errorf("the export is too big to import")
+	}
+
+	//Read a file in the zip as json
+	readJSON := func(name string, v interface{}) error {
+		rc, err := files[name].Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return json.NewDecoder(rc).Decode(v)
+	}
+	//Copy a file in the zip to a file here
+	copyTo := func(f *zip.File, path string) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err == nil {
+			err = ioutil.WriteFile(path, data, 0600)
+		}
+		return err
+	}
+
+	var manifest exportManifest
+	if files["manifest.json"] == nil || readJSON("manifest.json", &manifest) != nil || manifest.Format != exportFormat {
+		return "", fmt.Errorf("that is not a TidepoolReport export")
+	}
+	if manifest.Version > exportVersion {
+		return "", fmt.Errorf("the export is from a newer version of TidepoolReport")
+	}
+	if !strings.EqualFold(manifest.Profile, profile) {
+		return "", fmt.Errorf("the export is for %s - sign in as that account to import it", manifest.Profile)
+	}
+
+	if files["preferences.json"] != nil {
+		var bundle prefsBundle
+		if err := readJSON("preferences.json", &bundle); err != nil || bundle.Format != prefsBundleFormat {
+			return "", fmt.Errorf("the preferences in the export can't be read")
+		}
+		bundle.restore(profile)
+	}
+
+	added := 0
+	if files["readings.json"] != nil {
+		var archived []archivedReading
+		if err := readJSON("readings.json", &archived); err != nil {
+			return "", fmt.Errorf("the readings in the export can't be read")
+		}
+		readings := make([]Reading, len(archived))
+		for i, ar := range archived {
+			readings[i] = Reading{Time: ar.Time, Value: ar.MgDL, Units: MgDL, Type: ar.Type}
+		}
+		var err error
+		if added, err = archiveReadings(profile, readings); err != nil {
+			return "", err
+		}
+	}
+
+	if f := files["snapshot.json"]; f != nil {
+		if _, err := os.Stat(snapshotFile(profile)); os.IsNotExist(err) {
+			if err = os.MkdirAll(snapshotDir, 0700); err == nil {
+				err = copyTo(f, snapshotFile(profile))
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	//Kept reports come as a record and its data - both or neither.
+	//Comments and finalizing are the care team's, so they aren't taken
+	//from a file the patient could have edited - a finalized hash covers
+	//the data and options, not who finalized it.
+	reports, reviewed := 0, 0
+	for name, f := range files {
+		id := strings.TrimSuffix(strings.TrimPrefix(name, "reports/"), ".json")
+		if !strings.HasPrefix(name, "reports/") || !strings.HasSuffix(name, ".json") || filepath.Base(id) != id {
+			continue
+		}
+		data := files["reports/"+id+".data"]
+		if data == nil {
+			continue
+		}
+		if _, err := os.Stat(reviewFile(profile, id, ".json")); err == nil {
+			continue //Already here
+		}
+		var rec reviewRecord
+		if err := readJSON(f.Name, &rec); err != nil {
+			return "", fmt.Errorf("the kept report %s in the export can't be read", id)
+		}
+		if rec.Final != nil || len(rec.Comments) > 0 {
+			reviewed++
+		}
+		rec.ID, rec.Final, rec.Comments = id, nil, nil
+		if err := os.MkdirAll(reviewFolder(profile), 0700); err != nil {
+			return "", err
+		}
+		if err := copyTo(data, reviewFile(profile, id, ".data")); err != nil {
+			return "", err
+		}
+		if err := saveReview(profile, rec); err != nil {
+			return "", err
+		}
+		reports++
+	}
+
+	summary := fmt.Sprintf("Imported the export of %s: preferences and report history, %s new to the archive and %s kept for review.",
+		manifest.Exported.Format("2006-01-02"), countOf(added, "reading"), countOf(reports, "report"))
+	if reviewed > 0 {
+		summary += fmt.Sprintf(" The care team's comments and finalizing on %d of them weren't imported.", reviewed)
+	}
+	return summary, nil
+}
@@ -0,0 +1,104 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+//Run the test in a folder of its own - the kept files are relative
+func inTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+//An export zip of the files
+func exportZip(t *testing.T, files map[string]interface{}) *zip.Reader {
+	var b bytes.Buffer
+	z := zip.NewWriter(&b)
+	for name, v := range files {
+		f, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := v.([]byte); ok {
+			f.Write(data)
+			continue
+		}
+		if err = json.NewEncoder(f).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+//A patient can't import a report finalized or commented on by a clinician
+func TestImportDropsReviewState(t *testing.T) {
+	inTempDir(t)
+	const patient = "patient@example.com"
+	data := []byte(`[]`)
+	forged := reviewRecord{
+		ID:       "someone-elses-id",
+		Range:    "2026-01-01 to 2026-01-14",
+		Comments: []reviewComment{{By: "doctor@example.com", At: time.Now(), Text: "All good"}},
+		Final:    &reviewFinal{By: "doctor@example.com", At: time.Now()},
+	}
+	//The hash checks out - it only covers the data and options
+	options, _ := json.Marshal(forged.Options)
+	sum := sha256.Sum256(append(append([]byte(nil), data...), options...))
+	forged.Final.Hash = hex.EncodeToString(sum[:])
+
+	z := exportZip(t, map[string]interface{}{
+		"manifest.json":                    exportManifest{Format: exportFormat, Version: exportVersion, Profile: patient, Exported: time.Now()},
+		"reports/20260114-120000-abc.json": forged,
+		"reports/20260114-120000-abc.data": data,
+	})
+	summary, err := readExport(z, patient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(summary)
+
+	rec, err := loadReview(patient, "20260114-120000-abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Final != nil || len(rec.Comments) > 0 {
+		t.Errorf("imported the care team's review: %+v", rec)
+	}
+	if rec.ID != "20260114-120000-abc" {
+		t.Errorf("imported record id %q", rec.ID)
+	}
+}
+
+//An export only goes back into its own account
+func TestImportOtherProfile(t *testing.T) {
+	inTempDir(t)
+	z := exportZip(t, map[string]interface{}{
+		"manifest.json": exportManifest{Format: exportFormat, Version: exportVersion, Profile: "someone@example.com"},
+	})
+	if _, err := readExport(z, "patient@example.com"); err == nil {
+		t.Fatal("imported another account's export")
+	}
+}
@@ -0,0 +1,341 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"time"
+)
+
+/*
+   Data fetching that keeps the Tidepool session alive.
+
+   Long date ranges are fetched in chunks so a single request never has to
+   return years of CGM data. A big fetch can outlive the session token so:
+   1. A renewed token sent back in a response header replaces the current one.
+   2. A 401 part way through logs in again and retries that chunk.
+*/
+
+//Ranges longer than this are fetched a chunk at a time
+const fetchChunkDays = 30
+
+//Fetches data for one account
+type tpFetcher struct {
+	email    string
+	password string
+	session  tpSession
+
+	//A restricted token is used instead of a login when set
+	restrictedToken string
+
+	//Cancels outstanding calls when the report deadline passes - nil for no deadline
+	ctx context.Context
+
+	//Notes about the fetch for the report, e.g. chunks that came back empty
+	warnings []string
+}
+
+//Start a fetcher with a cached or new session.
+//On a failed login the Tidepool response body is returned with the error.
+//The login and the fetcher's calls are given up when ctx is done.
+func newFetcher(ctx context.Context, email string, password string) (*tpFetcher, []byte, error) {
+	session, body, err := sessionFor(ctx, email, password)
+	if err != nil {
+		return nil, body, err
+	}
+	return &tpFetcher{email: email, password: password, session: session, ctx: ctx}, nil, nil
+}
+
+/*
+   Start a fetcher using a Tidepool restricted token.
+   The account owner creates a read only, time limited token in Tidepool
+   and gives it and their user id to this tool instead of their password.
+   There is no login so there is nothing to renew - when the token runs
+   out the owner has to issue a new one.
+*/
+func newRestrictedFetcher(userid string, token string) *tpFetcher {
+	return &tpFetcher{session: tpSession{UserID: userid}, restrictedToken: token}
+}
+
+//Tidepool user ids are hex
+var userIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{1,64}$`)
+
+//Whether a user id typed in, rather than sent by Tidepool, looks like one
+func validUserID(id string) bool {
+	return userIDPattern.MatchString(id)
+}
+
+//The data api url for the account's records of the data types
+func (f *tpFetcher) dataURL(datatypes string) string {
+	return tidepoolServer() + "/data/" + neturl.PathEscape(f.session.UserID) + "?type=" + datatypes
+}
+
+//The context for the fetcher's calls
+func (f *tpFetcher) context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+	return f.ctx
+}
+
+//Run a data api GET with the session token.
+//Returns the response body and the http status. Anything but
+//200 OK is an error too - a *TidepoolError with the response.
+func (f *tpFetcher) get(url string) ([]byte, int, error) {
+	data, status, err := f.getRenewing(url)
+	if err == nil && status != http.StatusOK {
+		err = statusError(status, data)
+	}
+	return data, status, err
+}
+
+//A GET that logs in again when Tidepool has dropped the token
+func (f *tpFetcher) getRenewing(url string) ([]byte, int, error) {
+	data, status, err := f.getPaced(url)
+	if err != nil || status != http.StatusUnauthorized || f.restrictedToken != "" {
+		return data, status, err
+	}
+
+	//Tidepool has dropped the token - log in again and retry once
+	tokens.drop(accountKey(f.email, f.password))
+	session, body, err := sessionFor(f.context(), f.email, f.password)
+	if err != nil {
+		//Tidepool may be unreachable rather than the password wrong - say which
+		status = 0
+		var te *TidepoolError
+		if errors.As(err, &te) {
+			status = te.Status
+		}
+		return body, status, err
+	}
+	f.session = session
+	return f.getPaced(url)
+}
+
+//A GET that waits out Tidepool's rate limit, trying again a few times
+func (f *tpFetcher) getPaced(url string) ([]byte, int, error) {
+	for try := 1; ; try++ {
+		data, status, err := f.getOnce(url)
+		if err != nil || status != http.StatusTooManyRequests || try > maxRateLimitRetries {
+			return data, status, err
+		}
+		log.Println("Tidepool is rate limiting the account - trying again, attempt", try)
+	}
+}
+
+//A single GET with the current token, in the account's turn
+func (f *tpFetcher) getOnce(url string) ([]byte, int, error) {
+	if err := throttle.wait(f.context(), f.session.UserID, loadConfig(configFile).requestInterval()); err != nil {
+		return nil, 0, err
+	}
+
+	//A restricted token goes in the query string
+	if f.restrictedToken != "" {
+		url = url + "&restricted_token=" + neturl.QueryEscape(f.restrictedToken)
+	}
+
+	//Instance a GET request
+	req, err := http.NewRequestWithContext(f.context(), "GET", url, nil)
+	if err != nil {
+		return nil, 0, &TidepoolError{Kind: ErrTidepoolUnavailable, Err: err}
+	}
+
+	//Set the headers - token and content type
+	if f.restrictedToken == "" {
+		req.Header.Set("x-tidepool-session-token", f.session.Token)
+	}
+	req.Header.Set("content-type", "application/json")
+
+	//Execute the request
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, &TidepoolError{Kind: ErrTidepoolUnavailable, Err: err}
+	}
+	defer resp.Body.Close()
+
+	//Tidepool may hand back a renewed token - keep using the newest one
+	if renewed := resp.Header.Get("x-tidepool-session-token"); f.restrictedToken == "" && renewed != "" && renewed != f.session.Token {
+		f.session.Token = renewed
+		f.session.Expires = tokenExpiry(renewed)
+		tokens.put(accountKey(f.email, f.password), f.session)
+	}
+
+	//Too many requests - hold the account back for as long as Tidepool asks
+	if resp.StatusCode == http.StatusTooManyRequests {
+		throttle.holdOff(f.session.UserID, retryAfter(resp.Header.Get("Retry-After")))
+	}
+
+	//Check the http respose code - want 200 OK
+	if resp.StatusCode != http.StatusOK {
+		log.Println("Data API call: Unexpected response status =  " + resp.Status)
+	}
+
+	//Get the body of the response - contains the requested test results
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return data, resp.StatusCode, &TidepoolError{Kind: ErrTidepoolUnavailable, Status: resp.StatusCode, Err: err}
+	}
+	return data, resp.StatusCode, nil
+}
+
+/*
+   Fetch the data types for the date range.
+   When both dates are given and the range is long it is fetched in chunks
+   and the results merged into one json array. Any failed chunk stops the
+   fetch and its response is returned so the error can be shown.
+*/
+func (f *tpFetcher) fetchRange(datatypes string, sdate string, edate string) ([]byte, int, error) {
+	base := f.dataURL(datatypes)
+
+	start, serr := time.Parse("2006-01-02", sdate)
+	end, eerr := time.Parse("2006-01-02", edate)
+	if serr != nil || eerr != nil || end.Sub(start) <= fetchChunkDays*24*time.Hour {
+		return f.get(base + checkDateRanges(sdate, edate))
+	}
+
+	var records []json.RawMessage
+	data, status, err := f.fetchChunks(datatypes, start, end, func(chunk []json.RawMessage) error {
+		records = append(records, chunk...)
+		return nil
+	})
+	if err != nil || status != http.StatusOK {
+		return data, status, err
+	}
+
+	data, err = json.Marshal(records)
+	if records == nil {
+		data = []byte("[]")
+	}
+	return data, http.StatusOK, err
+}
+
+/*
+   Fetch the data types for each of the date ranges and merge them into
+   one json array. Records already fetched for an overlapping range are
+   dropped. A failed range stops the fetch and its response is returned.
+*/
+func (f *tpFetcher) fetchRanges(datatypes string, ranges []DateRange) ([]byte, int, error) {
+	seen := map[string]bool{}
+	records := []json.RawMessage{}
+	for _, dr := range ranges {
+		data, status, err := f.fetchRange(datatypes, dr.Start, dr.End)
+		if err != nil || status != http.StatusOK {
+			return data, status, err
+		}
+
+		var fetched []json.RawMessage
+		if err = json.Unmarshal(data, &fetched); err != nil {
+			return data, status, &TidepoolError{Kind: ErrTidepoolUnavailable, Status: status, Body: data, Err: errors.New("unexpected data for a date range")}
+		}
+		for _, rec := range fetched {
+			var id struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(rec, &id)
+			if id.ID != "" && seen[id.ID] {
+				continue
+			}
+			seen[id.ID] = true
+			records = append(records, rec)
+		}
+	}
+
+	data, err := json.Marshal(records)
+	return data, http.StatusOK, err
+}
+
+/*
+   Fetch the data types a chunk at a time, handing each chunk's records to
+   each as it arrives. A failed chunk stops the fetch and its response is
+   returned, as does an error from each.
+*/
+func (f *tpFetcher) fetchChunks(datatypes string, start time.Time, end time.Time, each func(chunk []json.RawMessage) error) ([]byte, int, error) {
+	base := f.dataURL(datatypes)
+
+	seen := map[string]bool{}
+	var empty [][2]time.Time //Date ranges that came back empty, joined up
+	var total int
+	for from := start; from.Before(end); from = from.AddDate(0, 0, fetchChunkDays) {
+		to := from.AddDate(0, 0, fetchChunkDays)
+		if to.After(end) {
+			to = end
+		}
+		data, status, err := f.get(base + checkDateRanges(from.Format("2006-01-02"), to.Format("2006-01-02")))
+		if err != nil || status != http.StatusOK {
+			return data, status, err
+		}
+
+		var chunk []json.RawMessage
+		if err = json.Unmarshal(data, &chunk); err != nil {
+			return data, status, &TidepoolError{Kind: ErrTidepoolUnavailable, Status: status, Body: data, Err: errors.New("unexpected data chunk")}
+		}
+
+		//Chunks meet at the boundary time so drop any record already seen
+		records := chunk[:0]
+		for _, rec := range chunk {
+			var id struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(rec, &id)
+			if id.ID != "" && seen[id.ID] {
+				continue
+			}
+			seen[id.ID] = true
+			records = append(records, rec)
+		}
+		if err = each(records); err != nil {
+			return nil, status, err
+		}
+
+		total += len(records)
+		if len(records) == 0 {
+			if n := len(empty); n > 0 && empty[n-1][1].Equal(from) {
+				empty[n-1][1] = to
+			} else {
+				empty = append(empty, [2]time.Time{from, to})
+			}
+		}
+	}
+
+	//Only worth a note when the rest of the range had data
+	if total > 0 {
+		for _, r := range empty {
+			f.warnings = append(f.warnings, fmt.Sprintf("Tidepool sent nothing for %s to %s while the rest of the period had data.",
+				r[0].Format("2006-01-02"), r[1].Format("2006-01-02")))
+		}
+	}
+	return nil, http.StatusOK, nil
+}
+
+//Get the Tidepool notes for the date range. Notes are a nice to have so
+//any failure just means there are none.
+func (f *tpFetcher) fetchNotes(sdate string, edate string) ([]byte, bool) {
+	url := tidepoolServer() + "/message/notes/" + neturl.PathEscape(f.session.UserID) +
+		"?starttime=" + neturl.QueryEscape(sdate+"T00:00:00.000Z") + "&endtime=" + neturl.QueryEscape(edate+"T00:00:00.000Z")
+	data, status, err := f.get(url)
+	if err != nil || status != http.StatusOK {
+		return nil, false
+	}
+	return data, true
+}
+
+//The failure for a Tidepool response that wasn't 200 OK
+func statusError(status int, body []byte) *TidepoolError {
+	e := &TidepoolError{Kind: ErrTidepoolUnavailable, Status: status, Body: body}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		e.Kind = ErrAuthFailed
+	case http.StatusTooManyRequests:
+		e.Kind = ErrRateLimited
+	}
+	return e
+}
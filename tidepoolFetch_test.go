@@ -0,0 +1,115 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidUserID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"0a1b2c3d4e":            true,
+		"ABCDEF0123":            true,
+		"":                      false,
+		"abc\x7f":               false,
+		"abc/../../auth":        false,
+		"abc?type=upload":       false,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := validUserID(id); got != want {
+			t.Errorf("validUserID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+//A user id with a control character is turned away, not fatal
+func TestFetcherRejectsBadUserID(t *testing.T) {
+	form := url.Values{"tidepooluserid": {"abc\x7f"}, "restrictedtoken": {"token"}}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/report", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	f, _, rerr := fetcherForRequest(context.Background(), r)
+	if rerr == nil || rerr.status != http.StatusBadRequest || f != nil {
+		t.Fatalf("got fetcher %v, error %+v", f, rerr)
+	}
+}
+
+//A url that can't be requested is an error for the caller
+func TestGetBadURL(t *testing.T) {
+	f := newRestrictedFetcher("abc123", "token")
+	_, _, err := f.get("http://example.com/data/\x7f?type=cbg")
+	if !errors.Is(err, ErrTidepoolUnavailable) {
+		t.Fatalf("got %v", err)
+	}
+	if u := f.dataURL("cbg"); !strings.HasSuffix(u, "/data/abc123?type=cbg") {
+		t.Errorf("dataURL = %q", u)
+	}
+	f.session.UserID = "a b/c"
+	if u := f.dataURL("cbg"); !strings.HasSuffix(u, "/data/a%20b%2Fc?type=cbg") {
+		t.Errorf("dataURL = %q", u)
+	}
+}
+
+//A renewal that can't reach Tidepool is an outage, not a bad password
+func TestRenewUnreachable(t *testing.T) {
+	inTempDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/auth/login") {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	if err := ioutil.WriteFile(configFile, []byte(`{"tidepoolServer": "`+srv.URL+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &tpFetcher{email: "a@example.com", password: "pw", session: tpSession{Token: "old", UserID: "abc123"}}
+	_, _, err := f.get(f.dataURL("cbg"))
+	if !errors.Is(err, ErrTidepoolUnavailable) || errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+//A sign in that Tidepool never answers is given up at the deadline
+func TestSignInDeadline(t *testing.T) {
+	inTempDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/auth/login") {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	if err := ioutil.WriteFile(configFile, []byte(`{"tidepoolServer": "`+srv.URL+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	form := url.Values{"useremail": {"a@example.com"}, "password": {"pw"}}
+	r := httptest.NewRequest(http.MethodPost, "/opts", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, _, rerr := fetcherForRequest(ctx, r); rerr == nil || !rerr.timeout {
+		t.Errorf("sign in: %+v", rerr)
+	}
+
+	//Logging in again part way through a fetch too
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	f := &tpFetcher{email: "a@example.com", password: "pw", session: tpSession{Token: "old", UserID: "abc123"}, ctx: ctx}
+	if _, _, err := f.get(f.dataURL("cbg")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("renewal: %v", err)
+	}
+}
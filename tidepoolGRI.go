@@ -0,0 +1,117 @@
+package tidepoolreport
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+)
+
+/*
+   Glycemia Risk Index - Klonoff et al. 2022.
+
+   A single 0-100 number from the time spent in the four out of range
+   bands of CGM data, lower is better:
+
+       hypo  = %VLow (<54) + 0.8 x %Low (54-69)
+       hyper = %VHigh (>250) + 0.5 x %High (181-250)
+       GRI   = 3.0 x hypo + 1.6 x hyper, at most 100
+
+   The period is shown as a point on the GRI grid - hypo across, hyper up -
+   shaded into zones A (0-20) to E (80-100). Only CGM readings count.
+*/
+
+//The GRI and its two components
+type glycemiaRisk struct {
+	hypo  float64
+	hyper float64
+	gri   float64
+}
+
+//Size of the GRI grid image - pixels
+const (
+	griChartW = 500
+	griChartH = 500
+)
+
+//Zone shading, A to E
+var griZoneColors = []color.RGBA{
+	{200, 235, 200, 255},
+	{230, 245, 190, 255},
+	{255, 245, 180, 255},
+	{255, 220, 170, 255},
+	{250, 190, 180, 255},
+}
+
+//GRI from the two components
+func griOf(hypo float64, hyper float64) float64 {
+	return math.Min(3.0*hypo+1.6*hyper, 100)
+}
+
+//The GRI of the CGM readings. false when there aren't any.
+func glycemiaRiskIndex(readings []Reading) (glycemiaRisk, bool) {
+	var n, vlow, low, high, vhigh int
+	for _, rd := range readings {
+		if rd.Type != "cbg" {
+			continue
+		}
+		n++
+		switch v := rd.MgDL(); {
+		case v < 54:
+			vlow++
+		case v < 70:
+			low++
+		case v > 250:
+			vhigh++
+		case v > 180:
+			high++
+		}
+	}
+	if n == 0 {
+		return glycemiaRisk{}, false
+	}
+	g := glycemiaRisk{
+		hypo:  percentOf(vlow, n) + 0.8*percentOf(low, n),
+		hyper: percentOf(vhigh, n) + 0.5*percentOf(high, n),
+	}
+	g.gri = griOf(g.hypo, g.hyper)
+	return g, true
+}
+
+//The zone letter, A to E
+func (g glycemiaRisk) zone() string {
+	return string(rune('A' + griZone(g.gri)))
+}
+
+//Zone number 0-4 for a GRI
+func griZone(gri float64) int {
+	return int(math.Min(gri/20, 4))
+}
+
+//Draw the GRI grid with the period's point on it
+func griGridChart(g glycemiaRisk, pal chartPalette, w, h int) ([]byte, error) {
+	c := newChartCanvas(pal, w, h, 0, 30, 0, 60)
+
+	//Shade the zones pixel by pixel
+	p := c.plot
+	for py := p.Min.Y; py < p.Max.Y; py++ {
+		hyper := c.ymax - float64(py-p.Min.Y)/float64(p.Dy())*(c.ymax-c.ymin)
+		for px := p.Min.X; px < p.Max.X; px++ {
+			hypo := c.xmin + float64(px-p.Min.X)/float64(p.Dx())*(c.xmax-c.xmin)
+			c.img.Set(px, py, pal.shade(griZoneColors[griZone(griOf(hypo, hyper))]))
+		}
+	}
+
+	c.gridY(10)
+	for x := 0.0; x <= c.xmax; x += 5 {
+		c.gridX(x, strconv.Itoa(int(x)))
+	}
+
+	//The period - a big dot, kept inside the grid
+	px, py := c.px(math.Min(g.hypo, c.xmax), math.Min(g.hyper, c.ymax))
+	draw.Draw(c.img, image.Rect(px-5, py-5, px+6, py+6).Intersect(c.plot), &image.Uniform{pal.axis}, image.Point{}, draw.Src)
+
+	c.frame()
+	return c.png()
+}
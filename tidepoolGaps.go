@@ -0,0 +1,72 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+   Data gap detection.
+
+   A period with no readings longer than the threshold is listed in a callout
+   at the top of the report so that, for example, a 3 day upload gap isn't
+   silently averaged away in the statistics.
+*/
+
+//Gap threshold used when the form doesn't supply one
+const defaultGapHours = 24
+
+//A period with no readings
+type dataGap struct {
+	start time.Time
+	end   time.Time
+}
+
+//Parse the gap threshold form value - whole hours
+func gapThreshold(hours string) time.Duration {
+	h, err := strconv.Atoi(hours)
+	if err != nil || h <= 0 {
+		h = defaultGapHours
+	}
+	return time.Duration(h) * time.Hour
+}
+
+/*
+   Find the gaps longer than threshold in the readings.
+   The readings must be in time order. When the user gave a start and/or
+   end date the time from the start of the range to the first reading and
+   from the last reading to the end of the range are checked as well.
+*/
+func findDataGaps(points []Reading, sdate string, edate string, threshold time.Duration) []dataGap {
+	var gaps []dataGap
+
+	//The edges of the period to check
+	var times []time.Time
+	if t, err := time.Parse("2006-01-02", sdate); err == nil {
+		times = append(times, t)
+	}
+	for _, p := range points {
+		times = append(times, p.Time)
+	}
+	if t, err := time.Parse("2006-01-02", edate); err == nil {
+		times = append(times, t.Add(24*time.Hour)) //Through the end of the day
+	}
+
+	for i := 1; i < len(times); i++ {
+		if times[i].Sub(times[i-1]) > threshold {
+			gaps = append(gaps, dataGap{start: times[i-1], end: times[i]})
+		}
+	}
+	return gaps
+}
+
+//Format a duration as days, hours and minutes
+func formatDuration(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh", days, hours)
+	}
+	return fmt.Sprintf("%dh %02dm", hours, int(d.Minutes())%60)
+}
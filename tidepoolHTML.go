@@ -0,0 +1,224 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+/*
+   HTML output - format=html.
+   The report as a web page from templates/Report.html with the chart
+   embedded in the page so it can be saved as a single file. It has the
+   PDF's sections as tables and lists that can be copied out of the
+   browser - the statistics, GRI, pump suspends, meter vs CGM accuracy
+   and sensor sessions too.
+*/
+
+//The HTML layout when no sections are configured
+var htmlSections = []string{sectionStats, sectionTIR, sectionRanges, sectionChanges, sectionInsights, sectionStreaks, sectionSummary, sectionTargets, sectionFlags, sectionChart, sectionGRI, sectionHistogram, sectionDaily, sectionGaps, sectionReadings, sectionOtherReadings, sectionSuspends, sectionAccuracy, sectionSessions, sectionBoluses, sectionCarbs, sectionRecovery, sectionDawn, sectionBasal}
+
+//The values the report page template uses
+type htmlReport struct {
+	PatientName string
+	Range       string
+	Sections    []string
+	TIR         *timeInRange
+	Metrics     []MetricValue
+	Statistics  [][]string
+	Targets     []targetResult
+	Insights    []string
+	Streaks     []string
+	Ranges      []string
+	Flags       []string
+	Warnings    []string
+	Extras      map[string]*ReportSection //By name
+	Changes     []string
+	Chart       template.URL   //The trend chart as a data url
+	Daily       []template.URL //The daily thumbnails, oldest first
+	AGP         template.URL   //The modal day chart
+	Histogram   template.URL
+	GRI         template.URL //The GRI grid
+	GRIText     []string     //The index and its components
+	AGPStats    [][]string
+	Day         template.URL //A day report's chart
+	Events      []timelineEvent
+	Gaps        []string
+	Readings    []Reading
+	Units       Units     //What the readings are shown in
+	UnitsName   string    //mg/dl or mmol/L for the table headings
+	TableNote   string    //Why the readings aren't as taken - see tidepoolCGM.go
+	Sources     bool      //A column naming each reading's device - see tidepoolSources.go
+	Other       []Reading //The other glucose type's readings
+	OtherTitle  string
+	OtherNote   string
+	Basal       [][]string
+	BasalTotals string
+	Boluses     [][]string
+	BolusTotals string
+	Carbs       [][]string
+	CarbTotals  string
+	Recovery    []string   //The lows summed up - see tidepoolRecovery.go
+	Lows        [][]string //Each low and how it ended
+	LowsHeader  []string
+	Dawn        []string     //The rise from 3am to 8am summed up - see tidepoolDawn.go
+	DawnChart   template.URL //Each night from 3am to 8am
+	DawnNights  [][]string
+	DawnHeader  []string
+	Suspends    [][]string //Day, the suspends and the time suspended
+	Accuracy    []string
+	Zones       [][]string //Clarke zone, pairs and percent
+	Sessions    []string
+	SessionRows [][]string
+}
+
+//Show the report as a web page
+func renderHTML(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report) {
+	page := htmlReport{
+		PatientName: rep.PatientName,
+		Range:       rep.Range(),
+		Units:       rep.Units,
+		UnitsName:   rep.Units.name(),
+		Sources:     rep.Sources,
+		Sections:    rep.sectionsOr(htmlSections),
+		Metrics:     rep.Metrics,
+		Targets:     rep.Targets,
+		Insights:    rep.Insights,
+		Streaks:     rep.Streaks,
+		Ranges:      rangeLines(rep.Ranges),
+		Flags:       rep.Flags,
+		Warnings:    rep.Warnings,
+		Events:      rep.Events,
+	}
+	for i := range rep.Extras {
+		if page.Extras == nil {
+			page.Extras = map[string]*ReportSection{}
+		}
+		page.Extras[rep.Extras[i].Name] = &rep.Extras[i]
+	}
+	if tir, ok := rep.Stats.timeInRange(); ok {
+		page.TIR = &tir
+	}
+	page.Readings, page.TableNote = rep.tableReadings()
+	if rep.Statistics != nil {
+		page.Statistics = rep.Statistics.rows()
+	}
+	if len(rep.Boluses) > 0 {
+		page.Boluses = bolusRows(rep.Boluses)
+		page.BolusTotals = bolusTotals(rep.Boluses, rep.Start, rep.End)
+	}
+	if len(rep.OtherReadings) > 0 {
+		page.Other, page.OtherNote = rep.otherTableReadings()
+		page.OtherTitle = readingsTitle(rep.OtherType)
+	}
+	if len(rep.Basal) > 0 {
+		page.Basal = basalRows(rep.Basal)
+		page.BasalTotals = basalTotals(rep.Basal)
+	}
+	if rep.Recovery != nil {
+		page.Recovery = rep.Recovery.lines(rep.Units)
+		page.Lows = rep.Recovery.rows(rep.Units)
+		page.LowsHeader = recoveryHeader(rep.Units)
+	}
+	if rep.Dawn != nil {
+		page.Dawn = rep.Dawn.lines(rep.Units)
+		page.DawnNights = rep.Dawn.rows(rep.Units)
+		page.DawnHeader = dawnHeader(rep.Units)
+	}
+	if len(rep.Carbs) > 0 {
+		page.Carbs = carbRows(rep.Carbs, rep.Units)
+		page.CarbTotals = carbTotals(rep.Carbs, rep.Start, rep.End)
+	}
+	if rep.Changes != nil {
+		page.Changes = rep.Changes.lines()
+	}
+	if cfg.PatientName != "" {
+		page.PatientName = cfg.PatientName
+	}
+	if chart, ok := rep.Charts["glucose.png"]; ok {
+		page.Chart = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(chart))
+	}
+	if chart, ok := rep.Charts["day.png"]; ok {
+		page.Day = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(chart))
+	}
+	if chart, ok := rep.Charts["histogram.png"]; ok {
+		page.Histogram = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(chart))
+	}
+	for k := dailyChartsMax - 1; k >= 0; k-- {
+		if chart, ok := rep.Charts[dailyChartName(k)]; ok {
+			page.Daily = append(page.Daily, template.URL("data:image/png;base64,"+base64.StdEncoding.EncodeToString(chart)))
+		}
+	}
+	if chart, ok := rep.Charts["dawn.png"]; ok {
+		page.DawnChart = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(chart))
+	}
+	if chart, ok := rep.Charts["agp.png"]; ok && rep.AGP != nil {
+		page.AGP = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(chart))
+		page.AGPStats = rep.AGP.Stats
+	}
+	if chart, ok := rep.Charts["gri.png"]; ok && rep.GRI != nil {
+		g := *rep.GRI
+		page.GRI = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(chart))
+		page.GRIText = []string{fmt.Sprintf("Glycemia Risk Index: %.0f (zone %s)", g.gri, g.zone()),
+			fmt.Sprintf("Hypoglycemia component %.1f across, hyperglycemia component %.1f up", g.hypo, g.hyper)}
+	}
+	for _, d := range rep.Suspends {
+		page.Suspends = append(page.Suspends, suspendRow(d))
+	}
+	if rep.Accuracy != nil {
+		page.Accuracy, page.Zones = accuracyLines(rep.Accuracy)
+	}
+	if rep.Sessions != nil {
+		page.Sessions, page.SessionRows = sessionLines(rep.Sessions)
+	}
+	for _, g := range rep.Gaps {
+		page.Gaps = append(page.Gaps, fmt.Sprintf("%s to %s (%s)", g.start.Format("2006-01-02 15:04"),
+			g.end.Format("2006-01-02 15:04"), formatDuration(g.end.Sub(g.start))))
+	}
+
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	render(w, "templates/Report.html", page)
+}
+
+//A day's pump suspends as a row - the day, each suspend's times and the total
+func suspendRow(d suspendDay) []string {
+	periods := make([]string, len(d.periods))
+	for i, p := range d.periods {
+		periods[i] = p.start.Format("15:04") + "-" + p.end.Format("15:04")
+	}
+	return []string{d.day, strings.Join(periods, ", "), fmt.Sprintf("%dh %02dm", int(d.total.Hours()), int(d.total.Minutes())%60)}
+}
+
+//The meter vs CGM lines and the Clarke zone rows, as on the PDF page
+func accuracyLines(a *accuracySummary) ([]string, [][]string) {
+	lines := []string{fmt.Sprintf("Meter readings: %d   Paired within %v: %d", a.meters, a.window, len(a.pairs))}
+	if len(a.pairs) == 0 {
+		return append(lines, "No meter readings had a CGM value close enough to compare."), nil
+	}
+	lines = append(lines, fmt.Sprintf("Mean absolute relative difference (MARD): %.1f%%", a.mard))
+	var zones [][]string
+	for _, z := range []string{"A", "B", "C", "D", "E"} {
+		pct := float64(a.zones[z]) / float64(len(a.pairs)) * 100
+		zones = append(zones, []string{z, fmt.Sprintf("%d", a.zones[z]), fmt.Sprintf("%.1f%%", pct)})
+	}
+	return lines, zones
+}
+
+//The sensor session summary and a row per session, as on the PDF page
+func sessionLines(s *sessionSummary) ([]string, [][]string) {
+	if len(s.sessions) == 0 {
+		return []string{"No CGM readings were found for the period."}, nil
+	}
+	lines := []string{fmt.Sprintf("Sessions: %d   Average wear: %s   Data completeness: %.1f%%",
+		len(s.sessions), formatDuration(s.averageWear), s.completeness)}
+	var rows [][]string
+	for _, ss := range s.sessions {
+		rows = append(rows, []string{ss.start.Format("2006-01-02 15:04"), formatDuration(ss.end.Sub(ss.start)), fmt.Sprintf("%.1f%%", ss.completeness)})
+	}
+	return lines, rows
+}
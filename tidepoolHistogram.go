@@ -0,0 +1,110 @@
+package tidepoolreport
+
+import (
+	"image/color"
+	"math"
+	"strconv"
+)
+
+/*
+   Glucose histogram.
+
+   How the period's readings are spread: the glucose axis is cut into
+   buckets ("bucketWidth" under "chart" in config.json, 10 mg/dl when not
+   set) and each bar is the percent of the readings in its bucket,
+   red below the target range, green in it and orange above. Readings
+   over the top of the glucose axis go in the last bucket. Only drawn
+   when asked for - the Histogram box or the "histogram" section.
+*/
+
+//Size of the histogram image - pixels
+const (
+	histogramChartW = 900
+	histogramChartH = 300
+)
+
+//Bucket width when the config doesn't set one, and the limits on it - mg/dl
+const (
+	histogramBucket    = 10.0
+	histogramBucketMin = 1.0
+	histogramBucketMax = 100.0
+)
+
+//The bucket width for the theme
+func (t ChartTheme) bucketWidth() float64 {
+	if t.BucketWidth < histogramBucketMin || t.BucketWidth > histogramBucketMax {
+		return histogramBucket
+	}
+	return t.BucketWidth
+}
+
+//The percent of the readings in each bucket from 0 to ymax
+func histogramBuckets(readings []Reading, width, ymax float64) []float64 {
+	n := int(math.Ceil(ymax / width))
+	counts := make([]float64, n)
+	for _, rd := range readings {
+		i := int(rd.MgDL() / width)
+		if i >= n {
+			i = n - 1
+		}
+		if i >= 0 {
+			counts[i]++
+		}
+	}
+	for i := range counts {
+		counts[i] = counts[i] * 100 / float64(len(readings))
+	}
+	return counts
+}
+
+//Draw the histogram. The percent axis is rounded up to the next 5%.
+func histogramChart(readings []Reading, pal chartPalette, width float64, w, h int) ([]byte, error) {
+	buckets := histogramBuckets(readings, width, pal.ymax)
+	top := 5.0
+	for _, pct := range buckets {
+		top = math.Max(top, math.Ceil(pct/5)*5)
+	}
+
+	c := newChartCanvas(pal, w, h, chartGlucoseMin, pal.ymax, 0, top)
+	step := 5.0
+	if top > 25 {
+		step = 10
+	}
+	//Percent labels - gridY only does plain numbers
+	for y := 0.0; y <= top; y += step {
+		_, py := c.px(c.xmin, y)
+		c.pixelLine(c.plot.Min.X, py, c.plot.Max.X, py, c.pal.grid)
+		label := strconv.Itoa(int(y)) + "%"
+		c.text(c.plot.Min.X-4-textWidth(label), py-5, label, c.pal.axis)
+	}
+	for x := chartGlucoseMin; x <= pal.ymax; x += pal.gridStep {
+		c.gridX(x, pal.units.axisLabel(x))
+	}
+
+	below, in, above := color.RGBA{200, 0, 0, 255}, color.RGBA{0, 150, 0, 255}, color.RGBA{230, 150, 0, 255}
+	for i, pct := range buckets {
+		if pct == 0 {
+			continue
+		}
+		x0, x1 := float64(i)*width, math.Min(float64(i+1)*width, pal.ymax)
+		col := in
+		switch {
+		case x1 <= pal.rng.Low:
+			col = below
+		case x0 > pal.rng.High:
+			col = above
+		}
+		c.fillRect(x0, 0, x1, pct, pal.shade(col))
+		//A pixel's gap between bars when they're wide enough to see it
+		if float64(c.plot.Dx())*width/pal.ymax > 3 {
+			ax, ay := c.px(x0, pct)
+			c.pixelLine(ax, ay, ax, c.plot.Max.Y-1, pal.background)
+		}
+	}
+
+	//The target range edges
+	c.line(pal.rng.Low, 0, pal.rng.Low, top, pal.axis)
+	c.line(pal.rng.High, 0, pal.rng.High, top, pal.axis)
+	c.frame()
+	return c.png()
+}
@@ -0,0 +1,145 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+   Report history.
+
+   Each report generated is noted in the profile's preferences - when it
+   was made and the range it covered. "Since the last report" on the home
+   form starts the new report on the day the previous one was generated,
+   so a report made at every clinic visit picks up where the last left off.
+
+   A report with the changes section also leaves a snapshot of itself in
+   the snapshots folder, one file per account, for the next one to be
+   compared with - see tidepoolChanges.go. The snapshot holds reading
+   times but not values.
+*/
+
+//How many reports are kept in a profile's history
+const maxReportHistory = 50
+
+//Folder for the last run's snapshot of each account
+const snapshotDir = "snapshots"
+
+//A generated report
+type reportRecord struct {
+	Generated time.Time `json:"generated"`
+	Start     string    `json:"start"` //Empty when open ended
+	End       string    `json:"end"`
+	DataType  string    `json:"dataType"`
+}
+
+//Note a generated report in the profile's history, newest last
+func recordReport(profile string, rec reportRecord) {
+	if profile == "" {
+		return
+	}
+	pr := prefs.get(profile)
+	pr.Reports = append(pr.Reports, rec)
+	if len(pr.Reports) > maxReportHistory {
+		pr.Reports = pr.Reports[len(pr.Reports)-maxReportHistory:]
+	}
+	prefs.put(profile, pr)
+}
+
+//The profile's previous report - false when there isn't one
+func (pr Preferences) lastReport() (reportRecord, bool) {
+	if len(pr.Reports) == 0 {
+		return reportRecord{}, false
+	}
+	return pr.Reports[len(pr.Reports)-1], true
+}
+
+//Start the report on the day the last one was generated when the form asks.
+//With no history the form's dates are used as they are.
+func sinceLastReport(r *http.Request, opts *ReportOptions) {
+	if r.PostFormValue("sincelast") != "on" || opts.Day != "" || len(opts.Ranges) > 0 {
+		return
+	}
+	pr := prefs.get(profileFor(r))
+	last, ok := pr.lastReport()
+	if !ok {
+		log.Println("No earlier report for", profileFor(r), "- using the dates on the form")
+		return
+	}
+	opts.StartDate = pr.localTime(last.Generated).Format("2006-01-02")
+	//An end before the new start would be a bad range - leave it open instead
+	if opts.EndDate != "" && opts.EndDate < opts.StartDate {
+		opts.EndDate = ""
+	}
+}
+
+//Note a report built for the request in its profile's history,
+//keep its snapshot when it has the changes section and add its readings
+//to the profile's archive when it keeps one
+func noteReport(r *http.Request, opts ReportOptions, rep *Report) {
+	now := time.Now()
+	recordReport(profileFor(r), reportRecord{
+		Generated: now,
+		Start:     opts.StartDate,
+		End:       opts.EndDate,
+		DataType:  opts.DataType,
+	})
+	if opts.Changes {
+		saveSnapshot(profileFor(r), snapshotOf(rep, now))
+	}
+	archiveReport(profileFor(r), rep)
+}
+
+//A profile's file in a folder - named by a hash so the folder doesn't list emails
+func profileFile(dir, profile, ext string) string {
+	sum := sha256.Sum256([]byte(profile))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])+ext)
+}
+
+//The snapshot file for a profile
+func snapshotFile(profile string) string {
+	return profileFile(snapshotDir, profile, ".json")
+}
+
+//The profile's last snapshot - nil when there isn't one
+func loadSnapshot(profile string) *reportSnapshot {
+	if profile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(snapshotFile(profile))
+	if err != nil {
+		return nil
+	}
+	var snap reportSnapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		log.Println("Ignoring the snapshot for", profile, err)
+		return nil
+	}
+	return &snap
+}
+
+//Keep the profile's snapshot for the next run
+func saveSnapshot(profile string, snap reportSnapshot) {
+	if profile == "" {
+		return
+	}
+	data, err := json.Marshal(snap)
+	if err == nil {
+		if err = os.MkdirAll(snapshotDir, 0700); err == nil {
+			err = ioutil.WriteFile(snapshotFile(profile), data, 0600)
+		}
+	}
+	if err != nil {
+		log.Println("Error saving the snapshot for", profile, err)
+	}
+}
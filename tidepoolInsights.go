@@ -0,0 +1,128 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+   Insights.
+
+   Simple patterns spotted in the readings and put into a sentence each,
+   shown at the top of the report. Most people get more out of "Glucose
+   tends to rise overnight" than out of a standard deviation. Each
+   detector returns "" when its pattern isn't there, and a pattern has to
+   show up on several days before it's mentioned.
+*/
+
+//Days a pattern must show up on before it's mentioned
+const insightMinDays = 3
+
+//A pattern detector - returns a sentence or ""
+type insightDetector func(readings []Reading, u Units) string
+
+//The detectors in the order their sentences are shown
+var insightDetectors = []insightDetector{
+	overnightRise,
+	breakfastSpikes,
+	weekendHighs,
+}
+
+//Run the detectors over the readings
+func findInsights(readings []Reading, u Units) []string {
+	var insights []string
+	for _, detect := range insightDetectors {
+		if s := detect(readings, u); s != "" {
+			insights = append(insights, s)
+		}
+	}
+	return insights
+}
+
+//Readings grouped by date, keeping those with the hour in [from, to)
+func readingsByDay(readings []Reading, from int, to int) map[string][]Reading {
+	days := map[string][]Reading{}
+	for _, rd := range readings {
+		if h := rd.Time.Hour(); h >= from && h < to {
+			day := rd.Time.Format("2006-01-02")
+			days[day] = append(days[day], rd)
+		}
+	}
+	return days
+}
+
+//Mean of the readings in mg/dl
+func meanOf(readings []Reading) float64 {
+	var sum float64
+	for _, rd := range readings {
+		sum += rd.MgDL()
+	}
+	return sum / float64(len(readings))
+}
+
+//Readings climbing from around midnight to the early morning
+func overnightRise(readings []Reading, u Units) string {
+	const minRise = 30.0
+	early := readingsByDay(readings, 0, 2)
+	late := readingsByDay(readings, 5, 8)
+
+	var nights, rising int
+	var total float64
+	for day, e := range early {
+		l, ok := late[day]
+		if !ok {
+			continue
+		}
+		nights++
+		if rise := meanOf(l) - meanOf(e); rise >= minRise {
+			rising++
+			total += rise
+		}
+	}
+	if rising < insightMinDays || rising*2 < nights {
+		return ""
+	}
+	return fmt.Sprintf("Glucose tends to rise overnight - up about %s between midnight and 8am on %d of %d nights.",
+		u.withName(total/float64(rising)), rising, nights)
+}
+
+//High readings in the couple of hours after breakfast
+func breakfastSpikes(readings []Reading, u Units) string {
+	var days, spiking int
+	for _, morning := range readingsByDay(readings, 7, 10) {
+		days++
+		for _, rd := range morning {
+			if rd.MgDL() > targetHigh {
+				spiking++
+				break
+			}
+		}
+	}
+	if spiking < insightMinDays || spiking*2 < days {
+		return ""
+	}
+	return fmt.Sprintf("Readings after breakfast (7 to 10am) went above %s on %d of %d days.", u.withName(targetHigh), spiking, days)
+}
+
+//Weekends running higher than weekdays
+func weekendHighs(readings []Reading, u Units) string {
+	const minDiff = 20.0
+	var weekend, weekday []Reading
+	weekendDays := map[string]bool{}
+	for _, rd := range readings {
+		if d := rd.Time.Weekday(); d == time.Saturday || d == time.Sunday {
+			weekend = append(weekend, rd)
+			weekendDays[rd.Time.Format("2006-01-02")] = true
+		} else {
+			weekday = append(weekday, rd)
+		}
+	}
+	if len(weekendDays) < insightMinDays || len(weekday) == 0 {
+		return ""
+	}
+	we, wd := meanOf(weekend), meanOf(weekday)
+	if we-wd < minDiff {
+		return ""
+	}
+	return fmt.Sprintf("Weekends run higher than weekdays - a mean of %s against %s.", u.withName(we), u.format(wd))
+}
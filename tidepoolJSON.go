@@ -0,0 +1,103 @@
+package tidepoolreport
+
+import (
+	"time"
+)
+
+/*
+   JSON output - format=json.
+   The report contents for scripts and other programs. Readings are in
+   the report's units and say so; the statistics and AGP percentiles are
+   always mg/dl.
+*/
+
+//The json form of a report
+type reportJSON struct {
+	PatientName string            `json:"patientName"`
+	Start       string            `json:"start"`
+	End         string            `json:"end"`
+	DataType    string            `json:"dataType"`
+	Units       Units             `json:"units"` //What the readings and text are in
+	TIR         *timeInRange      `json:"timeInRange,omitempty"`
+	Metrics     []MetricValue     `json:"metrics"`
+	Statistics  *periodStatistics `json:"statistics,omitempty"`
+	AGP         *agpSummary       `json:"agp,omitempty"`
+	Targets     []targetResult    `json:"targets"`
+	Ranges      []rangeSummary    `json:"ranges,omitempty"`
+	Excluded    []string          `json:"excludedDays,omitempty"`
+	Insights    []string          `json:"insights"`
+	Streaks     []string          `json:"streaks,omitempty"`
+	Flags       []string          `json:"flags"`
+	Warnings    []string          `json:"warnings"`
+	Extras      []ReportSection   `json:"extraSections,omitempty"`
+	Changes     *changeSummary    `json:"changes,omitempty"`
+	Gaps        []gapJSON         `json:"gaps"`
+	Readings    []Reading         `json:"readings"`
+	Events      []timelineEvent   `json:"events,omitempty"`
+	Other       []Reading         `json:"otherReadings,omitempty"`
+	Basal       []basalDay        `json:"basal,omitempty"`
+	Boluses     []bolusDose       `json:"boluses,omitempty"`
+	Carbs       []carbEntry       `json:"carbs,omitempty"`
+	Recovery    *recoverySummary  `json:"recovery,omitempty"`
+	Dawn        *dawnSummary      `json:"dawn,omitempty"`
+}
+
+//A data gap
+type gapJSON struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+//The json form of the report
+func jsonReport(rep *Report) reportJSON {
+	out := reportJSON{
+		PatientName: rep.PatientName,
+		Start:       rep.Start,
+		End:         rep.End,
+		DataType:    rep.DataType,
+		Units:       rep.Units,
+		Metrics:     rep.Metrics,
+		Targets:     rep.Targets,
+		Ranges:      rep.Ranges,
+		Excluded:    rep.ExcludedDays,
+		Insights:    rep.Insights,
+		Streaks:     rep.Streaks,
+		Flags:       rep.Flags,
+		Warnings:    rep.Warnings,
+		Extras:      rep.Extras,
+		Changes:     rep.Changes,
+		Gaps:        []gapJSON{},
+		Readings:    readingsIn(rep.Readings, rep.Units),
+		Events:      rep.Events,
+		Other:       readingsIn(rep.OtherReadings, rep.Units),
+		Basal:       rep.Basal,
+		Boluses:     rep.Boluses,
+		Statistics:  rep.Statistics,
+		AGP:         rep.AGP,
+		Carbs:       rep.Carbs,
+		Recovery:    rep.Recovery,
+		Dawn:        rep.Dawn,
+	}
+	if tir, ok := rep.Stats.timeInRange(); ok {
+		out.TIR = &tir
+	}
+	for _, g := range rep.Gaps {
+		out.Gaps = append(out.Gaps, gapJSON{Start: g.start, End: g.end})
+	}
+	if out.Insights == nil {
+		out.Insights = []string{}
+	}
+	if out.Targets == nil {
+		out.Targets = []targetResult{}
+	}
+	if out.Flags == nil {
+		out.Flags = []string{}
+	}
+	if out.Warnings == nil {
+		out.Warnings = []string{}
+	}
+	if out.Readings == nil {
+		out.Readings = []Reading{}
+	}
+	return out
+}
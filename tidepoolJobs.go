@@ -0,0 +1,76 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+)
+
+/*
+   Duplicate submission protection for /opts.
+
+   Double clicking Create Report during a slow fetch sends the form twice.
+   Rather than fetching and building everything twice, a request with the
+   same session and form as one still running waits for that one to finish
+   and renders its report. The browser shows whichever response it is still
+   waiting on - usually the second as it drops the first. Only the request
+   that built the report hands it to the post processors, so each plugin
+   sees it once. The home page starts the session so even the first
+   visit's submissions carry the same one.
+*/
+
+//A report being built
+type reportJob struct {
+	done chan struct{}
+	rep  *Report
+	cfg  Config
+	key  string
+	rerr *requestError
+}
+
+//The jobs in progress by session and form
+type jobTable struct {
+	mu   sync.Mutex
+	jobs map[string]*reportJob
+}
+
+//The jobs for the web form
+var reportJobs = &jobTable{jobs: map[string]*reportJob{}}
+
+//Key for a submission - the session and a hash of the form values
+func jobKey(sess *appSession, r *http.Request) string {
+	sum := sha256.Sum256([]byte(sess.id + "\x00" + r.Form.Encode()))
+	return hex.EncodeToString(sum[:])
+}
+
+//Build the report for the submission, or wait for the same one already running.
+//owner is true for the request that built it.
+func (t *jobTable) run(key string, build func() (*Report, Config, string, *requestError)) (rep *Report, cfg Config, account string, rerr *requestError, owner bool) {
+	t.mu.Lock()
+	if job, ok := t.jobs[key]; ok {
+		t.mu.Unlock()
+		log.Println("Repeated report submission - waiting for the one in progress")
+		<-job.done
+		return job.rep, job.cfg, job.key, job.rerr, false
+	}
+	job := &reportJob{done: make(chan struct{})}
+	t.jobs[key] = job
+	t.mu.Unlock()
+
+	//Waiters get an error if the build never finishes
+	job.rerr = &requestError{status: http.StatusInternalServerError, message: "Sorry, the report could not be made."}
+	defer func() {
+		t.mu.Lock()
+		delete(t.jobs, key)
+		t.mu.Unlock()
+		close(job.done)
+	}()
+
+	job.rep, job.cfg, job.key, job.rerr = build()
+	return job.rep, job.cfg, job.key, job.rerr, true
+}
@@ -0,0 +1,97 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//A repeated submission waits for the first and shares its report, and
+//only the first owns it
+func TestJobTableShared(t *testing.T) {
+	jobs := &jobTable{jobs: map[string]*reportJob{}}
+	release := make(chan struct{})
+	builds := 0
+	build := func() (*Report, Config, string, *requestError) {
+		builds++
+		<-release
+		return &Report{Start: "2026-01-01"}, Config{}, "", nil
+	}
+
+	var wg sync.WaitGroup
+	reports := make([]*Report, 2)
+	owners := make([]bool, 2)
+	started := make(chan struct{})
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		close(started)
+		reports[0], _, _, _, owners[0] = jobs.run("key", build)
+	}()
+	<-started
+	//Wait for the first to be running before repeating it
+	for {
+		jobs.mu.Lock()
+		_, running := jobs.jobs["key"]
+		jobs.mu.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		defer wg.Done()
+		reports[1], _, _, _, owners[1] = jobs.run("key", build)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if builds != 1 {
+		t.Errorf("built %d times", builds)
+	}
+	if reports[0] != reports[1] {
+		t.Error("the repeat got a report of its own")
+	}
+	if owners[0] == owners[1] {
+		t.Errorf("owners %v - want exactly one", owners)
+	}
+	if len(jobs.jobs) != 0 {
+		t.Error("the job is still listed")
+	}
+}
+
+//A first visit's form gets a session from the home page, so submitting
+//it twice gives the same job
+func TestFirstVisitSharesJob(t *testing.T) {
+	w := httptest.NewRecorder()
+	home(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 || cookies[0].Name != sessionCookie {
+		t.Fatal("the home page didn't start a session")
+	}
+
+	form := url.Values{"demo": {"on"}, "format": {"html"}, "datatype": {"cbg"}}
+	var keys []string
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/opts", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookies[0])
+		r.ParseForm()
+		w := httptest.NewRecorder()
+		keys = append(keys, jobKey(appSessions.get(w, r), r))
+		if len(w.Result().Cookies()) != 0 {
+			t.Error("the submission started a session of its own")
+		}
+	}
+	if keys[0] != keys[1] {
+		t.Error("the two submissions have different jobs")
+	}
+}
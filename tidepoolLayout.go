@@ -0,0 +1,249 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+/*
+   Custom PDF layouts.
+
+   A clinic can describe its own PDF layout in a JSON file named by
+   "layout" in config.json instead of changing the code. Everything is
+   optional - anything left out keeps the standard layout:
+
+       {
+           "sections": ["summary", "gaps", "readings"],
+           "orientation": "landscape",
+           "tableColumns": 3,
+           "font": {"family": "Times", "size": 11},
+           "titleFont": {"family": "Helvetica", "style": "B", "size": 14},
+           "indent": 1.0,
+           "columns": [
+               {"field": "date", "title": "Date", "width": 1.5},
+               {"field": "weekday", "title": "Day", "width": 1.0},
+               {"field": "time", "title": "Time", "width": 1.2},
+               {"field": "value", "title": "mg/dl", "width": 1.3}
+           ],
+           "thresholds": {"low": 70, "high": 250, "lowColor": "#c00000", "highColor": "#d07000"}
+       }
+
+   Column fields are date, weekday, time, value, units, type and source -
+   the device, filled in with "Source Column" on the form. Readings
+   below the low or above the high threshold are printed in that color.
+   Without thresholds the config's are used - red under 70 and orange
+   over 180 mg/dl unless changed on the admin page.
+
+   Orientation is portrait or landscape. tableColumns of 2 or 3 puts that
+   many sets of the readings columns side by side, filled down the page
+   one after the other like a newspaper, which cuts the pages for a long
+   date range by that much. The columns are shrunk when they won't all
+   fit across the page. The form can change both for one report.
+*/
+
+//Layout - a PDF layout read from a layout file
+type Layout struct {
+	Sections     []string         `json:"sections"`     //Report sections in order - see tidepoolSections.go
+	Orientation  string           `json:"orientation"`  //portrait or landscape
+	Font         LayoutFont       `json:"font"`         //Body text
+	TitleFont    LayoutFont       `json:"titleFont"`    //Page titles and column headers
+	Indent       float64          `json:"indent"`       //Left edge of the readings table in inches
+	Columns      []LayoutColumn   `json:"columns"`      //Readings table columns
+	TableColumns int              `json:"tableColumns"` //Sets of the readings columns across the page, 1 - 3
+	Thresholds   LayoutThresholds `json:"thresholds"`
+}
+
+//LayoutFont - one of the core PDF fonts: Arial, Helvetica, Times or Courier.
+//Style is any of B, I and U.
+type LayoutFont struct {
+	Family string  `json:"family"`
+	Style  string  `json:"style"`
+	Size   float64 `json:"size"`
+}
+
+//LayoutColumn - a column of the readings table
+type LayoutColumn struct {
+	Field string  `json:"field"`
+	Title string  `json:"title"`
+	Width float64 `json:"width"` //Inches
+}
+
+//LayoutThresholds - readings outside low - high (mg/dl) are colored. 0 means no threshold.
+type LayoutThresholds struct {
+	Low       float64 `json:"low"`
+	High      float64 `json:"high"`
+	LowColor  string  `json:"lowColor"` //#rrggbb
+	HighColor string  `json:"highColor"`
+}
+
+//The value coloring when the config doesn't set any - the colors of the time in range bar
+var defaultThresholds = LayoutThresholds{Low: targetLow, High: targetHigh, LowColor: "#c80000", HighColor: "#e69600"}
+
+//The readings table fields
+var layoutFields = map[string]func(rd Reading, u Units) string{
+	"date":    func(rd Reading, u Units) string { return rd.Time.Format("2006-01-02") },
+	"weekday": func(rd Reading, u Units) string { return rd.Time.Format("Mon") },
+	"time":    func(rd Reading, u Units) string { return rd.Time.Format("15:04:05") },
+	"value":   func(rd Reading, u Units) string { return rd.Format(u) },
+	"units":   func(rd Reading, u Units) string { return string(u) },
+	"type":    func(rd Reading, u Units) string { return rd.Type },
+	"source":  func(rd Reading, u Units) string { return rd.Source },
+}
+
+//The column title for the units - a mg/dl in it becomes mmol/L for a mmol/L report
+func (c LayoutColumn) title(u Units) string {
+	if u != MmolL {
+		return c.Title
+	}
+	for _, mgdl := range []string{"mg/dl", "mg/dL", "MG/DL"} {
+		if strings.Contains(c.Title, mgdl) {
+			return strings.Replace(c.Title, mgdl, string(MmolL), 1)
+		}
+	}
+	return c.Title
+}
+
+//Whether the readings table has a column of the field
+func (l Layout) hasColumn(field string) bool {
+	for _, c := range l.Columns {
+		if c.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+//The most sets of readings columns across a page
+const maxTableColumns = 3
+
+//The gofpdf orientation
+func (l Layout) orientation() string {
+	if l.Orientation == "landscape" {
+		return "L"
+	}
+	return "P"
+}
+
+//The core fonts gofpdf has built in
+var coreFonts = map[string]bool{"arial": true, "helvetica": true, "times": true, "courier": true}
+
+//The standard layout
+func defaultLayout() Layout {
+	return Layout{
+		Orientation:  "portrait",
+		TableColumns: 1,
+		Font:         LayoutFont{Family: "Arial", Size: 12},
+		TitleFont:    LayoutFont{Family: "Arial", Style: "B", Size: 15},
+		Indent:       1.35,
+		Columns: []LayoutColumn{
+			{Field: "date", Title: "Date", Width: 1.7},
+			{Field: "time", Title: "Time", Width: 1.7},
+			{Field: "value", Title: "Glucose mg/dl", Width: 1.7},
+		},
+	}
+}
+
+//Load a layout file over the standard layout.
+//No file name means the standard layout. Bad settings are logged and left at the standard.
+func loadLayout(filename string) Layout {
+	layout := defaultLayout()
+	if filename == "" {
+		return layout
+	}
+
+	file, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(file, &layout)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Println("The layout file", filename, "was not found")
+		} else {
+			log.Println("Ignoring the layout file", filename, err)
+		}
+		return defaultLayout()
+	}
+	layout.check()
+	return layout
+}
+
+//Put anything unusable in a layout back to the standard setting
+func (l *Layout) check() {
+	std := defaultLayout()
+	l.Font = l.Font.check(std.Font)
+	l.TitleFont = l.TitleFont.check(std.TitleFont)
+	if l.Indent < 0 {
+		log.Println("Layout: bad indent", l.Indent)
+		l.Indent = std.Indent
+	}
+	l.Orientation = strings.ToLower(l.Orientation)
+	if l.Orientation != "portrait" && l.Orientation != "landscape" {
+		log.Println("Layout: bad orientation", l.Orientation)
+		l.Orientation = std.Orientation
+	}
+	if l.TableColumns < 1 || l.TableColumns > maxTableColumns {
+		log.Println("Layout: bad tableColumns", l.TableColumns)
+		l.TableColumns = std.TableColumns
+	}
+
+	var columns []LayoutColumn
+	for _, c := range l.Columns {
+		c.Field = strings.ToLower(c.Field)
+		if layoutFields[c.Field] == nil {
+			log.Println("Layout: ignoring unknown column field", c.Field)
+			continue
+		}
+		if c.Width <= 0 {
+			c.Width = 1.7
+		}
+		columns = append(columns, c)
+	}
+	if columns == nil {
+		columns = std.Columns
+	}
+	l.Columns = columns
+}
+
+//A usable font - unknown families and sizes fall back to the standard
+func (f LayoutFont) check(std LayoutFont) LayoutFont {
+	if f.Family == "" {
+		f.Family = std.Family
+	}
+	if !coreFonts[strings.ToLower(f.Family)] {
+		log.Println("Layout: font", f.Family, "is not a core font - using", std.Family)
+		f.Family = std.Family
+	}
+	if f.Size <= 0 {
+		f.Size = std.Size
+	}
+	f.Style = strings.ToUpper(f.Style)
+	return f
+}
+
+//The thresholds moved to a target range. Only thresholds in use are moved.
+func (t LayoutThresholds) forRange(rng TargetRange) LayoutThresholds {
+	if t.Low > 0 {
+		t.Low = rng.Low
+	}
+	if t.High > 0 {
+		t.High = rng.High
+	}
+	return t
+}
+
+//The color for a reading - black unless it's past a threshold
+func (t LayoutThresholds) color(mgdl float64) (int, int, int) {
+	switch {
+	case t.Low > 0 && mgdl < t.Low && t.LowColor != "":
+		return layoutColor(t.LowColor)
+	case t.High > 0 && mgdl > t.High && t.HighColor != "":
+		return layoutColor(t.HighColor)
+	}
+	return 0, 0, 0
+}
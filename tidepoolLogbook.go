@@ -0,0 +1,162 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+/*
+   Blank logbook - /logbook.
+
+   A printable logbook for writing readings down between downloads: a row
+   per day with a before and after column for each meal plus bedtime,
+   overnight and notes. It carries the same header, footer and watermark
+   as the reports and shows the target range at the top of each page.
+
+   Optional parameters: start (yyyy-mm-dd, default today) and days
+   (default 14, at most 92).
+*/
+
+//Logbook days when none are asked for, and the most allowed
+const (
+	logbookDays    = 14
+	logbookMaxDays = 92
+)
+
+//The logbook columns - a title over one or two write-in columns
+var logbookColumns = []struct {
+	title string
+	slots []string
+}{
+	{"Breakfast", []string{"Before", "After"}},
+	{"Lunch", []string{"Before", "After"}},
+	{"Dinner", []string{"Before", "After"}},
+	{"Bedtime", []string{""}},
+	{"Overnight", []string{""}},
+}
+
+//Create the blank logbook PDF for the days from start
+func CreateLogbookPDF(filename string, cfg Config, start time.Time, days int) error {
+	pdfMu.Lock()
+	defer pdfMu.Unlock()
+	pdf = gofpdf.New("L", "in", "letter", "")
+	pageTitle = "Glucose Logbook"
+	tableHeader = false
+
+	const left, dateW, slotW, notesW, rowH = 0.5, 1.2, 0.8, 1.8, 0.42
+	end := start.AddDate(0, 0, days-1)
+
+	defaults := defaultConfig()
+	header := pageTemplate("header", cfg.Header, defaults.Header)
+	footer := pageTemplate("footer", cfg.Footer, defaults.Footer)
+	fields := HeaderFields{PatientName: cfg.PatientName, Range: start.Format("2006-01-02") + " to " + end.Format("2006-01-02")}
+
+	//Each page gets the branding, the target range and the column titles
+	pdf.SetHeaderFunc(func() {
+		if cfg.Watermark != "" {
+			watermarkOut(cfg.Watermark, cfg.WatermarkOpacity)
+		}
+		pdf.SetY(.2)
+		pdf.SetFont("Arial", "B", 15)
+		pdf.CellFormat(0, .4, pageText(header, fields), "", 1, "C", false, 0, "")
+		pdf.SetFont("Arial", "", 10)
+		pdf.CellFormat(0, .25, fmt.Sprintf("Target range %.0f - %.0f mg/dl", targetLow, targetHigh), "", 1, "C", false, 0, "")
+		pdf.Ln(0.1)
+
+		pdf.SetFont("Arial", "B", 10)
+		pdf.SetX(left)
+		pdf.CellFormat(dateW, 0.3, "", "LTR", 0, "C", false, 0, "")
+		for _, c := range logbookColumns {
+			pdf.CellFormat(slotW*float64(len(c.slots)), 0.3, c.title, "1", 0, "C", false, 0, "")
+		}
+		pdf.CellFormat(notesW, 0.3, "", "LTR", 1, "C", false, 0, "")
+		pdf.SetFont("Arial", "", 8)
+		pdf.SetX(left)
+		pdf.CellFormat(dateW, 0.25, "Date", "LBR", 0, "C", false, 0, "")
+		for _, c := range logbookColumns {
+			for _, s := range c.slots {
+				pdf.CellFormat(slotW, 0.25, s, "1", 0, "C", false, 0, "")
+			}
+		}
+		pdf.CellFormat(notesW, 0.25, "Notes", "LBR", 1, "C", false, 0, "")
+	})
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-.5)
+		pdf.SetFont("Arial", "I", 8)
+		pdf.CellFormat(0, .4, pageText(footer, fields), "", 0, "C", false, 0, "")
+	})
+	pdf.AliasNbPages("")
+
+	//A row per day to write in
+	pdf.AddPage()
+	_, pageH := pdf.GetPageSize()
+	for d := 0; d < days; d++ {
+		if pdf.GetY()+rowH > pageH-0.7 {
+			pdf.AddPage()
+		}
+		pdf.SetFont("Arial", "", 10)
+		pdf.SetX(left)
+		pdf.CellFormat(dateW, rowH, start.AddDate(0, 0, d).Format("Mon 01-02"), "1", 0, "L", false, 0, "")
+		for _, c := range logbookColumns {
+			for range c.slots {
+				pdf.CellFormat(slotW, rowH, "", "1", 0, "C", false, 0, "")
+			}
+		}
+		pdf.CellFormat(notesW, rowH, "", "1", 1, "C", false, 0, "")
+	}
+
+	return pdf.OutputFileAndClose(filename)
+}
+
+//Logbook handler - /logbook
+func logbook(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if s := r.FormValue("start"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			DisplayMessageScreen(w, "The start date should be yyyy-mm-dd.")
+			return
+		}
+		start = t
+	}
+	days := logbookDays
+	if d := r.FormValue("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 1 || n > logbookMaxDays {
+			DisplayMessageScreen(w, fmt.Sprintf("The logbook can have 1 to %d days.", logbookMaxDays))
+			return
+		}
+		days = n
+	}
+
+	//Branding from the config and the session's preferences
+	cfg := loadConfig(configFile)
+	sess := appSessions.lookup(r)
+	if sess != nil && sess.profile != "" {
+		prefs.get(sess.profile).apply(&cfg, sess.profile)
+		if cfg.PatientName == "" {
+			cfg.PatientName = sess.profile
+		}
+	}
+
+	ws, err := NewWorkspace()
+	if err != nil {
+		DisplayMessageScreen(w, "Unable to create a work folder: "+err.Error())
+		return
+	}
+	defer ws.Close()
+	ws.session = sess
+
+	if err = CreateLogbookPDF(ws.Path("logbook.pdf"), cfg, start, days); err != nil {
+		DisplayMessageScreen(w, "Unable to make the logbook: "+err.Error())
+		return
+	}
+	ws.deliver(w, r, "logbook.pdf", "application/pdf", false)
+}
@@ -0,0 +1,269 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+   Markdown report output - format=md.
+
+   The report is a Markdown file with the summary and readings as tables
+   and a link to the trend chart. The file and the chart images are sent
+   as a ZIP so the links work once unpacked into a wiki or Obsidian vault.
+*/
+
+//The Markdown and Word layout when no sections are configured
+var documentSections = []string{sectionTIR, sectionRanges, sectionChanges, sectionInsights, sectionStreaks, sectionSummary, sectionTargets, sectionFlags, sectionGaps, sectionChart, sectionHistogram, sectionDaily, sectionReadings, sectionOtherReadings, sectionBoluses, sectionCarbs, sectionRecovery, sectionDawn, sectionBasal}
+
+//Build the Markdown report. Returns the Markdown text and the chart images by file name.
+func markdownReport(rep *Report) (string, map[string][]byte) {
+	var b strings.Builder
+	images := map[string][]byte{}
+
+	b.WriteString("# Glucose Report\n\n")
+	fmt.Fprintf(&b, "Period: %s\n\n", rep.Range())
+
+	if len(rep.Warnings) > 0 {
+		b.WriteString("> **Notes about this report**\n>\n")
+		for _, s := range rep.Warnings {
+			fmt.Fprintf(&b, "> - %s\n", s)
+		}
+		b.WriteString("\n")
+	}
+
+	for _, section := range rep.sectionsOr(documentSections) {
+		switch section {
+		case sectionSummary:
+			b.WriteString("## Summary\n\n")
+			b.WriteString("| Metric | Value |\n|---|---|\n")
+			for _, m := range rep.Metrics {
+				fmt.Fprintf(&b, "| %s | %s |\n", m.Name, m.Value)
+			}
+			b.WriteString("\n")
+
+		case sectionTIR:
+			if tir, ok := rep.Stats.timeInRange(); ok {
+				fmt.Fprintf(&b, "## %s\n\n%s\n\n", tir.Headline(), tir.Breakdown())
+			}
+
+		case sectionAGP:
+			if chart, ok := rep.Charts["agp.png"]; ok && rep.AGP != nil {
+				images["agp.png"] = chart
+				b.WriteString("## Ambulatory glucose profile\n\n| Statistic | Value |\n|---|---|\n")
+				for _, row := range rep.AGP.Stats {
+					fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+				}
+				b.WriteString("\n![The modal day](agp.png)\n\n")
+			}
+
+		case sectionStats:
+			if rep.Statistics != nil {
+				b.WriteString("## Statistics\n\n| Statistic | Value |\n|---|---|\n")
+				for _, row := range rep.Statistics.rows() {
+					fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionTargets:
+			if len(rep.Targets) > 0 {
+				b.WriteString("## Clinical targets\n\n")
+				b.WriteString("| Goal | Target | Value | |\n|---|---|---|---|\n")
+				for _, t := range rep.Targets {
+					fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", t.Name, t.Goal, t.Value, t.Status())
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionChanges:
+			if rep.Changes != nil {
+				b.WriteString("## What's new\n\n")
+				for _, line := range rep.Changes.lines() {
+					fmt.Fprintf(&b, "- %s\n", line)
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionInsights:
+			if len(rep.Insights) > 0 {
+				b.WriteString("## Insights\n\n")
+				for _, s := range rep.Insights {
+					fmt.Fprintf(&b, "- %s\n", s)
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionRanges:
+			if len(rep.Ranges) > 0 {
+				b.WriteString("## Date ranges\n\n")
+				for _, s := range rangeLines(rep.Ranges) {
+					fmt.Fprintf(&b, "- %s\n", s)
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionStreaks:
+			if len(rep.Streaks) > 0 {
+				b.WriteString("## Streaks\n\n")
+				for _, s := range rep.Streaks {
+					fmt.Fprintf(&b, "- %s\n", s)
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionFlags:
+			if len(rep.Flags) > 0 {
+				b.WriteString("## Flags\n\n")
+				for _, f := range rep.Flags {
+					fmt.Fprintf(&b, "- %s\n", f)
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionGaps:
+			if len(rep.Gaps) > 0 {
+				b.WriteString("## Data gaps\n\n")
+				for _, g := range rep.Gaps {
+					fmt.Fprintf(&b, "- %s to %s (%s)\n", g.start.Format("2006-01-02 15:04"),
+						g.end.Format("2006-01-02 15:04"), formatDuration(g.end.Sub(g.start)))
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionChart:
+			if chart, ok := rep.Charts["glucose.png"]; ok {
+				images["glucose.png"] = chart
+				b.WriteString("## Trend\n\n![Glucose readings](glucose.png)\n\n")
+			}
+
+		case sectionHistogram:
+			if chart, ok := rep.Charts["histogram.png"]; ok {
+				images["histogram.png"] = chart
+				b.WriteString("## Glucose histogram\n\n![How the readings are spread](histogram.png)\n\n")
+			}
+
+		case sectionDaily:
+			if _, ok := rep.Charts["daily.png"]; ok {
+				b.WriteString("## Daily profiles\n\n")
+				for k := dailyChartsMax - 1; k >= 0; k-- {
+					if chart, ok := rep.Charts[dailyChartName(k)]; ok {
+						images[dailyChartName(k)] = chart
+						fmt.Fprintf(&b, "![14 days of glucose](%s)\n\n", dailyChartName(k))
+					}
+				}
+			}
+
+		case sectionReadings:
+			b.WriteString("## Readings\n\n")
+			table, note := rep.tableReadings()
+			if note != "" {
+				b.WriteString(note + "\n\n")
+			}
+			mdReadings(&b, table, rep)
+			b.WriteString("\n")
+
+		case sectionOtherReadings:
+			if len(rep.OtherReadings) > 0 {
+				fmt.Fprintf(&b, "## %s\n\n", readingsTitle(rep.OtherType))
+				table, note := rep.otherTableReadings()
+				if note != "" {
+					b.WriteString(note + "\n\n")
+				}
+				mdReadings(&b, table, rep)
+				b.WriteString("\n")
+			}
+
+		case sectionBoluses:
+			if len(rep.Boluses) > 0 {
+				b.WriteString("## Insulin boluses\n\n")
+				b.WriteString(bolusTotals(rep.Boluses, rep.Start, rep.End) + "\n\n")
+				b.WriteString("| Time | Normal U | Extended U | Duration | Kind |\n|---|---|---|---|---|\n")
+				for _, row := range bolusRows(rep.Boluses) {
+					fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionCarbs:
+			if len(rep.Carbs) > 0 {
+				b.WriteString("## Carbs\n\n")
+				b.WriteString(carbTotals(rep.Carbs, rep.Start, rep.End) + " - with the nearest reading and the insulin given within 15 minutes\n\n")
+				fmt.Fprintf(&b, "| Time | Carbs g | Glucose %s | Bolus U | From |\n|---|---|---|---|---|\n", rep.Units.name())
+				for _, row := range carbRows(rep.Carbs, rep.Units) {
+					fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+				}
+				b.WriteString("\n")
+			}
+
+		case sectionRecovery:
+			if rep.Recovery != nil {
+				b.WriteString("## Hypo recovery\n\n")
+				for _, line := range rep.Recovery.lines(rep.Units) {
+					fmt.Fprintf(&b, "- %s\n", line)
+				}
+				b.WriteString("\n")
+				if len(rep.Recovery.Lows) > 0 {
+					header := recoveryHeader(rep.Units)
+					fmt.Fprintf(&b, "| %s |\n|%s\n", strings.Join(header, " | "), strings.Repeat("---|", len(header)))
+					for _, row := range rep.Recovery.rows(rep.Units) {
+						fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+					}
+					b.WriteString("\n")
+				}
+			}
+
+		case sectionDawn:
+			if rep.Dawn != nil {
+				b.WriteString("## Dawn phenomenon\n\n")
+				for _, line := range rep.Dawn.lines(rep.Units) {
+					fmt.Fprintf(&b, "- %s\n", line)
+				}
+				b.WriteString("\n")
+				if chart, ok := rep.Charts["dawn.png"]; ok {
+					images["dawn.png"] = chart
+					b.WriteString("![Glucose from 3am to 8am](dawn.png)\n\n")
+				}
+				if len(rep.Dawn.Nights) > 0 {
+					header := dawnHeader(rep.Units)
+					fmt.Fprintf(&b, "| %s |\n|%s\n", strings.Join(header, " | "), strings.Repeat("---|", len(header)))
+					for _, row := range rep.Dawn.rows(rep.Units) {
+						fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+					}
+					b.WriteString("\n")
+				}
+			}
+
+		case sectionBasal:
+			if len(rep.Basal) > 0 {
+				b.WriteString("## Basal insulin\n\n")
+				b.WriteString(basalTotals(rep.Basal) + "\n\n")
+				b.WriteString("| Date | Basal U | Temp basals | Suspended |\n|---|---|---|---|\n")
+				for _, row := range basalRows(rep.Basal) {
+					fmt.Fprintf(&b, "| %s |\n", strings.Join(row, " | "))
+				}
+				b.WriteString("\n")
+			}
+
+		default:
+			if s, ok := rep.extra(section); ok && len(s.Lines) > 0 {
+				fmt.Fprintf(&b, "## %s\n\n", s.Title)
+				for _, line := range s.Lines {
+					fmt.Fprintf(&b, "- %s\n", line)
+				}
+				b.WriteString("\n")
+			}
+		}
+	}
+
+	return b.String(), images
+}
+
+//A readings table
+func mdReadings(b *strings.Builder, readings []Reading, rep *Report) {
+	header := readingsHeader(rep.Units, rep.Sources)
+	fmt.Fprintf(b, "| %s |\n|%s\n", strings.Join(header, " | "), strings.Repeat("---|", len(header)))
+	for _, s := range smbgRows(readings, rep.Units) {
+		fmt.Fprintf(b, "| %s |\n", strings.Join(s.cells(rep.Sources), " | "))
+	}
+}
@@ -0,0 +1,187 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+   Pluggable summary metrics.
+
+   Each line of the summary table is a Metric. The built in ones are
+   registered below; more (TIR variants, a clinic's own KPIs) can be added
+   with RegisterMetric from another file without touching the report
+   builder. Any metric can be turned on or off by name in config.json:
+
+       "metrics": {"Hypos": false, "Time in tight range": true}
+*/
+
+//Metric - one summary value computed from the readings
+type Metric interface {
+	//Name shown in the summary and used to turn it on or off in the config
+	Name() string
+
+	//The value for the readings (mg/dL, in time order) formatted for display.
+	//Return "" when the metric doesn't apply - it is left out of the report.
+	Compute(readings []Reading) string
+}
+
+//PeriodMetric - a Metric that needs the report period as well, e.g. to
+//count days with no readings at all. ComputePeriod is used in place of
+//Compute when the period is known.
+type PeriodMetric interface {
+	Metric
+	ComputePeriod(readings []Reading, start time.Time, end time.Time) string
+}
+
+//MetricValue - a computed metric as shown in the report
+type MetricValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+//A registered metric and whether it's on when the config doesn't say
+type registeredMetric struct {
+	metric  Metric
+	enabled bool
+}
+
+//The metric registry - in report order
+var metricRegistry struct {
+	mu      sync.Mutex
+	metrics []registeredMetric
+}
+
+//RegisterMetric - add a metric to the end of the summary.
+//A metric registered as not enabled only shows when the config turns it on.
+func RegisterMetric(m Metric, enabled bool) {
+	metricRegistry.mu.Lock()
+	defer metricRegistry.mu.Unlock()
+	metricRegistry.metrics = append(metricRegistry.metrics, registeredMetric{m, enabled})
+}
+
+//A built in metric that follows the report's target range
+type rangeMetric interface {
+	computeIn(readings []Reading, rng TargetRange, units Units) string
+}
+
+//Compute the metrics that are turned on for the period - yyyy-mm-dd dates
+func computeMetrics(readings []Reading, sdate string, edate string, rng TargetRange, units Units, settings map[string]bool) []MetricValue {
+	start, serr := time.Parse("2006-01-02", sdate)
+	end, eerr := time.Parse("2006-01-02", edate)
+
+	metricRegistry.mu.Lock()
+	registered := append([]registeredMetric(nil), metricRegistry.metrics...)
+	metricRegistry.mu.Unlock()
+
+	var values []MetricValue
+	for _, rm := range registered {
+		on, ok := settings[rm.metric.Name()]
+		if !ok {
+			on = rm.enabled
+		}
+		if !on {
+			continue
+		}
+		var v string
+		if pm, ok := rm.metric.(PeriodMetric); ok && serr == nil && eerr == nil {
+			v = pm.ComputePeriod(readings, start, end)
+		} else if rgm, ok := rm.metric.(rangeMetric); ok {
+			v = rgm.computeIn(readings, rng, units)
+		} else {
+			v = rm.metric.Compute(readings)
+		}
+		if v != "" {
+			values = append(values, MetricValue{Name: rm.metric.Name(), Value: v})
+		}
+	}
+	return values
+}
+
+//The settings with every PeriodMetric turned off - for reports that aren't one period
+func withoutPeriodMetrics(settings map[string]bool) map[string]bool {
+	metricRegistry.mu.Lock()
+	defer metricRegistry.mu.Unlock()
+	off := make(map[string]bool, len(settings))
+	for name, on := range settings {
+		off[name] = on
+	}
+	for _, rm := range metricRegistry.metrics {
+		if _, ok := rm.metric.(PeriodMetric); ok {
+			off[rm.metric.Name()] = false
+		}
+	}
+	return off
+}
+
+//A metric from a name and a function
+type metricFunc struct {
+	name    string
+	compute func(readings []Reading) string
+}
+
+func (m metricFunc) Name() string                      { return m.name }
+func (m metricFunc) Compute(readings []Reading) string { return m.compute(readings) }
+
+//A metric built from the standard statistics - left out when there are no readings
+type statMetricFunc struct {
+	name   string
+	format func(st glucoseStats) string
+}
+
+func (m statMetricFunc) Name() string { return m.name }
+func (m statMetricFunc) Compute(readings []Reading) string {
+	return m.computeIn(readings, defaultTargetRange, MgDL)
+}
+
+func (m statMetricFunc) computeIn(readings []Reading, rng TargetRange, units Units) string {
+	if len(readings) == 0 {
+		return ""
+	}
+	st := computeStatsIn(readings, rng)
+	st.units = units
+	return m.format(st)
+}
+
+//A metric from the standard statistics
+func statMetric(name string, format func(st glucoseStats) string) Metric {
+	return statMetricFunc{name, format}
+}
+
+//The built in metrics
+func init() {
+	RegisterMetric(metricFunc{"Readings", func(readings []Reading) string {
+		return fmt.Sprintf("%d", len(readings))
+	}}, true)
+	RegisterMetric(statMetric("Mean glucose", func(st glucoseStats) string {
+		return st.units.withName(st.mean)
+	}), true)
+	RegisterMetric(statMetric("GMI", func(st glucoseStats) string {
+		return fmt.Sprintf("%.1f%%", st.gmi)
+	}), true)
+	RegisterMetric(statMetric("Estimated A1c", func(st glucoseStats) string {
+		return fmt.Sprintf("%.1f%%", st.ea1c)
+	}), true)
+	RegisterMetric(statMetric("Time in range", func(st glucoseStats) string {
+		return fmt.Sprintf("%.0f%% (%s-%s)", st.inRange, st.units.format(st.rng.Low), st.units.withName(st.rng.High))
+	}), true)
+	RegisterMetric(statMetric("Below range", func(st glucoseStats) string {
+		return fmt.Sprintf("%.0f%%", st.below)
+	}), true)
+	RegisterMetric(statMetric("Above range", func(st glucoseStats) string {
+		return fmt.Sprintf("%.0f%%", st.above)
+	}), true)
+	RegisterMetric(statMetric("Hypos", func(st glucoseStats) string {
+		return fmt.Sprintf("%d", st.hypos)
+	}), true)
+	//CGM reports only
+	RegisterMetric(metricFunc{"GRI", func(readings []Reading) string {
+		g, ok := glycemiaRiskIndex(readings)
+		if !ok {
+			return ""
+		}
+		return fmt.Sprintf("%.0f (zone %s)", g.gri, g.zone())
+	}}, true)
+	RegisterMetric(cgmActiveMetric{}, true)
+}
@@ -0,0 +1,606 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+   The report model.
+
+   A Report holds everything the renderers need: who and what period it is
+   for, the readings, the computed statistics and the optional sections.
+   BuildReport runs the builder pipeline over the downloaded Tidepool data
+   to fill one in, and every output format (PDF, text, Markdown, Word)
+   renders from it.
+*/
+
+//ReportOptions - what the user asked for
+type ReportOptions struct {
+	PatientName  string
+	DataType     string //Glucose type for the readings - smbg or cbg
+	OtherType    string //The other glucose type when both were picked - see tidepoolTypes.go
+	StartDate    string //yyyy-mm-dd, either date may be empty
+	EndDate      string
+	GapThreshold time.Duration
+
+	//yyyy-mm-dd for a single day deep dive - see tidepoolDay.go
+	Day string
+
+	//Several date ranges summarized together - see tidepoolRanges.go.
+	//StartDate and EndDate are the first start and the last end.
+	Ranges []DateRange
+
+	//yyyy-mm-dd days left out of the statistics, and whether the tables
+	//and charts still show them - see tidepoolExclude.go
+	ExcludeDays  []string
+	ShowExcluded bool
+
+	//Name the device each reading came from in the tables - see tidepoolSources.go
+	Sources bool
+
+	//Optional sections
+	Suspends  bool
+	Accuracy  bool
+	Sessions  bool
+	Changes   bool
+	Boluses   bool
+	Streaks   bool
+	Carbs     bool
+	Basal     bool
+	Recovery  bool //How each low ended - see tidepoolRecovery.go
+	Dawn      bool //The rise before waking - see tidepoolDawn.go
+	Daily     bool //Daily charts for the whole period
+	Histogram bool
+
+	//The last run to compare with for the changes section - nil for none
+	Previous *reportSnapshot
+
+	//Summary metrics turned on or off by name - see RegisterMetric
+	Metrics map[string]bool
+
+	//The sections in order. nil for each output's usual layout.
+	Sections []string
+
+	//Flag rules for the flags section
+	Rules []Rule
+
+	//Target range - the default when not set - and the goals
+	//for the targets section. See tidepoolPresets.go.
+	Target TargetRange
+	Goals  ClinicalGoals
+
+	//Word the report for a parent or caregiver
+	Caregiver bool
+
+	//Chart colors, axis and grid
+	Chart ChartTheme
+
+	//Fail on records that don't match instead of skipping them - see tidepoolDecode.go
+	Strict bool
+
+	//Replace the name and ids so the report can be shared - see tidepoolAnonymize.go
+	Anonymize bool
+
+	//Every CGM reading in the readings tables rather than hourly averages - see tidepoolCGM.go
+	FullCGMTable bool
+
+	//Count control solution tests in the statistics - see tidepoolControl.go
+	KeepControl bool
+
+	//Move readings from uploads with a wrong device clock, and from devices
+	//by a set amount - see tidepoolClock.go
+	FixClocks   bool
+	ClockShifts map[string]time.Duration
+
+	//The units glucose is shown in - mg/dL when not set. See tidepoolReading.go.
+	Units Units
+}
+
+//Report - the report contents
+type Report struct {
+	PatientName string
+	Start       string //The period covered - yyyy-mm-dd
+	End         string
+	DataType    string
+
+	//The sections to show in order - nil for each output's usual layout
+	Sections []string
+
+	//The readings of the requested type in time order
+	Readings []Reading
+
+	//The other glucose type's readings when both were asked for
+	OtherType     string
+	OtherReadings []Reading
+
+	//The days left out of the statistics and their readings - shown in
+	//gray in the tables and charts with ShowExcluded. See tidepoolExclude.go.
+	ExcludedDays  []string
+	Excluded      []Reading
+	excludedOther []Reading
+	ShowExcluded  bool
+
+	//The readings are labeled with their devices - see tidepoolSources.go
+	Sources bool
+
+	//Every CGM reading in the readings tables - see tidepoolCGM.go
+	FullCGMTable bool
+
+	//A day report's events in time order
+	Events []timelineEvent
+
+	//The target range the statistics and colors are for
+	Target TargetRange
+
+	//The units glucose is shown in - always mg/dL or mmol/L
+	Units Units
+
+	//Worded for a parent or caregiver
+	Caregiver bool
+
+	//Computed statistics and the summary metrics
+	Stats glucoseStats
+	//The statistics page - nil when not asked for
+	Statistics *periodStatistics
+	Metrics    []MetricValue
+
+	//The period against the clinical goals
+	Targets []targetResult
+
+	//Each date range's summary - see tidepoolRanges.go
+	Ranges []rangeSummary
+
+	//Patterns in plain language, e.g. "Glucose tends to rise overnight..."
+	Insights []string
+
+	//Streaks and personal bests - see tidepoolStreaks.go
+	Streaks []string
+
+	//The lows and how they ended - see tidepoolRecovery.go
+	Recovery *recoverySummary
+
+	//Each night's rise from 3am to 8am - see tidepoolDawn.go
+	Dawn *dawnSummary
+
+	//What the flag rules found, e.g. "3 nights with lows"
+	Flags []string
+
+	//Problems with the data that didn't stop the report - see tidepoolWarnings.go
+	Warnings []string
+
+	//Sections added by a SectionProvider - see tidepoolPlugins.go
+	Extras []ReportSection
+
+	//Events in the period
+	Gaps     []dataGap
+	Suspends []suspendDay
+	Boluses  []bolusDose
+	Carbs    []carbEntry
+	Basal    []basalDay
+
+	//Optional summaries - nil when not requested
+	Accuracy *accuracySummary
+	Sessions *sessionSummary
+	Changes  *changeSummary
+
+	//The Glycemia Risk Index - nil without CGM readings
+	GRI *glycemiaRisk
+	AGP *agpSummary
+
+	//Rendered chart images by file name
+	Charts map[string][]byte
+}
+
+//The period as shown in headers
+func (rep *Report) Range() string {
+	return rep.Start + " to " + rep.End
+}
+
+//Whether the report has any of the optional sections
+func (rep *Report) hasSections() bool {
+	return len(rep.Suspends) > 0 || len(rep.Boluses) > 0 || len(rep.Carbs) > 0 || len(rep.Basal) > 0 || len(rep.OtherReadings) > 0 || rep.Accuracy != nil || rep.Sessions != nil
+}
+
+//The period covered by the report.
+//Use the first and last readings when the user left the dates open.
+func reportPeriod(points []Reading, sdate string, edate string) (string, string) {
+	if sdate == "" && len(points) > 0 {
+		sdate = points[0].Time.Format("2006-01-02")
+	}
+	if edate == "" && len(points) > 0 {
+		edate = points[len(points)-1].Time.Format("2006-01-02")
+	}
+	return sdate, edate
+}
+
+//Check the dates - yyyy-mm-dd when given and the end not before the start
+func (opts ReportOptions) validate() error {
+	var start, end time.Time
+	var err error
+	if opts.StartDate != "" {
+		if start, err = time.Parse("2006-01-02", opts.StartDate); err != nil {
+			return fmt.Errorf("%w: the start date %q isn't yyyy-mm-dd", ErrBadDateRange, opts.StartDate)
+		}
+	}
+	if opts.EndDate != "" {
+		if end, err = time.Parse("2006-01-02", opts.EndDate); err != nil {
+			return fmt.Errorf("%w: the end date %q isn't yyyy-mm-dd", ErrBadDateRange, opts.EndDate)
+		}
+	}
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return fmt.Errorf("%w: the end date is before the start date", ErrBadDateRange)
+	}
+	for _, dr := range opts.Ranges {
+		if err = dr.validate(); err != nil {
+			return err
+		}
+	}
+	if len(opts.Ranges) > 0 && opts.Day != "" {
+		return fmt.Errorf("%w: a day report can't have date ranges too", ErrBadDateRange)
+	}
+	if err = validateExcludeDays(opts.ExcludeDays); err != nil {
+		return err
+	}
+	if len(opts.ExcludeDays) > 0 && opts.Day != "" {
+		return fmt.Errorf("%w: a day report can't exclude days", ErrBadDateRange)
+	}
+	return nil
+}
+
+//The Tidepool data types to fetch for the options
+func (opts ReportOptions) dataTypes() string {
+	//Each type once, in the order first needed
+	var datatypes []string
+	seen := map[string]bool{}
+	add := func(types string) {
+		for _, t := range strings.Split(types, ",") {
+			if t != "" && !seen[t] {
+				seen[t] = true
+				datatypes = append(datatypes, t)
+			}
+		}
+	}
+
+	add(opts.DataType)
+	add(opts.OtherType)
+	//Pump suspends come from the basal and deviceEvent records
+	if opts.Suspends {
+		add("basal,deviceEvent")
+	}
+	//The meter vs CGM comparison needs both kinds of glucose readings
+	if opts.Accuracy {
+		add("smbg,cbg")
+	}
+	if opts.Sessions {
+		add("cbg")
+	}
+	if opts.Boluses {
+		add("bolus")
+	}
+	if opts.Basal {
+		add("basal")
+	}
+	//Carbs with the insulin given for them
+	if opts.Carbs {
+		add("wizard,food,bolus")
+	}
+	//The device names for the source column
+	if opts.Sources {
+		add("upload")
+	}
+	if opts.Day != "" && opts.wants(sectionTimeline) {
+		add(timelineTypes)
+	}
+	return strings.Join(datatypes, ",")
+}
+
+//State passed along the builder pipeline
+type reportBuilder struct {
+	opts    ReportOptions
+	data    []byte //The Tidepool records as sent, for the timeline
+	notes   []byte //Tidepool notes for the timeline - nil for none
+	records tpMeasurement
+	report  *Report
+
+	//Glucose readings by type when the data came in chunks - see tidepoolStream.go
+	glucose map[string][]Reading
+
+	//Problems found in the data for the notes
+	issues dataIssues
+
+	//The uploads with a wrong device clock to correct - see tidepoolClock.go
+	drifts map[uploadKey]time.Duration
+}
+
+//A step in the builder pipeline
+type reportStep func(b *reportBuilder)
+
+//The builder pipeline - run in order
+var reportPipeline = []reportStep{
+	readingsStep,
+	otherReadingsStep,
+	sourcesStep,
+	excludeStep,
+	rangesStep,
+	warningsStep,
+	statsStep,
+	agpStep,
+	targetsStep,
+	insightsStep,
+	streaksStep,
+	recoveryStep,
+	dawnStep,
+	flagsStep,
+	gapsStep,
+	suspendsStep,
+	bolusStep,
+	carbsStep,
+	basalStep,
+	accuracyStep,
+	sessionsStep,
+	timelineStep,
+	changesStep,
+	extrasStep,
+	anonymizeStep,
+	chartsStep,
+}
+
+//BuildReportFromData - build the report from Tidepool records already in
+//memory, e.g. in a browser. notes is the Tidepool notes for a day report's
+//timeline - nil for none. The errors are as for BuildReport.
+func BuildReportFromData(data []byte, notes []byte, opts ReportOptions) (*Report, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	records, skipped, err := decodeRecords(data, opts.Strict)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newReportBuilder(opts)
+	b.data = data
+	b.notes = notes
+	b.records = records
+	b.issues.skipped = skipped
+	b.issues.check(records, opts.DataType)
+	return b.build()
+}
+
+//A builder with an empty report
+func newReportBuilder(opts ReportOptions) *reportBuilder {
+	return &reportBuilder{
+		opts: opts,
+		report: &Report{
+			PatientName: opts.PatientName,
+			DataType:    opts.DataType,
+			Target:      opts.Target.orDefault(),
+			Units:       unitsFrom(string(opts.Units)),
+			Caregiver:   opts.Caregiver,
+			Sections:    opts.Sections,
+
+			FullCGMTable: opts.FullCGMTable,
+			ShowExcluded: opts.ShowExcluded,
+			Charts:       map[string][]byte{},
+		},
+	}
+}
+
+//Run the pipeline. Nothing to show is ErrNoData.
+func (b *reportBuilder) build() (*Report, error) {
+	for _, step := range reportPipeline {
+		step(b)
+	}
+	rep := b.report
+	if len(rep.Readings) == 0 && len(rep.Events) == 0 && len(rep.OtherReadings) == 0 && len(rep.Boluses) == 0 && len(rep.Basal) == 0 {
+		if b.opts.StartDate != "" && b.opts.EndDate != "" {
+			return nil, fmt.Errorf("%w - %s", ErrNoData, b.report.Range())
+		}
+		return nil, ErrNoData
+	}
+	return rep, nil
+}
+
+//The readings of a glucose type
+func (b *reportBuilder) readings(datatype string) []Reading {
+	rds, ok := b.glucose[datatype]
+	if !ok {
+		rds = readingsFrom(b.records, datatype)
+	}
+	if b.opts.FixClocks && b.drifts == nil {
+		b.drifts = b.issues.clockDrifts(b.opts.ClockShifts)
+	}
+	rds = correctClocks(rds, b.drifts, b.opts.ClockShifts)
+	if b.opts.KeepControl {
+		return rds
+	}
+	return withoutControl(rds)
+}
+
+//The readings of the requested glucose type
+func readingsStep(b *reportBuilder) {
+	b.report.Readings = filterReadings(b.readings(b.opts.DataType), b.opts)
+	if b.opts.Day != "" {
+		//Just the day - the fetch took in the days either side
+		b.report.Readings = readingsOnDay(b.report.Readings, b.opts.Day)
+	}
+	b.report.Start, b.report.End = reportPeriod(b.report.Readings, b.opts.StartDate, b.opts.EndDate)
+}
+
+//Summary statistics
+func statsStep(b *reportBuilder) {
+	b.report.Stats = computeStatsIn(b.report.Readings, b.report.Target)
+	b.report.Stats.units = b.report.Units
+	if b.opts.wants(sectionStats) {
+		b.report.Statistics = periodStatisticsFor(b.report.Readings)
+		if b.report.Statistics != nil {
+			b.report.Statistics.units = b.report.Units
+		}
+	}
+	if b.opts.wants(sectionSummary) {
+		//Metrics over a whole period don't fit several ranges - the ranges section has those.
+		//Nor a period with days left out.
+		settings := b.opts.Metrics
+		if len(b.opts.Ranges) > 0 || len(b.opts.ExcludeDays) > 0 {
+			settings = withoutPeriodMetrics(settings)
+		}
+		b.report.Metrics = computeMetrics(b.report.Readings, b.report.Start, b.report.End, b.report.Target, b.report.Units, settings)
+	}
+}
+
+//The period against the clinical goals
+func targetsStep(b *reportBuilder) {
+	if b.opts.wants(sectionTargets) {
+		b.report.Targets = checkTargets(b.report.Stats, b.opts.Goals)
+	}
+}
+
+//Patterns spotted in the readings
+func insightsStep(b *reportBuilder) {
+	if b.opts.wants(sectionInsights) {
+		b.report.Insights = findInsights(b.report.Readings, b.report.Units)
+		if b.opts.Caregiver {
+			b.report.Insights = forCaregiver(b.report.Insights)
+		}
+	}
+}
+
+//Streaks and personal bests when asked for
+func streaksStep(b *reportBuilder) {
+	if b.opts.Streaks {
+		b.report.Streaks = findStreaks(b.report.Readings, b.report.Target, b.opts.Goals)
+	}
+}
+
+//What the flag rules found
+func flagsStep(b *reportBuilder) {
+	if b.opts.wants(sectionFlags) {
+		b.report.Flags = evalRules(b.opts.Rules, "flag", b.report.Readings)
+	}
+}
+
+//Periods with no readings
+func gapsStep(b *reportBuilder) {
+	if !b.opts.wants(sectionGaps) {
+		return
+	}
+	if len(b.opts.Ranges) > 0 || len(b.report.ExcludedDays) > 0 {
+		//Inside each range - the time between them isn't missing data,
+		//and neither are the excluded days
+		spans := b.opts.Ranges
+		if len(spans) == 0 {
+			spans = []DateRange{{Start: b.report.Start, End: b.report.End}}
+		}
+		days := make(map[string]bool, len(b.report.ExcludedDays))
+		for _, day := range b.report.ExcludedDays {
+			days[day] = true
+		}
+		for _, dr := range withoutDays(spans, days) {
+			in := readingsInRanges(b.report.Readings, []DateRange{dr})
+			b.report.Gaps = append(b.report.Gaps, findDataGaps(in, dr.Start, dr.End, b.opts.GapThreshold)...)
+		}
+		return
+	}
+	b.report.Gaps = findDataGaps(b.report.Readings, b.opts.StartDate, b.opts.EndDate, b.opts.GapThreshold)
+}
+
+//Pump suspend periods broken out by day
+func suspendsStep(b *reportBuilder) {
+	if b.opts.Suspends {
+		b.report.Suspends = suspendDays(suspendPeriodsFrom(b.records))
+	}
+}
+
+//Meter readings paired with the nearest CGM value
+func accuracyStep(b *reportBuilder) {
+	if b.opts.Accuracy {
+		b.report.Accuracy = compareMeterToCGM(b.readings("smbg"), b.readings("cbg"), pairingWindow)
+	}
+}
+
+//CGM sensor sessions
+func sessionsStep(b *reportBuilder) {
+	if b.opts.Sessions {
+		b.report.Sessions = detectSensorSessions(b.readings("cbg"))
+	}
+}
+
+//A day report's events
+func timelineStep(b *reportBuilder) {
+	if b.opts.Day != "" && b.opts.wants(sectionTimeline) {
+		b.report.Events = timelineFrom(b.data, b.notes, b.opts.Day)
+	}
+}
+
+//The trend chart, daily thumbnails, day chart, dawn chart and the GRI grid.
+//Charts drawn before from the same data come from the chart cache.
+func chartsStep(b *reportBuilder) {
+	rep := b.report
+	if len(rep.Readings) == 0 && len(rep.Events) == 0 && len(rep.Excluded) == 0 {
+		return
+	}
+	pal := b.opts.Chart.palette().withRange(rep.Target).withUnits(rep.Units)
+
+	//Get a chart from the cache or draw it
+	add := func(name string, what string, key string, draw func() ([]byte, error)) {
+		chart, err := charts.get(key, draw)
+		if err != nil {
+			log.Println("Error drawing the "+what, err)
+			return
+		}
+		rep.Charts[name] = chart
+	}
+
+	//The trend and daily charts show the excluded days in gray when asked to
+	shown := rep.shown(rep.Readings, rep.Excluded)
+	if b.opts.wants(sectionChart) {
+		add("glucose.png", "trend chart", chartKey("trend", pal, shown, trendChartW, trendChartH), func() ([]byte, error) {
+			return glucoseTrendChart(shown, pal, trendChartW, trendChartH)
+		})
+	}
+	//Only when asked for - no output shows it by default. The last 14 days,
+	//and with the daily charts every 14 days before back to the start.
+	if b.opts.Daily || b.opts.Sections != nil && b.opts.wants(sectionDaily) {
+		first, _ := time.Parse("2006-01-02", rep.Start)
+		end, _ := time.Parse("2006-01-02", rep.End)
+		for k := 0; k < dailyChartsMax; k++ {
+			lastDay := end.AddDate(0, 0, -k*dailyDays)
+			if k > 0 && (!b.opts.Daily || lastDay.Before(first)) {
+				break
+			}
+			add(dailyChartName(k), "daily thumbnails", chartKey("daily", pal, shown, lastDay, dailyChartW, dailyChartH), func() ([]byte, error) {
+				return dailyThumbnailsChart(shown, lastDay, pal, dailyChartW, dailyChartH)
+			})
+		}
+	}
+	if b.opts.Histogram && len(rep.Readings) > 0 {
+		width := b.opts.Chart.bucketWidth()
+		add("histogram.png", "histogram", chartKey("histogram", pal, rep.Readings, width, histogramChartW, histogramChartH), func() ([]byte, error) {
+			return histogramChart(rep.Readings, pal, width, histogramChartW, histogramChartH)
+		})
+	}
+	if b.opts.Day != "" && b.opts.wants(sectionTimeline) {
+		day, _ := time.Parse("2006-01-02", b.opts.Day)
+		add("day.png", "day chart", chartKey("day", pal, rep.Readings, day, rep.Events, dayChartW, dayChartH), func() ([]byte, error) {
+			return dayChart(rep.Readings, rep.Events, day, pal, dayChartW, dayChartH)
+		})
+	}
+	if rep.AGP != nil {
+		add("agp.png", "AGP chart", chartKey("agp", pal, rep.Readings, agpChartW, agpChartH), func() ([]byte, error) {
+			return agpChart(rep.AGP.Profile, pal, agpChartW, agpChartH)
+		})
+	}
+	if rep.Dawn != nil && len(rep.Dawn.Nights) > 0 {
+		add("dawn.png", "dawn chart", chartKey("dawn", pal, rep.Readings, dawnChartW, dawnChartH), func() ([]byte, error) {
+			return dawnChart(rep.Readings, rep.Dawn, pal, dawnChartW, dawnChartH)
+		})
+	}
+	if risk, ok := glycemiaRiskIndex(rep.Readings); ok && b.opts.wants(sectionGRI) {
+		rep.GRI = &risk
+		add("gri.png", "GRI grid", chartKey("gri", pal, nil, risk, griChartW, griChartH), func() ([]byte, error) {
+			return griGridChart(risk, pal, griChartW, griChartH)
+		})
+	}
+}
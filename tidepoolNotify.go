@@ -0,0 +1,227 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   Notifications.
+
+   "Report ready" messages, digests and alerts go out through Notifiers.
+   Each user picks their channels on the preferences page - email,
+   a webhook, an ntfy topic or Pushover - and every channel they filled
+   in gets the message. New channels only need to implement Notifier.
+*/
+
+//Notification - a message for a user
+type Notification struct {
+	Title      string
+	Body       string
+	Attachment *Attachment //Only sent by email
+}
+
+//Attachment - a file sent with a notification
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+//Notifier - a way of reaching a user
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+//Time allowed for a webhook, ntfy or Pushover call
+const notifyTimeout = 20 * time.Second
+
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+//Send by email through the configured mail server
+type emailNotifier struct {
+	server SMTPConfig
+	to     string
+}
+
+func (e emailNotifier) Notify(n Notification) error {
+	if e.server.Host == "" || e.server.From == "" {
+		return errors.New("the mail server is not set up")
+	}
+	port := e.server.Port
+	if port == 0 {
+		port = 587
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n",
+		e.server.From, e.to, mimeHeader(n.Title), time.Now().Format(time.RFC1123Z))
+	if n.Attachment == nil {
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n" + n.Body + "\r\n")
+	} else {
+		mw := multipart.NewWriter(&msg)
+		fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+		text, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+		text.Write([]byte(n.Body + "\r\n"))
+
+		file, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {n.Attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {`attachment; filename="` + n.Attachment.Name + `"`},
+		})
+		encoded := base64.StdEncoding.EncodeToString(n.Attachment.Data)
+		for len(encoded) > 76 {
+			file.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		file.Write([]byte(encoded + "\r\n"))
+		mw.Close()
+	}
+
+	var auth smtp.Auth
+	if e.server.Username != "" {
+		auth = smtp.PlainAuth("", e.server.Username, e.server.Password, e.server.Host)
+	}
+	return smtp.SendMail(e.server.Host+":"+strconv.Itoa(port), auth, e.server.From, []string{e.to}, msg.Bytes())
+}
+
+//Encode a header value that isn't plain ascii
+func mimeHeader(s string) string {
+	for _, r := range s {
+		if r > 126 {
+			return "=?utf-8?b?" + base64.StdEncoding.EncodeToString([]byte(s)) + "?="
+		}
+	}
+	return s
+}
+
+//POST the notification as json to a url
+type webhookNotifier struct {
+	url string
+}
+
+func (h webhookNotifier) Notify(n Notification) error {
+	body, _ := json.Marshal(struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	}{n.Title, n.Body})
+	resp, err := notifyClient.Post(h.url, "application/json", bytes.NewReader(body))
+	return notifyResult(resp, err)
+}
+
+//Publish to an ntfy topic url, e.g. https://ntfy.sh/my-topic
+type ntfyNotifier struct {
+	topic string
+}
+
+func (t ntfyNotifier) Notify(n Notification) error {
+	req, err := http.NewRequest("POST", t.topic, strings.NewReader(n.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.Title)
+	resp, err := notifyClient.Do(req)
+	return notifyResult(resp, err)
+}
+
+//Send through Pushover - the app token is a server setting, the user key is the user's
+type pushoverNotifier struct {
+	token string
+	user  string
+}
+
+func (p pushoverNotifier) Notify(n Notification) error {
+	if p.token == "" {
+		return errors.New("the Pushover app token is not set up")
+	}
+	resp, err := notifyClient.PostForm("https://api.pushover.net/1/messages.json", neturl.Values{
+		"token":   {p.token},
+		"user":    {p.user},
+		"title":   {n.Title},
+		"message": {n.Body},
+	})
+	return notifyResult(resp, err)
+}
+
+//An error for a failed call or a non 2xx response
+func notifyResult(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("notification refused: " + resp.Status)
+	}
+	return nil
+}
+
+//The channels a user has filled in
+func notifiersFor(pr Preferences, cfg Config) []Notifier {
+	var notifiers []Notifier
+	if pr.NotifyEmail != "" {
+		notifiers = append(notifiers, emailNotifier{server: cfg.SMTP, to: pr.NotifyEmail})
+	}
+	if pr.NotifyWebhook != "" {
+		notifiers = append(notifiers, webhookNotifier{url: pr.NotifyWebhook})
+	}
+	if pr.NotifyNtfy != "" {
+		notifiers = append(notifiers, ntfyNotifier{topic: pr.NotifyNtfy})
+	}
+	if pr.PushoverUser != "" {
+		notifiers = append(notifiers, pushoverNotifier{token: cfg.PushoverToken, user: pr.PushoverUser})
+	}
+	return notifiers
+}
+
+//Send a notification through all of a profile's channels.
+//Failures are logged and the first one returned.
+func notifyProfile(profile string, n Notification) error {
+	notifiers := notifiersFor(prefs.get(profile), loadConfig(configFile))
+	if len(notifiers) == 0 {
+		return errors.New("no notification channels are set up")
+	}
+	var first error
+	for _, nt := range notifiers {
+		if err := nt.Notify(n); err != nil {
+			log.Printf("Notification to %s by %T failed: %v", profile, nt, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+//Send a test notification to the session profile - /prefs/testnotify
+func testNotification(w http.ResponseWriter, r *http.Request) {
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" || r.Method != http.MethodPost {
+		http.Redirect(w, r, "/prefs", http.StatusSeeOther)
+		return
+	}
+	err := notifyProfile(sess.profile, Notification{
+		Title: "TidepoolReport test",
+		Body:  "Notifications from TidepoolReport will arrive here.",
+	})
+	if err != nil {
+		DisplayMessageScreen(w, "The test notification failed: "+err.Error())
+		return
+	}
+	DisplayMessageScreen(w, "The test notification was sent.")
+}
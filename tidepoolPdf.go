@@ -1,3 +1,6 @@
+//go:build !js
+// +build !js
+
 package tidepoolreport
 
 import (
@@ -6,26 +9,74 @@ import (
 	"fmt"
 	"github.com/jung-kurt/gofpdf"
 	//"html/template"
-	"io/ioutil"
-	//"log"
+	"log"
 	"net/http"
-	"os"
+	"path/filepath"
 	//"strconv"
-	//"time"
-    //"errors"
+	"sync"
+	"text/template"
+	"time"
+	//"errors"
 )
 
-
 //Setup the pdf generator
 var pdf = gofpdf.New("P", "in", "letter", "") //portrait, inches, letter size
 
+//The document is built in these globals so only one PDF is made at a time
+var pdfMu sync.Mutex
+
+//The page header shows the title and, on table pages, the column headers.
+var pageTitle string = "Glucose Values"
+var tableHeader bool = true
+
+//The layout of the PDF being made
+var pageLayout = defaultLayout()
+
+//The units the report shows glucose in
+var pageUnits = MgDL
+
+//The PDF layout when no sections are configured
+var pdfSections = []string{sectionStats, sectionTIR, sectionRanges, sectionChanges, sectionInsights, sectionStreaks, sectionTargets, sectionFlags, sectionGRI, sectionHistogram, sectionDaily, sectionGaps, sectionReadings, sectionOtherReadings, sectionSuspends, sectionAccuracy, sectionSessions, sectionBoluses, sectionCarbs, sectionRecovery, sectionDawn, sectionBasal}
+
+//HeaderFields - the values available to the page header and footer templates
+type HeaderFields struct {
+	PatientName string
+	Range       string
+	Title       string
+	Page        int
+	Pages       string
+}
+
+//Parse a header or footer template, falling back to the default when it is bad
+func pageTemplate(name string, text string, fallback string) *template.Template {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		log.Println("Bad", name, "template in the config file:", err)
+		tmpl = template.Must(template.New(name).Parse(fallback))
+	}
+	return tmpl
+}
+
+//Fill in a header or footer template for the current page
+func pageText(tmpl *template.Template, fields HeaderFields) string {
+	fields.Title = pageTitle
+	fields.Page = pdf.PageNo()
+	fields.Pages = "{nb}" //Replaced with the page count by gofpdf
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, fields); err != nil {
+		log.Println("Error filling in the page", tmpl.Name(), err)
+	}
+	return b.String()
+}
+
 /*
    Using the gofpdf package, create a pdf file from the
-   users measurments data
-   The filename param is the file that contains the downloaded json.
+   users report
+   The filename param is the pdf file to write.
    The pdf ge. object is instanced up top for global access
 */
-func CreatePDF(w http.ResponseWriter, smbgs []Smbg) error{
+func CreatePDF(w http.ResponseWriter, filename string, cfg Config, rep *Report) error {
 
 	/*
 	   Now we are ready to produce the PDF.
@@ -34,15 +85,45 @@ func CreatePDF(w http.ResponseWriter, smbgs []Smbg) error{
 	   Stay tuned...
 	*/
 
+	//A fresh document for each report
+	pdfMu.Lock()
+	defer pdfMu.Unlock()
+	pageLayout = cfg.layout
+	pdf = gofpdf.New(pageLayout.orientation(), "in", "letter", "")
+	pageUnits = rep.Units
+	//A column naming each reading's device when asked for and the layout hasn't one
+	if rep.Sources && !pageLayout.hasColumn("source") {
+		pageLayout.Columns = append(append([]LayoutColumn(nil), pageLayout.Columns...), LayoutColumn{Field: "source", Title: "Source", Width: 2.2})
+	}
+	//Coloring follows a target range other than the usual one
+	if rep.Target != defaultTargetRange {
+		pageLayout.Thresholds = pageLayout.Thresholds.forRange(rep.Target)
+	}
+
+	//Header and footer text comes from the config templates
+	defaults := defaultConfig()
+	header := pageTemplate("header", cfg.Header, defaults.Header)
+	footer := pageTemplate("footer", cfg.Footer, defaults.Footer)
+	fields := HeaderFields{PatientName: cfg.PatientName, Range: rep.Range()}
+	if fields.PatientName == "" {
+		fields.PatientName = rep.PatientName
+	}
+
 	//Set up the page header function - kind of an override...
 	pdf.SetHeaderFunc(func() {
+		//Watermark first so the page content is printed over it
+		if cfg.Watermark != "" {
+			watermarkOut(cfg.Watermark, cfg.WatermarkOpacity)
+		}
 		pdf.SetY(.2)
-		pdf.SetFont("Arial", "B", 15)
+		fontOut(pageLayout.TitleFont)
 		//pdf.Cell(2.2, 0, "")
-		pdf.CellFormat(0, .4, "Glucose Values", "", 0, "C", false, 0, "")
+		pdf.CellFormat(0, .4, pageText(header, fields), "", 0, "C", false, 0, "")
 		pdf.Ln(.5)
 		//Add the column headers
-		lineOut("Date", "Time", "Glucose mg/dl")
+		if tableHeader {
+			columnHeadersOut()
+		}
 
 	})
 
@@ -50,22 +131,634 @@ func CreatePDF(w http.ResponseWriter, smbgs []Smbg) error{
 	pdf.SetFooterFunc(func() {
 		pdf.SetY(-.5)
 		pdf.SetFont("Arial", "I", 8)
-		pdf.CellFormat(0, .4, fmt.Sprintf("Page %d /{nb}", pdf.PageNo()),
+		pdf.CellFormat(0, .4, pageText(footer, fields),
 			"", 0, "C", false, 0, "")
 	})
 
-	pdf.AliasNbPages("")         //Gets us page/pages in the footer
-	pdf.AddPage()                //Put in the first page
-	pdf.SetFont("Arial", "", 12) //Set the document font
+	pageTitle = "Glucose Values"
+	tableHeader = true
+
+	pdf.AliasNbPages("") //Gets us page/pages in the footer
+
+	fontOut(pageLayout.Font) //Set the document font
 
-	//Add all of the measurements.
-	for i := range smbgs {
-		lineOut(smbgs[i].smbgDate, smbgs[i].smbgTime, smbgs[i].smbgValue)
+	//The statistics have the first page to themselves
+	if rep.Statistics != nil && rep.wants(sectionStats, pdfSections) {
+		statisticsOut(rep.Range(), rep.Statistics)
+	}
+
+	//Problems with the data come first so they aren't missed.
+	//A CGM table of hourly averages says so there too.
+	notes := rep.Warnings
+	table, tableNote := rep.tableDays()
+	if tableNote != "" && len(table) > 0 && rep.wants(sectionReadings, pdfSections) {
+		notes = append(append([]string(nil), notes...), tableNote)
+	}
+	if len(notes) > 0 {
+		notesOut(notes)
+	}
+
+	//Output the sections in order.
+	//The summary, chart and gaps share the page ahead of the readings.
+	for _, section := range rep.sectionsOr(pdfSections) {
+		switch section {
+		case sectionStats:
+			//Already out ahead of everything else
+		case sectionTIR:
+			if tir, ok := rep.Stats.timeInRange(); ok {
+				tirOut(tir)
+			}
+		case sectionSummary:
+			if len(rep.Metrics) > 0 {
+				summaryOut(rep.Metrics)
+			}
+		case sectionRanges:
+			if len(rep.Ranges) > 0 {
+				listOut("Date ranges", rangeLines(rep.Ranges))
+			}
+		case sectionTargets:
+			if len(rep.Targets) > 0 {
+				targetsOut(rep.Targets)
+			}
+		case sectionChanges:
+			if rep.Changes != nil {
+				listOut("What's new", rep.Changes.lines())
+			}
+		case sectionInsights:
+			if len(rep.Insights) > 0 {
+				listOut("Insights", rep.Insights)
+			}
+		case sectionStreaks:
+			if len(rep.Streaks) > 0 {
+				listOut("Streaks", rep.Streaks)
+			}
+		case sectionFlags:
+			if len(rep.Flags) > 0 {
+				listOut("Flags", rep.Flags)
+			}
+		case sectionChart:
+			if chart, ok := rep.Charts["glucose.png"]; ok {
+				chartOut("glucose.png", chart, trendChartW, trendChartH, 6)
+			}
+		case sectionHistogram:
+			if chart, ok := rep.Charts["histogram.png"]; ok {
+				chartOut("histogram.png", chart, histogramChartW, histogramChartH, 6)
+			}
+		case sectionDaily:
+			//Oldest first
+			for k := dailyChartsMax - 1; k >= 0; k-- {
+				if chart, ok := rep.Charts[dailyChartName(k)]; ok {
+					dailyOut(dailyChartName(k), chart, rep.End, k, rep.Target)
+				}
+			}
+		case sectionAGP:
+			if chart, ok := rep.Charts["agp.png"]; ok && rep.AGP != nil {
+				agpOut(rep.AGP.Stats, chart, rep.Target)
+			}
+		case sectionTimeline:
+			if chart, ok := rep.Charts["day.png"]; ok {
+				timelineOut(rep.Events, chart)
+			}
+		case sectionGRI:
+			if chart, ok := rep.Charts["gri.png"]; ok && rep.GRI != nil {
+				griOut(*rep.GRI, chart)
+			}
+		case sectionGaps:
+			if len(rep.Gaps) > 0 {
+				gapsOut(rep.Gaps)
+			}
+		case sectionReadings:
+			//Pages of just the optional sections leave out the empty table
+			if len(table) > 0 || !rep.hasSections() {
+				readingsOut(table)
+			}
+		case sectionOtherReadings:
+			if len(rep.OtherReadings) > 0 {
+				other, note := rep.otherTableDays()
+				otherReadingsOut(readingsTitle(rep.OtherType), other, note)
+			}
+		case sectionSuspends:
+			//Pump suspend timeline on its own pages
+			if len(rep.Suspends) > 0 {
+				suspendTimelineOut(rep.Suspends)
+			}
+		case sectionAccuracy:
+			if rep.Accuracy != nil {
+				accuracyOut(rep.Accuracy)
+			}
+		case sectionSessions:
+			if rep.Sessions != nil {
+				sessionsOut(rep.Sessions)
+			}
+		case sectionBoluses:
+			if len(rep.Boluses) > 0 {
+				bolusesOut(rep.Boluses, rep.Start, rep.End)
+			}
+		case sectionCarbs:
+			if len(rep.Carbs) > 0 {
+				carbsOut(rep.Carbs, rep.Start, rep.End)
+			}
+		case sectionRecovery:
+			if rep.Recovery != nil {
+				recoveryOut(rep.Recovery)
+			}
+		case sectionDawn:
+			if rep.Dawn != nil {
+				dawnOut(rep.Dawn, rep.Charts["dawn.png"])
+			}
+		case sectionBasal:
+			if len(rep.Basal) > 0 {
+				basalOut(rep.Basal)
+			}
+		default:
+			if s, ok := rep.extra(section); ok && len(s.Lines) > 0 {
+				listOut(s.Title, s.Lines)
+			}
+		}
+	}
+
+	//Never an empty document
+	if pdf.PageNo() == 0 {
+		pdf.AddPage()
 	}
 
 	//Store the pdf file and cleanup.
-	pdf.OutputFileAndClose("tidepool.pdf")
-    return nil
+	//Any error building the document comes back here too.
+	return pdf.OutputFileAndClose(filename)
+}
+
+//Make room on the first page for a section of the given height.
+//A new page is started when there isn't one or it's full or has some other title.
+func firstPageOut(height float64) {
+	_, pageH := pdf.GetPageSize()
+	if pdf.PageNo() == 0 || pageTitle != "Glucose Values" || pdf.GetY()+height > pageH-1 {
+		pageTitle = "Glucose Values"
+		tableHeader = false
+		pdf.AddPage()
+	}
+	tableHeader = false
+}
+
+//Output the readings table. It carries on under any summary, chart or gaps.
+func readingsOut(days []readingDay) {
+	if pdf.PageNo() > 0 && pageTitle == "Glucose Values" {
+		fontOut(pageLayout.TitleFont)
+		columnHeadersOut()
+		tableHeader = true
+	} else {
+		pageTitle = "Glucose Values"
+		tableHeader = true
+		pdf.AddPage()
+	}
+	fontOut(pageLayout.Font)
+	readingDaysOut(days)
+}
+
+//Output the other glucose type's readings on pages of their own
+func otherReadingsOut(title string, days []readingDay, note string) {
+	//The note goes above the column headers on the first page
+	pageTitle = title
+	tableHeader = note == ""
+	pdf.AddPage()
+	if note != "" {
+		pdf.SetFont("Arial", "I", 9)
+		pdf.Cell(pageLayout.Indent, 0, "")
+		pdf.CellFormat(0, 0.3, note, "", 1, "L", false, 0, "")
+		fontOut(pageLayout.TitleFont)
+		columnHeadersOut()
+		tableHeader = true
+	}
+	fontOut(pageLayout.Font)
+	readingDaysOut(days)
+}
+
+//Output the readings a day at a time, each under a heading with the
+//day's numbers - see tidepoolDayGroups.go
+func readingDaysOut(days []readingDay) {
+	left, scale := tableGeometry()
+	width := float64(tableSets()-1) * tableGap
+	for _, c := range pageLayout.Columns {
+		width += c.Width * scale * float64(tableSets())
+	}
+	rowH := 0.3 * scale
+
+	_, pageH := pdf.GetPageSize()
+	_, bottom := pdf.GetAutoPageBreak()
+	for _, d := range days {
+		//Keep the heading with at least one row of the day
+		if pdf.GetY()+2*rowH > pageH-bottom {
+			pdf.AddPage()
+		}
+		heading := scaledFont(pageLayout.Font, scale)
+		heading.Style = "B"
+		fontOut(heading)
+		pdf.SetFillColor(235, 235, 235)
+		if d.Excluded {
+			pdf.SetTextColor(150, 150, 150)
+		}
+		pdf.Cell(left, 0, "")
+		pdf.CellFormat(width, rowH, d.heading(pageUnits), "1", 1, "L", true, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+		readingRowsOut(d.Rows)
+	}
+}
+
+//The gap between sets of readings columns
+const tableGap = 0.3
+
+//Where the readings table goes across the page - the space before each set
+//of columns and how much the columns are shrunk to fit them all.
+//One set sits at the layout's indent when it fits, more are centered.
+func tableGeometry() (left float64, scale float64) {
+	n := tableSets()
+	width := 0.0
+	for _, c := range pageLayout.Columns {
+		width += c.Width
+	}
+	pageW, _ := pdf.GetPageSize()
+	margin, _, _, _ := pdf.GetMargins()
+	if n == 1 && pageLayout.Indent+width <= pageW-2*margin {
+		return pageLayout.Indent, 1
+	}
+	gaps := float64(n-1) * tableGap
+	scale = 1
+	if room := pageW - 2*margin - gaps; float64(n)*width > room {
+		scale = room / (float64(n) * width)
+	}
+	left = (pageW-float64(n)*width*scale-gaps)/2 - margin
+	return left, scale
+}
+
+//The sets of readings columns across the page
+func tableSets() int {
+	if pageLayout.TableColumns < 1 {
+		return 1
+	}
+	return pageLayout.TableColumns
+}
+
+//A layout font shrunk with the table
+func scaledFont(f LayoutFont, scale float64) LayoutFont {
+	f.Size *= scale
+	return f
+}
+
+//Output the readings table rows. With more than one set of columns each
+//page is filled down the first set, then the next.
+func readingRowsOut(readings []Reading) {
+	//Look up the column fields once - this runs for every reading
+	fields := make([]func(rd Reading, u Units) string, len(pageLayout.Columns))
+	for i, c := range pageLayout.Columns {
+		fields[i] = layoutFields[c.Field]
+	}
+
+	left, scale := tableGeometry()
+	sets := tableSets()
+	rowH := 0.3 * scale
+	fontOut(scaledFont(pageLayout.Font, scale))
+
+	_, pageH := pdf.GetPageSize()
+	_, bottom := pdf.GetAutoPageBreak()
+	for len(readings) > 0 {
+		rows := int((pageH - bottom - pdf.GetY() - 0.001) / rowH)
+		if rows < 1 {
+			pdf.AddPage()
+			fontOut(scaledFont(pageLayout.Font, scale))
+			continue
+		}
+		//A last page that isn't full is shared out evenly
+		page := rows * sets
+		if page > len(readings) {
+			page = len(readings)
+			rows = (page + sets - 1) / sets
+		}
+		for r := 0; r < rows; r++ {
+			pdf.Cell(left, 0, "")
+			for k := 0; k < sets; k++ {
+				if k > 0 {
+					pdf.Cell(tableGap, 0, "")
+				}
+				if i := k*rows + r; i < page {
+					readingRowOut(readings[i], fields, scale, rowH)
+				}
+			}
+			pdf.Ln(rowH)
+		}
+		readings = readings[page:]
+		if len(readings) > 0 {
+			pdf.AddPage()
+			fontOut(scaledFont(pageLayout.Font, scale))
+		}
+	}
+	fontOut(pageLayout.Font)
+}
+
+//Output a reading's cells - the layout's columns with any out of range
+//value colored. Excluded days are gray throughout.
+func readingRowOut(rd Reading, fields []func(rd Reading, u Units) string, scale float64, rowH float64) {
+	if rd.Excluded {
+		pdf.SetTextColor(150, 150, 150)
+	}
+	for i, c := range pageLayout.Columns {
+		//Only out of range values change the color
+		colored := false
+		if c.Field == "value" && !rd.Excluded {
+			if r, g, b := pageLayout.Thresholds.color(rd.MgDL()); r|g|b != 0 {
+				pdf.SetTextColor(r, g, b)
+				colored = true
+			}
+		}
+		pdf.CellFormat(c.Width*scale, rowH, fields[i](rd, pageUnits), "1", 0, "C", false, 0, "")
+		if colored {
+			pdf.SetTextColor(0, 0, 0)
+		}
+	}
+	if rd.Excluded {
+		pdf.SetTextColor(0, 0, 0)
+	}
+}
+
+//Output the readings table column headers - over each set of columns
+func columnHeadersOut() {
+	left, scale := tableGeometry()
+	fontOut(scaledFont(pageLayout.TitleFont, scale))
+	pdf.Cell(left, 0, "")
+	for k := 0; k < tableSets(); k++ {
+		if k > 0 {
+			pdf.Cell(tableGap, 0, "")
+		}
+		for _, c := range pageLayout.Columns {
+			pdf.CellFormat(c.Width*scale, 0.3*scale, c.title(pageUnits), "1", 0, "C", false, 0, "")
+		}
+	}
+	pdf.Ln(0.3 * scale)
+}
+
+//Set a layout font
+func fontOut(f LayoutFont) {
+	pdf.SetFont(f.Family, f.Style, f.Size)
+}
+
+//Output the summary metrics as a two column table
+func summaryOut(metrics []MetricValue) {
+	firstPageOut(0.3*float64(len(metrics)+1) + 0.2)
+
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(5.1, 0.3, "Summary", "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 11)
+	for _, m := range metrics {
+		pdf.Cell(1.35, 0, "")
+		pdf.CellFormat(2.55, 0.3, m.Name, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(2.55, 0.3, m.Value, "1", 1, "C", false, 0, "")
+	}
+	pdf.Ln(0.2)
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output the statistics page
+func statisticsOut(period string, ps *periodStatistics) {
+	pageTitle = "Glucose Statistics"
+	tableHeader = false
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "B", 14)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(5.1, 0.4, "Statistics for "+period, "", 1, "L", false, 0, "")
+	pdf.Ln(0.2)
+	pdf.SetFont("Arial", "", 12)
+	for _, row := range ps.rows() {
+		pdf.Cell(1.35, 0, "")
+		pdf.CellFormat(2.55, 0.35, row[0], "1", 0, "L", false, 0, "")
+		pdf.CellFormat(2.55, 0.35, row[1], "1", 1, "C", false, 0, "")
+	}
+	pdf.Ln(0.2)
+	pdf.SetFont("Arial", "I", 10)
+	pdf.Cell(1.35, 0, "")
+	pdf.MultiCell(5.1, 0.2, "All the readings in the period, not the hourly averages a CGM table shows.", "", "L", false)
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output the time in range headline with a bar split below, in and above
+func tirOut(tir timeInRange) {
+	firstPageOut(1.2)
+
+	pdf.SetFont("Arial", "B", 16)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(5.1, 0.4, tir.Headline(), "", 1, "L", false, 0, "")
+
+	//The bar - red below, green in range, orange above
+	const barX, barW = 1.35, 5.1
+	y := pdf.GetY() + 0.05
+	x := barX
+	for _, part := range []struct {
+		percent float64
+		r, g, b int
+	}{{tir.Below, 200, 0, 0}, {tir.InRange, 0, 150, 0}, {tir.Above, 230, 150, 0}} {
+		w := barW * part.percent / 100
+		if w > 0 {
+			pdf.SetFillColor(part.r, part.g, part.b)
+			pdf.Rect(x, y, w, 0.3, "F")
+		}
+		x += w
+	}
+	pdf.Rect(barX, y, barW, 0.3, "D")
+	pdf.SetY(y + 0.35)
+
+	pdf.SetFont("Arial", "", 11)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(5.1, 0.3, tir.Breakdown(), "", 1, "L", false, 0, "")
+	pdf.Ln(0.2)
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output the clinical targets table with a green or red marker for each goal
+func targetsOut(targets []targetResult) {
+	firstPageOut(0.3*float64(len(targets)+2) + 0.2)
+
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(5.1, 0.3, "Clinical Targets - "+targetsMet(targets)+" met", "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 11)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(2.1, 0.3, "Goal", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(1.0, 0.3, "Target", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(1.0, 0.3, "Value", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(1.0, 0.3, "", "1", 1, "C", false, 0, "")
+	for _, t := range targets {
+		pdf.Cell(1.35, 0, "")
+		pdf.CellFormat(2.1, 0.3, t.Name, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(1.0, 0.3, t.Goal, "1", 0, "C", false, 0, "")
+		pdf.CellFormat(1.0, 0.3, t.Value, "1", 0, "C", false, 0, "")
+		if t.Met {
+			pdf.SetTextColor(0, 128, 0)
+		} else {
+			pdf.SetTextColor(200, 0, 0)
+		}
+		pdf.CellFormat(1.0, 0.3, t.Status(), "1", 1, "C", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+	}
+	pdf.Ln(0.2)
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output a titled list - the insights or flags. Long lines wrap.
+func listOut(title string, items []string) {
+	pdf.SetFont("Arial", "", 11)
+	lines := 1
+	for _, item := range items {
+		lines += len(pdf.SplitLines([]byte("- "+item), 5.1))
+	}
+	firstPageOut(0.25*float64(lines) + 0.2)
+
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(5.1, 0.3, title, "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 11)
+	for _, item := range items {
+		pdf.SetX(1.35)
+		pdf.MultiCell(5.1, 0.25, "- "+item, "", "L", false)
+	}
+	pdf.Ln(0.2)
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output the notes about the report in a shaded box
+func notesOut(notes []string) {
+	pdf.SetFont("Arial", "", 10)
+	lines := 0
+	for _, note := range notes {
+		lines += len(pdf.SplitLines([]byte("- "+note), 4.9))
+	}
+	height := 0.3 + 0.2*float64(lines) + 0.1
+	firstPageOut(height + 0.2)
+
+	pdf.SetFillColor(255, 248, 220)
+	pdf.Rect(1.35, pdf.GetY(), 5.1, height, "FD")
+	pdf.SetFont("Arial", "B", 11)
+	pdf.SetX(1.45)
+	pdf.CellFormat(4.9, 0.3, "Notes about this report", "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 10)
+	for _, note := range notes {
+		pdf.SetX(1.45)
+		pdf.MultiCell(4.9, 0.2, "- "+note, "", "L", false)
+	}
+	pdf.Ln(0.3)
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output a chart image w x h pixels centered on the page, width inches across
+func chartOut(name string, chart []byte, w int, h int, width float64) {
+	height := width * float64(h) / float64(w)
+	firstPageOut(height + 0.2)
+
+	opts := gofpdf.ImageOptions{ImageType: "PNG"}
+	pdf.RegisterImageOptionsReader(name, opts, bytes.NewReader(chart))
+	pageW, _ := pdf.GetPageSize()
+	pdf.ImageOptions(name, (pageW-width)/2, pdf.GetY(), width, height, false, opts, 0, "")
+	pdf.SetY(pdf.GetY() + height + 0.2)
+}
+
+//Output a daily thumbnails image on a page of its own. k is how many
+//fortnights before the end of the period it finishes.
+func dailyOut(name string, chart []byte, end string, k int, rng TargetRange) {
+	pageTitle = "Daily Glucose Profiles"
+	tableHeader = false
+	pdf.AddPage()
+
+	const width = 7.5
+	opts := gofpdf.ImageOptions{ImageType: "PNG"}
+	pdf.RegisterImageOptionsReader(name, opts, bytes.NewReader(chart))
+	pageW, _ := pdf.GetPageSize()
+	pdf.ImageOptions(name, (pageW-width)/2, pdf.GetY(), width, width*dailyChartH/dailyChartW, false, opts, 0, "")
+	pdf.SetY(pdf.GetY() + width*dailyChartH/dailyChartW + 0.1)
+	pdf.SetFont("Arial", "", 9)
+	days := fmt.Sprintf("The last %d days", dailyDays)
+	if last, err := time.Parse("2006-01-02", end); err == nil && k > 0 {
+		last = last.AddDate(0, 0, -k*dailyDays)
+		days = fmt.Sprintf("%s to %s", last.AddDate(0, 0, 1-dailyDays).Format("Jan 2"), last.Format("Jan 2"))
+	}
+	pdf.CellFormat(0, 0.25, fmt.Sprintf("%s, midnight to midnight. Shaded band %s-%s, line at noon.", days, pageUnits.format(rng.Low), pageUnits.withName(rng.High)), "", 1, "C", false, 0, "")
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output the AGP statistics block and modal day chart on a page of their own
+func agpOut(stats [][]string, chart []byte, rng TargetRange) {
+	pageTitle = "Ambulatory Glucose Profile"
+	tableHeader = false
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "", 11)
+	for _, row := range stats {
+		pdf.Cell(1.85, 0, "")
+		pdf.CellFormat(2.4, 0.28, row[0], "1", 0, "L", false, 0, "")
+		pdf.CellFormat(2.4, 0.28, row[1], "1", 1, "C", false, 0, "")
+	}
+	pdf.Ln(0.2)
+
+	const width = 7.5
+	opts := gofpdf.ImageOptions{ImageType: "PNG"}
+	pdf.RegisterImageOptionsReader("agp.png", opts, bytes.NewReader(chart))
+	pageW, _ := pdf.GetPageSize()
+	pdf.ImageOptions("agp.png", (pageW-width)/2, pdf.GetY(), width, width*agpChartH/agpChartW, false, opts, 0, "")
+	pdf.SetY(pdf.GetY() + width*agpChartH/agpChartW + 0.1)
+	pdf.SetFont("Arial", "", 9)
+	pdf.MultiCell(0, 0.2, fmt.Sprintf("Every day of the period laid over one, midnight to midnight. The line is the median, the dark band the 25th to 75th percentiles "+
+		"and the light band the 10th to 90th. Shaded band %s-%s.", pageUnits.format(rng.Low), pageUnits.withName(rng.High)), "", "C", false)
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output a day report's chart and its list of events on pages of their own
+func timelineOut(events []timelineEvent, chart []byte) {
+	pageTitle = "Day Timeline"
+	tableHeader = false
+	pdf.AddPage()
+
+	const width = 7.0
+	height := width * dayChartH / dayChartW
+	opts := gofpdf.ImageOptions{ImageType: "PNG"}
+	pdf.RegisterImageOptionsReader("day.png", opts, bytes.NewReader(chart))
+	pageW, pageH := pdf.GetPageSize()
+	pdf.ImageOptions("day.png", (pageW-width)/2, pdf.GetY(), width, height, false, opts, 0, "")
+	pdf.SetY(pdf.GetY() + height + 0.1)
+	pdf.SetFont("Arial", "", 9)
+	pdf.CellFormat(0, 0.25, "Marks along the bottom, lowest first: bolus, carbs, activity, device events, notes", "", 1, "C", false, 0, "")
+	pdf.Ln(0.1)
+
+	if len(events) == 0 {
+		pdf.SetFont("Arial", "", 11)
+		pdf.CellFormat(0, 0.3, "No boluses, carbs or other events were recorded.", "", 1, "C", false, 0, "")
+	}
+	for _, ev := range events {
+		pdf.SetFont("Arial", "", 10)
+		lines := pdf.SplitLines([]byte(ev.Text), 4.6)
+		if pdf.GetY()+0.25*float64(len(lines)) > pageH-1 {
+			pdf.AddPage()
+		}
+		r, g, b := timelineColors[ev.Kind].R, timelineColors[ev.Kind].G, timelineColors[ev.Kind].B
+		pdf.SetX(0.75)
+		pdf.CellFormat(0.8, 0.25, ev.Time.Format("15:04"), "", 0, "L", false, 0, "")
+		pdf.SetTextColor(int(r), int(g), int(b))
+		pdf.CellFormat(1.0, 0.25, ev.Kind, "", 0, "L", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+		pdf.MultiCell(4.6, 0.25, ev.Text, "", "L", false)
+	}
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output the GRI grid with its caption
+func griOut(g glycemiaRisk, chart []byte) {
+	const width = 3.5
+	firstPageOut(width*griChartH/griChartW + 0.8)
+
+	pdf.SetFont("Arial", "B", 12)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(5.1, 0.3, fmt.Sprintf("Glycemia Risk Index: %.0f (zone %s)", g.gri, g.zone()), "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 9)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(5.1, 0.25, fmt.Sprintf("Hypoglycemia component %.1f across, hyperglycemia component %.1f up", g.hypo, g.hyper), "", 1, "L", false, 0, "")
+	chartOut("gri.png", chart, griChartW, griChartH, width)
+	pdf.SetFont("Arial", "", 12)
 }
 
 //Output a result line of cells to the pdf.
@@ -82,23 +775,325 @@ func cellOut(s string) {
 	pdf.CellFormat(1.7, 0.3, s, "1", 0, "C", false, 0, "")
 }
 
+/*
+   Output the pump suspend timeline.
+   Each day gets a 24 hour bar with the suspended periods shaded
+   and the total suspended time at the right.
+*/
+func suspendTimelineOut(days []suspendDay) {
+	pageTitle = "Pump Suspend Timeline"
+	tableHeader = false
+	pdf.AddPage()
+
+	const left, barX, barW, rowH = 0.75, 1.9, 4.8, 0.45
+	_, pageH := pdf.GetPageSize()
+
+	for _, d := range days {
+		if pdf.GetY()+rowH > pageH-1 {
+			pdf.AddPage()
+		}
+		y := pdf.GetY()
+
+		//Date label
+		pdf.SetFont("Arial", "", 10)
+		pdf.Text(left, y+0.2, d.day)
+
+		//The day bar with a tick every 3 hours
+		pdf.SetDrawColor(0, 0, 0)
+		pdf.Rect(barX, y+0.05, barW, 0.2, "D")
+		pdf.SetFont("Arial", "", 6)
+		for h := 0; h <= 24; h += 3 {
+			x := barX + barW*float64(h)/24
+			pdf.Line(x, y+0.25, x, y+0.3)
+			pdf.Text(x-0.05, y+0.38, fmt.Sprintf("%02d", h))
+		}
+
+		//Shade the suspends
+		pdf.SetFillColor(160, 160, 160)
+		for _, p := range d.periods {
+			x := barX + barW*dayFraction(p.start)
+			w := barW * p.end.Sub(p.start).Hours() / 24
+			pdf.Rect(x, y+0.05, w, 0.2, "F")
+		}
+
+		//Total suspended time for the day
+		pdf.SetFont("Arial", "", 10)
+		pdf.Text(barX+barW+0.15, y+0.2, fmt.Sprintf("%dh %02dm", int(d.total.Hours()), int(d.total.Minutes())%60))
+
+		pdf.SetY(y + rowH)
+	}
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Fraction of the day elapsed at time t
+func dayFraction(t time.Time) float64 {
+	return (float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600) / 24
+}
+
+//Stamp the watermark text diagonally across the middle of the page
+func watermarkOut(text string, opacity float64) {
+	if opacity <= 0 || opacity > 1 {
+		opacity = defaultConfig().WatermarkOpacity
+	}
+	pageW, pageH := pdf.GetPageSize()
+	cx, cy := pageW/2, pageH/2
+
+	pdf.SetFont("Arial", "B", 72)
+	pdf.SetTextColor(200, 0, 0)
+	pdf.SetAlpha(opacity, "Normal")
+	pdf.TransformBegin()
+	pdf.TransformRotate(45, cx, cy)
+	pdf.Text(cx-pdf.GetStringWidth(text)/2, cy, text)
+	pdf.TransformEnd()
+	pdf.SetAlpha(1, "Normal")
+	pdf.SetTextColor(0, 0, 0)
+}
+
+//Output the data gaps callout - a shaded box listing each gap.
+func gapsOut(gaps []dataGap) {
+	const left, width, lineH, maxListed = 1.35, 5.1, 0.22, 25
+
+	//Keep the box on the first page
+	var more int
+	if len(gaps) > maxListed {
+		more = len(gaps) - maxListed
+	}
+	rows := len(gaps) - more + 1
+	if more > 0 {
+		rows++
+	}
+	height := lineH*float64(rows) + 0.15
+	firstPageOut(height + 0.2)
+	x, y := left, pdf.GetY()
+
+	pdf.SetFillColor(255, 228, 225)
+	pdf.SetDrawColor(200, 0, 0)
+	pdf.Rect(x, y, width, height, "DF")
+	pdf.SetDrawColor(0, 0, 0)
+
+	pdf.SetXY(x+0.1, y+0.05)
+	pdf.SetFont("Arial", "B", 11)
+	pdf.CellFormat(width-0.2, lineH, fmt.Sprintf("Data gaps: %d periods with no readings", len(gaps)), "", 2, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 10)
+	for _, g := range gaps[:len(gaps)-more] {
+		pdf.CellFormat(width-0.2, lineH, fmt.Sprintf("%s  to  %s  (%s)", g.start.Format("2006-01-02 15:04"),
+			g.end.Format("2006-01-02 15:04"), formatDuration(g.end.Sub(g.start))), "", 2, "L", false, 0, "")
+	}
+	if more > 0 {
+		pdf.CellFormat(width-0.2, lineH, fmt.Sprintf("... and %d more", more), "", 2, "L", false, 0, "")
+	}
+	pdf.SetY(y + height + 0.2)
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output the meter vs CGM accuracy page.
+func accuracyOut(a *accuracySummary) {
+	pageTitle = "Meter vs CGM Accuracy"
+	tableHeader = false
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "", 12)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(0, 0.3, fmt.Sprintf("Meter readings: %d   Paired within %v: %d", a.meters, a.window, len(a.pairs)), "", 1, "L", false, 0, "")
+	if len(a.pairs) == 0 {
+		pdf.Cell(1.35, 0, "")
+		pdf.CellFormat(0, 0.3, "No meter readings had a CGM value close enough to compare.", "", 1, "L", false, 0, "")
+		return
+	}
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(0, 0.3, fmt.Sprintf("Mean absolute relative difference (MARD): %.1f%%", a.mard), "", 1, "L", false, 0, "")
+	pdf.Ln(0.3)
+
+	//Clarke error grid zone counts
+	lineOut("Clarke Zone", "Pairs", "Percent")
+	for _, z := range []string{"A", "B", "C", "D", "E"} {
+		pct := float64(a.zones[z]) / float64(len(a.pairs)) * 100
+		lineOut(z, fmt.Sprintf("%d", a.zones[z]), fmt.Sprintf("%.1f%%", pct))
+	}
+	pdf.Ln(0.2)
+	pdf.SetFont("Arial", "I", 9)
+	pdf.Cell(1.35, 0, "")
+	pdf.MultiCell(5.1, 0.2, "Zones A and B are clinically acceptable. A sensor session with many C, D or E pairs "+
+		"or a MARD well above 10-15% should not be trusted for treatment decisions.", "", "L", false)
+	pdf.SetFont("Arial", "", 12)
+}
+
+//Output the CGM sensor session page - the summary then a line per session.
+func sessionsOut(s *sessionSummary) {
+	pageTitle = "CGM Sensor Sessions"
+	tableHeader = false
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "", 12)
+	pdf.Cell(1.35, 0, "")
+	if len(s.sessions) == 0 {
+		pdf.CellFormat(0, 0.3, "No CGM readings were found for the period.", "", 1, "L", false, 0, "")
+		return
+	}
+	pdf.CellFormat(0, 0.3, fmt.Sprintf("Sessions: %d   Average wear: %s   Data completeness: %.1f%%",
+		len(s.sessions), formatDuration(s.averageWear), s.completeness), "", 1, "L", false, 0, "")
+	pdf.Ln(0.3)
+
+	lineOut("Session Start", "Duration", "Completeness")
+	for _, ss := range s.sessions {
+		lineOut(ss.start.Format("2006-01-02 15:04"), formatDuration(ss.end.Sub(ss.start)), fmt.Sprintf("%.1f%%", ss.completeness))
+	}
+}
+
+//Output the bolus table on pages of its own
+func bolusesOut(doses []bolusDose, start, end string) {
+	pageTitle = "Insulin Boluses"
+	tableHeader = false
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "", 12)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(0, 0.3, bolusTotals(doses, start, end), "", 1, "L", false, 0, "")
+	pdf.Ln(0.3)
+
+	widths := []float64{1.5, 0.9, 0.9, 1.0, 1.4}
+	row := func(cells ...string) {
+		pdf.Cell(1.35, 0, "")
+		for i, s := range cells {
+			pdf.CellFormat(widths[i], 0.3, s, "1", 0, "C", false, 0, "")
+		}
+		pdf.Ln(0.3)
+	}
+	row("Time", "Normal U", "Extended U", "Duration", "Kind")
+	for _, r := range bolusRows(doses) {
+		row(r...)
+	}
+}
+
+//Output the carb table on pages of its own
+func carbsOut(entries []carbEntry, start, end string) {
+	pageTitle = "Carbs"
+	tableHeader = false
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "", 12)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(0, 0.3, carbTotals(entries, start, end), "", 1, "L", false, 0, "")
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(0, 0.3, "With the nearest reading and the insulin given within 15 minutes", "", 1, "L", false, 0, "")
+	pdf.Ln(0.3)
+
+	widths := []float64{1.5, 0.8, 1.0, 0.9, 1.4}
+	row := func(cells ...string) {
+		pdf.Cell(1.35, 0, "")
+		for i, s := range cells {
+			pdf.CellFormat(widths[i], 0.3, s, "1", 0, "C", false, 0, "")
+		}
+		pdf.Ln(0.3)
+	}
+	row("Time", "Carbs g", "Glucose", "Bolus U", "From")
+	for _, r := range carbRows(entries, pageUnits) {
+		row(r...)
+	}
+}
+
+//Output the lows and how they ended on a page of their own
+func recoveryOut(s *recoverySummary) {
+	pageTitle = "Hypo Recovery"
+	tableHeader = false
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "", 12)
+	for _, line := range s.lines(pageUnits) {
+		pdf.Cell(1.35, 0, "")
+		pdf.CellFormat(0, 0.3, line, "", 1, "L", false, 0, "")
+	}
+	if len(s.Lows) == 0 {
+		return
+	}
+	pdf.Ln(0.3)
+
+	widths := []float64{1.5, 1.2, 1.6, 1.3}
+	row := func(cells ...string) {
+		pdf.Cell(1.35, 0, "")
+		for i, s := range cells {
+			pdf.CellFormat(widths[i], 0.3, s, "1", 0, "C", false, 0, "")
+		}
+		pdf.Ln(0.3)
+	}
+	pdf.SetFont("Arial", "B", 11)
+	row(recoveryHeader(pageUnits)...)
+	pdf.SetFont("Arial", "", 11)
+	for _, r := range s.rows(pageUnits) {
+		row(r...)
+	}
+}
+
+//Output the dawn rise, its chart and the nights on a page of their own
+func dawnOut(s *dawnSummary, chart []byte) {
+	pageTitle = "Dawn Phenomenon"
+	tableHeader = false
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "", 12)
+	for _, line := range s.lines(pageUnits) {
+		pdf.Cell(1.35, 0, "")
+		pdf.MultiCell(5.8, 0.3, line, "", "L", false)
+	}
+	if len(s.Nights) == 0 {
+		return
+	}
+	pdf.Ln(0.2)
+	if chart != nil {
+		const width = 6.5
+		opts := gofpdf.ImageOptions{ImageType: "PNG"}
+		pdf.RegisterImageOptionsReader("dawn.png", opts, bytes.NewReader(chart))
+		pageW, _ := pdf.GetPageSize()
+		pdf.ImageOptions("dawn.png", (pageW-width)/2, pdf.GetY(), width, width*dawnChartH/dawnChartW, false, opts, 0, "")
+		pdf.SetY(pdf.GetY() + width*dawnChartH/dawnChartW + 0.2)
+	}
+
+	widths := []float64{1.3, 1.3, 1.3, 1.3}
+	row := func(cells ...string) {
+		pdf.Cell(1.65, 0, "")
+		for i, s := range cells {
+			pdf.CellFormat(widths[i], 0.3, s, "1", 0, "C", false, 0, "")
+		}
+		pdf.Ln(0.3)
+	}
+	pdf.SetFont("Arial", "B", 11)
+	row(dawnHeader(pageUnits)...)
+	pdf.SetFont("Arial", "", 11)
+	for _, r := range s.rows(pageUnits) {
+		row(r...)
+	}
+}
+
 //Render the pdf to the browser.
+//Range requests are supported so a large pdf can resume.
 func ShowPDF(w http.ResponseWriter, r *http.Request, filename string) {
-	//Load the PDF file
-	streamPDFbytes, err := ioutil.ReadFile(filename)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if err := serveFile(w, r, filename, "application/pdf", filepath.Base(filename), false); err != nil {
+		log.Println("Error sending the pdf", err)
+		http.Error(w, "Sorry, the report could not be sent", http.StatusInternalServerError)
 	}
+}
 
-	//To buffer
-	b := bytes.NewBuffer(streamPDFbytes)
+//Output the basal table on pages of its own
+func basalOut(days []basalDay) {
+	pageTitle = "Basal Insulin"
+	tableHeader = false
+	pdf.AddPage()
 
-	//Let 'em know what's coming
-	w.Header().Set("Content-type", "application/pdf")
+	pdf.SetFont("Arial", "", 12)
+	pdf.Cell(1.35, 0, "")
+	pdf.CellFormat(0, 0.3, basalTotals(days), "", 1, "L", false, 0, "")
+	pdf.Ln(0.3)
 
-	//Write the file bytes to the brower
-	if _, err := b.WriteTo(w); err != nil {
-		fmt.Fprintf(w, "%s", err)
+	widths := []float64{1.3, 1.1, 1.1, 1.3}
+	row := func(cells ...string) {
+		pdf.Cell(1.35, 0, "")
+		for i, s := range cells {
+			pdf.CellFormat(widths[i], 0.3, s, "1", 0, "C", false, 0, "")
+		}
+		pdf.Ln(0.3)
+	}
+	row("Date", "Basal U", "Temp Basals", "Suspended")
+	for _, r := range basalRows(days) {
+		row(r...)
 	}
 }
@@ -0,0 +1,67 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+//The PDF of 90 days of CGM readings with every reading in the table
+func BenchmarkCreatePDF(b *testing.B) {
+	opts := ReportOptions{StartDate: benchStart, EndDate: benchEnd, FullCGMTable: true}
+	opts.setDataTypes([]string{"cbg"})
+	rep, err := BuildReportFromData(benchRecords(b), nil, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.layout = defaultLayout()
+	file := filepath.Join(b.TempDir(), "tidepool.pdf")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := CreatePDF(nil, file, cfg, rep); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//The whole of a 90 day CGM PDF from the records - the target is under a second
+func BenchmarkRecordsToPDF(b *testing.B) {
+	data := benchRecords(b)
+	opts := ReportOptions{StartDate: benchStart, EndDate: benchEnd, FullCGMTable: true}
+	opts.setDataTypes([]string{"cbg"})
+	cfg := defaultConfig()
+	cfg.layout = defaultLayout()
+	file := filepath.Join(b.TempDir(), "tidepool.pdf")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rep, err := BuildReportFromData(data, nil, opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := CreatePDF(nil, file, cfg, rep); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//A PDF that can't be written is an error, not an empty download
+func TestCreatePDFUnwritten(t *testing.T) {
+	rep := demoReport(t)
+	cfg := defaultConfig()
+	cfg.layout = defaultLayout()
+	if err := CreatePDF(nil, filepath.Join(t.TempDir(), "gone", "tidepool.pdf"), cfg, rep); err == nil {
+		t.Error("no error for a PDF that wasn't written")
+	}
+
+	ws := goneWorkspace(t)
+	w := httptest.NewRecorder()
+	renderPDF(w, httptest.NewRequest(http.MethodPost, "/opts", nil), ws, cfg, rep)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("render status %d", w.Code)
+	}
+}
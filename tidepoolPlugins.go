@@ -0,0 +1,156 @@
+package tidepoolreport
+
+import (
+	"log"
+	"sync"
+)
+
+/*
+   Hook points for programs embedding the package.
+
+   A Go program that imports tidepoolreport can register its own code
+   before it starts serving, in the same way as RegisterMetric:
+
+       RecordFilter    drops or changes glucose readings before anything
+                       is worked out from them - e.g. a sensor known to
+                       read badly
+       SectionProvider an extra report section. Its name can be listed in
+                       the sections like the built in ones, and it is added
+                       to the end of each output's usual layout.
+       PostProcessor   runs after a report has been sent - e.g. to archive
+                       it or write an audit log
+
+   Each kind runs in the order it was registered.
+*/
+
+//RecordFilter - changes the glucose readings a report is built from
+type RecordFilter interface {
+	//The readings to keep, in time order
+	FilterReadings(readings []Reading, opts ReportOptions) []Reading
+}
+
+//ReportSection - the contents of an extra section: a title and lines of text
+type ReportSection struct {
+	Name  string   `json:"name"`
+	Title string   `json:"title"`
+	Lines []string `json:"lines"`
+}
+
+//SectionProvider - an extra report section
+type SectionProvider interface {
+	//The section name used in the sections list, e.g. "ketones"
+	Name() string
+
+	//The section for the report, which has everything but the charts
+	//worked out. nil leaves the section out.
+	BuildSection(rep *Report) *ReportSection
+}
+
+//PostProcessor - a step run after a report has been sent
+type PostProcessor interface {
+	//Called with the report and the format it was sent as.
+	//Errors are logged - the report has already gone.
+	PostProcess(rep *Report, format string) error
+}
+
+//The registered hooks
+var plugins struct {
+	mu       sync.Mutex
+	filters  []RecordFilter
+	sections []SectionProvider
+	post     []PostProcessor
+}
+
+//RegisterRecordFilter - add a filter for the readings
+func RegisterRecordFilter(f RecordFilter) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.filters = append(plugins.filters, f)
+}
+
+//RegisterSection - add an extra section. A name already used is logged and ignored.
+func RegisterSection(p SectionProvider) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	if knownSections[p.Name()] || sectionProvider(p.Name()) != nil {
+		log.Println("Ignoring a second report section named", p.Name())
+		return
+	}
+	plugins.sections = append(plugins.sections, p)
+}
+
+//RegisterPostProcessor - add a step to run after each report is sent
+func RegisterPostProcessor(p PostProcessor) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.post = append(plugins.post, p)
+}
+
+//The provider for a section name - nil when there isn't one. Call with the lock held.
+func sectionProvider(name string) SectionProvider {
+	for _, p := range plugins.sections {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+//Whether a section name was registered
+func registeredSection(name string) bool {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	return sectionProvider(name) != nil
+}
+
+//Run the readings through the filters
+func filterReadings(readings []Reading, opts ReportOptions) []Reading {
+	plugins.mu.Lock()
+	filters := append([]RecordFilter(nil), plugins.filters...)
+	plugins.mu.Unlock()
+
+	for _, f := range filters {
+		readings = f.FilterReadings(readings, opts)
+	}
+	return readings
+}
+
+//Build the extra sections the report wants
+func extrasStep(b *reportBuilder) {
+	plugins.mu.Lock()
+	providers := append([]SectionProvider(nil), plugins.sections...)
+	plugins.mu.Unlock()
+
+	for _, p := range providers {
+		if !b.opts.wants(p.Name()) {
+			continue
+		}
+		if s := p.BuildSection(b.report); s != nil {
+			s.Name = p.Name()
+			b.report.Extras = append(b.report.Extras, *s)
+		}
+	}
+}
+
+//An extra section by name
+func (rep *Report) extra(name string) (ReportSection, bool) {
+	for _, s := range rep.Extras {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return ReportSection{}, false
+}
+
+//Run the post processors for a report that has been sent
+func postProcess(rep *Report, format string) {
+	plugins.mu.Lock()
+	post := append([]PostProcessor(nil), plugins.post...)
+	plugins.mu.Unlock()
+
+	for _, p := range post {
+		if err := p.PostProcess(rep, format); err != nil {
+			log.Println("Report post processing failed", err)
+		}
+	}
+}
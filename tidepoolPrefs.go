@@ -0,0 +1,381 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   Per user preferences.
+
+   Preferences are kept per profile - the Tidepool account's email, or its
+   user id when a restricted token is used - in prefs.json. The form
+   defaults are filled in from them on the home page once the session
+   knows whose it is, and a layout file chosen here replaces the one in
+   config.json for that profile's reports. The layout is looked for in the
+   profile's own folder under layouts first - where an imported one goes -
+   then in the working folder. "Remember these choices" on the
+   form saves its settings; the rest are set on the /prefs page.
+*/
+
+//Preferences file
+const prefsFile = "prefs.json"
+
+//Layouts imported with a profile's preferences, a folder per profile
+const layoutsDir = "layouts"
+
+//Preferences - one profile's settings
+type Preferences struct {
+	Units      Units   `json:"units"`     //mg/dL or mmol/L
+	Preset     string  `json:"preset"`    //Targets for a group, e.g. pregnancy - see tidepoolPresets.go
+	Timezone   string  `json:"timezone"`  //IANA name, e.g. America/Denver
+	TargetLow  float64 `json:"targetLow"` //Target range in mg/dl - 0 for the default
+	TargetHigh float64 `json:"targetHigh"`
+	Layout     string  `json:"layout"` //PDF layout file in the working folder
+	Language   string  `json:"language"`
+
+	//Where notifications go - every one filled in is used
+	NotifyEmail   string `json:"notifyEmail"`
+	NotifyWebhook string `json:"notifyWebhook"`
+	NotifyNtfy    string `json:"notifyNtfy"`   //ntfy topic url
+	PushoverUser  string `json:"pushoverUser"` //Pushover user key
+
+	//The daily check of the last 24 hours - see tidepoolAlerts.go
+	Alerts AlertSettings `json:"alerts"`
+
+	//Flag and alert rules, one per line - see tidepoolRules.go
+	Rules string `json:"rules"`
+
+	//Goals for the targets section - 0 keeps the config's
+	Goals ClinicalGoals `json:"goals"`
+
+	//Home form defaults
+	DataType    string `json:"dataType"`
+	Format      string `json:"format"`
+	GapHours    string `json:"gapHours"`
+	Sections    string `json:"sections"`
+	Watermark   string `json:"watermark"`
+	EmailTo     string `json:"emailTo"`     //Where to email the PDF, e.g. the clinic - see tidepoolEmail.go
+	ClockShifts string `json:"clockShifts"` //Device time corrections - see tidepoolClock.go
+
+	//PDF pages - see tidepoolLayout.go
+	Orientation  string `json:"orientation"`
+	TableColumns string `json:"tableColumns"`
+
+	//Care team emails that can comment on reports - see tidepoolReview.go
+	CareTeam string `json:"careTeam"`
+
+	//Keep every reading fetched for the year in review - see tidepoolArchive.go
+	Archive bool `json:"archive"`
+
+	//Reports generated, newest last - see tidepoolHistory.go
+	Reports []reportRecord `json:"reports,omitempty"`
+}
+
+//Preferences by profile, saved to a file
+type prefsStore struct {
+	mu       sync.Mutex
+	filename string
+	profiles map[string]Preferences
+}
+
+//The store used by the web handlers
+var prefs = &prefsStore{filename: prefsFile}
+
+//The profile a report request is for. A demo never signs in to Tidepool
+//so it has none - the email on the form proves nothing.
+func profileFor(r *http.Request) string {
+	if r.FormValue("demo") == "on" {
+		return ""
+	}
+	if r.FormValue("restrictedtoken") != "" {
+		return r.FormValue("tidepooluserid")
+	}
+	email := r.FormValue("useremail")
+	if email == "" {
+		email, _, _ = r.BasicAuth()
+	}
+	return strings.ToLower(email)
+}
+
+//Load the file the first time the store is used. Call with the lock held.
+func (p *prefsStore) load() {
+	if p.profiles != nil {
+		return
+	}
+	p.profiles = map[string]Preferences{}
+	file, err := ioutil.ReadFile(p.filename)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(file, &p.profiles); err != nil {
+		log.Println("Ignoring the preferences file", p.filename, err)
+		p.profiles = map[string]Preferences{}
+	}
+}
+
+//A profile's preferences - empty when it has none
+func (p *prefsStore) get(profile string) Preferences {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.load()
+	return p.profiles[profile]
+}
+
+//A copy of every profile's preferences
+func (p *prefsStore) all() map[string]Preferences {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.load()
+	all := make(map[string]Preferences, len(p.profiles))
+	for profile, pr := range p.profiles {
+		all[profile] = pr
+	}
+	return all
+}
+
+//Save a profile's preferences
+func (p *prefsStore) put(profile string, pr Preferences) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.load()
+	p.profiles[profile] = pr
+	data, err := json.MarshalIndent(p.profiles, "", "    ")
+	if err == nil {
+		err = ioutil.WriteFile(p.filename, data, 0600)
+	}
+	if err != nil {
+		log.Println("Error saving the preferences", err)
+	}
+}
+
+//Save the home form's choices as the profile's defaults
+func rememberFormChoices(profile string, r *http.Request) {
+	pr := prefs.get(profile)
+	pr.DataType = strings.Join(r.PostForm["datatype"], ",")
+	pr.Format = r.FormValue("format")
+	pr.GapHours = r.FormValue("gaphours")
+	pr.Sections = r.FormValue("sections")
+	pr.Watermark = r.FormValue("watermark")
+	pr.EmailTo = r.FormValue("emailto")
+	pr.ClockShifts = r.FormValue("clockshifts")
+	pr.Orientation = r.FormValue("orientation")
+	pr.TableColumns = r.FormValue("tablecolumns")
+	if units := r.FormValue("units"); units != "" {
+		pr.Units = unitsFrom(units)
+	}
+	prefs.put(profile, pr)
+}
+
+//The layout file a profile's preferences name - its own imported one
+//if it has one, otherwise the shared one in the working folder
+func profileLayout(profile string, name string) string {
+	own := filepath.Join(profileFile(layoutsDir, profile, ""), name)
+	if _, err := os.Stat(own); err == nil {
+		return own
+	}
+	return name
+}
+
+//Apply a profile's preferences to the report settings
+func (pr Preferences) apply(cfg *Config, profile string) {
+	//The profile's rules go after the global ones
+	if pr.Rules != "" {
+		cfg.Rules = append(cfg.Rules, pr.Rules)
+	}
+	if pr.Preset != "" {
+		cfg.Preset = pr.Preset
+	}
+	if pr.TargetLow > 0 {
+		cfg.TargetRange.Low = pr.TargetLow
+	}
+	if pr.TargetHigh > 0 {
+		cfg.TargetRange.High = pr.TargetHigh
+	}
+	cfg.Goals = pr.Goals.over(cfg.Goals)
+	//Only a file in the working folder - not any path on the server
+	if pr.Layout != "" && filepath.Base(pr.Layout) == pr.Layout {
+		cfg.Layout = pr.Layout
+		cfg.useLayout(profileLayout(profile, pr.Layout))
+	}
+}
+
+//Preferences page handler - /prefs. Shows the session profile's
+//preferences, or saves them on a POST and goes back home.
+func preferences(w http.ResponseWriter, r *http.Request) {
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so your preferences can be kept with your Tidepool account.")
+		return
+	}
+
+	pr := prefs.get(sess.profile)
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		pr.Units = Units(r.PostFormValue("units"))
+		pr.Timezone = strings.TrimSpace(r.PostFormValue("timezone"))
+		pr.Preset = r.PostFormValue("preset")
+		pr.TargetLow = formFloat(r, "targetlow")
+		pr.TargetHigh = formFloat(r, "targethigh")
+		pr.Layout = strings.TrimSpace(r.PostFormValue("layout"))
+		pr.Language = r.PostFormValue("language")
+		pr.NotifyEmail = strings.TrimSpace(r.PostFormValue("notifyemail"))
+		pr.NotifyWebhook = strings.TrimSpace(r.PostFormValue("notifywebhook"))
+		pr.NotifyNtfy = strings.TrimSpace(r.PostFormValue("notifyntfy"))
+		pr.PushoverUser = strings.TrimSpace(r.PostFormValue("pushoveruser"))
+		pr.Alerts.Enabled = r.PostFormValue("alertsenabled") == "on"
+		pr.Alerts.Hour, _ = strconv.Atoi(r.PostFormValue("alerthour"))
+		pr.Alerts.UserID = strings.TrimSpace(r.PostFormValue("alertuserid"))
+		if token := strings.TrimSpace(r.PostFormValue("alerttoken")); token != "" {
+			pr.Alerts.Token = token //Blank keeps the current one
+		}
+		pr.Alerts.DataType = r.PostFormValue("alertdatatype")
+		pr.Alerts.MaxLows, _ = strconv.Atoi(r.PostFormValue("alertmaxlows"))
+		pr.Alerts.MeanAbove = formFloat(r, "alertmeanabove")
+		pr.Alerts.NoData = r.PostFormValue("alertnodata") == "on"
+		pr.Rules = r.PostFormValue("rules")
+		pr.Archive = r.PostFormValue("archive") == "on"
+		pr.CareTeam = strings.TrimSpace(r.PostFormValue("careteam"))
+		pr.Goals = ClinicalGoals{
+			TimeInRange: formFloat(r, "goaltir"),
+			BelowRange:  formFloat(r, "goalbelow"),
+			CV:          formFloat(r, "goalcv"),
+			GMI:         formFloat(r, "goalgmi"),
+		}
+		prefs.put(sess.profile, pr)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	render(w, "templates/Preferences.html", struct {
+		Profile string
+		Prefs   Preferences
+		Presets []presetChoice
+		Year    int
+	}{sess.profile, pr, presetChoices(), time.Now().Year()})
+}
+
+/*
+   Portable preferences.
+
+   A profile's preferences can be downloaded as a JSON file and loaded
+   again on another machine, so moving doesn't mean setting everything up
+   by hand. The PDF layout file the preferences use is carried along in
+   the bundle.
+*/
+
+//The bundle format name and version
+const (
+	prefsBundleFormat  = "tidepoolreport-preferences"
+	prefsBundleVersion = 1
+)
+
+//A preferences export
+type prefsBundle struct {
+	Format      string          `json:"format"`
+	Version     int             `json:"version"`
+	Profile     string          `json:"profile"`
+	Preferences Preferences     `json:"preferences"`
+	Layout      json.RawMessage `json:"layout,omitempty"` //Contents of the layout file
+}
+
+//The profile's preferences export
+func prefsBundleFor(profile string) prefsBundle {
+	bundle := prefsBundle{
+		Format:      prefsBundleFormat,
+		Version:     prefsBundleVersion,
+		Profile:     profile,
+		Preferences: prefs.get(profile),
+	}
+	bundle.Preferences.Alerts.Token = "" //A credential - issue a new one on the new machine
+	if name := bundle.Preferences.Layout; name != "" && filepath.Base(name) == name {
+		if layout, err := ioutil.ReadFile(profileLayout(profile, name)); err == nil && json.Valid(layout) {
+			bundle.Layout = layout
+		}
+	}
+	return bundle
+}
+
+//Download the session profile's preferences - /prefs/export
+func exportPreferences(w http.ResponseWriter, r *http.Request) {
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know whose preferences to export.")
+		return
+	}
+
+	bundle := prefsBundleFor(sess.profile)
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="tidepoolreport-preferences.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(bundle); err != nil {
+		log.Println("Error writing the preferences export", err)
+	}
+}
+
+/*
+   Load an exported preferences file into the session profile - /prefs/import.
+   The layout file comes along into the profile's own layouts folder, so
+   it's only ever used for this profile's reports.
+*/
+func importPreferences(w http.ResponseWriter, r *http.Request) {
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know whose preferences to import.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/prefs", http.StatusSeeOther)
+		return
+	}
+
+	file, _, err := r.FormFile("prefsfile")
+	if err != nil {
+		DisplayMessageScreen(w, "Please choose an exported preferences file.")
+		return
+	}
+	defer file.Close()
+
+	var bundle prefsBundle
+	if err = json.NewDecoder(file).Decode(&bundle); err != nil || bundle.Format != prefsBundleFormat {
+		DisplayMessageScreen(w, "That is not a TidepoolReport preferences file.")
+		return
+	}
+	if bundle.Version > prefsBundleVersion {
+		DisplayMessageScreen(w, "That preferences file is from a newer version of TidepoolReport.")
+		return
+	}
+	bundle.restore(sess.profile)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+//Make the bundle the profile's preferences, bringing the layout file along
+//into the profile's layouts folder
+func (bundle prefsBundle) restore(profile string) {
+	pr := bundle.Preferences
+	if filepath.Base(pr.Layout) != pr.Layout || pr.Layout == "." || pr.Layout == ".." {
+		pr.Layout = "" //Only a file name - never a path
+	}
+	if pr.Layout != "" && json.Valid(bundle.Layout) {
+		dir := profileFile(layoutsDir, profile, "")
+		err := os.MkdirAll(dir, 0700)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, pr.Layout), bundle.Layout, 0600)
+		}
+		if err != nil {
+			log.Println("Error saving the imported layout", err)
+		}
+	}
+	prefs.put(profile, pr)
+}
@@ -0,0 +1,51 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//An imported layout is the importing profile's alone
+func TestImportedLayoutPerProfile(t *testing.T) {
+	inTempDir(t)
+	saved := prefs
+	prefs = &prefsStore{filename: filepath.Join(t.TempDir(), "prefs.json")}
+	defer func() { prefs = saved }()
+
+	bundle := prefsBundle{
+		Format:      prefsBundleFormat,
+		Version:     prefsBundleVersion,
+		Preferences: Preferences{Layout: "clinic.json"},
+		Layout:      []byte(`{"orientation": "landscape"}`),
+	}
+	bundle.restore("mallory@example.com")
+	if _, err := os.Stat("clinic.json"); !os.IsNotExist(err) {
+		t.Fatalf("the import wrote to the working folder: %v", err)
+	}
+
+	layoutOf := func(profile string) string {
+		cfg := defaultConfig()
+		Preferences{Layout: "clinic.json"}.apply(&cfg, profile)
+		return cfg.layout.orientation()
+	}
+	if got := layoutOf("mallory@example.com"); got != "L" {
+		t.Errorf("importer's layout orientation %q", got)
+	}
+	if got := layoutOf("victim@example.com"); got == "L" {
+		t.Error("another profile got the imported layout")
+	}
+	if b := prefsBundleFor("mallory@example.com"); string(b.Layout) != string(bundle.Layout) {
+		t.Errorf("export carries layout %s", b.Layout)
+	}
+
+	//A name that's a path is dropped
+	bundle.Preferences.Layout = ".."
+	bundle.restore("mallory@example.com")
+	if pr := prefs.get("mallory@example.com"); pr.Layout != "" {
+		t.Errorf("layout %q kept", pr.Layout)
+	}
+}
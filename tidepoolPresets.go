@@ -0,0 +1,118 @@
+package tidepoolreport
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+/*
+   Report presets.
+
+   A preset sets the target range and the clinical goals for a group of
+   people whose numbers aren't judged by the usual adult targets. The
+   range is used for the time in range bands, the chart's target band,
+   the readings coloring and the targets table. A preset is picked per
+   profile on the Preferences page, or for everyone with "preset" in
+   config.json. A target range or goals set in config.json or the
+   profile go over the preset's.
+
+       pregnancy   63-140 mg/dl, over 70% in range, under 4% below
+       pediatric   70-200 mg/dl, over 60% in range, under 4% below,
+                   with the report worded for a parent or caregiver
+*/
+
+//A report preset
+type reportPreset struct {
+	Title string //As shown on the Preferences page
+	Range TargetRange
+	Goals ClinicalGoals //Goals left at 0 are the usual ones
+
+	//Word the summary and insights for a parent or caregiver
+	Caregiver bool
+}
+
+//The presets by name
+var reportPresets = map[string]reportPreset{
+	//Battelino et al. 2019 targets for pregnancy with type 1 diabetes
+	"pregnancy": {
+		Title: "Pregnancy (63-140 mg/dl)",
+		Range: TargetRange{63, 140},
+		Goals: ClinicalGoals{TimeInRange: 70, BelowRange: 4, GMI: 6},
+	},
+	//Wider targets so well managed numbers for a growing child aren't
+	//marked as missed - a clinic's own can go in config.json
+	"pediatric": {
+		Title:     "Children (70-200 mg/dl)",
+		Range:     TargetRange{70, 200},
+		Goals:     ClinicalGoals{TimeInRange: 60, BelowRange: 4, GMI: 7.5},
+		Caregiver: true,
+	},
+}
+
+//Insight openings reworded for a caregiver
+var caregiverOpenings = []struct {
+	from string
+	to   string
+}{
+	{"Glucose tends to", "Your child's glucose tends to"},
+	{"Readings after breakfast", "Your child's readings after breakfast"},
+	{"Weekends run higher than weekdays", "Your child runs higher at weekends than on weekdays"},
+}
+
+//The insights worded for a caregiver
+func forCaregiver(insights []string) []string {
+	worded := make([]string, len(insights))
+	for i, s := range insights {
+		worded[i] = s
+		for _, o := range caregiverOpenings {
+			if strings.HasPrefix(s, o.from) {
+				worded[i] = o.to + strings.TrimPrefix(s, o.from)
+				break
+			}
+		}
+	}
+	return worded
+}
+
+//A preset by name. The usual targets for "" and unknown names.
+func presetNamed(name string) reportPreset {
+	if name == "" {
+		return reportPreset{Range: defaultTargetRange}
+	}
+	p, ok := reportPresets[name]
+	if !ok {
+		log.Println("Ignoring unknown report preset", name)
+		return reportPreset{Range: defaultTargetRange}
+	}
+	return p
+}
+
+//A preset for a select list
+type presetChoice struct {
+	Name  string
+	Title string
+}
+
+//The presets in name order
+func presetChoices() []presetChoice {
+	var choices []presetChoice
+	for name, p := range reportPresets {
+		choices = append(choices, presetChoice{name, p.Title})
+	}
+	sort.Slice(choices, func(i, j int) bool { return choices[i].Name < choices[j].Name })
+	return choices
+}
+
+//The target range, goals and wording for a preset, with a range or
+//goals set elsewhere going over the preset's
+func presetTargets(name string, rng TargetRange, goals ClinicalGoals) (TargetRange, ClinicalGoals, bool) {
+	p := presetNamed(name)
+	if rng.Low <= 0 {
+		rng.Low = p.Range.Low
+	}
+	if rng.High <= 0 {
+		rng.High = p.Range.High
+	}
+	return rng.orDefault(), goals.over(p.Goals), p.Caregiver
+}
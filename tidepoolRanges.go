@@ -0,0 +1,189 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+   Several date ranges in one report.
+
+   For "the two weeks before each of my last three appointments" the
+   Date Ranges box on the form (ranges= to the api) takes a range a line,
+   the start and end dates and an optional label:
+
+       2026-03-01 2026-03-14 Before the March visit
+       2026-06-01 to 2026-06-14
+
+   Each range is fetched on its own and readings outside all of them are
+   dropped, so the statistics, metrics, charts and tables are for the
+   ranges together. The "ranges" section has a line for each one with its
+   own readings, mean, time in range and CGM active time. Metrics over the
+   whole period, like CGM active, are left out of the summary, and data
+   gaps are looked for inside each range rather than between them.
+*/
+
+//DateRange - one of the report's date ranges, yyyy-mm-dd dates
+type DateRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Label string `json:"label,omitempty"`
+}
+
+//A range's summary for the ranges section
+type rangeSummary struct {
+	DateRange
+	Readings int     `json:"readings"`
+	Mean     float64 `json:"mean,omitempty"`      //mg/dl
+	InRange  float64 `json:"inRange"`             //Percent
+	Active   float64 `json:"cgmActive,omitempty"` //Percent of the time the CGM was active - 0 for meter readings
+	units    Units
+}
+
+//Parse the form's ranges - one a line, or separated by semicolons.
+//The dates are checked by validate.
+func parseDateRanges(s string) []DateRange {
+	var ranges []DateRange
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ';' }) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		dr := DateRange{Start: fields[0]}
+		rest := fields[1:]
+		if len(rest) > 0 && strings.EqualFold(rest[0], "to") {
+			rest = rest[1:]
+		}
+		if len(rest) > 0 {
+			dr.End, rest = rest[0], rest[1:]
+		}
+		dr.Label = strings.Join(rest, " ")
+		ranges = append(ranges, dr)
+	}
+	return ranges
+}
+
+//Use the ranges - in date order, with the report period running from the
+//first start to the last end
+func (opts *ReportOptions) setRanges(ranges []DateRange) {
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	opts.Ranges = ranges
+	if len(ranges) == 0 {
+		return
+	}
+	opts.StartDate, opts.EndDate = ranges[0].Start, ranges[0].End
+	for _, dr := range ranges[1:] {
+		if dr.End > opts.EndDate {
+			opts.EndDate = dr.End
+		}
+	}
+}
+
+//Check a range's dates
+func (dr DateRange) validate() error {
+	start, serr := time.Parse("2006-01-02", dr.Start)
+	end, eerr := time.Parse("2006-01-02", dr.End)
+	if serr != nil || eerr != nil {
+		return fmt.Errorf("%w: the range %q needs a yyyy-mm-dd start and end", ErrBadDateRange, strings.TrimSpace(dr.Start+" "+dr.End))
+	}
+	if end.Before(start) {
+		return fmt.Errorf("%w: the range %s to %s ends before it starts", ErrBadDateRange, dr.Start, dr.End)
+	}
+	return nil
+}
+
+//The range's name - its label or its dates
+func (dr DateRange) name() string {
+	if dr.Label != "" {
+		return dr.Label
+	}
+	return dr.Start + " to " + dr.End
+}
+
+//Whether the device time is on one of the range's days
+func (dr DateRange) contains(t time.Time) bool {
+	day := t.Format("2006-01-02")
+	return day >= dr.Start && day <= dr.End
+}
+
+//The readings inside any of the ranges - all of them when there are no ranges
+func readingsInRanges(readings []Reading, ranges []DateRange) []Reading {
+	if len(ranges) == 0 {
+		return readings
+	}
+	kept := readings[:0:0]
+	for _, rd := range readings {
+		for _, dr := range ranges {
+			if dr.contains(rd.Time) {
+				kept = append(kept, rd)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+//Each range's summary
+func summarizeRanges(readings []Reading, ranges []DateRange, rng TargetRange, u Units) []rangeSummary {
+	summaries := make([]rangeSummary, 0, len(ranges))
+	for _, dr := range ranges {
+		var in []Reading
+		for _, rd := range readings {
+			if dr.contains(rd.Time) {
+				in = append(in, rd)
+			}
+		}
+		rs := rangeSummary{DateRange: dr, Readings: len(in), units: u}
+		if len(in) > 0 {
+			st := computeStatsIn(in, rng)
+			rs.Mean, rs.InRange = st.mean, st.inRange
+			start, _ := time.Parse("2006-01-02", dr.Start)
+			end, _ := time.Parse("2006-01-02", dr.End)
+			rs.Active, _ = cgmActive(in, start, end)
+		}
+		summaries = append(summaries, rs)
+	}
+	return summaries
+}
+
+//The range as a line, e.g. "Before the March visit (2026-03-01 to 2026-03-14): 1344 readings, mean 154 mg/dl, 76% in range"
+func (rs rangeSummary) line() string {
+	s := rs.name()
+	if rs.Label != "" {
+		s += " (" + rs.Start + " to " + rs.End + ")"
+	}
+	if rs.Readings == 0 {
+		return s + ": no readings"
+	}
+	s = fmt.Sprintf("%s: %s, mean %s, %.0f%% in range", s, countOf(rs.Readings, "reading"), rs.units.withName(rs.Mean), rs.InRange)
+	if rs.Active > 0 {
+		s += fmt.Sprintf(", CGM active %.1f%%", rs.Active)
+	}
+	return s
+}
+
+//The ranges section as lines of text
+func rangeLines(summaries []rangeSummary) []string {
+	lines := make([]string, len(summaries))
+	for i, rs := range summaries {
+		lines[i] = rs.line()
+	}
+	return lines
+}
+
+//Keep the report to the ranges and summarize each one
+func rangesStep(b *reportBuilder) {
+	if len(b.opts.Ranges) == 0 {
+		return
+	}
+	rep := b.report
+	rep.Readings = readingsInRanges(rep.Readings, b.opts.Ranges)
+	rep.OtherReadings = readingsInRanges(rep.OtherReadings, b.opts.Ranges)
+	rep.Excluded = readingsInRanges(rep.Excluded, b.opts.Ranges)
+	rep.excludedOther = readingsInRanges(rep.excludedOther, b.opts.Ranges)
+	if b.opts.wants(sectionRanges) {
+		rep.Ranges = summarizeRanges(rep.Readings, b.opts.Ranges, rep.Target, rep.Units)
+	}
+}
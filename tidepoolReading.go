@@ -0,0 +1,134 @@
+package tidepoolreport
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   Glucose readings.
+
+   Tidepool stores glucose in mmol/L. Everything inside the report works
+   in mg/dL so readings are converted as they are decoded; Units is kept
+   on each reading so code outside the package never has to guess.
+   Reports can show mmol/L instead (ReportOptions.Units) - the values are
+   converted back as they're shown, with one decimal place.
+
+   Each reading keeps the Tidepool record id, upload id and device id it
+   came from so exported data can be traced back to the upload.
+*/
+
+//Units - glucose units
+type Units string
+
+//The glucose units
+const (
+	MgDL  Units = "mg/dL"
+	MmolL Units = "mmol/L"
+)
+
+//mmol/L to mg/dL
+const mmolToMgdl = 18
+
+//Reading - one glucose reading
+type Reading struct {
+	Time  time.Time `json:"time"`  //Device local clock time
+	Value float64   `json:"value"` //The reading in Units
+	Units Units     `json:"units"`
+	Type  string    `json:"type"` //Tidepool data type - smbg (meter) or cbg (CGM)
+
+	//Where it came from in Tidepool
+	ID       string `json:"id,omitempty"`
+	UploadID string `json:"uploadId,omitempty"`
+	DeviceID string `json:"deviceId,omitempty"`
+
+	//The device's name when asked for - see tidepoolSources.go
+	Source string `json:"source,omitempty"`
+
+	//On a day left out of the statistics - see tidepoolExclude.go
+	Excluded bool `json:"excluded,omitempty"`
+
+	//A meter's control solution test - see tidepoolControl.go
+	Control bool `json:"control,omitempty"`
+}
+
+//MgDL - the reading in mg/dL
+func (rd Reading) MgDL() float64 {
+	if rd.Units == MmolL {
+		return rd.Value * mmolToMgdl
+	}
+	return rd.Value
+}
+
+//MmolL - the reading in mmol/L
+func (rd Reading) MmolL() float64 {
+	if rd.Units == MmolL {
+		return rd.Value
+	}
+	return rd.Value / mmolToMgdl
+}
+
+//The units for a form or config value - mg/dL unless it says mmol
+func unitsFrom(s string) Units {
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(s)), "mmol") {
+		return MmolL
+	}
+	return MgDL
+}
+
+//The units name as the report shows it
+func (u Units) name() string {
+	if u == MmolL {
+		return string(MmolL)
+	}
+	return "mg/dl"
+}
+
+//A mg/dL value in the units - whole mg/dl or mmol/L to one decimal place
+func (u Units) format(mgdl float64) string {
+	if u == MmolL {
+		return strconv.FormatFloat(mgdl/mmolToMgdl, 'f', 1, 64)
+	}
+	return strconv.FormatFloat(mgdl, 'f', 0, 64)
+}
+
+//A mg/dL value in the units as a number, rounded the way format shows it
+func (u Units) in(mgdl float64) float64 {
+	if u == MmolL {
+		return math.Round(mgdl/mmolToMgdl*10) / 10
+	}
+	return math.Round(mgdl)
+}
+
+//A mg/dL value in the units with the units name, e.g. "7.4 mmol/L"
+func (u Units) withName(mgdl float64) string {
+	return u.format(mgdl) + " " + u.name()
+}
+
+//A glucose axis label - mmol/L without a trailing .0
+func (u Units) axisLabel(mgdl float64) string {
+	if u == MmolL {
+		return strconv.FormatFloat(u.in(mgdl), 'f', -1, 64)
+	}
+	return strconv.Itoa(int(mgdl))
+}
+
+//Format - the reading in the units, e.g. for a report template
+func (rd Reading) Format(u Units) string {
+	return u.format(rd.MgDL())
+}
+
+//Copies of the readings with their values in the units
+func readingsIn(readings []Reading, u Units) []Reading {
+	if u != MmolL || readings == nil {
+		return readings
+	}
+	out := make([]Reading, len(readings))
+	for i, rd := range readings {
+		rd.Value, rd.Units = rd.MmolL(), MmolL
+		out[i] = rd
+	}
+	return out
+}
@@ -0,0 +1,219 @@
+package tidepoolreport
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+/*
+   Tidepool records.
+
+   The records as Tidepool sends them and the glucose readings taken from
+   them. Nothing here touches the network or the disk so it builds for
+   WebAssembly along with the rest of the report engine - see tidepoolWasm.go.
+*/
+
+//Tidepool structures generated by github JSONtoGo
+type tpMeasurement []struct {
+	Conversionoffset    int           `json:"conversionOffset"`
+	Deviceid            string        `json:"deviceId"`
+	Devicetime          string        `json:"deviceTime"`
+	GUID                string        `json:"guid"`
+	ID                  string        `json:"id"`
+	Payload             Payload       `json:"payload,omitempty"`
+	Time                time.Time     `json:"time"`
+	Timezoneoffset      int           `json:"timezoneOffset"`
+	Type                string        `json:"type"`
+	Units               string        `json:"units,omitempty"`
+	Uploadid            string        `json:"uploadId"`
+	Value               float64       `json:"value,omitempty"`
+	Annotations         []Annotations `json:"annotations,omitempty"`
+	Byuser              string        `json:"byUser,omitempty"`
+	Client              Client        `json:"client,omitempty"`
+	Computertime        string        `json:"computerTime,omitempty"`
+	Devicemanufacturers []string      `json:"deviceManufacturers,omitempty"`
+	Devicemodel         string        `json:"deviceModel,omitempty"`
+	Deviceserialnumber  string        `json:"deviceSerialNumber,omitempty"`
+	Devicetags          []string      `json:"deviceTags,omitempty"`
+	Timeprocessing      string        `json:"timeProcessing,omitempty"`
+	Timezone            string        `json:"timezone,omitempty"`
+	Version             string        `json:"version,omitempty"`
+	Deliverytype        string        `json:"deliveryType,omitempty"`
+	Rate                float64       `json:"rate,omitempty"` //Basal units an hour
+	Duration            int           `json:"duration,omitempty"`
+	Subtype             string        `json:"subType,omitempty"`
+	Status              string        `json:"status,omitempty"`
+
+	//Bolus units - given and, when stopped part way, what was asked for
+	Normal           float64 `json:"normal,omitempty"`
+	Extended         float64 `json:"extended,omitempty"`
+	Expectednormal   float64 `json:"expectedNormal,omitempty"`
+	Expectedextended float64 `json:"expectedExtended,omitempty"`
+	Expectedduration int     `json:"expectedDuration,omitempty"`
+
+	//Carbs - the bolus calculator's entry or a food record's
+	Carbinput float64      `json:"carbInput,omitempty"`
+	Nutrition *tpNutrition `json:"nutrition,omitempty"`
+}
+
+//What a food record says was eaten
+type tpNutrition struct {
+	Carbohydrate struct {
+		Net   float64 `json:"net"`
+		Units string  `json:"units"`
+	} `json:"carbohydrate"`
+}
+
+//Additional structures passed by Tidepool
+//inside the measurement structure.
+//This code does not use them
+
+//Payload - not used
+type Payload struct {
+	Logindices []int `json:"logIndices"`
+}
+
+//Annotations - not used
+type Annotations struct {
+	Code string `json:"code"`
+}
+
+//Private - not used
+type Private struct {
+	Os string `json:"os"`
+}
+
+//Client - not used
+type Client struct {
+	Name    string  `json:"name"`
+	Private Private `json:"private"`
+	Version string  `json:"version"`
+}
+
+//This is the structure passed to the PDF generator
+//Date, time and value
+type Smbg struct {
+	smbgDate   string
+	smbgTime   string
+	smbgValue  string
+	smbgSource string
+}
+
+//The row's cells - with the source when the report has that column
+func (s Smbg) cells(sources bool) []string {
+	if sources {
+		return []string{s.smbgDate, s.smbgTime, s.smbgValue, s.smbgSource}
+	}
+	return []string{s.smbgDate, s.smbgTime, s.smbgValue}
+}
+
+//The readings table column headings
+func readingsHeader(u Units, sources bool) []string {
+	if sources {
+		return []string{"Date", "Time", "Glucose " + u.name(), "Source"}
+	}
+	return []string{"Date", "Time", "Glucose " + u.name()}
+}
+
+//Decode a Tidepool result set and count the records that couldn't be read.
+//An error means it isn't a result set - Tidepool probably returned an error response.
+//Strict decoding fails on any record that doesn't match - see tidepoolDecode.go.
+func decodeRecords(data []byte, strict bool) (tpMeasurement, int, error) {
+	//Usually the whole set decodes in one go
+	var result tpMeasurement
+	var err error
+	if !strict {
+		if err = json.Unmarshal(data, &result); err == nil {
+			return result, 0, nil
+		}
+	}
+
+	//Anything but an array is an error response
+	var raw []json.RawMessage
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, &TidepoolError{Kind: ErrTidepoolUnavailable, Body: data, Err: errors.New("the response is not a list of records")}
+	}
+	if strict {
+		result, err = decodeRecordsStrict(raw)
+		return result, 0, err
+	}
+
+	//Extract the measurement records one at a time - a record type with
+	//fields shaped differently (physicalActivity's duration) is skipped
+	result = make(tpMeasurement, 0, len(raw))
+	var skipped int
+	for _, rec := range raw {
+		one := make(tpMeasurement, 1)
+		if err = json.Unmarshal(rec, &one[0]); err != nil {
+			skipped++
+			continue
+		}
+		result = append(result, one[0])
+	}
+	if skipped > 0 {
+		log.Println("Skipped", skipped, "Tidepool records that couldn't be read")
+	}
+	return result, skipped, nil
+}
+
+//Build the smbg table rows from the measurement records
+func smbgsFrom(result tpMeasurement) []Smbg {
+	return smbgRows(readingsFrom(result, "smbg"), MgDL)
+}
+
+//Format readings as the PDF table rows - date, time and the value in the units,
+//whole mg/dl or mmol/L to one decimal place
+func smbgRows(readings []Reading, u Units) []Smbg {
+	smbgs := make([]Smbg, 0, len(readings)) //Slice of smbg structures
+
+	for _, rd := range readings {
+		smbgs = append(smbgs, Smbg{
+			smbgDate:   rd.Time.Format("2006-01-02"),
+			smbgTime:   rd.Time.Format("15:04:05"),
+			smbgValue:  rd.Format(u),
+			smbgSource: rd.Source,
+		})
+		if rd.Excluded {
+			smbgs[len(smbgs)-1].smbgValue += " (excluded)"
+		}
+	}
+	return smbgs
+}
+
+/*
+   Extract the readings of one glucose type (smbg or cbg).
+   The times are the device's local clock time and the values are
+   converted to mg/dL by the units each record gives - mmol/L, as Tidepool
+   stores them, is multiplied out and mg/dL is kept as it is. Readings in
+   units it doesn't know are left out. Control solution tests are marked.
+   Returned in time order.
+*/
+func readingsFrom(result tpMeasurement, datatype string) []Reading {
+	readings := make([]Reading, 0, len(result))
+
+	for i := range result {
+		if result[i].Type != datatype {
+			continue
+		}
+		mgdl, ok := glucoseMgDL(result[i].Value, result[i].Units)
+		if !ok {
+			continue
+		}
+		readings = append(readings, Reading{
+			Time:  deviceLocalTime(result[i].Devicetime, result[i].Time, result[i].Timezoneoffset),
+			Value: mgdl,
+			Units: MgDL,
+			Type:  datatype,
+
+			ID:       result[i].ID,
+			UploadID: result[i].Uploadid,
+			DeviceID: result[i].Deviceid,
+			Control:  controlSolution(result, i),
+		})
+	}
+	sort.Slice(readings, func(i, j int) bool { return readings[i].Time.Before(readings[j].Time) })
+	return readings
+}
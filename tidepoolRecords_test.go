@@ -0,0 +1,72 @@
+package tidepoolreport
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edrobinson/TidepoolReport/synth"
+)
+
+//90 days of made up pump, CGM and meter records - about 26,000 CGM readings
+var (
+	benchOnce sync.Once
+	benchData []byte
+)
+
+const benchStart, benchEnd = "2026-01-01", "2026-03-31"
+
+func benchRecords(b *testing.B) []byte {
+	benchOnce.Do(func() {
+		start, _ := time.Parse("2006-01-02", benchStart)
+		end, _ := time.Parse("2006-01-02", benchEnd)
+		p := synth.Default()
+		p.Start, p.End = start, end
+		benchData = synth.Generate(p)
+	})
+	return benchData
+}
+
+//The CGM readings from the records
+func benchReadings(b *testing.B) []Reading {
+	records, _, err := decodeRecords(benchRecords(b), false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return readingsFrom(records, "cbg")
+}
+
+func BenchmarkDecodeRecords(b *testing.B) {
+	data := benchRecords(b)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodeRecords(data, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeRecordsStrict(b *testing.B) {
+	data := benchRecords(b)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodeRecords(data, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//Decoding, the statistics and every step of the pipeline but the output
+func BenchmarkBuildReport(b *testing.B) {
+	data := benchRecords(b)
+	opts := ReportOptions{StartDate: benchStart, EndDate: benchEnd}
+	opts.setDataTypes([]string{"cbg"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := BuildReportFromData(data, nil, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
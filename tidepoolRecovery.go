@@ -0,0 +1,168 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+   Hypo recovery.
+
+   The "recovery" section (Hypo Recovery on the form) looks at how each
+   low was treated. A low is a run of readings under the target low. It
+   has recovered at the first reading back at or over the target low
+   that stays there for 15 minutes - a dip back under before then is the
+   same low, so a CGM wavering around the line isn't several lows. The
+   time from the first low reading to the recovery is how long it took.
+   A high over the target high within 2 hours of recovering is a
+   rebound - usually too much treatment.
+
+   A recovery needs a reading within an hour of the last low one. A meter
+   user who didn't test again for hours hasn't shown when the low ended,
+   so those lows are listed as not seen and left out of the average.
+*/
+
+//A reading this long after the last low one doesn't say when the low ended
+const recoveryGap = time.Hour
+
+//How long readings have to stay back up for the low to be over
+const sustainedRecovery = 15 * time.Minute
+
+//A high this soon after recovering is a rebound
+const reboundWindow = 2 * time.Hour
+
+//One low and how it ended
+type lowRecovery struct {
+	Start  time.Time `json:"start"`
+	Lowest float64   `json:"lowest"` //mg/dl
+
+	//From the first low reading to the first back in range - 0 when the
+	//readings don't show it
+	Recovery time.Duration `json:"recovery"`
+
+	//The highest reading over the target high within 2 hours of recovering, mg/dl - 0 for none
+	Rebound float64 `json:"rebound,omitempty"`
+}
+
+//The lows in the period
+type recoverySummary struct {
+	Lows   []lowRecovery `json:"lows"`
+	target TargetRange
+}
+
+//Find the lows in the readings and how each one ended.
+//The readings must be in time order.
+func findRecoveries(readings []Reading, rng TargetRange) *recoverySummary {
+	summary := &recoverySummary{target: rng}
+	for i := 0; i < len(readings); i++ {
+		if readings[i].MgDL() >= rng.Low {
+			continue
+		}
+		low := lowRecovery{Start: readings[i].Time, Lowest: readings[i].MgDL()}
+		last, back := i, -1
+		for {
+			for last+1 < len(readings) && readings[last+1].MgDL() < rng.Low {
+				last++
+				if readings[last].MgDL() < low.Lowest {
+					low.Lowest = readings[last].MgDL()
+				}
+			}
+			if last+1 == len(readings) || readings[last+1].Time.Sub(readings[last].Time) > recoveryGap {
+				break
+			}
+			//Back up - unless it dips under again within 15 minutes
+			dip := -1
+			for k := last + 1; k < len(readings) && readings[k].Time.Sub(readings[last+1].Time) < sustainedRecovery; k++ {
+				if readings[k].MgDL() < rng.Low {
+					dip = k
+					break
+				}
+			}
+			if dip < 0 {
+				back = last + 1
+				break
+			}
+			last = dip
+			if readings[dip].MgDL() < low.Lowest {
+				low.Lowest = readings[dip].MgDL()
+			}
+		}
+		i = last
+
+		if back >= 0 {
+			recovered := readings[back].Time
+			low.Recovery = recovered.Sub(low.Start)
+			for _, rd := range readings[back:] {
+				if rd.Time.Sub(recovered) > reboundWindow {
+					break
+				}
+				if rd.MgDL() > rng.High && rd.MgDL() > low.Rebound {
+					low.Rebound = rd.MgDL()
+				}
+			}
+		}
+		summary.Lows = append(summary.Lows, low)
+	}
+	return summary
+}
+
+//The summary lines - how many lows, the average recovery and the rebounds
+func (s *recoverySummary) lines(u Units) []string {
+	if len(s.Lows) == 0 {
+		return []string{fmt.Sprintf("No readings under %s in the period.", u.withName(s.target.Low))}
+	}
+	var total, longest time.Duration
+	var seen, rebounds int
+	for _, low := range s.Lows {
+		if low.Recovery == 0 {
+			continue
+		}
+		seen++
+		total += low.Recovery
+		if low.Recovery > longest {
+			longest = low.Recovery
+		}
+		if low.Rebound > 0 {
+			rebounds++
+		}
+	}
+
+	lines := []string{fmt.Sprintf("%s under %s, %d with a reading showing the recovery.", countOf(len(s.Lows), "low"), u.withName(s.target.Low), seen)}
+	if seen == 0 {
+		return lines
+	}
+	lines = append(lines,
+		fmt.Sprintf("Back to %s after %s on average, the longest %s.", u.withName(s.target.Low),
+			durationWords((total/time.Duration(seen)).Round(time.Minute)), durationWords(longest.Round(time.Minute))),
+		fmt.Sprintf("%d of the %d (%.0f%%) went over %s within 2 hours of recovering.", rebounds, seen,
+			percentOf(rebounds, seen), u.withName(s.target.High)))
+	return lines
+}
+
+//The table rows - time, lowest, minutes to recover and any rebound
+func (s *recoverySummary) rows(u Units) [][]string {
+	rows := make([][]string, 0, len(s.Lows))
+	for _, low := range s.Lows {
+		recovery, rebound := "not seen", ""
+		if low.Recovery > 0 {
+			recovery = fmt.Sprintf("%.0f", low.Recovery.Minutes())
+		}
+		if low.Rebound > 0 {
+			rebound = u.format(low.Rebound)
+		}
+		rows = append(rows, []string{low.Start.Format("2006-01-02 15:04"), u.format(low.Lowest), recovery, rebound})
+	}
+	return rows
+}
+
+//The table column headings
+func recoveryHeader(u Units) []string {
+	return []string{"Time", "Lowest " + u.name(), "Minutes To Recover", "Rebound " + u.name()}
+}
+
+//The lows in the readings counted and how they ended
+func recoveryStep(b *reportBuilder) {
+	if b.opts.Recovery {
+		b.report.Recovery = findRecoveries(b.report.Readings, b.report.Target)
+	}
+}
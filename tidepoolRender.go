@@ -0,0 +1,199 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+   The output formats.
+
+   Every way of sending a report is a renderer in the registry below.
+   A request picks one with the format parameter, or failing that with
+   its Accept header, so the same endpoint can hand a browser a PDF and a
+   script json.
+*/
+
+//An output format
+type renderer struct {
+	format      string //The format parameter value
+	contentType string //The media type matched against the Accept header
+	render      func(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report)
+}
+
+//The renderer registry. The first is used when any format will do.
+var renderers = []renderer{
+	{"pdf", "application/pdf", renderPDF},
+	{"html", "text/html", renderHTML},
+	{"csv", "text/csv", renderCSV},
+	{"xlsx", xlsxContentType, renderXlsx},
+	{"json", "application/json", renderJSON},
+	{"txt", "text/plain", renderText},
+	{"md", "text/markdown", renderMarkdown},
+	{"docx", docxContentType, renderDocx},
+}
+
+//The renderer for a format parameter
+func rendererFor(format string) (renderer, bool) {
+	for _, rd := range renderers {
+		if rd.format == strings.ToLower(format) {
+			return rd, true
+		}
+	}
+	return renderer{}, false
+}
+
+/*
+   Pick the renderer for the request.
+   An explicit format parameter wins. Otherwise the Accept header is
+   searched by quality, and no Accept header means the first renderer.
+   False when nothing asked for is available.
+*/
+func negotiateRenderer(r *http.Request) (renderer, bool) {
+	if format := r.FormValue("format"); format != "" {
+		return rendererFor(format)
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return renderers[0], true
+	}
+
+	//Media ranges with their quality, best first
+	type mediaRange struct {
+		media string
+		q     float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mr := mediaRange{media: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					mr.q = q
+				}
+			}
+		}
+		if mr.q > 0 {
+			ranges = append(ranges, mr)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, mr := range ranges {
+		for _, rd := range renderers {
+			if mr.media == "*/*" || mr.media == rd.contentType ||
+				(strings.HasSuffix(mr.media, "/*") && strings.HasPrefix(rd.contentType, strings.TrimSuffix(mr.media, "*"))) {
+				return rd, true
+			}
+		}
+	}
+	return renderer{}, false
+}
+
+//PDF - one per week in a zip when asked for
+func renderPDF(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report) {
+	if r.FormValue("splitweeks") == "on" {
+		ShowWeeklyPDFs(w, r, ws, cfg, rep)
+		return
+	}
+	if err := CreatePDF(w, ws.Path("tidepool.pdf"), cfg, rep); err != nil {
+		log.Println("Error creating the PDF", err)
+		http.Error(w, "Sorry, the PDF could not be made", http.StatusInternalServerError)
+		return
+	}
+	ws.deliver(w, r, "tidepool.pdf", "application/pdf", false)
+}
+
+//Plain text summary
+func renderText(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report) {
+	ShowText(w, textSummary(rep))
+}
+
+//Markdown report and charts as a zip
+func renderMarkdown(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report) {
+	md, images := markdownReport(rep)
+	ShowMarkdown(w, md, images)
+}
+
+//Editable Word document
+func renderDocx(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report) {
+	ShowDocx(w, docxReport(rep))
+}
+
+//Write the text summary to the browser
+func ShowText(w http.ResponseWriter, summary string) {
+	w.Header().Set("Content-type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, summary)
+}
+
+//Send the Markdown report and its images to the browser as a ZIP download
+func ShowMarkdown(w http.ResponseWriter, md string, images map[string][]byte) {
+	w.Header().Set("Content-type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="tidepool-report.zip"`)
+
+	//A browser that went away just stops the download
+	if err := writeMarkdownZip(w, md, images); err != nil {
+		log.Println("Error writing the Markdown report", err)
+	}
+}
+
+//Zip the Markdown report and its images
+func writeMarkdownZip(w io.Writer, md string, images map[string][]byte) error {
+	z := zip.NewWriter(w)
+	f, err := z.Create("tidepool-report.md")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write([]byte(md)); err != nil {
+		return err
+	}
+
+	for name, img := range images {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(img); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+//Send the Word report to the browser as a download
+func ShowDocx(w http.ResponseWriter, d *docxWriter) {
+	w.Header().Set("Content-type", docxContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="tidepool-report.docx"`)
+	if err := d.write(w); err != nil {
+		log.Println("Error writing the Word report", err)
+	}
+}
+
+//Send the workbook to the browser as a download
+func renderXlsx(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report) {
+	w.Header().Set("Content-type", xlsxContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="tidepool-report.xlsx"`)
+	if err := xlsxReport(rep).write(w); err != nil {
+		log.Println("Error writing the Excel report", err)
+	}
+}
+
+//Write the report to the browser as json
+func renderJSON(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report) {
+	w.Header().Set("Content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(jsonReport(rep)); err != nil {
+		log.Println("Error writing the json report", err)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+//A response writer whose browser went away
+type droppedWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (droppedWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func dropped() http.ResponseWriter {
+	return droppedWriter{httptest.NewRecorder()}
+}
+
+//A dropped download is logged, not fatal
+func TestShowMarkdownDropped(t *testing.T) {
+	ShowMarkdown(dropped(), "# Report", map[string][]byte{"glucose.png": {1, 2, 3}})
+}
+
+//A couple of days of demo meter readings
+func demoReport(t *testing.T) *Report {
+	opts := ReportOptions{StartDate: "2026-01-01", EndDate: "2026-01-09"}
+	opts.setDataTypes([]string{"smbg"})
+	rep, err := BuildDemoReport(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+func TestShowDocxDropped(t *testing.T) {
+	ShowDocx(dropped(), docxReport(demoReport(t)))
+}
+
+func TestShowWeeklyPDFsDropped(t *testing.T) {
+	ws := &Workspace{Dir: t.TempDir()}
+	cfg := defaultConfig()
+	cfg.layout = defaultLayout()
+	ShowWeeklyPDFs(dropped(), httptest.NewRequest(http.MethodGet, "/opts", nil), ws, cfg, demoReport(t))
+}
+
+//A workspace that's gone is a failed request, not the end of the server
+func TestShowWeeklyPDFsNoWorkspace(t *testing.T) {
+	ws := &Workspace{Dir: filepath.Join(t.TempDir(), "gone")}
+	cfg := defaultConfig()
+	cfg.layout = defaultLayout()
+	w := httptest.NewRecorder()
+	ShowWeeklyPDFs(w, httptest.NewRequest(http.MethodGet, "/opts", nil), ws, cfg, demoReport(t))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %d", w.Code)
+	}
+}
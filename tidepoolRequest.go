@@ -0,0 +1,416 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+   Running a report request.
+
+   The web form (/opts) and the api (/api/v1/report) take the same
+   parameters. reportForRequest does the shared work - sign in, fetch the
+   data and build the report - and each front end shows the result or the
+   failure its own way. The api also accepts the Tidepool email and
+   password as HTTP basic auth.
+*/
+
+//Why a report request failed
+type requestError struct {
+	status  int    //The http status for api callers
+	message string //What went wrong
+	body    []byte //The Tidepool error response when there is one
+	timeout bool   //The report deadline passed
+	err     error  //The cause - see tidepoolErrors.go
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+//Unwrap gives the cause so errors.Is works on request errors too
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+//The request error for a failure - the http status from its cause.
+//A passed deadline gets the timeout page.
+func requestErrorFor(err error) *requestError {
+	rerr := &requestError{status: http.StatusBadGateway, message: err.Error(), err: err}
+	var tpe *TidepoolError
+	if errors.As(err, &tpe) {
+		rerr.body = tpe.Body
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		rerr.status, rerr.timeout = http.StatusGatewayTimeout, true
+		rerr.message = "The report took too long and was stopped."
+	case errors.Is(err, ErrAuthFailed):
+		rerr.status = http.StatusUnauthorized
+	case errors.Is(err, ErrRateLimited):
+		rerr.status = http.StatusTooManyRequests
+	case errors.Is(err, ErrBadDateRange):
+		rerr.status = http.StatusBadRequest
+	case errors.Is(err, ErrNoData):
+		rerr.status = http.StatusNotFound
+	case errors.Is(err, ErrBadRecords):
+		rerr.status = http.StatusUnprocessableEntity
+	}
+	return rerr
+}
+
+//Read the report options from the home page form
+func reportOptionsFromForm(r *http.Request) ReportOptions {
+	opts := ReportOptions{
+		PatientName:  r.PostFormValue("useremail"),
+		StartDate:    r.PostFormValue("startdate"),
+		EndDate:      r.PostFormValue("enddate"),
+		GapThreshold: gapThreshold(r.PostFormValue("gaphours")),
+		Suspends:     r.PostFormValue("suspends") == "on",
+		Accuracy:     r.PostFormValue("accuracy") == "on",
+		Sessions:     r.PostFormValue("sessions") == "on",
+		Boluses:      r.PostFormValue("boluses") == "on",
+		Streaks:      r.PostFormValue("streaks") == "on",
+		Carbs:        r.PostFormValue("carbs") == "on",
+		Recovery:     r.PostFormValue("recovery") == "on",
+		Dawn:         r.PostFormValue("dawn") == "on",
+		Daily:        r.PostFormValue("daily") == "on",
+		Histogram:    r.PostFormValue("histogram") == "on",
+		Day:          r.PostFormValue("day"),
+		Anonymize:    r.PostFormValue("anonymize") == "on",
+		Changes:      r.PostFormValue("changes") == "on",
+		Units:        Units(r.PostFormValue("units")), //Blank for the preferences' units
+		ExcludeDays:  parseExcludeDays(r.PostFormValue("excludedays")),
+		ShowExcluded: r.PostFormValue("showexcluded") == "on",
+		Sources:      r.PostFormValue("sources") == "on",
+		KeepControl:  r.PostFormValue("keepcontrol") == "on",
+		FixClocks:    r.PostFormValue("fixclocks") == "on",
+		ClockShifts:  parseClockShifts(r.PostFormValue("clockshifts")),
+	}
+	//Several date ranges replace the start and end dates - see tidepoolRanges.go
+	if ranges := parseDateRanges(r.PostFormValue("ranges")); ranges != nil {
+		opts.setRanges(ranges)
+	}
+	//Several data types can be picked - see tidepoolTypes.go
+	opts.setDataTypes(parseDataTypes(r.PostForm["datatype"]...))
+	//Sections listed on the form replace the checkboxes
+	if sections := parseSections(r.PostFormValue("sections")); sections != nil {
+		opts.setSections(sections)
+	}
+	//An AGP report is CGM only with a layout of its own - see tidepoolAGP.go
+	if r.PostFormValue("agp") == "on" {
+		opts.setDataTypes([]string{"cbg"})
+		if opts.Sections == nil {
+			opts.setSections(agpSections)
+		}
+	}
+	//A day report covers just the day and has a layout of its own
+	if _, err := time.Parse("2006-01-02", opts.Day); err != nil {
+		opts.Day = ""
+	} else {
+		opts.StartDate, opts.EndDate = opts.Day, opts.Day
+		if opts.Sections == nil {
+			opts.setSections(daySections)
+		}
+	}
+	return opts
+}
+
+//Sign in to Tidepool for the request. A restricted token from the account
+//owner needs no login, otherwise a cached token is reused until it expires.
+//Also returns the token cache key of the account - empty with a restricted token.
+//The sign in and the fetcher's calls are given up when ctx is done.
+func fetcherForRequest(ctx context.Context, r *http.Request) (*tpFetcher, string, *requestError) {
+	email, password := r.FormValue("useremail"), r.FormValue("password")
+	if email == "" && password == "" {
+		email, password, _ = r.BasicAuth()
+	}
+	if r.FormValue("restrictedtoken") != "" {
+		if r.FormValue("tidepooluserid") == "" {
+			return nil, "", &requestError{status: http.StatusBadRequest, message: "The Tidepool user id is required with a restricted token."}
+		}
+		if !validUserID(r.FormValue("tidepooluserid")) {
+			return nil, "", &requestError{status: http.StatusBadRequest, message: "That isn't a Tidepool user id - it's only the digits 0-9 and the letters a-f."}
+		}
+		fetcher := newRestrictedFetcher(r.FormValue("tidepooluserid"), r.FormValue("restrictedtoken"))
+		fetcher.ctx = ctx
+		return fetcher, "", nil
+	}
+	if email == "" || password == "" {
+		return nil, "", &requestError{status: http.StatusUnauthorized, message: "Email and Password are required unless a restricted token is given."}
+	}
+	fetcher, _, err := newFetcher(ctx, email, password)
+	if err != nil {
+		log.Println(err)
+		return nil, "", requestErrorFor(err)
+	}
+	return fetcher, accountKey(email, password), nil
+}
+
+/*
+   Sign in, fetch the data into the workspace and build the report.
+   Also returns the report settings and the token cache key of the
+   account used - empty with a restricted token. A demo request skips
+   Tidepool and uses made up data - see tidepoolDemo.go.
+*/
+func reportForRequest(r *http.Request, ws *Workspace) (*Report, Config, string, *requestError) {
+	var cfg Config
+
+	//The deadline runs from the sign in, and is the report's own rather than
+	//the browser request's - a repeated submission may still be waiting on it
+	//after the first is dropped
+	ctx, cancel := context.WithTimeout(context.Background(), loadConfig(configFile).reportTimeout())
+	defer cancel()
+
+	var fetcher *tpFetcher
+	var key string
+	demo := r.FormValue("demo") == "on"
+	if !demo {
+		var rerr *requestError
+		if fetcher, key, rerr = fetcherForRequest(ctx, r); rerr != nil {
+			return nil, cfg, "", rerr
+		}
+	}
+
+	opts := reportOptionsFromForm(r)
+	sinceLastReport(r, &opts)
+	if opts.Changes {
+		opts.Previous = loadSnapshot(profileFor(r))
+	}
+	if err := opts.validate(); err != nil {
+		return nil, cfg, key, requestErrorFor(err)
+	}
+
+	//Report settings - header, footer, watermark and summary metrics
+	cfg = loadConfig(configFile)
+	pr := prefs.get(profileFor(r))
+	pr.apply(&cfg, profileFor(r))
+	if opts.Units == "" {
+		opts.Units = pr.Units
+	}
+	opts.Units = unitsFrom(string(opts.Units))
+	//A target range on the form is for this report only, in the report's units
+	scale := 1.0
+	if opts.Units == MmolL {
+		scale = mmolToMgdl
+	}
+	if low := formFloat(r, "targetlow"); low > 0 {
+		cfg.TargetRange.Low = low * scale
+	}
+	if high := formFloat(r, "targethigh"); high > 0 {
+		cfg.TargetRange.High = high * scale
+	}
+	if r.FormValue("watermark") != "" {
+		cfg.Watermark = r.FormValue("watermark")
+	}
+	//Landscape pages and readings side by side - see tidepoolLayout.go
+	if orientation := r.FormValue("orientation"); orientation != "" {
+		cfg.layout.Orientation = orientation
+	}
+	if sets, err := strconv.Atoi(r.FormValue("tablecolumns")); err == nil {
+		cfg.layout.TableColumns = sets
+	}
+	cfg.layout.check()
+	if opts.Anonymize {
+		cfg.PatientName = "" //The report's name is used instead
+	}
+	opts.Metrics = cfg.Metrics
+	opts.Rules = parseRules(cfg.Rules...)
+	opts.Target, opts.Goals, opts.Caregiver = cfg.targets()
+	//The form can switch the charts to grayscale or change the glucose axis
+	opts.Chart = cfg.Chart
+	opts.FullCGMTable = cfg.CGMTable == cgmTableAll
+	if style := r.FormValue("chartstyle"); style != "" {
+		opts.Chart.Style = style
+	}
+	if ymax, err := strconv.ParseFloat(r.FormValue("chartymax"), 64); err == nil && ymax > 0 {
+		opts.Chart.YMax = ymax
+	}
+	//The decoding mode from the config unless the request picks one
+	decoding := cfg.Decoding
+	if d := r.FormValue("decoding"); d != "" {
+		decoding = d
+	}
+	opts.Strict = decoding == decodeStrict
+	//Sections from the layout file, otherwise the config
+	if opts.Sections == nil && len(cfg.layout.Sections) > 0 {
+		opts.setSections(parseSections(cfg.layout.Sections...))
+	}
+	if opts.Sections == nil && len(cfg.Sections) > 0 {
+		opts.setSections(parseSections(cfg.Sections...))
+	}
+
+	if demo {
+		rep, err := BuildDemoReport(opts)
+		if err != nil {
+			return nil, cfg, "", requestErrorFor(err)
+		}
+		return rep, cfg, "", nil
+	}
+
+	//Very long ranges are processed a chunk at a time to stay in the memory budget
+	sdate, edate := opts.fetchDates()
+	if len(opts.Ranges) > 0 {
+		//Date ranges are fetched whole - they have to fit together
+		var need int64
+		for _, dr := range opts.Ranges {
+			need += estimateFetchBytes(opts.dataTypes(), dr.Start, dr.End)
+		}
+		if need > cfg.memoryBudget() {
+			return nil, cfg, key, requestErrorFor(fmt.Errorf("%w: the date ranges together are more data than can be handled at once - try fewer or shorter ranges", ErrBadDateRange))
+		}
+	} else if need := estimateFetchBytes(opts.dataTypes(), sdate, edate); need > cfg.memoryBudget() {
+		log.Printf("The fetch needs about %dMB - over the memory budget so it is done in chunks", need>>20)
+		rep, rerr := streamReport(fetcher, ws, opts, sdate, edate)
+		if rerr == nil {
+			noteReport(r, opts, rep)
+		}
+		return rep, cfg, key, rerr
+	}
+
+	//Get the data - long ranges are fetched in chunks, renewing the token as needed.
+	//Each of several date ranges is fetched on its own.
+	var data []byte
+	var err error
+	if len(opts.Ranges) > 0 {
+		data, _, err = fetcher.fetchRanges(opts.dataTypes(), opts.Ranges)
+	} else {
+		data, _, err = fetcher.fetchRange(opts.dataTypes(), sdate, edate)
+	}
+	if err != nil {
+		return nil, cfg, key, requestErrorFor(err)
+	}
+
+	//A day report shows any notes from Tidepool on its timeline
+	if opts.Day != "" && opts.wants(sectionTimeline) {
+		if notes, ok := fetcher.fetchNotes(sdate, edate); ok {
+			//The notes are extra - the report goes without them if they can't be saved
+			if err := ioutil.WriteFile(ws.Path("notes.json"), notes, 0600); err != nil {
+				log.Println("Error saving the notes file", err)
+			}
+		}
+	}
+
+	//Write it to a file
+	datafile := ws.Path("tidepool.json")
+	if err = ioutil.WriteFile(datafile, data, 0600); err != nil {
+		log.Println("Error saving the result data file", err)
+		return nil, cfg, key, &requestError{status: http.StatusInternalServerError, message: "Sorry, the report could not be made.", err: err}
+	}
+
+	//Build the report from the result data.
+	//It fails when Tidepool sent something other than data or there's nothing to show.
+	rep, err := BuildReport(datafile, opts)
+	if err != nil {
+		return nil, cfg, key, requestErrorFor(err)
+	}
+	rep.Warnings = append(fetcher.warnings, rep.Warnings...)
+	noteReport(r, opts, rep)
+	keepForReview(profileFor(r), opts, rep, data)
+	return rep, cfg, key, nil
+}
+
+//Show a failed request on the web page - the Tidepool error page when Tidepool sent one
+func showRequestError(w http.ResponseWriter, r *http.Request, ws *Workspace, e *requestError) {
+	if e.timeout {
+		showTimeout(w, r, e)
+		return
+	}
+	var tpe tpError
+	if e.body == nil || json.Unmarshal(e.body, &tpe) != nil {
+		DisplayMessageScreen(w, e.message)
+		return
+	}
+	//Without the file the message is still shown, just not Tidepool's page
+	datafile := ws.Path("tidepool-error.json")
+	if err := ioutil.WriteFile(datafile, e.body, 0600); err != nil {
+		log.Println("Error saving the Tidepool error response", err)
+		DisplayMessageScreen(w, e.message)
+		return
+	}
+	_ = CheckTidepoolErrorResponse(w, datafile)
+}
+
+//Api report endpoint - the same parameters as the form with the format
+//picked by the format parameter or the Accept header. Failures are json.
+func apiReport(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	rd, ok := negotiateRenderer(r)
+	if !ok {
+		writeJSONError(w, &requestError{status: http.StatusNotAcceptable, message: "None of the requested formats are available"})
+		return
+	}
+
+	ws, err := NewWorkspace()
+	if err != nil {
+		writeJSONError(w, &requestError{status: http.StatusInternalServerError, message: "Unable to create a work folder: " + err.Error()})
+		return
+	}
+	defer ws.Close()
+
+	rep, cfg, _, rerr := reportForRequest(r, ws)
+	if rerr != nil {
+		writeJSONError(w, rerr)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	rd.render(w, r, ws, cfg, rep)
+	postProcess(rep, rd.format)
+}
+
+//Api span endpoint - sign in as for a report and get how many records
+//of the datatype there are, the first and last and the days with data.
+//All of the type is fetched so it takes as long as a report with no dates.
+func apiSpan(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	datatype := r.FormValue("datatype")
+	if _, ok := recordsPerDay[datatype]; !ok {
+		writeJSONError(w, &requestError{status: http.StatusBadRequest, message: "datatype must be one of cbg, smbg, basal, bolus, wizard, food or deviceEvent"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), loadConfig(configFile).reportTimeout())
+	defer cancel()
+	fetcher, _, rerr := fetcherForRequest(ctx, r)
+	if rerr != nil {
+		writeJSONError(w, rerr)
+		return
+	}
+
+	data, _, err := fetcher.fetchRange(datatype, "", "")
+	if err != nil {
+		writeJSONError(w, requestErrorFor(err))
+		return
+	}
+	span, err := DataSpanOf(data, datatype)
+	if err != nil {
+		writeJSONError(w, requestErrorFor(err))
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(span)
+}
+
+//Write a failed request as json - the message and any Tidepool error response
+func writeJSONError(w http.ResponseWriter, e *requestError) {
+	reply := struct {
+		Error    string          `json:"error"`
+		Tidepool json.RawMessage `json:"tidepool,omitempty"`
+	}{Error: e.message}
+	if json.Valid(e.body) {
+		reply.Tidepool = e.body
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(reply)
+}
@@ -0,0 +1,56 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+//A workspace gone from under the request
+func goneWorkspace(t *testing.T) *Workspace {
+	ws, err := NewWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+	return ws
+}
+
+//A Tidepool error page that can't be saved still shows the message
+func TestShowRequestErrorUnsaved(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/opts", nil)
+	e := &requestError{status: http.StatusUnauthorized, message: "Tidepool refused the sign in", body: []byte(`{"code": 401, "reason": "No user matched"}`)}
+	showRequestError(w, r, goneWorkspace(t), e)
+	if !strings.Contains(w.Body.String(), e.message) {
+		t.Errorf("got %q", w.Body.String())
+	}
+}
+
+//Data that can't be saved is an error for the request, not the end of the server
+func TestReportDataUnsaved(t *testing.T) {
+	inTempDir(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+	if err := ioutil.WriteFile(configFile, []byte(`{"tidepoolServer": "`+srv.URL+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"tidepooluserid": {"abc123"}, "restrictedtoken": {"token"}, "datatype": {"cbg"},
+		"startdate": {"2026-01-01"}, "enddate": {"2026-01-07"}}
+	r := httptest.NewRequest(http.MethodPost, "/opts", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm()
+	_, _, _, rerr := reportForRequest(r, goneWorkspace(t))
+	if rerr == nil || rerr.status != http.StatusInternalServerError {
+		t.Errorf("got %+v", rerr)
+	}
+}
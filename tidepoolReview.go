@@ -0,0 +1,628 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   Care team review.
+
+   A patient names the people on their care team on the Preferences page,
+   and the admin lists who is a clinician under "clinicians" in
+   config.json. Both have to agree - the admin gives the role, the
+   patient gives the access. While a patient has a care team each report
+   they run is kept in the reviews folder: the Tidepool data it was built
+   from and the options it was built with. A clinician on the team finds
+   it on /reviews, reads it and adds comments, and the patient downloads
+   it again from /reviews with the comments as a last section. Reports
+   are rebuilt from the kept data each time so the comments show up in
+   every format.
+
+   A clinician finalizes the report that was gone over at the visit.
+   That locks it - no more comments - and records a hash of the data and
+   options it's built from, checked each time it's rebuilt, so the final
+   report is the one that was reviewed. Going on from there takes a new
+   version, a draft copy of the locked one.
+
+   Running a report for the same period again makes it the next version
+   of the one kept before rather than a report of its own. The earlier
+   versions stay, and /reviews/versions lists them with their summary
+   metrics side by side so two can be compared.
+*/
+
+//Folder for reports kept for review, a folder per patient
+const reviewDir = "reviews"
+
+//How many reports are kept for review for each patient
+const maxReviews = 20
+
+//The comments section's name
+const commentsSectionName = "comments"
+
+//A clinician's comment on a report
+type reviewComment struct {
+	By   string    `json:"by"`
+	At   time.Time `json:"at"`
+	Text string    `json:"text"`
+}
+
+//Who finalized a report and when, with the hash of what it's built from
+type reviewFinal struct {
+	By   string    `json:"by"`
+	At   time.Time `json:"at"`
+	Hash string    `json:"hash"` //sha256 of the data and options
+}
+
+//A report kept for review. The data is in a file of its own next to it.
+type reviewRecord struct {
+	ID        string          `json:"id"`
+	Generated time.Time       `json:"generated"`
+	Range     string          `json:"range"`
+	DataType  string          `json:"dataType"`
+	Options   ReportOptions   `json:"options"`
+	Comments  []reviewComment `json:"comments,omitempty"`
+	Metrics   []MetricValue   `json:"metrics,omitempty"` //The summary when it was made
+
+	//Versions - a new version is a draft copy of a finalized report
+	Version int          `json:"version,omitempty"` //1 when blank
+	Of      string       `json:"of,omitempty"`      //The first version's id
+	Final   *reviewFinal `json:"final,omitempty"`   //nil for a draft
+}
+
+//The version number
+func (rec reviewRecord) VersionNo() int {
+	if rec.Version == 0 {
+		return 1
+	}
+	return rec.Version
+}
+
+//The first version's id - the id of the report's versions
+func (rec reviewRecord) root() string {
+	if rec.Of == "" {
+		return rec.ID
+	}
+	return rec.Of
+}
+
+//The draft or final state as listed
+func (rec reviewRecord) Status() string {
+	if rec.Final == nil {
+		return fmt.Sprintf("Draft, version %d", rec.VersionNo())
+	}
+	return fmt.Sprintf("Final, version %d - %s %s", rec.VersionNo(), rec.Final.By, rec.Final.At.Format("2006-01-02"))
+}
+
+//Whether the profile has the clinician role
+func (cfg Config) isClinician(profile string) bool {
+	for _, c := range cfg.Clinicians {
+		if strings.EqualFold(strings.TrimSpace(c), profile) {
+			return true
+		}
+	}
+	return false
+}
+
+//The patient's care team - lower case emails
+func (pr Preferences) careTeam() []string {
+	var team []string
+	for _, email := range strings.FieldsFunc(pr.CareTeam, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+		team = append(team, strings.ToLower(email))
+	}
+	return team
+}
+
+//Whether the clinician can see and comment on the patient's reports
+func canReview(cfg Config, clinician string, patient string) bool {
+	if clinician == "" || !cfg.isClinician(clinician) {
+		return false
+	}
+	for _, member := range prefs.get(patient).careTeam() {
+		if member == clinician {
+			return true
+		}
+	}
+	return false
+}
+
+//The patient's review folder
+func reviewFolder(patient string) string {
+	return profileFile(reviewDir, patient, "")
+}
+
+//A kept report's file - ext is .json for the record or .data for the Tidepool data
+func reviewFile(patient, id, ext string) string {
+	return filepath.Join(reviewFolder(patient), filepath.Base(id)+ext)
+}
+
+//Keep a report for review when the patient has a care team
+func keepForReview(patient string, opts ReportOptions, rep *Report, data []byte) {
+	if patient == "" || len(prefs.get(patient).careTeam()) == 0 {
+		return
+	}
+	rec := reviewRecord{
+		ID:        newReviewID(),
+		Generated: time.Now(),
+		Range:     rep.Range(),
+		DataType:  opts.DataType,
+		Options:   opts,
+		Metrics:   rep.Metrics,
+	}
+	//The same period again is the next version of the report
+	for _, old := range loadReviews(patient) {
+		if old.Range == rec.Range && old.DataType == rec.DataType {
+			rec.Of, rec.Version = old.root(), nextVersion(patient, old.root())
+			break
+		}
+	}
+	err := os.MkdirAll(reviewFolder(patient), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(reviewFile(patient, rec.ID, ".data"), data, 0600)
+	}
+	if err == nil {
+		err = saveReview(patient, rec)
+	}
+	if err != nil {
+		log.Println("Error keeping the report for review for", patient, err)
+		return
+	}
+
+	//Only the newest reports are kept, all their versions with them.
+	//Final versions stay whatever their age.
+	reports := map[string]bool{}
+	for _, old := range loadReviews(patient) {
+		reports[old.root()] = true
+		if len(reports) > maxReviews && old.Final == nil {
+			os.Remove(reviewFile(patient, old.ID, ".json"))
+			os.Remove(reviewFile(patient, old.ID, ".data"))
+		}
+	}
+}
+
+//A new kept report's id
+func newReviewID() string {
+	return time.Now().Format("20060102-150405") + "-" + newSessionID()[:8]
+}
+
+//A report's versions, oldest first
+func loadVersions(patient, root string) []reviewRecord {
+	var versions []reviewRecord
+	for _, rec := range loadReviews(patient) {
+		if rec.root() == root {
+			versions = append(versions, rec)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].VersionNo() < versions[j].VersionNo() })
+	return versions
+}
+
+//The number for a report's next version
+func nextVersion(patient, root string) int {
+	last := 0
+	for _, rec := range loadVersions(patient, root) {
+		if rec.VersionNo() > last {
+			last = rec.VersionNo()
+		}
+	}
+	return last + 1
+}
+
+//The hash of what a kept report is built from - its data and options
+func (rec reviewRecord) hash(patient string) (string, error) {
+	data, err := ioutil.ReadFile(reviewFile(patient, rec.ID, ".data"))
+	if err != nil {
+		return "", err
+	}
+	options, err := json.Marshal(rec.Options)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(data)
+	h.Write(options)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//Save a review record
+func saveReview(patient string, rec reviewRecord) error {
+	data, err := json.MarshalIndent(rec, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(reviewFile(patient, rec.ID, ".json"), data, 0600)
+}
+
+//One of the patient's kept reports
+func loadReview(patient, id string) (reviewRecord, error) {
+	var rec reviewRecord
+	data, err := ioutil.ReadFile(reviewFile(patient, id, ".json"))
+	if err == nil {
+		err = json.Unmarshal(data, &rec)
+	}
+	return rec, err
+}
+
+//The patient's kept reports, newest first
+func loadReviews(patient string) []reviewRecord {
+	files, _ := filepath.Glob(filepath.Join(reviewFolder(patient), "*.json"))
+	var reviews []reviewRecord
+	for _, file := range files {
+		if rec, err := loadReview(patient, strings.TrimSuffix(filepath.Base(file), ".json")); err == nil {
+			reviews = append(reviews, rec)
+		}
+	}
+	sort.Slice(reviews, func(i, j int) bool { return reviews[i].Generated.After(reviews[j].Generated) })
+	return reviews
+}
+
+//Rebuild a kept report with its comments as the last section
+func (rec reviewRecord) report(patient string) (*Report, error) {
+	data, err := ioutil.ReadFile(reviewFile(patient, rec.ID, ".data"))
+	if err != nil {
+		return nil, err
+	}
+	//A final report has to be the one that was finalized
+	if rec.Final != nil {
+		hash, err := rec.hash(patient)
+		if err != nil {
+			return nil, err
+		}
+		if hash != rec.Final.Hash {
+			return nil, fmt.Errorf("the report has changed since it was finalized")
+		}
+	}
+	rep, err := BuildReportFromData(data, nil, rec.Options)
+	if err != nil {
+		return nil, err
+	}
+	if len(rec.Comments) == 0 && rec.Final == nil && rec.VersionNo() == 1 {
+		return rep, nil
+	}
+	comments := ReportSection{Name: commentsSectionName, Title: "Care team comments"}
+	comments.Lines = append(comments.Lines, rec.Status())
+	if rec.Final != nil {
+		comments.Lines = append(comments.Lines, "sha256 "+rec.Final.Hash)
+	}
+	for _, c := range rec.Comments {
+		comments.Lines = append(comments.Lines, fmt.Sprintf("%s, %s: %s", c.By, c.At.Format("2006-01-02"), c.Text))
+	}
+	rep.Extras = append(rep.Extras, comments)
+	if rep.Sections != nil {
+		rep.Sections = append(append([]string(nil), rep.Sections...), commentsSectionName)
+	}
+	return rep, nil
+}
+
+//A patient's reports as listed on the review page
+type reviewPatient struct {
+	Profile string
+	Reports []reviewRecord
+}
+
+//Review page handler - /reviews. The session profile's own kept reports
+//and, for a clinician, those of the patients who named them.
+func reviewPage(w http.ResponseWriter, r *http.Request) {
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know who you are.")
+		return
+	}
+	cfg := loadConfig(configFile)
+
+	var patients []reviewPatient
+	if cfg.isClinician(sess.profile) {
+		for patient := range prefs.all() {
+			if canReview(cfg, sess.profile, patient) {
+				patients = append(patients, reviewPatient{patient, loadReviews(patient)})
+			}
+		}
+		sort.Slice(patients, func(i, j int) bool { return patients[i].Profile < patients[j].Profile })
+	}
+	render(w, "templates/Reviews.html", struct {
+		Profile   string
+		Own       []reviewRecord
+		Clinician bool
+		Patients  []reviewPatient
+	}{sess.profile, loadReviews(sess.profile), cfg.isClinician(sess.profile), patients})
+}
+
+//The patient a review request is for - the session's own unless a
+//clinician on the team asks for another. "" when not allowed.
+func reviewPatientFor(r *http.Request, cfg Config, profile string) string {
+	patient := strings.ToLower(r.FormValue("patient"))
+	if patient == "" || patient == profile {
+		return profile
+	}
+	if canReview(cfg, profile, patient) {
+		return patient
+	}
+	return ""
+}
+
+//A kept report with its comments - /reviews/report?id=...&patient=...&format=...
+func reviewReport(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know who you are.")
+		return
+	}
+	cfg := loadConfig(configFile)
+	patient := reviewPatientFor(r, cfg, sess.profile)
+	if patient == "" {
+		DisplayMessageScreen(w, "You are not on that patient's care team.")
+		return
+	}
+	rd, ok := negotiateRenderer(r)
+	if !ok {
+		DisplayMessageScreen(w, "Sorry, that report format is not available.")
+		return
+	}
+	rec, err := loadReview(patient, r.FormValue("id"))
+	if err != nil {
+		DisplayMessageScreen(w, "That report is no longer kept.")
+		return
+	}
+	rep, err := rec.report(patient)
+	if err != nil {
+		DisplayMessageScreen(w, "Unable to rebuild the report: "+err.Error())
+		return
+	}
+
+	prefs.get(patient).apply(&cfg, patient)
+	ws, err := NewWorkspace()
+	if err != nil {
+		DisplayMessageScreen(w, "Unable to create a work folder: "+err.Error())
+		return
+	}
+	defer ws.Close()
+	ws.session = sess
+	w.Header().Set("Vary", "Accept")
+	rd.render(w, r, ws, cfg, rep)
+}
+
+//Add a clinician's comment to a patient's report - /reviews/comment
+func addReviewComment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/reviews", http.StatusSeeOther)
+		return
+	}
+	r.ParseForm()
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know who you are.")
+		return
+	}
+	cfg := loadConfig(configFile)
+	patient := strings.ToLower(r.PostFormValue("patient"))
+	if !canReview(cfg, sess.profile, patient) {
+		DisplayMessageScreen(w, "You are not on that patient's care team.")
+		return
+	}
+	text := strings.TrimSpace(r.PostFormValue("comment"))
+	if text == "" {
+		http.Redirect(w, r, "/reviews", http.StatusSeeOther)
+		return
+	}
+
+	rec, err := loadReview(patient, r.PostFormValue("id"))
+	if err != nil {
+		DisplayMessageScreen(w, "That report is no longer kept.")
+		return
+	}
+	if rec.Final != nil {
+		DisplayMessageScreen(w, "That report is final. Start a new version to comment on it again.")
+		return
+	}
+	rec.Comments = append(rec.Comments, reviewComment{By: sess.profile, At: time.Now(), Text: text})
+	if err = saveReview(patient, rec); err != nil {
+		log.Println("Error saving the comment", err)
+		DisplayMessageScreen(w, "Sorry, the comment couldn't be saved.")
+		return
+	}
+	http.Redirect(w, r, "/reviews", http.StatusSeeOther)
+}
+
+//Finalize a patient's report - /reviews/finalize. Only a clinician on
+//the team can, and a final report can't be changed.
+func finalizeReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/reviews", http.StatusSeeOther)
+		return
+	}
+	r.ParseForm()
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know who you are.")
+		return
+	}
+	cfg := loadConfig(configFile)
+	patient := strings.ToLower(r.PostFormValue("patient"))
+	if !canReview(cfg, sess.profile, patient) {
+		DisplayMessageScreen(w, "You are not on that patient's care team.")
+		return
+	}
+	rec, err := loadReview(patient, r.PostFormValue("id"))
+	if err != nil {
+		DisplayMessageScreen(w, "That report is no longer kept.")
+		return
+	}
+	if rec.Final != nil {
+		DisplayMessageScreen(w, "That report is already final.")
+		return
+	}
+	hash, err := rec.hash(patient)
+	if err == nil {
+		rec.Final = &reviewFinal{By: sess.profile, At: time.Now(), Hash: hash}
+		err = saveReview(patient, rec)
+	}
+	if err != nil {
+		log.Println("Error finalizing the report", err)
+		DisplayMessageScreen(w, "Sorry, the report couldn't be finalized.")
+		return
+	}
+	http.Redirect(w, r, "/reviews", http.StatusSeeOther)
+}
+
+//Start a new version of a final report - /reviews/version. A draft copy
+//of the data and options that the patient or a clinician on the team
+//can go on with while the final one stays as it was.
+func newReviewVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/reviews", http.StatusSeeOther)
+		return
+	}
+	r.ParseForm()
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know who you are.")
+		return
+	}
+	patient := reviewPatientFor(r, loadConfig(configFile), sess.profile)
+	if patient == "" {
+		DisplayMessageScreen(w, "You are not on that patient's care team.")
+		return
+	}
+	rec, err := loadReview(patient, r.PostFormValue("id"))
+	if err != nil {
+		DisplayMessageScreen(w, "That report is no longer kept.")
+		return
+	}
+	if rec.Final == nil {
+		DisplayMessageScreen(w, "That report is still a draft - carry on with it.")
+		return
+	}
+
+	draft := rec
+	draft.ID = newReviewID()
+	draft.Generated = time.Now()
+	draft.Version, draft.Of, draft.Final, draft.Comments = nextVersion(patient, rec.root()), rec.root(), nil, nil
+	data, err := ioutil.ReadFile(reviewFile(patient, rec.ID, ".data"))
+	if err == nil {
+		err = ioutil.WriteFile(reviewFile(patient, draft.ID, ".data"), data, 0600)
+	}
+	if err == nil {
+		err = saveReview(patient, draft)
+	}
+	if err != nil {
+		log.Println("Error starting a new version of the report", err)
+		DisplayMessageScreen(w, "Sorry, the new version couldn't be started.")
+		return
+	}
+	http.Redirect(w, r, "/reviews", http.StatusSeeOther)
+}
+
+//A summary metric in two versions
+type metricChange struct {
+	Name   string
+	A, B   string //The values - "" when the version didn't have it
+	Change string //B less A when both are numbers
+}
+
+//The summary metrics of two versions side by side, in a's order with
+//any only b has after
+func diffMetrics(a, b []MetricValue) []metricChange {
+	var changes []metricChange
+	inA := map[string]bool{}
+	for _, m := range a {
+		inA[m.Name] = true
+		c := metricChange{Name: m.Name, A: m.Value}
+		for _, n := range b {
+			if n.Name == m.Name {
+				c.B = n.Value
+			}
+		}
+		changes = append(changes, c)
+	}
+	for _, n := range b {
+		if !inA[n.Name] {
+			changes = append(changes, metricChange{Name: n.Name, B: n.Value})
+		}
+	}
+
+	//The difference of the leading numbers, e.g. "134 mg/dl" to "141 mg/dl" is +7
+	for i := range changes {
+		var x, y float64
+		_, errA := fmt.Sscanf(changes[i].A, "%g", &x)
+		_, errB := fmt.Sscanf(changes[i].B, "%g", &y)
+		switch {
+		case errA != nil || errB != nil:
+		case y == x:
+			changes[i].Change = "-"
+		default:
+			changes[i].Change = strconv.FormatFloat(math.Round((y-x)*100)/100, 'f', -1, 64)
+			if y > x {
+				changes[i].Change = "+" + changes[i].Change
+			}
+		}
+	}
+	return changes
+}
+
+//A report's versions - /reviews/versions?id=...&patient=... with a and b
+//picking two versions to compare
+func reviewVersions(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	sess := appSessions.lookup(r)
+	if sess == nil || sess.profile == "" {
+		DisplayMessageScreen(w, "Run a report first so we know who you are.")
+		return
+	}
+	patient := reviewPatientFor(r, loadConfig(configFile), sess.profile)
+	if patient == "" {
+		DisplayMessageScreen(w, "You are not on that patient's care team.")
+		return
+	}
+	rec, err := loadReview(patient, r.FormValue("id"))
+	if err != nil {
+		DisplayMessageScreen(w, "That report is no longer kept.")
+		return
+	}
+	versions := loadVersions(patient, rec.root())
+
+	//The last two versions are compared unless others are picked
+	page := struct {
+		Patient  string //Blank for the session's own
+		Range    string
+		Versions []reviewRecord
+		A, B     int
+		Changes  []metricChange
+	}{Range: rec.Range, Versions: versions}
+	if patient != sess.profile {
+		page.Patient = patient
+	}
+	page.A, _ = strconv.Atoi(r.FormValue("a"))
+	page.B, _ = strconv.Atoi(r.FormValue("b"))
+	if (page.A == 0 || page.B == 0) && len(versions) > 1 {
+		page.A, page.B = versions[len(versions)-2].VersionNo(), versions[len(versions)-1].VersionNo()
+	}
+	var a, b *reviewRecord
+	for i := range versions {
+		switch versions[i].VersionNo() {
+		case page.A:
+			a = &versions[i]
+		case page.B:
+			b = &versions[i]
+		}
+	}
+	if a != nil && b != nil {
+		page.Changes = diffMetrics(a.Metrics, b.Metrics)
+	}
+	render(w, "templates/ReviewVersions.html", page)
+}
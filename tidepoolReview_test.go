@@ -0,0 +1,142 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testPatient   = "patient@example.com"
+	testClinician = "doc@example.com"
+)
+
+//A patient with a clinician on their care team and a report kept for
+//review, in a folder of its own
+func reviewSetup(t *testing.T) reviewRecord {
+	inTempDir(t)
+	saved := prefs
+	prefs = &prefsStore{filename: filepath.Join(t.TempDir(), "prefs.json")}
+	t.Cleanup(func() { prefs = saved })
+	if err := saveConfig(configFile, Config{Clinicians: []string{testClinician}}); err != nil {
+		t.Fatal(err)
+	}
+	prefs.put(testPatient, Preferences{CareTeam: testClinician})
+
+	start, _ := time.Parse("2006-01-02", "2026-01-01")
+	data := demoRecords(start, start.AddDate(0, 0, 6))
+	opts := ReportOptions{StartDate: "2026-01-01", EndDate: "2026-01-07"}
+	opts.setDataTypes([]string{"smbg"})
+	rep, err := BuildReportFromData(data, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepForReview(testPatient, opts, rep, data)
+	kept := loadReviews(testPatient)
+	if len(kept) != 1 {
+		t.Fatalf("%d reports kept", len(kept))
+	}
+	return kept[0]
+}
+
+//Post a review form as the profile
+func postReview(t *testing.T, handler http.HandlerFunc, profile string, form url.Values) *httptest.ResponseRecorder {
+	sess := &appSession{id: newSessionID(), profile: profile}
+	appSessions.save(sess)
+	r := httptest.NewRequest(http.MethodPost, "/reviews", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: sess.id})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+//Only a clinician on the team finalizes, and a final report is locked
+func TestFinalizeReview(t *testing.T) {
+	rec := reviewSetup(t)
+	form := url.Values{"patient": {testPatient}, "id": {rec.ID}}
+
+	for _, who := range []string{testPatient, "other@example.com"} {
+		postReview(t, finalizeReview, who, form)
+		if got, _ := loadReview(testPatient, rec.ID); got.Final != nil {
+			t.Fatalf("%s finalized the report", who)
+		}
+	}
+
+	postReview(t, finalizeReview, testClinician, form)
+	final, err := loadReview(testPatient, rec.ID)
+	if err != nil || final.Final == nil || final.Final.By != testClinician {
+		t.Fatalf("not finalized: %+v %v", final.Final, err)
+	}
+	if hash, _ := final.hash(testPatient); hash != final.Final.Hash {
+		t.Errorf("final hash %s, the data's %s", final.Final.Hash, hash)
+	}
+
+	//No more comments
+	postReview(t, addReviewComment, testClinician, url.Values{"patient": {testPatient}, "id": {rec.ID}, "comment": {"Late"}})
+	if got, _ := loadReview(testPatient, rec.ID); len(got.Comments) != 0 {
+		t.Errorf("commented on a final report: %+v", got.Comments)
+	}
+
+	//The final report rebuilds with the hash in its comments
+	rep, err := final.report(testPatient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := rep.extra(commentsSectionName); !ok || !strings.Contains(strings.Join(s.Lines, "\n"), final.Final.Hash) {
+		t.Errorf("no hash in the comments section: %+v", s)
+	}
+}
+
+//A final report whose data or options changed won't rebuild
+func TestFinalReviewTampered(t *testing.T) {
+	rec := reviewSetup(t)
+	postReview(t, finalizeReview, testClinician, url.Values{"patient": {testPatient}, "id": {rec.ID}})
+	final, _ := loadReview(testPatient, rec.ID)
+	if final.Final == nil {
+		t.Fatal("not finalized")
+	}
+
+	changed := final
+	changed.Options.EndDate = "2026-01-06"
+	if _, err := changed.report(testPatient); err == nil || !strings.Contains(err.Error(), "changed since it was finalized") {
+		t.Errorf("rebuilt a final report with changed options: %v", err)
+	}
+
+	file := reviewFile(testPatient, rec.ID, ".data")
+	data, _ := ioutil.ReadFile(file)
+	if err := ioutil.WriteFile(file, append(data[:len(data)-1], []byte(",{}]")...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := final.report(testPatient); err == nil || !strings.Contains(err.Error(), "changed since it was finalized") {
+		t.Errorf("rebuilt a final report with changed data: %v", err)
+	}
+}
+
+//A new version of a final report is a draft and the final one stays
+func TestNewReviewVersion(t *testing.T) {
+	rec := reviewSetup(t)
+	form := url.Values{"patient": {testPatient}, "id": {rec.ID}}
+	postReview(t, newReviewVersion, testPatient, form)
+	if len(loadReviews(testPatient)) != 1 {
+		t.Fatal("started a new version of a draft")
+	}
+
+	postReview(t, finalizeReview, testClinician, form)
+	postReview(t, newReviewVersion, testPatient, form)
+	versions := loadVersions(testPatient, rec.ID)
+	if len(versions) != 2 {
+		t.Fatalf("%d versions", len(versions))
+	}
+	if versions[0].Final == nil || versions[1].Final != nil || versions[1].VersionNo() != 2 {
+		t.Errorf("versions %s and %s", versions[0].Status(), versions[1].Status())
+	}
+}
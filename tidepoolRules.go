@@ -0,0 +1,221 @@
+package tidepoolreport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+   Rules.
+
+   A rule is one line:
+
+       action "label" when aggregation op threshold [per window]
+
+   e.g.
+       flag "nights with lows" when count(<70) >= 1 per night
+       flag "days averaging over 200" when mean > 200 per day
+       alert "More than 2 lows" when lows > 2
+       alert "No uploads" when count = 0
+
+   action      flag - listed in the report's flags section
+               alert - sent by the daily check
+   aggregation count, mean, min, max, lows (separate lows),
+               count(<70) - readings past a value,
+               percent(>180) - percent of readings past a value
+   op          < <= > >= = !=
+   window      day, night (midnight to 6am), week or nothing for the whole period
+
+   Values are mg/dl. A windowed rule reports how many windows matched,
+   e.g. "3 nights with lows". Only windows with readings are looked at.
+   Rules come from "rules" in config.json and the profile's preferences.
+*/
+
+//Rule - a parsed rule line
+type Rule struct {
+	Action    string //flag or alert
+	Label     string
+	Agg       string //count, mean, min, max, lows or percent
+	CountOp   string //For count(...) and percent(...) - "" counts every reading
+	CountAt   float64
+	Op        string
+	Threshold float64
+	Window    string //day, night, week or "" for the whole period
+}
+
+//The rule line syntax
+var rulePattern = regexp.MustCompile(`^(flag|alert)\s+"([^"]+)"\s+when\s+(count|mean|min|max|lows|percent)(?:\(\s*(<=|>=|<|>)\s*([0-9.]+)\s*\))?\s*(<=|>=|!=|<|>|=)\s*([0-9.]+)(?:\s+per\s+(day|night|week))?$`)
+
+//Parse one rule line
+func parseRule(line string) (Rule, error) {
+	m := rulePattern.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return Rule{}, errors.New("not a rule")
+	}
+	rl := Rule{Action: m[1], Label: m[2], Agg: m[3], CountOp: m[4], Op: m[6], Window: m[8]}
+	var err error
+	if rl.CountOp != "" {
+		if rl.Agg != "count" && rl.Agg != "percent" {
+			return Rule{}, errors.New("only count and percent take a value")
+		}
+		if rl.CountAt, err = strconv.ParseFloat(m[5], 64); err != nil {
+			return Rule{}, err
+		}
+	} else if rl.Agg == "percent" {
+		return Rule{}, errors.New("percent needs a value, e.g. percent(>180)")
+	}
+	if rl.Threshold, err = strconv.ParseFloat(m[7], 64); err != nil {
+		return Rule{}, err
+	}
+	return rl, nil
+}
+
+//Parse rule lines. Each entry may hold several lines. Blank lines
+//and # comments are skipped, bad rules are logged and dropped.
+func parseRules(entries ...string) []Rule {
+	var rules []Rule
+	for _, entry := range entries {
+		for _, line := range strings.Split(entry, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			rl, err := parseRule(line)
+			if err != nil {
+				log.Printf("Ignoring rule %q: %v", line, err)
+				continue
+			}
+			rules = append(rules, rl)
+		}
+	}
+	return rules
+}
+
+//Compare a value with op
+func compare(v float64, op string, to float64) bool {
+	switch op {
+	case "<":
+		return v < to
+	case "<=":
+		return v <= to
+	case ">":
+		return v > to
+	case ">=":
+		return v >= to
+	case "=":
+		return v == to
+	case "!=":
+		return v != to
+	}
+	return false
+}
+
+//The rule's aggregation over some readings. false when there's nothing to aggregate.
+func (rl Rule) aggregate(readings []Reading) (float64, bool) {
+	switch rl.Agg {
+	case "count", "percent":
+		var n int
+		for _, rd := range readings {
+			if rl.CountOp == "" || compare(rd.MgDL(), rl.CountOp, rl.CountAt) {
+				n++
+			}
+		}
+		if rl.Agg == "count" {
+			return float64(n), true
+		}
+		if len(readings) == 0 {
+			return 0, false
+		}
+		return percentOf(n, len(readings)), true
+	case "lows":
+		return float64(computeStats(readings).hypos), true
+	}
+
+	if len(readings) == 0 {
+		return 0, false
+	}
+	st := computeStats(readings)
+	switch rl.Agg {
+	case "mean":
+		return st.mean, true
+	case "min", "max":
+		v := readings[0].MgDL()
+		for _, rd := range readings[1:] {
+			if (rl.Agg == "min") == (rd.MgDL() < v) {
+				v = rd.MgDL()
+			}
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+//The window a reading falls in - "" when it's outside every window
+func (rl Rule) windowOf(rd Reading) string {
+	switch rl.Window {
+	case "day":
+		return rd.Time.Format("2006-01-02")
+	case "night":
+		if rd.Time.Hour() < 6 {
+			return rd.Time.Format("2006-01-02")
+		}
+		return ""
+	case "week":
+		year, week := rd.Time.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	return ""
+}
+
+//Run the rule over the readings, which must be in time order.
+//Returns what it found or "" for nothing.
+func (rl Rule) eval(readings []Reading) string {
+	if rl.Window == "" {
+		if v, ok := rl.aggregate(readings); ok && compare(v, rl.Op, rl.Threshold) {
+			return rl.Label
+		}
+		return ""
+	}
+
+	//Split the readings into windows and count the ones that match
+	var order []string
+	windows := map[string][]Reading{}
+	for _, rd := range readings {
+		key := rl.windowOf(rd)
+		if key == "" {
+			continue
+		}
+		if _, ok := windows[key]; !ok {
+			order = append(order, key)
+		}
+		windows[key] = append(windows[key], rd)
+	}
+	var matched int
+	for _, key := range order {
+		if v, ok := rl.aggregate(windows[key]); ok && compare(v, rl.Op, rl.Threshold) {
+			matched++
+		}
+	}
+	if matched == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d %s", matched, rl.Label)
+}
+
+//Run the rules with the action over the readings
+func evalRules(rules []Rule, action string, readings []Reading) []string {
+	var found []string
+	for _, rl := range rules {
+		if rl.Action != action {
+			continue
+		}
+		if msg := rl.eval(readings); msg != "" {
+			found = append(found, msg)
+		}
+	}
+	return found
+}
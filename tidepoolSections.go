@@ -0,0 +1,158 @@
+package tidepoolreport
+
+import (
+	"log"
+	"strings"
+)
+
+/*
+   Report sections.
+
+   Which sections a report has, and their order, can be declared in
+   config.json or on the form, e.g. "summary, chart, readings". The
+   builder only works out the sections that were asked for and each
+   renderer outputs them in the order given. A renderer skips a section
+   it has no way to show. With nothing declared each output keeps its
+   usual layout.
+*/
+
+//The report sections
+const (
+	sectionInsights  = "insights"   //Patterns spotted in the readings
+	sectionSummary   = "summary"    //The summary metrics
+	sectionFlags     = "flags"      //What the flag rules found
+	sectionTargets   = "targets"    //The period against the clinical goals
+	sectionChart     = "chart"      //The trend chart
+	sectionGRI       = "gri"        //The GRI grid - CGM only
+	sectionDaily     = "daily"      //Thumbnails of the last 14 days, or every day with daily charts
+	sectionGaps      = "gaps"       //Periods with no readings
+	sectionReadings  = "readings"   //The table of readings
+	sectionSuspends  = "suspends"   //Pump suspend timeline
+	sectionAccuracy  = "accuracy"   //Meter vs CGM accuracy
+	sectionSessions  = "sessions"   //CGM sensor sessions
+	sectionTimeline  = "timeline"   //Events through the day - day reports only
+	sectionChanges   = "changes"    //What's new since the last run
+	sectionBoluses   = "boluses"    //Insulin boluses
+	sectionStreaks   = "streaks"    //Streaks and personal bests
+	sectionCarbs     = "carbs"      //Carb entries with the glucose and insulin around them
+	sectionBasal     = "basal"      //Basal insulin a day at a time
+	sectionStats     = "statistics" //Count, mean, median, lowest, highest and SD
+	sectionTIR       = "tir"        //Time in range up top
+	sectionAGP       = "agp"        //Ambulatory glucose profile - CGM only
+	sectionHistogram = "histogram"  //How the readings are spread
+	sectionRanges    = "ranges"     //Each date range on its own - reports over several ranges
+	sectionRecovery  = "recovery"   //How each low ended
+	sectionDawn      = "dawn"       //The rise from 3am to 8am
+
+	sectionOtherReadings = "otherreadings" //The table of the other glucose type's readings
+)
+
+//Section names that can be asked for
+var knownSections = map[string]bool{
+	sectionInsights:  true,
+	sectionSummary:   true,
+	sectionFlags:     true,
+	sectionTargets:   true,
+	sectionChart:     true,
+	sectionGRI:       true,
+	sectionDaily:     true,
+	sectionGaps:      true,
+	sectionReadings:  true,
+	sectionSuspends:  true,
+	sectionAccuracy:  true,
+	sectionSessions:  true,
+	sectionTimeline:  true,
+	sectionChanges:   true,
+	sectionBoluses:   true,
+	sectionStreaks:   true,
+	sectionCarbs:     true,
+	sectionBasal:     true,
+	sectionStats:     true,
+	sectionTIR:       true,
+	sectionAGP:       true,
+	sectionHistogram: true,
+	sectionRanges:    true,
+	sectionRecovery:  true,
+	sectionDawn:      true,
+
+	sectionOtherReadings: true,
+}
+
+//Parse section names. Each entry may hold several names separated
+//by commas or spaces. Unknown and repeated names are logged and dropped.
+func parseSections(entries ...string) []string {
+	var sections []string
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		for _, name := range strings.FieldsFunc(entry, func(r rune) bool { return r == ',' || r == ' ' }) {
+			name = strings.ToLower(name)
+			switch {
+			case !knownSections[name] && !registeredSection(name):
+				log.Println("Ignoring unknown report section", name)
+			case seen[name]:
+				log.Println("Ignoring repeated report section", name)
+			default:
+				seen[name] = true
+				sections = append(sections, name)
+			}
+		}
+	}
+	return sections
+}
+
+//Use a declared section list. The optional sections are on exactly
+//when they are listed so the right data gets fetched.
+func (opts *ReportOptions) setSections(sections []string) {
+	opts.Sections = sections
+	opts.Suspends = opts.wants(sectionSuspends)
+	opts.Accuracy = opts.wants(sectionAccuracy)
+	opts.Sessions = opts.wants(sectionSessions)
+	opts.Changes = opts.wants(sectionChanges)
+	opts.Boluses = opts.wants(sectionBoluses)
+	opts.Streaks = opts.wants(sectionStreaks)
+	opts.Carbs = opts.wants(sectionCarbs)
+	opts.Recovery = opts.wants(sectionRecovery)
+	opts.Dawn = opts.wants(sectionDawn)
+	opts.Basal = opts.wants(sectionBasal)
+	opts.Daily = opts.wants(sectionDaily)
+	opts.Histogram = opts.wants(sectionHistogram)
+}
+
+//Whether the report has the section. Everything is wanted when no sections were declared.
+func (opts ReportOptions) wants(section string) bool {
+	if opts.Sections == nil {
+		return true
+	}
+	for _, s := range opts.Sections {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
+//Whether a renderer with the layout shows the section
+func (rep *Report) wants(section string, layout []string) bool {
+	for _, s := range rep.sectionsOr(layout) {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
+//The sections to render - the declared ones or the renderer's usual
+//layout followed by any extra sections - see tidepoolPlugins.go
+func (rep *Report) sectionsOr(layout []string) []string {
+	if rep.Sections != nil {
+		return rep.Sections
+	}
+	if len(rep.Extras) == 0 {
+		return layout
+	}
+	sections := append([]string(nil), layout...)
+	for _, s := range rep.Extras {
+		sections = append(sections, s.Name)
+	}
+	return sections
+}
@@ -0,0 +1,128 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"text/template"
+)
+
+/*
+   "tidepoolreport install-service" - keep the server running on a home
+   machine.
+
+   The service runs the current binary in the current folder, so the
+   config.json, prefs.json and layouts there are the ones it uses.
+
+       Linux     writes a systemd unit to /etc/systemd/system and enables
+                 and starts it - run as root. -print just shows the unit.
+       Windows   registers a task that starts the server at boot as
+                 SYSTEM with schtasks - run from an admin prompt. A real
+                 Windows service needs the service control calls from
+                 golang.org/x/sys, which the project doesn't use, and a
+                 plain program registered with sc.exe is stopped by
+                 Windows after 30 seconds.
+
+   The admin password isn't written into the unit - put
+   TIDEPOOLREPORT_ADMIN_PASSWORD in an EnvironmentFile if it's wanted.
+*/
+
+//The systemd unit
+var serviceUnit = template.Must(template.New("unit").Parse(`[Unit]
+Description=Tidepool report server
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+WorkingDirectory={{.Dir}}
+ExecStart="{{.Exe}}"
+Restart=on-failure
+{{- if .User}}
+User={{.User}}
+{{- end}}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+//What the service runs
+type serviceSetup struct {
+	Name string
+	Exe  string
+	Dir  string
+	User string
+}
+
+//The install-service command
+func installService(args []string) error {
+	fl := flag.NewFlagSet("install-service", flag.ExitOnError)
+	name := fl.String("name", "tidepoolreport", "Service name")
+	user := fl.String("user", "", "Run as this user (systemd only)")
+	printOnly := fl.Bool("print", false, "Print the systemd unit instead of installing it")
+	fl.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	setup := serviceSetup{Name: *name, Exe: exe, Dir: dir, User: *user}
+
+	if runtime.GOOS == "windows" {
+		return installWindowsTask(setup)
+	}
+	var unit bytes.Buffer
+	if err := serviceUnit.Execute(&unit, setup); err != nil {
+		return err
+	}
+	if *printOnly {
+		fmt.Print(unit.String())
+		return nil
+	}
+	return installSystemdUnit(setup, unit.Bytes())
+}
+
+//Write, enable and start the systemd unit
+func installSystemdUnit(setup serviceSetup, unit []byte) error {
+	path := filepath.Join("/etc/systemd/system", setup.Name+".service")
+	if err := ioutil.WriteFile(path, unit, 0644); err != nil {
+		return fmt.Errorf("Can't write %s - run as root or use -print: %v", path, err)
+	}
+	for _, cmd := range [][]string{{"daemon-reload"}, {"enable", "--now", setup.Name}} {
+		if out, err := exec.Command("systemctl", cmd...).CombinedOutput(); err != nil {
+			return fmt.Errorf("systemctl %v failed: %v %s", cmd, err, out)
+		}
+	}
+	fmt.Println("Installed and started", path)
+	return nil
+}
+
+//Register a task starting the server at boot, then start it now
+func installWindowsTask(setup serviceSetup) error {
+	//schtasks has no working folder option so cd there first
+	run := fmt.Sprintf(`cmd /c cd /d "%s" && "%s"`, setup.Dir, setup.Exe)
+	create := []string{"/create", "/tn", setup.Name, "/tr", run, "/sc", "onstart", "/ru", "SYSTEM", "/rl", "highest", "/f"}
+	if out, err := exec.Command("schtasks", create...).CombinedOutput(); err != nil {
+		return fmt.Errorf("schtasks failed - run from an admin prompt: %v %s", err, out)
+	}
+	if out, err := exec.Command("schtasks", "/run", "/tn", setup.Name).CombinedOutput(); err != nil {
+		return fmt.Errorf("Task installed but didn't start: %v %s", err, out)
+	}
+	fmt.Println("Installed task", setup.Name, "- the server starts with Windows")
+	return nil
+}
@@ -0,0 +1,228 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+   App sessions.
+
+   Each browser gets a session cookie. The session remembers which Tidepool
+   account it used so logout can drop the cached token. The files for each
+   report live in a Workspace of their own and are gone once it's sent.
+
+   Sessions are kept in memory unless a program embedding the package
+   gives a SessionStore of its own with UseSessionStore, e.g. one backed
+   by Redis so several servers behind a load balancer share them. The
+   memory store forgets a session that hasn't been used for sessionIdle,
+   or for as long as a download link lasts if that's longer, so a public
+   server doesn't fill up with the sessions of one-off visitors.
+*/
+
+//Name of the session cookie
+const sessionCookie = "tidepoolreport_session"
+
+//A session not used for this long is forgotten
+const sessionIdle = 2 * time.Hour
+
+//How often the memory store looks for idle sessions
+const sessionSweepInterval = time.Minute
+
+//One browser session
+type appSession struct {
+	id         string
+	accountKey string //Token cache key of the Tidepool account last used
+	profile    string //Preferences profile of that account
+}
+
+//SessionData - what a session remembers, for a SessionStore to keep
+type SessionData struct {
+	AccountKey string `json:"accountKey"` //Token cache key of the Tidepool account last used
+	Profile    string `json:"profile"`    //Preferences profile of that account
+}
+
+//SessionStore - where the sessions are kept by id. Called from many
+//requests at once. Save errors are logged and the request carries on.
+type SessionStore interface {
+	Load(id string) (SessionData, bool)
+	Save(id string, data SessionData) error
+	Delete(id string)
+}
+
+//The default store - sessions in memory, gone when the server stops
+//or when they sit idle
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+	swept    time.Time
+}
+
+//A session in memory and when it was last used
+type memorySession struct {
+	data SessionData
+	used time.Time
+}
+
+//How long an idle session is kept - its download links have to outlive it
+func sessionLife() time.Duration {
+	if life := downloadLife(); life > sessionIdle {
+		return life
+	}
+	return sessionIdle
+}
+
+//Forget the idle sessions, at most once every sessionSweepInterval.
+//Call with the lock held.
+func (m *memorySessions) sweep() {
+	if time.Since(m.swept) < sessionSweepInterval {
+		return
+	}
+	m.swept = time.Now()
+	life := sessionLife()
+	for id, s := range m.sessions {
+		if time.Since(s.used) > life {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+//Load - the session with the id, unless it has sat idle too long
+func (m *memorySessions) Load(id string) (SessionData, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return SessionData{}, false
+	}
+	if time.Since(s.used) > sessionLife() {
+		delete(m.sessions, id)
+		return SessionData{}, false
+	}
+	s.used = time.Now()
+	return s.data, true
+}
+
+//Save - keep the session
+func (m *memorySessions) Save(id string, data SessionData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	m.sessions[id] = &memorySession{data: data, used: time.Now()}
+	return nil
+}
+
+//Delete - forget the session
+func (m *memorySessions) Delete(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+}
+
+//The sessions for the web handlers
+type sessionStore struct {
+	mu    sync.Mutex
+	store SessionStore
+}
+
+//The sessions used by the web handlers
+var appSessions = &sessionStore{store: &memorySessions{sessions: map[string]*memorySession{}}}
+
+//UseSessionStore - keep the sessions in the store instead of in memory.
+//Call it before starting the server.
+func UseSessionStore(s SessionStore) {
+	appSessions.mu.Lock()
+	defer appSessions.mu.Unlock()
+	appSessions.store = s
+}
+
+//The store in use
+func (st *sessionStore) backend() SessionStore {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.store
+}
+
+//Load a session by id - nil when there isn't one
+func (st *sessionStore) load(id string) *appSession {
+	data, ok := st.backend().Load(id)
+	if !ok {
+		return nil
+	}
+	return &appSession{id: id, accountKey: data.AccountKey, profile: data.Profile}
+}
+
+//Keep the session's changes
+func (st *sessionStore) save(sess *appSession) {
+	if err := st.backend().Save(sess.id, SessionData{AccountKey: sess.accountKey, Profile: sess.profile}); err != nil {
+		log.Println("Error saving the session", err)
+	}
+}
+
+//A random session id
+func newSessionID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	check(err, "Error creating a session id")
+	return hex.EncodeToString(b)
+}
+
+//The session for the request, starting a new one when there isn't one.
+func (st *sessionStore) get(w http.ResponseWriter, r *http.Request) *appSession {
+	var sess *appSession
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		sess = st.load(c.Value)
+	}
+	if sess == nil {
+		sess = &appSession{id: newSessionID()}
+		st.save(sess)
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: sess.id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	}
+	return sess
+}
+
+//The session for the request if it has one
+func (st *sessionStore) lookup(r *http.Request) *appSession {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	return st.load(c.Value)
+}
+
+//End the session for the request - forget the cached Tidepool token,
+//delete its stored downloads and expire the cookie.
+func (st *sessionStore) end(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return
+	}
+
+	sess := st.load(c.Value)
+	st.backend().Delete(c.Value)
+
+	if sess != nil && sess.accountKey != "" {
+		tokens.drop(sess.accountKey)
+	}
+	downloads.dropSession(c.Value)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+}
+
+//Log out - clear everything for the session and go back to the home page
+func logout(w http.ResponseWriter, r *http.Request) {
+	appSessions.end(w, r)
+	if desktop != nil {
+		//Logging out ends a desktop session - there's no one else to serve
+		DisplayMessageScreen(w, "Logged out. You can close this window.")
+		desktop.end()
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,36 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"testing"
+	"time"
+)
+
+//Idle sessions are forgotten, on use and by the sweep
+func TestMemorySessionsExpire(t *testing.T) {
+	inTempDir(t)
+	m := &memorySessions{sessions: map[string]*memorySession{}}
+	for _, id := range []string{"idle", "swept", "used"} {
+		m.Save(id, SessionData{Profile: id + "@example.com"})
+	}
+	m.sessions["idle"].used = time.Now().Add(-sessionIdle - time.Minute)
+	m.sessions["swept"].used = time.Now().Add(-sessionIdle - time.Minute)
+
+	if _, ok := m.Load("idle"); ok {
+		t.Error("an idle session was loaded")
+	}
+	if data, ok := m.Load("used"); !ok || data.Profile != "used@example.com" {
+		t.Errorf("got %+v, %v", data, ok)
+	}
+
+	m.swept = time.Time{}
+	m.Save("new", SessionData{})
+	if _, ok := m.sessions["swept"]; ok {
+		t.Error("the sweep kept an idle session")
+	}
+	if len(m.sessions) != 2 {
+		t.Errorf("%d sessions kept, want 2", len(m.sessions))
+	}
+}
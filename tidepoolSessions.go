@@ -0,0 +1,152 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+   CGM sensor session tracking.
+
+   Tidepool does not record sensor changes for most CGMs so sessions are
+   detected from the continuity of the cbg readings. A new sensor needs a
+   warmup period (2 hours for most Dexcom sensors) so a gap at least that
+   long is taken as the end of one session and the start of the next.
+*/
+
+//A gap in the CGM readings at least this long starts a new session
+const sessionGap = 2 * time.Hour
+
+//CGMs report a reading every 5 minutes
+const cgmInterval = 5 * time.Minute
+
+//One sensor session
+type sensorSession struct {
+	start        time.Time
+	end          time.Time
+	readings     int
+	completeness float64 //Percent of the expected readings received
+}
+
+//Sessions found in the period and the averages over them
+type sessionSummary struct {
+	sessions     []sensorSession
+	averageWear  time.Duration
+	completeness float64 //Percent over all sessions
+}
+
+//Break the cbg readings into sensor sessions.
+//The readings must be in time order.
+func detectSensorSessions(cbg []Reading) *sessionSummary {
+	summary := &sessionSummary{}
+	if len(cbg) == 0 {
+		return summary
+	}
+
+	current := sensorSession{start: cbg[0].Time, end: cbg[0].Time, readings: 1}
+	for _, p := range cbg[1:] {
+		if p.Time.Sub(current.end) >= sessionGap {
+			summary.sessions = append(summary.sessions, current)
+			current = sensorSession{start: p.Time, end: p.Time}
+		}
+		current.end = p.Time
+		current.readings++
+	}
+	summary.sessions = append(summary.sessions, current)
+
+	//Completeness per session and the overall averages
+	var wear time.Duration
+	var expectedTotal, readingsTotal int
+	for i := range summary.sessions {
+		s := &summary.sessions[i]
+		expected := int(s.end.Sub(s.start)/cgmInterval) + 1
+		s.completeness = percentOf(s.readings, expected)
+		wear += s.end.Sub(s.start)
+		expectedTotal += expected
+		readingsTotal += s.readings
+	}
+	summary.averageWear = wear / time.Duration(len(summary.sessions))
+	summary.completeness = percentOf(readingsTotal, expectedTotal)
+
+	return summary
+}
+
+/*
+   Percent of the time the CGM was active - part of the consensus AGP report.
+   Each day should have a reading in every 5 minute slot. The slots that
+   got at least one reading are counted per day and the total compared
+   with what the whole period should have had, so days with no readings
+   at all count against it.
+*/
+func cgmActive(readings []Reading, start time.Time, end time.Time) (float64, bool) {
+	const slotsPerDay = int(24 * time.Hour / cgmInterval)
+	days := int(end.Sub(start).Hours()/24+0.5) + 1
+	if days < 1 {
+		return 0, false
+	}
+	limit := start.AddDate(0, 0, days)
+
+	slots := map[string]map[int]bool{}
+	var any bool
+	for _, rd := range readings {
+		if rd.Type != "cbg" {
+			continue
+		}
+		any = true
+		t := rd.Time
+		//Compare as wall clock times - readings are in device time
+		wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+		if wall.Before(start) || !wall.Before(limit) {
+			continue
+		}
+		day := wall.Format("2006-01-02")
+		if slots[day] == nil {
+			slots[day] = map[int]bool{}
+		}
+		slots[day][int(wall.Sub(startOfDay(wall))/cgmInterval)] = true
+	}
+	if !any {
+		return 0, false
+	}
+
+	var active int
+	for _, s := range slots {
+		active += len(s)
+	}
+	return percentOf(active, days*slotsPerDay), true
+}
+
+//The CGM active metric - CGM reports only
+type cgmActiveMetric struct{}
+
+func (cgmActiveMetric) Name() string { return "CGM active" }
+
+//Without a period just the days with readings are counted
+func (m cgmActiveMetric) Compute(readings []Reading) string {
+	if len(readings) == 0 {
+		return ""
+	}
+	first, _ := time.Parse("2006-01-02", readings[0].Time.Format("2006-01-02"))
+	last, _ := time.Parse("2006-01-02", readings[len(readings)-1].Time.Format("2006-01-02"))
+	return m.ComputePeriod(readings, first, last)
+}
+
+func (cgmActiveMetric) ComputePeriod(readings []Reading, start time.Time, end time.Time) string {
+	pct, ok := cgmActive(readings, start, end)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%.1f%%", pct)
+}
+
+//n as a percentage of total, capped at 100 for the odd duplicate reading
+func percentOf(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	pct := float64(n) / float64(total) * 100
+	if pct > 100 {
+		pct = 100
+	}
+	return pct
+}
@@ -0,0 +1,73 @@
+package tidepoolreport
+
+import "strings"
+
+/*
+   Where each reading came from.
+
+   A report with readings from two meters, or a meter and a CGM, is
+   hard to follow without knowing which device took each one. "Source
+   Column" on the form (sources=on) adds a column naming the device to
+   the readings tables and the CSV and xlsx exports.
+
+   The name is the manufacturer and model from Tidepool's upload record,
+   e.g. "Abbott FreeStyle Libre". Upload records are dated when the
+   upload was made, so one made after the report's end date isn't among
+   the records fetched - another upload from the same device is used
+   then, and failing that the device id, which is usually the model and
+   serial number run together.
+*/
+
+//The names of the devices in the upload records - by upload and by device
+func uploadSources(records tpMeasurement) (byUpload map[string]string, byDevice map[string]string) {
+	byUpload, byDevice = map[string]string{}, map[string]string{}
+	for i := range records {
+		if records[i].Type != "upload" {
+			continue
+		}
+		name := sourceName(records[i].Devicemanufacturers, records[i].Devicemodel)
+		if name == "" {
+			continue
+		}
+		byUpload[records[i].Uploadid] = name
+		byDevice[records[i].Deviceid] = name
+	}
+	return byUpload, byDevice
+}
+
+//The manufacturer and model - just the model when it already says who made it
+func sourceName(manufacturers []string, model string) string {
+	model = strings.TrimSpace(model)
+	maker := strings.TrimSpace(strings.Join(manufacturers, " "))
+	if maker == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		return model
+	}
+	return strings.TrimSpace(maker + " " + model)
+}
+
+//Name the device each reading came from
+func labelSources(readings []Reading, byUpload map[string]string, byDevice map[string]string) {
+	for i := range readings {
+		rd := &readings[i]
+		switch {
+		case byUpload[rd.UploadID] != "":
+			rd.Source = byUpload[rd.UploadID]
+		case byDevice[rd.DeviceID] != "":
+			rd.Source = byDevice[rd.DeviceID]
+		default:
+			rd.Source = rd.DeviceID
+		}
+	}
+}
+
+//Label the readings with their devices for the source column
+func sourcesStep(b *reportBuilder) {
+	if !b.opts.Sources {
+		return
+	}
+	rep := b.report
+	rep.Sources = true
+	byUpload, byDevice := uploadSources(b.records)
+	labelSources(rep.Readings, byUpload, byDevice)
+	labelSources(rep.OtherReadings, byUpload, byDevice)
+}
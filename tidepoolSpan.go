@@ -0,0 +1,63 @@
+package tidepoolreport
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+/*
+   What data an account has.
+
+   DataSpanOf boils a Tidepool download down to how many records of a type
+   there are, the first and last of them and the days they're on - enough
+   for a date picker to only offer days with data. /api/v1/span does it for
+   an account - see apiSpan.
+*/
+
+//DataSpan - how much of one data type there is. Times are the device's local time.
+type DataSpan struct {
+	Type     string    `json:"type"`
+	Count    int       `json:"count"`
+	Earliest time.Time `json:"earliest,omitempty"`
+	Latest   time.Time `json:"latest,omitempty"`
+	Days     []string  `json:"days"` //yyyy-mm-dd with data, in order
+}
+
+//DataSpanOf - the span of the data type in Tidepool json data. Like
+//BuildReport anything but a list of records is an ErrTidepoolUnavailable.
+func DataSpanOf(data []byte, datatype string) (DataSpan, error) {
+	span := DataSpan{Type: datatype, Days: []string{}}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return span, &TidepoolError{Kind: ErrTidepoolUnavailable, Body: data, Err: errors.New("the response is not a list of records")}
+	}
+
+	days := map[string]bool{}
+	for _, one := range raw {
+		var rec struct {
+			Type           string    `json:"type"`
+			Time           time.Time `json:"time"`
+			Devicetime     string    `json:"deviceTime"`
+			Timezoneoffset int       `json:"timezoneOffset"`
+		}
+		if json.Unmarshal(one, &rec) != nil || rec.Type != datatype {
+			continue
+		}
+		t := deviceLocalTime(rec.Devicetime, rec.Time, rec.Timezoneoffset)
+		if span.Count == 0 || t.Before(span.Earliest) {
+			span.Earliest = t
+		}
+		if span.Count == 0 || t.After(span.Latest) {
+			span.Latest = t
+		}
+		span.Count++
+		days[t.Format("2006-01-02")] = true
+	}
+	for day := range days {
+		span.Days = append(span.Days, day)
+	}
+	sort.Strings(span.Days)
+	return span, nil
+}
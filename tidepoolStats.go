@@ -0,0 +1,202 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+/*
+   Summary statistics for a set of glucose readings.
+   All values are mg/dl.
+*/
+
+//Default target range
+const (
+	targetLow  = 70.0
+	targetHigh = 180.0
+)
+
+//TargetRange - a target range in mg/dl
+type TargetRange struct {
+	Low  float64 `json:"low"`
+	High float64 `json:"high"`
+}
+
+//The usual target range
+var defaultTargetRange = TargetRange{targetLow, targetHigh}
+
+//The range with the default for anything not set. A range upside down is the default.
+func (t TargetRange) orDefault() TargetRange {
+	if t.Low <= 0 {
+		t.Low = targetLow
+	}
+	if t.High <= 0 {
+		t.High = targetHigh
+	}
+	if t.High <= t.Low {
+		return defaultTargetRange
+	}
+	return t
+}
+
+//Statistics for the period
+type glucoseStats struct {
+	rng     TargetRange //The target range the percents are for
+	count   int
+	mean    float64
+	gmi     float64 //Glucose management indicator - percent
+	ea1c    float64 //Estimated A1c - percent
+	below   float64 //Percent of readings below the target range
+	inRange float64 //Percent of readings in the target range
+	above   float64 //Percent of readings above the target range
+	hypos   int     //Number of separate lows
+	sd      float64 //Standard deviation
+	cv      float64 //Coefficient of variation - percent
+	units   Units   //What the values are shown in - they're computed in mg/dl
+}
+
+//Compute the statistics for the usual target range. The readings must be in time order.
+func computeStats(points []Reading) glucoseStats {
+	return computeStatsIn(points, defaultTargetRange)
+}
+
+//Compute the statistics for a target range
+func computeStatsIn(points []Reading, rng TargetRange) glucoseStats {
+	st := glucoseStats{rng: rng}
+	st.count = len(points)
+	if st.count == 0 {
+		return st
+	}
+
+	var sum float64
+	var below, inRange, above int
+	var inHypo bool
+	for _, p := range points {
+		sum += p.MgDL()
+		switch {
+		case p.MgDL() < rng.Low:
+			below++
+			//A run of low readings is one hypo
+			if !inHypo {
+				st.hypos++
+			}
+			inHypo = true
+			continue
+		case p.MgDL() > rng.High:
+			above++
+		default:
+			inRange++
+		}
+		inHypo = false
+	}
+
+	st.mean = sum / float64(st.count)
+	st.gmi = glucoseManagementIndicator(st.mean)
+	st.ea1c = estimatedA1c(st.mean)
+	st.below = percentOf(below, st.count)
+	st.inRange = percentOf(inRange, st.count)
+	st.above = percentOf(above, st.count)
+
+	//Variability
+	var squares float64
+	for _, p := range points {
+		d := p.MgDL() - st.mean
+		squares += d * d
+	}
+	st.sd = math.Sqrt(squares / float64(st.count))
+	if st.mean > 0 {
+		st.cv = st.sd / st.mean * 100
+	}
+	return st
+}
+
+//Estimated A1c from the mean glucose in mg/dl - the ADAG study, Nathan et al. 2008.
+//GMI is the one made for CGM data; this is the older lab-style estimate
+//many people still know their numbers by.
+func estimatedA1c(mean float64) float64 {
+	return math.Round((mean+46.7)/28.7*10) / 10
+}
+
+//GMI from the mean glucose in mg/dl - Bergenstal et al. 2018
+func glucoseManagementIndicator(mean float64) float64 {
+	return math.Round((3.31+0.02392*mean)*10) / 10
+}
+
+//Time in range - the percents below, in and above the target range
+type timeInRange struct {
+	Low     float64 `json:"low"` //The range in mg/dl
+	High    float64 `json:"high"`
+	Below   float64 `json:"below"`
+	InRange float64 `json:"inRange"`
+	Above   float64 `json:"above"`
+	units   Units   //What the headline shows the range in
+}
+
+//The time in range from the statistics - false when there were no readings
+func (st glucoseStats) timeInRange() (timeInRange, bool) {
+	return timeInRange{st.rng.Low, st.rng.High, st.below, st.inRange, st.above, st.units}, st.count > 0
+}
+
+//The headline, e.g. "Time in range 81% (70-180 mg/dl)"
+func (t timeInRange) Headline() string {
+	return fmt.Sprintf("Time in range %.0f%% (%s-%s)", t.InRange, t.units.format(t.Low), t.units.withName(t.High))
+}
+
+//The breakdown, e.g. "1% below, 81% in range, 18% above"
+func (t timeInRange) Breakdown() string {
+	return fmt.Sprintf("%.0f%% below, %.0f%% in range, %.0f%% above", t.Below, t.InRange, t.Above)
+}
+
+//The plain statistics for the period's first page - count, mean,
+//median, lowest, highest and standard deviation
+type periodStatistics struct {
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	SD     float64 `json:"sd"`
+	units  Units   //What the rows show the values in - they're kept in mg/dl
+}
+
+//The statistics for the readings - nil when there are none
+func periodStatisticsFor(readings []Reading) *periodStatistics {
+	if len(readings) == 0 {
+		return nil
+	}
+	values := make([]float64, len(readings))
+	for i, rd := range readings {
+		values[i] = rd.MgDL()
+	}
+	sort.Float64s(values)
+
+	st := computeStats(readings)
+	ps := &periodStatistics{
+		Count: st.count,
+		Mean:  st.mean,
+		Min:   values[0],
+		Max:   values[len(values)-1],
+		SD:    st.sd,
+	}
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		ps.Median = (values[mid-1] + values[mid]) / 2
+	} else {
+		ps.Median = values[mid]
+	}
+	return ps
+}
+
+//The statistics as name and value rows
+func (ps *periodStatistics) rows() [][]string {
+	glucose := ps.units.withName
+	return [][]string{
+		{"Readings", fmt.Sprint(ps.Count)},
+		{"Mean", glucose(ps.Mean)},
+		{"Median", glucose(ps.Median)},
+		{"Lowest", glucose(ps.Min)},
+		{"Highest", glucose(ps.Max)},
+		{"Standard deviation", glucose(ps.SD)},
+	}
+}
@@ -0,0 +1,19 @@
+package tidepoolreport
+
+import "testing"
+
+func BenchmarkComputeStats(b *testing.B) {
+	readings := benchReadings(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		computeStatsIn(readings, defaultTargetRange)
+	}
+}
+
+func BenchmarkPeriodStatistics(b *testing.B) {
+	readings := benchReadings(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		periodStatisticsFor(readings)
+	}
+}
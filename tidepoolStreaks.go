@@ -0,0 +1,176 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+   Streaks.
+
+   A few numbers to aim at rather than judge by, for teens and anyone
+   who likes keeping score - the longest run of days over the time in
+   range goal, the best week, and the part of the day that got better
+   the most from the first half of the period to the second. Optional -
+   the "streaks" section or the Streaks box on the form.
+*/
+
+//Days of readings a week needs to be the best week
+const streakWeekMinDays = 4
+
+//Parts of the day compared for the most improved - [from, to) hours
+var streakBuckets = []struct {
+	name     string
+	from, to int
+}{
+	{"overnight", 0, 6},
+	{"mornings", 6, 12},
+	{"afternoons", 12, 18},
+	{"evenings", 18, 24},
+}
+
+//The streak lines for the readings. The readings must be in time order.
+func findStreaks(readings []Reading, rng TargetRange, goals ClinicalGoals) []string {
+	goal := goals.over(defaultGoals).TimeInRange
+	byDay := readingsByDay(readings, 0, 24)
+	if len(byDay) == 0 {
+		return nil
+	}
+	days := make([]string, 0, len(byDay))
+	for day := range byDay {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	var lines []string
+	if s := dayStreak(days, byDay, rng, goal); s != "" {
+		lines = append(lines, s)
+	}
+	if s := bestWeek(days, byDay, rng); s != "" {
+		lines = append(lines, s)
+	}
+	if s := mostImproved(days, byDay, rng); s != "" {
+		lines = append(lines, s)
+	}
+	return lines
+}
+
+//The longest run of days in a row over the time in range goal
+func dayStreak(days []string, byDay map[string][]Reading, rng TargetRange, goal float64) string {
+	var best, run int
+	var bestEnd string
+	var prev time.Time
+	bestTIR, bestDay := -1.0, ""
+	for _, day := range days {
+		t, _ := time.Parse("2006-01-02", day)
+		tir := computeStatsIn(byDay[day], rng).inRange
+		if tir > bestTIR {
+			bestTIR, bestDay = tir, day
+		}
+		switch {
+		case tir <= goal:
+			run = 0
+		case run > 0 && t.Sub(prev) == 24*time.Hour:
+			run++
+		default:
+			run = 1
+		}
+		prev = t
+		if run > best {
+			best, bestEnd = run, day
+		}
+	}
+
+	if best == 0 {
+		return fmt.Sprintf("No days over %g%% in range this time - the best was %s at %.0f%%. One day over is the start of a streak.", goal, bestDay, bestTIR)
+	}
+	end, _ := time.Parse("2006-01-02", bestEnd)
+	line := fmt.Sprintf("Longest streak: %s in a row over %g%% in range", countOf(best, "day"), goal)
+	if best > 1 {
+		line += fmt.Sprintf(" (%s to %s)", end.AddDate(0, 0, 1-best).Format("2006-01-02"), bestEnd)
+	} else {
+		line += fmt.Sprintf(" (%s)", bestEnd)
+	}
+	if bestEnd == days[len(days)-1] {
+		line += " - and still going"
+	}
+	return line
+}
+
+//The week with the most time in range - "" with fewer than two full enough weeks
+func bestWeek(days []string, byDay map[string][]Reading, rng TargetRange) string {
+	type week struct {
+		monday   string
+		days     int
+		readings []Reading
+	}
+	var weeks []*week
+	byWeek := map[[2]int]*week{}
+	for _, day := range days {
+		t, _ := time.Parse("2006-01-02", day)
+		y, w := t.ISOWeek()
+		wk, ok := byWeek[[2]int{y, w}]
+		if !ok {
+			monday := t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+			wk = &week{monday: monday.Format("2006-01-02")}
+			byWeek[[2]int{y, w}] = wk
+			weeks = append(weeks, wk)
+		}
+		wk.days++
+		wk.readings = append(wk.readings, byDay[day]...)
+	}
+
+	var best *week
+	var bestTIR float64
+	counted := 0
+	for _, wk := range weeks {
+		if wk.days < streakWeekMinDays {
+			continue
+		}
+		counted++
+		if tir := computeStatsIn(wk.readings, rng).inRange; best == nil || tir > bestTIR {
+			best, bestTIR = wk, tir
+		}
+	}
+	if counted < 2 {
+		return ""
+	}
+	return fmt.Sprintf("Best week: the week of %s with %.0f%% in range", best.monday, bestTIR)
+}
+
+//The part of the day whose time in range went up the most from the
+//first half of the period to the second - "" when none did
+func mostImproved(days []string, byDay map[string][]Reading, rng TargetRange) string {
+	if len(days) < 4 {
+		return ""
+	}
+	half := len(days) / 2
+	collect := func(days []string, from, to int) []Reading {
+		var rds []Reading
+		for _, day := range days {
+			for _, rd := range byDay[day] {
+				if h := rd.Time.Hour(); h >= from && h < to {
+					rds = append(rds, rd)
+				}
+			}
+		}
+		return rds
+	}
+
+	best, bestFrom, bestTo := "", 0.0, 0.0
+	for _, b := range streakBuckets {
+		first, second := collect(days[:half], b.from, b.to), collect(days[half:], b.from, b.to)
+		if len(first) == 0 || len(second) == 0 {
+			continue
+		}
+		from, to := computeStatsIn(first, rng).inRange, computeStatsIn(second, rng).inRange
+		if to-from >= 1 && (best == "" || to-from > bestTo-bestFrom) {
+			best, bestFrom, bestTo = b.name, from, to
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf("Most improved: %s, from %.0f%% in range in the first half of the period to %.0f%% in the second", best, bestFrom, bestTo)
+}
@@ -0,0 +1,147 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+   A memory budget for very long date ranges.
+
+   A report normally holds the whole Tidepool download in memory a few
+   times over - the json, the decoded records and the readings. When the
+   estimate for a fetch is over the budget (memoryBudgetMB in config.json)
+   it is fetched a chunk at a time instead. Each chunk is spilled to a file
+   in the workspace as it arrives, then the files are read back one at a
+   time and boiled down to the compact glucose readings plus the other
+   records the sections need. Only one chunk of raw data is held at once.
+*/
+
+//Budget used when the config doesn't set one
+const defaultMemoryBudgetMB = 256
+
+//Rough memory per record - the json plus the decoded record
+const recordBytes = 2048
+
+//Rough records per day for each data type
+var recordsPerDay = map[string]int{
+	"cbg":         288, //Every 5 minutes
+	"smbg":        8,
+	"basal":       48,
+	"bolus":       8,
+	"wizard":      8,
+	"food":        6,
+	"deviceEvent": 6,
+	"upload":      1,
+}
+
+//Guess for the types not in recordsPerDay
+const otherRecordsPerDay = 10
+
+//The memory budget in bytes
+func (cfg Config) memoryBudget() int64 {
+	mb := cfg.MemoryBudgetMB
+	if mb <= 0 {
+		mb = defaultMemoryBudgetMB
+	}
+	return int64(mb) << 20
+}
+
+//Rough memory needed to hold a fetch all at once.
+//Open ranges can't be estimated (or chunked) so they come out as 0.
+func estimateFetchBytes(datatypes string, sdate string, edate string) int64 {
+	start, serr := time.Parse("2006-01-02", sdate)
+	end, eerr := time.Parse("2006-01-02", edate)
+	if serr != nil || eerr != nil || !end.After(start) {
+		return 0
+	}
+	days := int64(end.Sub(start).Hours()/24) + 1
+
+	var perDay int64
+	seen := map[string]bool{}
+	for _, t := range strings.Split(datatypes, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		n, ok := recordsPerDay[t]
+		if !ok {
+			n = otherRecordsPerDay
+		}
+		perDay += int64(n)
+	}
+	return days * perDay * recordBytes
+}
+
+//Fetch the data a chunk at a time, spilling each chunk to the workspace,
+//then build the report from the chunk files.
+func streamReport(f *tpFetcher, ws *Workspace, opts ReportOptions, sdate string, edate string) (*Report, *requestError) {
+	start, _ := time.Parse("2006-01-02", sdate)
+	end, _ := time.Parse("2006-01-02", edate)
+
+	var files []string
+	_, _, err := f.fetchChunks(opts.dataTypes(), start, end, func(chunk []json.RawMessage) error {
+		file := ws.Path(fmt.Sprintf("tidepool-%03d.json", len(files)+1))
+		data, err := json.Marshal(chunk)
+		if err == nil {
+			err = ioutil.WriteFile(file, data, 0600)
+		}
+		files = append(files, file)
+		return err
+	})
+	if err != nil {
+		return nil, requestErrorFor(err)
+	}
+
+	rep, err := BuildReportFromChunks(files, opts)
+	if err != nil {
+		return nil, requestErrorFor(err)
+	}
+	rep.Warnings = append(f.warnings, rep.Warnings...)
+	return rep, nil
+}
+
+//BuildReportFromChunks - build the report from data saved a chunk per file,
+//holding one chunk's records at a time.
+func BuildReportFromChunks(files []string, opts ReportOptions) (*Report, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	b := newReportBuilder(opts)
+	b.glucose = map[string][]Reading{}
+	for _, file := range files {
+		records, skipped, err := loadRecords(file, opts.Strict)
+		if err != nil {
+			return nil, err
+		}
+		b.issues.skipped += skipped
+		b.issues.check(records, opts.DataType)
+		b.addChunk(records)
+	}
+
+	//Chunks come in date order but device clocks can wander across a boundary
+	for _, rds := range b.glucose {
+		sort.SliceStable(rds, func(i, j int) bool { return rds[i].Time.Before(rds[j].Time) })
+	}
+	return b.build()
+}
+
+//Boil a chunk down to its glucose readings and keep the other records
+func (b *reportBuilder) addChunk(records tpMeasurement) {
+	for _, datatype := range []string{"smbg", "cbg"} {
+		b.glucose[datatype] = append(b.glucose[datatype], readingsFrom(records, datatype)...)
+	}
+	for _, rec := range records {
+		if rec.Type != "smbg" && rec.Type != "cbg" {
+			b.records = append(b.records, rec)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package tidepoolreport
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+   Pump suspend tracking.
+
+   Tidepool reports a pump suspension two ways:
+   1. A basal record with deliveryType "suspend" and a duration in milliseconds.
+   2. A deviceEvent record with subType "status", status "suspended" and a duration.
+
+   Predictive low suspend systems can produce both for the same stop so the
+   periods are merged before they are broken out by day.
+*/
+
+//A single period when the pump was not delivering insulin
+type suspendPeriod struct {
+	start time.Time
+	end   time.Time
+}
+
+//The suspends that fall on one day and the total time suspended
+type suspendDay struct {
+	day     string //yyyy-mm-dd
+	periods []suspendPeriod
+	total   time.Duration
+}
+
+//Device time layout used by Tidepool - Example: 2021-03-17T08:33:00
+const deviceTimeLayout = "2006-01-02T15:04:05"
+
+//deviceLocalTime returns the measurement time as the device saw it.
+//Falls back to the UTC time shifted by the timezone offset when there is no device time.
+func deviceLocalTime(devicetime string, utc time.Time, offset int) time.Time {
+	if len(devicetime) >= 19 {
+		t, err := time.Parse(deviceTimeLayout, devicetime[:19])
+		if err == nil {
+			return t
+		}
+	}
+	return utc.Add(time.Duration(offset) * time.Minute).UTC()
+}
+
+//Extract the suspend periods from the Tidepool records
+func suspendPeriodsFrom(result tpMeasurement) []suspendPeriod {
+	var periods []suspendPeriod
+
+	for i := range result {
+		var suspended bool
+		switch result[i].Type {
+		case "basal":
+			suspended = result[i].Deliverytype == "suspend"
+		case "deviceEvent":
+			suspended = result[i].Subtype == "status" && result[i].Status == "suspended"
+		}
+		if !suspended || result[i].Duration <= 0 {
+			continue
+		}
+
+		start := deviceLocalTime(result[i].Devicetime, result[i].Time, result[i].Timezoneoffset)
+		end := start.Add(time.Duration(result[i].Duration) * time.Millisecond)
+		periods = append(periods, suspendPeriod{start: start, end: end})
+	}
+
+	return mergeSuspendPeriods(periods)
+}
+
+//Sort the periods and combine any that overlap
+func mergeSuspendPeriods(periods []suspendPeriod) []suspendPeriod {
+	if len(periods) == 0 {
+		return nil
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].start.Before(periods[j].start) })
+
+	merged := []suspendPeriod{periods[0]}
+	for _, p := range periods[1:] {
+		last := &merged[len(merged)-1]
+		if !p.start.After(last.end) {
+			if p.end.After(last.end) {
+				last.end = p.end
+			}
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+//Break the suspend periods out by day, splitting any that cross midnight.
+//Days are returned in date order.
+func suspendDays(periods []suspendPeriod) []suspendDay {
+	var days []suspendDay
+
+	for _, p := range periods {
+		start := p.start
+		for start.Before(p.end) {
+			midnight := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+			end := p.end
+			if end.After(midnight) {
+				end = midnight
+			}
+
+			day := start.Format("2006-01-02")
+			if len(days) == 0 || days[len(days)-1].day != day {
+				days = append(days, suspendDay{day: day})
+			}
+			d := &days[len(days)-1]
+			d.periods = append(d.periods, suspendPeriod{start: start, end: end})
+			d.total += end.Sub(start)
+
+			start = end
+		}
+	}
+	return days
+}
@@ -0,0 +1,105 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"math"
+)
+
+/*
+   Clinical targets.
+
+   The targets section checks the period against the consensus goals
+   and marks each one met or not met:
+
+       Time in range (70-180)  over 70%
+       Below range (<70)       under 4%
+       CV                      under 36%
+       GMI                     under 7%
+
+   The goals can be changed in config.json ("goals") and per profile on
+   the Preferences page. A goal left at 0 keeps the preset's, or the
+   default. The ranges are the report's target range - see tidepoolPresets.go.
+*/
+
+//ClinicalGoals - the goals for the targets section, all percents. 0 for the default.
+type ClinicalGoals struct {
+	TimeInRange float64 `json:"timeInRange"` //Time in range over this
+	BelowRange  float64 `json:"belowRange"`  //Time below range under this
+	CV          float64 `json:"cv"`          //Coefficient of variation under this
+	GMI         float64 `json:"gmi"`         //GMI under this
+}
+
+//The consensus goals
+var defaultGoals = ClinicalGoals{TimeInRange: 70, BelowRange: 4, CV: 36, GMI: 7}
+
+//A goal checked against the period
+type targetResult struct {
+	Name  string `json:"name"`
+	Goal  string `json:"goal"` //e.g. "> 70%"
+	Value string `json:"value"`
+	Met   bool   `json:"met"`
+}
+
+//The marker shown for the result
+func (t targetResult) Status() string {
+	if t.Met {
+		return "Met"
+	}
+	return "Not met"
+}
+
+//The goals set here with the ones in base for the rest
+func (g ClinicalGoals) over(base ClinicalGoals) ClinicalGoals {
+	if g.TimeInRange > 0 {
+		base.TimeInRange = g.TimeInRange
+	}
+	if g.BelowRange > 0 {
+		base.BelowRange = g.BelowRange
+	}
+	if g.CV > 0 {
+		base.CV = g.CV
+	}
+	if g.GMI > 0 {
+		base.GMI = g.GMI
+	}
+	return base
+}
+
+//Check the period's statistics against the goals. nil without readings.
+func checkTargets(st glucoseStats, goals ClinicalGoals) []targetResult {
+	if st.count == 0 {
+		return nil
+	}
+	goals = goals.over(defaultGoals)
+
+	//Compared as shown - to one place - so the marker agrees with the value
+	result := func(name string, value float64, over bool, goal float64) targetResult {
+		value = math.Round(value*10) / 10
+		t := targetResult{Name: name, Value: fmt.Sprintf("%.1f%%", value)}
+		if over {
+			t.Goal = fmt.Sprintf("> %g%%", goal)
+			t.Met = value > goal
+		} else {
+			t.Goal = fmt.Sprintf("< %g%%", goal)
+			t.Met = value < goal
+		}
+		return t
+	}
+	return []targetResult{
+		result(fmt.Sprintf("Time in range (%.0f-%.0f)", st.rng.Low, st.rng.High), st.inRange, true, goals.TimeInRange),
+		result(fmt.Sprintf("Below range (<%.0f)", st.rng.Low), st.below, false, goals.BelowRange),
+		result("Variability (CV)", st.cv, false, goals.CV),
+		result("GMI", st.gmi, false, goals.GMI),
+	}
+}
+
+//How many of the goals were met, e.g. "3 of 4"
+func targetsMet(targets []targetResult) string {
+	met := 0
+	for _, t := range targets {
+		if t.Met {
+			met++
+		}
+	}
+	return fmt.Sprintf("%d of %d", met, len(targets))
+}
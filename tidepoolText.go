@@ -0,0 +1,91 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+   Plain text summary output - format=txt.
+   A few lines suitable for pasting into a patient portal message.
+*/
+
+//Build the text summary for the report
+func textSummary(rep *Report) string {
+	var b strings.Builder
+
+	if rep.Caregiver {
+		fmt.Fprintf(&b, "Your child's glucose summary %s\n", rep.Range())
+	} else {
+		fmt.Fprintf(&b, "Glucose summary %s\n", rep.Range())
+	}
+
+	if rep.Changes != nil {
+		for _, line := range rep.Changes.lines() {
+			fmt.Fprintf(&b, "%s\n", line)
+		}
+	}
+	if len(rep.Readings) == 0 {
+		b.WriteString("No readings were found for the period.\n")
+		//A report of just insulin still has that to say
+		if !rep.hasSections() {
+			return b.String()
+		}
+	}
+	for _, s := range rangeLines(rep.Ranges) {
+		fmt.Fprintf(&b, "%s\n", s)
+	}
+	for _, s := range rep.Insights {
+		fmt.Fprintf(&b, "%s\n", s)
+	}
+	for _, s := range rep.Streaks {
+		fmt.Fprintf(&b, "%s\n", s)
+	}
+	for _, m := range rep.Metrics {
+		fmt.Fprintf(&b, "%s: %s\n", m.Name, m.Value)
+	}
+	if len(rep.Targets) > 0 {
+		if rep.Caregiver {
+			fmt.Fprintf(&b, "Your child met %s of the targets for children.\n", targetsMet(rep.Targets))
+		} else {
+			fmt.Fprintf(&b, "Clinical targets met: %s\n", targetsMet(rep.Targets))
+		}
+		for _, t := range rep.Targets {
+			fmt.Fprintf(&b, "  %s %s (goal %s): %s\n", t.Name, t.Value, t.Goal, t.Status())
+		}
+	}
+	for _, f := range rep.Flags {
+		fmt.Fprintf(&b, "Flag: %s\n", f)
+	}
+	if len(rep.Boluses) > 0 {
+		fmt.Fprintf(&b, "Insulin: %s\n", bolusTotals(rep.Boluses, rep.Start, rep.End))
+	}
+	if len(rep.OtherReadings) > 0 {
+		fmt.Fprintf(&b, "%s: %d\n", readingsTitle(rep.OtherType), len(rep.OtherReadings))
+	}
+	if len(rep.Basal) > 0 {
+		fmt.Fprintf(&b, "Basal: %s\n", basalTotals(rep.Basal))
+	}
+	if len(rep.Carbs) > 0 {
+		fmt.Fprintf(&b, "Carbs: %s\n", carbTotals(rep.Carbs, rep.Start, rep.End))
+	}
+	if rep.Recovery != nil {
+		for _, line := range rep.Recovery.lines(rep.Units) {
+			fmt.Fprintf(&b, "Hypo recovery: %s\n", line)
+		}
+	}
+	if rep.Dawn != nil {
+		for _, line := range rep.Dawn.lines(rep.Units) {
+			fmt.Fprintf(&b, "Dawn phenomenon: %s\n", line)
+		}
+	}
+	for _, s := range rep.Extras {
+		for _, line := range s.Lines {
+			fmt.Fprintf(&b, "%s: %s\n", s.Title, line)
+		}
+	}
+	for _, s := range rep.Warnings {
+		fmt.Fprintf(&b, "Note: %s\n", s)
+	}
+	return b.String()
+}
@@ -0,0 +1,106 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   Per account throttling of Tidepool calls.
+
+   Batch runs, weekly reports and the daily checks can send a lot of
+   requests for one account in a short time. Each account's calls are
+   spaced out to requestsPerMinute (config.json, default 60) across all
+   the fetches running for it, and a 429 Too Many Requests holds the
+   account back for the Retry-After time before the call is tried again.
+   Accounts are told apart by their Tidepool user id.
+*/
+
+//Rate used when the config doesn't set one
+const defaultRequestsPerMinute = 60
+
+//Times a rate limited call is tried again before giving up
+const maxRateLimitRetries = 3
+
+//Wait used when a 429 has no usable Retry-After
+const defaultRetryAfter = 30 * time.Second
+
+//When each account may next call Tidepool
+type accountThrottle struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+//The throttle for all fetches
+var throttle = &accountThrottle{next: map[string]time.Time{}}
+
+//Time between calls for one account
+func (cfg Config) requestInterval() time.Duration {
+	rpm := cfg.RequestsPerMinute
+	if rpm <= 0 {
+		rpm = defaultRequestsPerMinute
+	}
+	return time.Minute / time.Duration(rpm)
+}
+
+//Wait for the account's turn and book the one after it.
+//Fails when the context ends first.
+func (t *accountThrottle) wait(ctx context.Context, account string, interval time.Duration) error {
+	t.mu.Lock()
+	now := time.Now()
+	at := t.next[account]
+	if at.Before(now) {
+		at = now
+	}
+	t.next[account] = at.Add(interval)
+
+	//Forget accounts that have gone quiet
+	for key, next := range t.next {
+		if next.Before(now) {
+			delete(t.next, key)
+		}
+	}
+	t.mu.Unlock()
+
+	if !at.After(now) {
+		return nil
+	}
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Hold the account back - Tidepool asked for a pause
+func (t *accountThrottle) holdOff(account string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := time.Now().Add(d); until.After(t.next[account]) {
+		t.next[account] = until
+	}
+}
+
+//The pause asked for by a Retry-After header - seconds or an http date
+func retryAfter(header string) time.Duration {
+	if secs, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
@@ -0,0 +1,98 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+/*
+   The report deadline.
+
+   A report gets reportTimeoutSeconds (config.json, default 300) to sign
+   in to Tidepool and fetch its data. When that passes the Tidepool calls still running are
+   cancelled and the browser gets a page explaining what happened, with
+   a form to try again over a shorter range. The form carries the other
+   choices along but not the password or restricted token - those are
+   typed again.
+*/
+
+//Report deadline used when the config doesn't set one
+const defaultReportTimeoutSeconds = 300
+
+//A form value carried over to the retry
+type formValue struct {
+	Name  string
+	Value string
+}
+
+//The timeout page
+type timeoutPage struct {
+	Message    string
+	Seconds    int
+	Start      string //The range that timed out - empty when open ended
+	End        string
+	RetryStart string //The shorter range suggested
+	RetryEnd   string
+	Token      bool //Ask for the restricted token rather than the password
+	Hidden     []formValue
+}
+
+//How long a report has to fetch its data
+func (cfg Config) reportTimeout() time.Duration {
+	secs := cfg.ReportTimeoutSeconds
+	if secs <= 0 {
+		secs = defaultReportTimeoutSeconds
+	}
+	return time.Duration(secs) * time.Second
+}
+
+//A shorter range to try - the later half of the one that timed out,
+//or the last 90 days when it had no start
+func shorterRange(sdate string, edate string) (string, string) {
+	end, err := time.Parse("2006-01-02", edate)
+	if err != nil {
+		end = time.Now()
+	}
+	start, err := time.Parse("2006-01-02", sdate)
+	if err != nil {
+		start = end.AddDate(0, 0, -90)
+	} else if days := int(end.Sub(start).Hours() / 24); days > 1 {
+		start = start.AddDate(0, 0, days/2)
+	}
+	return start.Format("2006-01-02"), end.Format("2006-01-02")
+}
+
+//Show the timeout page for a report that ran out of time
+func showTimeout(w http.ResponseWriter, r *http.Request, e *requestError) {
+	page := timeoutPage{
+		Message: e.message,
+		Seconds: int(loadConfig(configFile).reportTimeout().Seconds()),
+		Start:   r.FormValue("startdate"),
+		End:     r.FormValue("enddate"),
+		Token:   r.FormValue("restrictedtoken") != "",
+	}
+	page.RetryStart, page.RetryEnd = shorterRange(page.Start, page.End)
+
+	//Everything else on the form goes along as is
+	names := make([]string, 0, len(r.Form))
+	for name := range r.Form {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "password", "restrictedtoken", "startdate", "enddate", "day":
+			continue
+		}
+		for _, value := range r.Form[name] {
+			page.Hidden = append(page.Hidden, formValue{Name: name, Value: value})
+		}
+	}
+
+	w.WriteHeader(http.StatusGatewayTimeout)
+	render(w, "templates/Timeout.html", page)
+}
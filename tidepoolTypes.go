@@ -0,0 +1,85 @@
+package tidepoolreport
+
+import (
+	"strings"
+)
+
+/*
+   Data types.
+
+   The form can pick several data types for one report - meter and CGM
+   glucose, bolus and basal insulin - and they're fetched together in a
+   single query, e.g. type=smbg,cbg,bolus. Each goes into its own part of
+   the report: the first glucose type is the report's readings with the
+   statistics and charts, the other glucose type gets a readings table of
+   its own, and bolus and basal turn on their sections.
+*/
+
+//The glucose data types
+var glucoseTypes = map[string]bool{"smbg": true, "cbg": true}
+
+//The data types from the form - each value may hold several separated by commas
+func parseDataTypes(values ...string) []string {
+	var types []string
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types = append(types, t)
+			}
+		}
+	}
+	return types
+}
+
+//Use the data types picked on the form
+func (opts *ReportOptions) setDataTypes(types []string) {
+	opts.DataType, opts.OtherType = "", ""
+	for _, t := range types {
+		switch {
+		case glucoseTypes[t] && opts.DataType == "":
+			opts.DataType = t
+		case glucoseTypes[t] && t != opts.DataType:
+			opts.OtherType = t
+		case t == "bolus":
+			opts.Boluses = true
+		case t == "basal":
+			opts.Basal = true
+		}
+	}
+}
+
+//What a glucose type's readings are called in headings
+func readingsTitle(datatype string) string {
+	if datatype == "cbg" {
+		return "CGM readings"
+	}
+	return "Meter readings"
+}
+
+//Just the readings on the day
+func readingsOnDay(readings []Reading, day string) []Reading {
+	var on []Reading
+	for _, rd := range readings {
+		if rd.Time.Format("2006-01-02") == day {
+			on = append(on, rd)
+		}
+	}
+	return on
+}
+
+//The other glucose type's readings
+func otherReadingsStep(b *reportBuilder) {
+	if b.opts.OtherType == "" || !b.opts.wants(sectionOtherReadings) {
+		return
+	}
+	b.report.OtherType = b.opts.OtherType
+	b.report.OtherReadings = filterReadings(b.readings(b.opts.OtherType), b.opts)
+	if b.opts.Day != "" {
+		b.report.OtherReadings = readingsOnDay(b.report.OtherReadings, b.opts.Day)
+	}
+}
+
+//The other glucose type's readings for a table and a note to go with them
+func (rep *Report) otherTableReadings() ([]Reading, string) {
+	return rep.tableFor(rep.shown(rep.OtherReadings, rep.excludedOther), rep.OtherType)
+}
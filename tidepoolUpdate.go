@@ -0,0 +1,262 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   "tidepoolreport update" - replace the binary with the latest release.
+
+   The release endpoint is a GitHub style "latest release" api. The
+   release holds a binary per platform named
+
+       tidepoolreport-<os>-<arch>[.exe]
+
+   with a .sig beside each - the base64 ed25519 signature of
+
+       <tag>\n<hex sha256 of the binary>
+
+   The signature is checked against updatePublicKey before anything is
+   replaced, so a changed download or a hijacked release page can't put
+   its own program on a patient's machine. The tag is signed with the
+   binary so an old release can't be passed off under a newer tag.
+
+   Release builds set the version and key:
+
+       go build -ldflags "-X github.com/edrobinson/TidepoolReport.Version=v1.2.0
+           -X github.com/edrobinson/TidepoolReport.updatePublicKey=<base64 key>"
+           -o tidepoolreport ./cmd/tidepoolreport
+
+   A build without a key refuses to update.
+
+   Old releases are signed too, so a signature alone doesn't stop someone
+   serving one under its own tag to put a fixed bug back. Only a release
+   newer than this one is installed unless -force is given - a "dev"
+   build can't tell so it needs -force as well.
+*/
+
+//Version - the release this binary was built from
+var Version = "dev"
+
+//Base64 ed25519 public key releases are signed with - set at build time
+var updatePublicKey = ""
+
+//Where the latest release is described
+const updateEndpoint = "https://api.github.com/repos/edrobinson/TidepoolReport/releases/latest"
+
+//How long the release checks and downloads may take
+const updateTimeout = 5 * time.Minute
+
+var updateClient = &http.Client{Timeout: updateTimeout}
+
+//The parts of the release description used
+type releaseInfo struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+//The download url of an asset - "" when the release doesn't have it
+func (rel releaseInfo) asset(name string) string {
+	for _, a := range rel.Assets {
+		if a.Name == name {
+			return a.URL
+		}
+	}
+	return ""
+}
+
+//The release binary's name for this platform
+func releaseBinaryName() string {
+	name := "tidepoolreport-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+//The update command
+func selfUpdate(args []string) error {
+	fl := flag.NewFlagSet("update", flag.ExitOnError)
+	endpoint := fl.String("url", updateEndpoint, "Latest release endpoint")
+	checkOnly := fl.Bool("check", false, "Only say whether there is a newer release")
+	force := fl.Bool("force", false, "Install the release even when it isn't newer")
+	fl.Parse(args)
+
+	key, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("This build has no release key so it can't check an update - download the new release by hand")
+	}
+
+	var rel releaseInfo
+	body, err := getUpdate(*endpoint)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(body, &rel); err != nil || rel.Tag == "" {
+		return fmt.Errorf("Can't read the release from %s: %v", *endpoint, err)
+	}
+	newer, known := newerVersion(rel.Tag, Version)
+	if rel.Tag == Version || known && !newer && !*force {
+		fmt.Println("Already up to date -", Version, "- the latest release is", rel.Tag)
+		return nil
+	}
+	if *checkOnly {
+		fmt.Println("Release", rel.Tag, "is available - this is", Version)
+		return nil
+	}
+
+	if !known && !*force {
+		return fmt.Errorf("Can't tell whether %s is newer than %s - use -force to install it anyway", rel.Tag, Version)
+	}
+
+	name := releaseBinaryName()
+	binURL, sigURL := rel.asset(name), rel.asset(name+".sig")
+	if binURL == "" || sigURL == "" {
+		return fmt.Errorf("Release %s has no %s with a signature", rel.Tag, name)
+	}
+	bin, err := getUpdate(binURL)
+	if err != nil {
+		return err
+	}
+	sigText, err := getUpdate(sigURL)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), signedRelease(rel.Tag, bin), sig) {
+		return fmt.Errorf("The signature on %s %s doesn't match - not updating", rel.Tag, name)
+	}
+
+	if err = replaceBinary(bin); err != nil {
+		return err
+	}
+	fmt.Println("Updated from", Version, "to", rel.Tag, "- restart to use it")
+	return nil
+}
+
+//What a release's signature is over - its tag and the binary's hash
+func signedRelease(tag string, bin []byte) []byte {
+	sum := sha256.Sum256(bin)
+	return []byte(tag + "\n" + hex.EncodeToString(sum[:]))
+}
+
+/*
+   Whether release tag is a later version than current, e.g. v1.10.0 is
+   later than v1.9.2 and v1.2.0 later than v1.2.0-rc1. Known is false
+   when either isn't a vX.Y.Z version.
+*/
+func newerVersion(tag string, current string) (newer bool, known bool) {
+	a, aPre, ok := parseVersion(tag)
+	b, bPre, ok2 := parseVersion(current)
+	if !ok || !ok2 {
+		return false, false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i], true
+		}
+	}
+	//Same numbers - a release is later than its pre-releases
+	switch {
+	case aPre == bPre:
+		return false, true
+	case aPre == "":
+		return true, true
+	case bPre == "":
+		return false, true
+	}
+	return aPre > bPre, true
+}
+
+//The numbers and pre-release suffix of a vX.Y.Z[-pre] version
+func parseVersion(v string) ([3]int, string, bool) {
+	var nums [3]int
+	v = strings.TrimPrefix(v, "v")
+	pre := ""
+	if i := strings.Index(v, "-"); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return nums, "", false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nums, "", false
+		}
+		nums[i] = n
+	}
+	return nums, pre, true
+}
+
+//GET a release url
+func getUpdate(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+/*
+   Swap the running binary for the new one. The new file is written next
+   to it and renamed over it - the running one is moved aside first since
+   Windows won't replace a program that's running. The old one is put
+   back when the swap fails.
+*/
+func replaceBinary(bin []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+
+	newExe, oldExe := exe+".new", exe+".old"
+	if err = ioutil.WriteFile(newExe, bin, info.Mode().Perm()|0700); err != nil {
+		return fmt.Errorf("Can't write the update beside %s: %v", exe, err)
+	}
+	os.Remove(oldExe)
+	if err = os.Rename(exe, oldExe); err != nil {
+		os.Remove(newExe)
+		return err
+	}
+	if err = os.Rename(newExe, exe); err != nil {
+		os.Rename(oldExe, exe)
+		return err
+	}
+	//Windows keeps the running one locked - it goes on the next update
+	os.Remove(oldExe)
+	return nil
+}
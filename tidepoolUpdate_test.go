@@ -0,0 +1,113 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewerVersion(t *testing.T) {
+	for _, c := range []struct {
+		tag, current string
+		newer, known bool
+	}{
+		{"v1.2.1", "v1.2.0", true, true},
+		{"v1.10.0", "v1.9.2", true, true},
+		{"v2.0.0", "v1.99.99", true, true},
+		{"v1.2.0", "v1.2.0", false, true},
+		{"v1.1.9", "v1.2.0", false, true},
+		{"v1.2.0", "v1.2.0-rc1", true, true},
+		{"v1.2.0-rc1", "v1.2.0", false, true},
+		{"v1.2.0-rc2", "v1.2.0-rc1", true, true},
+		{"v1.2.0", "dev", false, false},
+		{"latest", "v1.2.0", false, false},
+		{"v1.2", "v1.1.0", false, false},
+	} {
+		newer, known := newerVersion(c.tag, c.current)
+		if newer != c.newer || known != c.known {
+			t.Errorf("newerVersion(%q, %q) = %v, %v", c.tag, c.current, newer, known)
+		}
+	}
+}
+
+//An older or unknown release is turned down before anything is downloaded
+func TestSelfUpdateRefusesOlder(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedKey, savedVersion := updatePublicKey, Version
+	updatePublicKey = base64.StdEncoding.EncodeToString(pub)
+	defer func() { updatePublicKey, Version = savedKey, savedVersion }()
+
+	tag, downloads := "", 0
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/latest" {
+			downloads++
+			return
+		}
+		name := releaseBinaryName()
+		fmt.Fprintf(w, `{"tag_name": %q, "assets": [{"name": %q, "browser_download_url": "%s/bin"},
+			{"name": %q, "browser_download_url": "%s/sig"}]}`, tag, name, srv.URL, name+".sig", srv.URL)
+	}))
+	defer srv.Close()
+
+	Version, tag = "v1.2.0", "v1.1.0"
+	if err := selfUpdate([]string{"-url", srv.URL + "/latest"}); err != nil {
+		t.Errorf("older release: %v", err)
+	}
+	Version, tag = "dev", "v1.2.0"
+	if err := selfUpdate([]string{"-url", srv.URL + "/latest"}); err == nil {
+		t.Error("a dev build updated without -force")
+	}
+	if downloads != 0 {
+		t.Errorf("%d downloads of a release that wasn't newer", downloads)
+	}
+}
+
+//An old signed binary served under a newer tag is turned down
+func TestSelfUpdateRelabelled(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedKey, savedVersion := updatePublicKey, Version
+	updatePublicKey, Version = base64.StdEncoding.EncodeToString(pub), "v1.2.0"
+	defer func() { updatePublicKey, Version = savedKey, savedVersion }()
+
+	bin := []byte("the v1.1.0 binary")
+	var sig []byte
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bin":
+			w.Write(bin)
+		case "/sig":
+			w.Write([]byte(base64.StdEncoding.EncodeToString(sig)))
+		default:
+			name := releaseBinaryName()
+			fmt.Fprintf(w, `{"tag_name": "v99.0.0", "assets": [{"name": %q, "browser_download_url": "%s/bin"},
+				{"name": %q, "browser_download_url": "%s/sig"}]}`, name, srv.URL, name+".sig", srv.URL)
+		}
+	}))
+	defer srv.Close()
+
+	for what, signed := range map[string][]byte{
+		"its own tag":     signedRelease("v1.1.0", bin),
+		"the binary only": bin,
+	} {
+		sig = ed25519.Sign(priv, signed)
+		err := selfUpdate([]string{"-url", srv.URL + "/latest"})
+		if err == nil || !strings.Contains(err.Error(), "signature") {
+			t.Errorf("signed with %s: %v", what, err)
+		}
+	}
+}
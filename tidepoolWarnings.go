@@ -0,0 +1,104 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+   Notes about the report.
+
+   Problems with the data that don't stop the report - records that
+   couldn't be read, glucose in units it doesn't know, control solution
+   tests, device clocks that were off, parts of a long fetch that came back empty - are collected
+   while the report is built and shown in a "Notes about this report" box
+   instead of only going to the server log.
+*/
+
+//Device clocks off by more than this get a note
+const clockSkewLimit = 15 * time.Minute
+
+//Problems found in the records
+type dataIssues struct {
+	skipped      int                           //Records that couldn't be read
+	unknownUnits map[string]int                //Glucose records left out, by their units
+	clocks       map[uploadKey][]time.Duration //How far off the device clock was for each record - see tidepoolClock.go
+	control      int                           //Control solution tests
+}
+
+//mg/dL for a glucose value in the units given - only mmol/L is converted.
+//Tidepool uses mmol/L, and a record with no units is taken to be that.
+//ok is false for units it doesn't know.
+func glucoseMgDL(value float64, units string) (float64, bool) {
+	switch strings.ToLower(units) {
+	case "mmol/l", "":
+		return value * mmolToMgdl, true
+	case "mg/dl":
+		return value, true
+	}
+	return 0, false
+}
+
+//Count the problems in the glucose records of the type. Device clocks
+//are checked for both glucose types.
+func (d *dataIssues) check(records tpMeasurement, datatype string) {
+	for i := range records {
+		if records[i].Type == "smbg" || records[i].Type == "cbg" {
+			d.sampleClock(records[i].Devicetime, records[i].Time, records[i].Timezoneoffset, records[i].Deviceid, records[i].Uploadid)
+		}
+		if records[i].Type != datatype {
+			continue
+		}
+		if _, ok := glucoseMgDL(records[i].Value, records[i].Units); !ok {
+			if d.unknownUnits == nil {
+				d.unknownUnits = map[string]int{}
+			}
+			d.unknownUnits[records[i].Units]++
+		}
+		if controlSolution(records, i) {
+			d.control++
+		}
+	}
+}
+
+//A count and the noun to go with it, e.g. "1 reading" or "3 readings"
+func countOf(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+//Add a note about the report
+func (b *reportBuilder) warn(format string, args ...interface{}) {
+	b.report.Warnings = append(b.report.Warnings, fmt.Sprintf(format, args...))
+}
+
+//Notes for the problems found in the data
+func warningsStep(b *reportBuilder) {
+	d := b.issues
+	if d.skipped > 0 {
+		b.warn("Left out %s that couldn't be read.", countOf(d.skipped, "Tidepool record"))
+	}
+
+	units := make([]string, 0, len(d.unknownUnits))
+	for u := range d.unknownUnits {
+		units = append(units, u)
+	}
+	sort.Strings(units)
+	for _, u := range units {
+		b.warn("Left out %s in %q - only mmol/L and mg/dL are understood.", countOf(d.unknownUnits[u], "reading"), u)
+	}
+
+	if d.control > 0 {
+		if b.opts.KeepControl {
+			b.warn("%s marked by the meter as control solution tests are counted in the statistics.", countOf(d.control, "reading"))
+		} else {
+			b.warn("Left out %s marked by the meter as control solution tests.", countOf(d.control, "reading"))
+		}
+	}
+
+	b.report.Warnings = append(b.report.Warnings, d.clockNotes(b.opts.FixClocks, b.opts.ClockShifts)...)
+}
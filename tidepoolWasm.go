@@ -0,0 +1,112 @@
+//go:build js && wasm
+// +build js,wasm
+
+package tidepoolreport
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"syscall/js"
+)
+
+/*
+   The report engine in the browser.
+
+   Built with GOOS=js GOARCH=wasm (see wasm/main.go) the package leaves
+   out the web server, the Tidepool client and everything that touches
+   the disk. What is left builds reports from Tidepool data the page
+   already has, so the Tidepool credentials and the data never leave the
+   browser. ExportJS adds one function for the page to call:
+
+       tidepoolReport(data, options)
+
+   data is the Tidepool records as json text. options is an object with
+   any of dataType, startDate, endDate, day, ranges, excludeDays,
+   showExcluded ("on"), sources ("on"), keepControl ("on"), fixClocks
+   ("on"), clockShifts, gapHours, sections, preset, units (mg/dL or
+   mmol/L) and format (txt, md or json - txt when not given). It returns
+   an object with the report as text in output and, for md, the chart
+   images as base64 png in images - or the reason it failed in error.
+*/
+
+//ExportJS - make tidepoolReport callable from JavaScript
+func ExportJS() {
+	js.Global().Set("tidepoolReport", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 {
+			return map[string]interface{}{"error": "tidepoolReport needs the Tidepool data"}
+		}
+		options := js.Undefined()
+		if len(args) > 1 {
+			options = args[1]
+		}
+		return reportForJS(args[0].String(), options)
+	}))
+}
+
+//A string option - "" when not given
+func jsOption(options js.Value, name string) string {
+	if options.Type() != js.TypeObject {
+		return ""
+	}
+	if v := options.Get(name); v.Type() == js.TypeString {
+		return v.String()
+	}
+	return ""
+}
+
+//Build the report and render it for the page
+func reportForJS(data string, options js.Value) interface{} {
+	opts := ReportOptions{
+		StartDate:    jsOption(options, "startDate"),
+		EndDate:      jsOption(options, "endDate"),
+		Day:          jsOption(options, "day"),
+		GapThreshold: gapThreshold(jsOption(options, "gapHours")),
+		Units:        Units(jsOption(options, "units")),
+		ExcludeDays:  parseExcludeDays(jsOption(options, "excludeDays")),
+		ShowExcluded: jsOption(options, "showExcluded") == "on",
+		Sources:      jsOption(options, "sources") == "on",
+		KeepControl:  jsOption(options, "keepControl") == "on",
+		FixClocks:    jsOption(options, "fixClocks") == "on",
+		ClockShifts:  parseClockShifts(jsOption(options, "clockShifts")),
+	}
+	opts.setDataTypes(parseDataTypes(jsOption(options, "dataType")))
+	if opts.DataType == "" {
+		opts.DataType = "smbg"
+	}
+	if sections := parseSections(jsOption(options, "sections")); sections != nil {
+		opts.setSections(sections)
+	}
+	if ranges := parseDateRanges(jsOption(options, "ranges")); ranges != nil {
+		opts.setRanges(ranges)
+	}
+	if opts.Day != "" {
+		opts.StartDate, opts.EndDate = opts.Day, opts.Day
+		if opts.Sections == nil {
+			opts.setSections(daySections)
+		}
+	}
+	opts.Target, opts.Goals, opts.Caregiver = presetTargets(jsOption(options, "preset"), TargetRange{}, ClinicalGoals{})
+
+	rep, err := BuildReportFromData([]byte(data), nil, opts)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+
+	switch jsOption(options, "format") {
+	case "md":
+		md, images := markdownReport(rep)
+		encoded := map[string]interface{}{}
+		for name, img := range images {
+			encoded[name] = base64.StdEncoding.EncodeToString(img)
+		}
+		return map[string]interface{}{"output": md, "images": encoded}
+	case "json":
+		out, err := json.Marshal(jsonReport(rep))
+		if err != nil {
+			return map[string]interface{}{"error": err.Error()}
+		}
+		return map[string]interface{}{"output": string(out)}
+	default:
+		return map[string]interface{}{"output": textSummary(rep)}
+	}
+}
@@ -0,0 +1,184 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+   Split the report into one PDF per ISO week, bundled as a zip.
+
+   Clinics filing reports by week prefer this and it keeps each file small
+   enough to email. Each weekly PDF has that week's readings, data gaps and
+   pump suspends. The meter vs CGM and sensor session pages summarize the
+   whole period so they go in a separate summary PDF when requested.
+*/
+
+//An ISO year and week number
+type isoWeek struct {
+	year int
+	week int
+}
+
+//Label used in the file names - 2021-W05
+func (k isoWeek) String() string {
+	return fmt.Sprintf("%d-W%02d", k.year, k.week)
+}
+
+//The ISO week of a yyyy-mm-dd date
+func weekOf(date string) isoWeek {
+	t, _ := time.Parse("2006-01-02", date)
+	y, w := t.ISOWeek()
+	return isoWeek{year: y, week: w}
+}
+
+//Monday of the ISO week
+func (k isoWeek) monday() time.Time {
+	//January 4th is always in week 1
+	jan4 := time.Date(k.year, 1, 4, 0, 0, 0, 0, time.UTC)
+	offset := (int(jan4.Weekday()) + 6) % 7 //Days since Monday
+	return jan4.AddDate(0, 0, -offset+(k.week-1)*7)
+}
+
+//Split the report by week - each week gets that week's readings, gaps
+//and suspends. Weeks are in date order.
+func splitByWeek(rep *Report) []*Report {
+	byWeek := map[isoWeek]*Report{}
+	var order []isoWeek
+	week := func(k isoWeek) *Report {
+		if wr, ok := byWeek[k]; ok {
+			return wr
+		}
+		monday := k.monday()
+		byWeek[k] = &Report{
+			PatientName: rep.PatientName,
+			Start:       monday.Format("2006-01-02"),
+			End:         monday.AddDate(0, 0, 6).Format("2006-01-02"),
+			DataType:    rep.DataType,
+			OtherType:   rep.OtherType,
+			Sections:    rep.Sections,
+			Units:       rep.Units,
+
+			FullCGMTable: rep.FullCGMTable,
+		}
+		order = append(order, k)
+		return byWeek[k]
+	}
+
+	for _, rd := range rep.Readings {
+		wr := week(weekOf(rd.Time.Format("2006-01-02")))
+		wr.Readings = append(wr.Readings, rd)
+	}
+	for _, g := range rep.Gaps {
+		wr := week(weekOf(g.start.Format("2006-01-02")))
+		wr.Gaps = append(wr.Gaps, g)
+	}
+	for _, d := range rep.Suspends {
+		wr := week(weekOf(d.day))
+		wr.Suspends = append(wr.Suspends, d)
+	}
+	for _, d := range rep.Boluses {
+		wr := week(weekOf(d.Time.Format("2006-01-02")))
+		wr.Boluses = append(wr.Boluses, d)
+	}
+	for _, rd := range rep.OtherReadings {
+		wr := week(weekOf(rd.Time.Format("2006-01-02")))
+		wr.OtherReadings = append(wr.OtherReadings, rd)
+	}
+	for _, d := range rep.Basal {
+		wr := week(weekOf(d.Day))
+		wr.Basal = append(wr.Basal, d)
+	}
+	for _, e := range rep.Carbs {
+		wr := week(weekOf(e.Time.Format("2006-01-02")))
+		wr.Carbs = append(wr.Carbs, e)
+	}
+
+	//Date order
+	sort.Slice(order, func(i, j int) bool {
+		return order[i].year < order[j].year || (order[i].year == order[j].year && order[i].week < order[j].week)
+	})
+	var weeks []*Report
+	for _, k := range order {
+		//Each week's time in range and statistics page are that week's
+		byWeek[k].Stats = computeStatsIn(byWeek[k].Readings, rep.Target)
+		byWeek[k].Stats.units = rep.Units
+		if rep.Statistics != nil {
+			byWeek[k].Statistics = periodStatisticsFor(byWeek[k].Readings)
+			if byWeek[k].Statistics != nil {
+				byWeek[k].Statistics.units = rep.Units
+			}
+		}
+		weeks = append(weeks, byWeek[k])
+	}
+	return weeks
+}
+
+//Generate the weekly PDFs in the workspace and send them to the browser as a zip
+func ShowWeeklyPDFs(w http.ResponseWriter, r *http.Request, ws *Workspace, cfg Config, rep *Report) {
+	if err := writeWeeklyZip(w, ws, cfg, rep); err != nil {
+		log.Println("Error making the weekly PDFs", err)
+		http.Error(w, "Sorry, the weekly PDFs could not be made", http.StatusInternalServerError)
+		return
+	}
+	ws.deliver(w, r, "tidepool-weekly.zip", "application/zip", true)
+}
+
+//Make the weekly PDFs and zip them up in the workspace - the zip is made
+//there so it can be sent with range support
+func writeWeeklyZip(w http.ResponseWriter, ws *Workspace, cfg Config, rep *Report) error {
+	zipfile, err := os.Create(ws.Path("tidepool-weekly.zip"))
+	if err != nil {
+		return err
+	}
+	defer zipfile.Close()
+	z := zip.NewWriter(zipfile)
+
+	//Make a pdf, add it to the zip and remove the file
+	addPDF := func(name string, wr *Report) error {
+		filename := ws.Path(name)
+		if err := CreatePDF(w, filename, cfg, wr); err != nil {
+			return err
+		}
+		defer os.Remove(filename)
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	for _, wr := range splitByWeek(rep) {
+		if err := addPDF("tidepool-"+weekOf(wr.Start).String()+".pdf", wr); err != nil {
+			return err
+		}
+	}
+
+	//Whole period summaries
+	if rep.Accuracy != nil || rep.Sessions != nil {
+		summary := &Report{PatientName: rep.PatientName, Start: rep.Start, End: rep.End, DataType: rep.DataType,
+			Sections: rep.Sections, Units: rep.Units, Accuracy: rep.Accuracy, Sessions: rep.Sessions}
+		if err := addPDF("tidepool-summary.pdf", summary); err != nil {
+			return err
+		}
+	}
+
+	if err := z.Close(); err != nil {
+		return err
+	}
+	return zipfile.Close()
+}
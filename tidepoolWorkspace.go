@@ -0,0 +1,110 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+/*
+   Workspaces.
+
+   Every report run gets its own Workspace - a temporary folder for the
+   downloaded json, chart images and generated files. Whatever starts the
+   run (the web handlers, the api, a command line) creates one and closes
+   it when done, so nothing is ever written to a shared fixed path and
+   nothing is left behind.
+*/
+
+//Workspace - a temporary folder owning the files for one report run
+type Workspace struct {
+	Dir string
+
+	//The web session the run is for. Finished files are then stored
+	//behind a one-time download link instead of sent straight back.
+	session *appSession
+}
+
+//Folder the workspaces are made in - "" for the system's temporary folder
+var workspaceRoot string
+
+//NewWorkspace - create an empty workspace. Close it when done.
+func NewWorkspace() (*Workspace, error) {
+	dir, err := ioutil.TempDir(workspaceRoot, "tidepoolreport-")
+	if err != nil {
+		return nil, err
+	}
+	return &Workspace{Dir: dir}, nil
+}
+
+//Path - the path of a file in the workspace
+func (ws *Workspace) Path(name string) string {
+	return filepath.Join(ws.Dir, name)
+}
+
+//Close - delete the workspace and everything in it
+func (ws *Workspace) Close() error {
+	return os.RemoveAll(ws.Dir)
+}
+
+/*
+   Send a stored file with http.ServeContent so byte ranges, ETags and
+   If-None-Match work - a big PDF can be resumed over a flaky connection
+   instead of starting again. The ETag is a hash of the contents.
+   An attachment is downloaded as downloadName rather than shown.
+*/
+func serveFile(w http.ResponseWriter, r *http.Request, filename string, contentType string, downloadName string, attachment bool) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	sum := sha256.New()
+	if _, err = io.Copy(sum, f); err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	disposition := "inline"
+	if attachment {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-type", contentType)
+	w.Header().Set("Content-Disposition", disposition+`; filename="`+downloadName+`"`)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum.Sum(nil))+`"`)
+	http.ServeContent(w, r, downloadName, info.ModTime(), f)
+	return nil
+}
+
+//Send a finished file from the workspace - straight back, or for a web
+//session stored with a redirect to its one-time download link
+func (ws *Workspace) deliver(w http.ResponseWriter, r *http.Request, name string, contentType string, attachment bool) {
+	var err error
+	if ws.session == nil {
+		err = serveFile(w, r, ws.Path(name), contentType, name, attachment)
+	} else {
+		var token string
+		if token, err = downloads.add(ws.session.id, ws.Path(name), contentType, name, attachment); err == nil {
+			http.Redirect(w, r, "/download/"+token, http.StatusSeeOther)
+		}
+	}
+	if err != nil {
+		log.Println("Error sending", name, err)
+		http.Error(w, "Sorry, the report could not be sent", http.StatusInternalServerError)
+	}
+}
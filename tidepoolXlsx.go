@@ -0,0 +1,356 @@
+package tidepoolreport
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+   Excel output - format=xlsx.
+
+   Like a .docx an .xlsx file is a zip of XML parts, so a minimal writer
+   is built here: sheets of text and number cells, the first row of each
+   in bold. Columns can be hidden - the readings sheets keep the Tidepool
+   ids each reading came from in hidden columns.
+
+   The table sheets are formatted for working in Excel - the header row
+   stays put when scrolling and has filter buttons, the columns are wide
+   enough for their values, glucose shows whole mg/dl or mmol/L to one
+   place and readings below or above the target range are red or orange.
+   There's a summary sheet, a statistics sheet, a readings sheet for each
+   glucose type and sheets for the boluses, carbs and basal.
+*/
+
+//The .xlsx media type
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+//A worksheet - cells are strings, numbers or an xlsxCell for a styled one
+type xlsxSheet struct {
+	name   string
+	rows   [][]interface{}
+	hidden []int     //Hidden columns, 0 based
+	widths []float64 //Column widths in characters - 0 leaves it to Excel
+	table  bool      //Header row frozen with filter buttons
+}
+
+//A cell with one of the styles in styles.xml
+type xlsxCell struct {
+	value interface{}
+	style int
+}
+
+//The cell styles - the order of cellXfs in styles.xml
+const (
+	xlsxPlain = iota
+	xlsxBold
+	xlsxWhole  //A number to no places
+	xlsxTenths //To one place
+	xlsxLowWhole
+	xlsxLowTenths
+	xlsxHighWhole
+	xlsxHighTenths
+)
+
+//Builds up the workbook
+type xlsxWriter struct {
+	sheets []*xlsxSheet
+}
+
+//Add a sheet with any hidden columns
+func (x *xlsxWriter) sheet(name string, rows [][]interface{}, hidden ...int) *xlsxSheet {
+	s := &xlsxSheet{name: name, rows: rows, hidden: hidden}
+	x.sheets = append(x.sheets, s)
+	return s
+}
+
+//Make the sheet a table with the column widths
+func (s *xlsxSheet) asTable(widths ...float64) {
+	s.table = true
+	s.widths = widths
+}
+
+//A glucose cell in the units, colored when out of the target range
+func xlsxGlucose(mgdl float64, rng TargetRange, u Units) xlsxCell {
+	style := xlsxWhole
+	if u == MmolL {
+		style = xlsxTenths
+	}
+	switch {
+	case mgdl < rng.Low:
+		style += xlsxLowWhole - xlsxWhole
+	case mgdl > rng.High:
+		style += xlsxHighWhole - xlsxWhole
+	}
+	return xlsxCell{u.in(mgdl), style}
+}
+
+//Spreadsheet column letters - A, B, ... Z, AA, ...
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+//The XML for one sheet
+func (s xlsxSheet) xml() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	if s.table {
+		//Keep the header row in view
+		b.WriteString(`<sheetViews><sheetView workbookViewId="0">` +
+			`<pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/>` +
+			`</sheetView></sheetViews>`)
+	}
+
+	//Column widths and hidden columns
+	hidden := map[int]bool{}
+	cols := len(s.widths)
+	for _, c := range s.hidden {
+		hidden[c] = true
+		if c+1 > cols {
+			cols = c + 1
+		}
+	}
+	var colsXML strings.Builder
+	for c := 0; c < cols; c++ {
+		width := 0.0
+		if c < len(s.widths) {
+			width = s.widths[c]
+		}
+		switch {
+		case hidden[c]:
+			if width == 0 {
+				width = 24
+			}
+			fmt.Fprintf(&colsXML, `<col min="%d" max="%d" width="%g" hidden="1" customWidth="1"/>`, c+1, c+1, width)
+		case width > 0:
+			fmt.Fprintf(&colsXML, `<col min="%d" max="%d" width="%g" customWidth="1"/>`, c+1, c+1, width)
+		}
+	}
+	if colsXML.Len() > 0 {
+		b.WriteString(`<cols>` + colsXML.String() + `</cols>`)
+	}
+
+	b.WriteString(`<sheetData>`)
+	for r, row := range s.rows {
+		fmt.Fprintf(&b, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			ref := fmt.Sprintf("%s%d", xlsxColumn(c), r+1)
+			style := ""
+			if xc, ok := cell.(xlsxCell); ok {
+				cell = xc.value
+				style = fmt.Sprintf(` s="%d"`, xc.style)
+			}
+			if r == 0 {
+				style = fmt.Sprintf(` s="%d"`, xlsxBold)
+			}
+			switch v := cell.(type) {
+			case int:
+				fmt.Fprintf(&b, `<c r="%s"%s><v>%d</v></c>`, ref, style, v)
+			case float64:
+				fmt.Fprintf(&b, `<c r="%s"%s><v>%g</v></c>`, ref, style, v)
+			default:
+				fmt.Fprintf(&b, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, style, docxEscape(fmt.Sprint(v)))
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData>`)
+	if s.table && len(s.rows) > 0 && len(s.rows[0]) > 0 {
+		fmt.Fprintf(&b, `<autoFilter ref="A1:%s%d"/>`, xlsxColumn(len(s.rows[0])-1), len(s.rows))
+	}
+	b.WriteString(`</worksheet>`)
+	return b.String()
+}
+
+//Write the .xlsx package
+func (x *xlsxWriter) write(w io.Writer) error {
+	var types, sheets, rels strings.Builder
+	for i, s := range x.sheets {
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		fmt.Fprintf(&sheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, docxEscape(s.name), i+1, i+1)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(x.sheets)+1)
+
+	parts := [][2]string{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			types.String() + `</Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="` + docxNsR + `">` +
+			`<sheets>` + sheets.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` + rels.String() + `</Relationships>`},
+		//The cellXfs are the xlsxPlain ... xlsxHighTenths styles. Fonts are
+		//plain, bold, red for lows and orange for highs.
+		{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<numFmts count="1"><numFmt numFmtId="164" formatCode="0.0"/></numFmts>` +
+			`<fonts count="4"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font>` +
+			`<font><sz val="11"/><color rgb="FFC00000"/><name val="Calibri"/></font>` +
+			`<font><sz val="11"/><color rgb="FFE46C0A"/><name val="Calibri"/></font></fonts>` +
+			`<fills count="1"><fill><patternFill patternType="none"/></fill></fills>` +
+			`<borders count="1"><border/></borders>` +
+			`<cellStyleXfs count="1"><xf/></cellStyleXfs>` +
+			`<cellXfs count="8"><xf fontId="0"/><xf fontId="1" applyFont="1"/>` +
+			`<xf numFmtId="1" fontId="0" applyNumberFormat="1"/><xf numFmtId="164" fontId="0" applyNumberFormat="1"/>` +
+			`<xf numFmtId="1" fontId="2" applyNumberFormat="1" applyFont="1"/><xf numFmtId="164" fontId="2" applyNumberFormat="1" applyFont="1"/>` +
+			`<xf numFmtId="1" fontId="3" applyNumberFormat="1" applyFont="1"/><xf numFmtId="164" fontId="3" applyNumberFormat="1" applyFont="1"/>` +
+			`</cellXfs></styleSheet>`},
+	}
+	for i, s := range x.sheets {
+		parts = append(parts, [2]string{fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), s.xml()})
+	}
+
+	z := zip.NewWriter(w)
+	for _, part := range parts {
+		f, err := z.Create(part[0])
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(f, part[1]); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+//Build the workbook - summary and statistics sheets, a sheet of each
+//glucose type's readings and the other records
+func xlsxReport(rep *Report) *xlsxWriter {
+	x := &xlsxWriter{}
+
+	summary := [][]interface{}{{"Metric", "Value"}, {"Period", rep.Range()}}
+	for _, m := range rep.Metrics {
+		summary = append(summary, []interface{}{m.Name, m.Value})
+	}
+	if len(rep.Targets) > 0 {
+		summary = append(summary, []interface{}{}, []interface{}{"Clinical targets", "Target", "Value", ""})
+		for _, t := range rep.Targets {
+			summary = append(summary, []interface{}{t.Name, t.Goal, t.Value, t.Status()})
+		}
+	}
+	x.sheet("Summary", summary).widths = []float64{30, 30, 12, 10}
+
+	if rep.Stats.count > 0 {
+		x.sheet("Statistics", xlsxStatistics(rep)).widths = []float64{34, 12}
+	}
+
+	//A sheet for each glucose type
+	x.readingsSheet(rep, rep.DataType, rep.Readings)
+	if len(rep.OtherReadings) > 0 {
+		x.readingsSheet(rep, rep.OtherType, rep.OtherReadings)
+	}
+
+	if len(rep.Boluses) > 0 {
+		boluses := [][]interface{}{{"Date", "Time", "Normal U", "Extended U", "Extended Minutes", "Kind", "Interrupted"}}
+		for _, d := range rep.Boluses {
+			interrupted := ""
+			if d.Interrupted {
+				interrupted = "Yes"
+			}
+			boluses = append(boluses, []interface{}{d.Time.Format("2006-01-02"), d.Time.Format("15:04:05"), d.Normal, d.Extended,
+				int(d.Duration.Minutes()), d.KindName(), interrupted})
+		}
+		x.sheet("Boluses", boluses).asTable(12, 10, 10, 12, 17, 14, 12)
+	}
+	if len(rep.Carbs) > 0 {
+		carbs := [][]interface{}{{"Date", "Time", "Carbs g", "Glucose " + rep.Units.name(), "Bolus U", "From"}}
+		for _, e := range rep.Carbs {
+			glucose := interface{}("")
+			if e.MgDL > 0 {
+				glucose = xlsxGlucose(e.MgDL, rep.Target, rep.Units)
+			}
+			carbs = append(carbs, []interface{}{e.Time.Format("2006-01-02"), e.Time.Format("15:04:05"), e.Grams, glucose, e.Bolus, e.SourceName()})
+		}
+		x.sheet("Carbs", carbs).asTable(12, 10, 10, 14, 10, 18)
+	}
+	if rep.Recovery != nil && len(rep.Recovery.Lows) > 0 {
+		lows := [][]interface{}{{"Date", "Time", "Lowest " + rep.Units.name(), "Minutes To Recover", "Rebound " + rep.Units.name()}}
+		for _, low := range rep.Recovery.Lows {
+			recovery, rebound := interface{}(""), interface{}("")
+			if low.Recovery > 0 {
+				recovery = int(low.Recovery.Minutes())
+			}
+			if low.Rebound > 0 {
+				rebound = xlsxGlucose(low.Rebound, rep.Target, rep.Units)
+			}
+			lows = append(lows, []interface{}{low.Start.Format("2006-01-02"), low.Start.Format("15:04:05"),
+				xlsxGlucose(low.Lowest, rep.Target, rep.Units), recovery, rebound})
+		}
+		x.sheet("Lows", lows).asTable(12, 10, 14, 20, 16)
+	}
+	if len(rep.Basal) > 0 {
+		basal := [][]interface{}{{"Date", "Basal U", "Temp Basals", "Suspended Minutes"}}
+		for _, d := range rep.Basal {
+			basal = append(basal, []interface{}{d.Day, d.Units, d.Temps, int(d.Suspended.Minutes())})
+		}
+		x.sheet("Basal", basal).asTable(12, 10, 12, 18)
+	}
+	return x
+}
+
+//Add a sheet of a glucose type's readings
+func (x *xlsxWriter) readingsSheet(rep *Report, datatype string, readings []Reading) {
+	rows := [][]interface{}{{"Date", "Time", "Glucose " + rep.Units.name(), "Type", "Record Id", "Upload Id", "Device Id"}}
+	if rep.Sources {
+		rows[0] = append(rows[0], "Source")
+	}
+	for _, rd := range readings {
+		row := []interface{}{rd.Time.Format("2006-01-02"), rd.Time.Format("15:04:05"), xlsxGlucose(rd.MgDL(), rep.Target, rep.Units), rd.Type,
+			rd.ID, rd.UploadID, rd.DeviceID}
+		if rep.Sources {
+			row = append(row, rd.Source)
+		}
+		rows = append(rows, row)
+	}
+	//The ids are there for tracing a reading back - unhide them in Excel
+	x.sheet(readingsTitle(datatype), rows, 4, 5, 6).asTable(12, 10, 14, 8, 12, 12, 12, 24)
+}
+
+//The statistics sheet - the numbers behind the time in range and summary
+func xlsxStatistics(rep *Report) [][]interface{} {
+	st, u := rep.Stats, rep.Units
+	glucose := func(mgdl float64) xlsxCell {
+		if u == MmolL {
+			return xlsxCell{u.in(mgdl), xlsxTenths}
+		}
+		return xlsxCell{u.in(mgdl), xlsxWhole}
+	}
+	percent := func(p float64) xlsxCell { return xlsxCell{p, xlsxTenths} }
+
+	rows := [][]interface{}{
+		{"Statistic", "Value"},
+		{"Readings", st.count},
+		{"Mean " + u.name(), glucose(st.mean)},
+	}
+	if ps := rep.Statistics; ps != nil {
+		rows = append(rows,
+			[]interface{}{"Median " + u.name(), glucose(ps.Median)},
+			[]interface{}{"Lowest " + u.name(), glucose(ps.Min)},
+			[]interface{}{"Highest " + u.name(), glucose(ps.Max)})
+	}
+	return append(rows,
+		[]interface{}{"Standard deviation " + u.name(), glucose(st.sd)},
+		[]interface{}{"Coefficient of variation %", percent(st.cv)},
+		[]interface{}{"GMI %", percent(st.gmi)},
+		[]interface{}{"Estimated A1c %", percent(st.ea1c)},
+		[]interface{}{fmt.Sprintf("Below %s %%", u.withName(st.rng.Low)), percent(st.below)},
+		[]interface{}{"In range %", percent(st.inRange)},
+		[]interface{}{fmt.Sprintf("Above %s %%", u.withName(st.rng.High)), percent(st.above)},
+		[]interface{}{"Separate lows", st.hypos})
+}
@@ -0,0 +1,184 @@
+package tidepoolreport
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+   Year in review.
+
+   Built from the readings kept in a profile's archive (see
+   tidepoolArchive.go) rather than a fetch, so it can cover more than
+   Tidepool will hand over in one go. The usual summary, targets and
+   trend chart for the year come first, then a section with the year's
+   totals, time in range and GMI a quarter at a time and which way they
+   went, and the longest stretches spent in range.
+*/
+
+//The year section's name
+const yearSectionName = "year"
+
+//How many of the longest in range stretches are listed
+const yearStreaks = 3
+
+//What a year in review report shows
+var yearSections = []string{yearSectionName, sectionSummary, sectionTargets, sectionChart}
+
+//A quarter's numbers
+type quarterStats struct {
+	Name     string //Q1 to Q4
+	Readings int
+	InRange  float64 //Percent
+	GMI      float64
+}
+
+//A run of readings all in range with no gap between them
+type rangeStreak struct {
+	Start time.Time
+	End   time.Time
+}
+
+//How long it lasted
+func (s rangeStreak) Length() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+//BuildYearReport - the year in review for a calendar year from archived
+//readings of any type. opts picks the data type and target range; its
+//dates and sections are set here.
+func BuildYearReport(readings []Reading, year int, opts ReportOptions) (*Report, error) {
+	opts.StartDate = fmt.Sprintf("%04d-01-01", year)
+	opts.EndDate = fmt.Sprintf("%04d-12-31", year)
+	opts.Sections = yearSections
+
+	//The archive holds every year - the builder only sees this one
+	b := newReportBuilder(opts)
+	b.glucose = map[string][]Reading{}
+	for _, rd := range readings {
+		if rd.Time.Year() == year {
+			b.glucose[rd.Type] = append(b.glucose[rd.Type], rd)
+		}
+	}
+	for _, rds := range b.glucose {
+		sort.SliceStable(rds, func(i, j int) bool { return rds[i].Time.Before(rds[j].Time) })
+	}
+	rep, err := b.build()
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := opts.GapThreshold
+	if threshold <= 0 {
+		threshold = gapThreshold("")
+	}
+	rep.Extras = append(rep.Extras, ReportSection{
+		Name:  yearSectionName,
+		Title: fmt.Sprintf("%d in review", year),
+		Lines: yearLines(rep.Readings, rep.Target, threshold),
+	})
+	return rep, nil
+}
+
+//The year section's lines
+func yearLines(readings []Reading, rng TargetRange, threshold time.Duration) []string {
+	if len(readings) == 0 {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("%d readings from %s to %s", len(readings),
+		readings[0].Time.Format("2006-01-02"), readings[len(readings)-1].Time.Format("2006-01-02"))}
+
+	quarters := quarterlyStats(readings, rng)
+	for _, q := range quarters {
+		lines = append(lines, fmt.Sprintf("%s: time in range %.0f%%, GMI %.1f%% (%d readings)", q.Name, q.InRange, q.GMI, q.Readings))
+	}
+	if len(quarters) > 1 {
+		first, last := quarters[0], quarters[len(quarters)-1]
+		lines = append(lines,
+			trendLine("Time in range", first.Name, last.Name, first.InRange, last.InRange, 1, "%.0f%%"),
+			trendLine("GMI", first.Name, last.Name, first.GMI, last.GMI, 0.1, "%.1f%%"))
+	}
+
+	for i, s := range longestStreaks(readings, rng, threshold, yearStreaks) {
+		label := "Longest time in range"
+		if i > 0 {
+			label = "Next longest"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s, %s to %s", label, formatDuration(s.Length()),
+			s.Start.Format("2006-01-02 15:04"), s.End.Format("2006-01-02 15:04")))
+	}
+	return lines
+}
+
+//The numbers for each quarter with readings, in order
+func quarterlyStats(readings []Reading, rng TargetRange) []quarterStats {
+	var byQuarter [4][]Reading
+	for _, rd := range readings {
+		q := (int(rd.Time.Month()) - 1) / 3
+		byQuarter[q] = append(byQuarter[q], rd)
+	}
+	var quarters []quarterStats
+	for i, rds := range byQuarter {
+		if len(rds) == 0 {
+			continue
+		}
+		st := computeStatsIn(rds, rng)
+		quarters = append(quarters, quarterStats{
+			Name:     fmt.Sprintf("Q%d", i+1),
+			Readings: st.count,
+			InRange:  st.inRange,
+			GMI:      st.gmi,
+		})
+	}
+	return quarters
+}
+
+//Which way a number went from the first quarter to the last - a move
+//smaller than steady counts as holding
+func trendLine(name, from, to string, a, b, steady float64, format string) string {
+	av, bv := fmt.Sprintf(format, a), fmt.Sprintf(format, b)
+	switch {
+	case math.Abs(b-a) < steady:
+		return fmt.Sprintf("%s held at about %s from %s to %s", name, bv, from, to)
+	case b > a:
+		return fmt.Sprintf("%s rose from %s in %s to %s in %s", name, av, from, bv, to)
+	default:
+		return fmt.Sprintf("%s fell from %s in %s to %s in %s", name, av, from, bv, to)
+	}
+}
+
+//The longest runs of in range readings, longest first. A reading out of
+//range or a gap longer than threshold ends a run. The readings must be in time order.
+func longestStreaks(readings []Reading, rng TargetRange, threshold time.Duration, n int) []rangeStreak {
+	var streaks []rangeStreak
+	var cur *rangeStreak
+	for _, rd := range readings {
+		in := rd.MgDL() >= rng.Low && rd.MgDL() <= rng.High
+		if cur != nil && (!in || rd.Time.Sub(cur.End) > threshold) {
+			streaks = append(streaks, *cur)
+			cur = nil
+		}
+		if !in {
+			continue
+		}
+		if cur == nil {
+			cur = &rangeStreak{Start: rd.Time}
+		}
+		cur.End = rd.Time
+	}
+	if cur != nil {
+		streaks = append(streaks, *cur)
+	}
+
+	sort.SliceStable(streaks, func(i, j int) bool { return streaks[i].Length() > streaks[j].Length() })
+	if len(streaks) > n {
+		streaks = streaks[:n]
+	}
+	//A single reading isn't much of a stretch
+	for len(streaks) > 0 && streaks[len(streaks)-1].Length() == 0 {
+		streaks = streaks[:len(streaks)-1]
+	}
+	return streaks
+}
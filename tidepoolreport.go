@@ -1,3 +1,6 @@
+//go:build !js
+// +build !js
+
 /*
    This package implements the Tidepool APIs to get authorization
    then user data for blood glucose values using Golang.
@@ -27,127 +30,116 @@
 package tidepoolreport
 
 import (
-	"encoding/json"
-	"fmt"
-	"html/template"
+	"flag"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strconv"
-	"time"
-    "errors"
-) 
+	"path/filepath"
+	"strings"
+)
 
 //Tidepool error response message.
 //For things like 403 errors when user enters invalid credentials
 type tpError struct {
-    Status      int
-    Id          string  
-    Code        string
-    Message     string  
-}
-
-
-//Tidepool structures generated by github JSONtoGo
-type tpMeasurement []struct {
-	Conversionoffset    int           `json:"conversionOffset"`
-	Deviceid            string        `json:"deviceId"`
-	Devicetime          string        `json:"deviceTime"`
-	GUID                string        `json:"guid"`
-	ID                  string        `json:"id"`
-	Payload             Payload       `json:"payload,omitempty"`
-	Time                time.Time     `json:"time"`
-	Timezoneoffset      int           `json:"timezoneOffset"`
-	Type                string        `json:"type"`
-	Units               string        `json:"units,omitempty"`
-	Uploadid            string        `json:"uploadId"`
-	Value               float64       `json:"value,omitempty"`
-	Annotations         []Annotations `json:"annotations,omitempty"`
-	Byuser              string        `json:"byUser,omitempty"`
-	Client              Client        `json:"client,omitempty"`
-	Computertime        string        `json:"computerTime,omitempty"`
-	Devicemanufacturers []string      `json:"deviceManufacturers,omitempty"`
-	Devicemodel         string        `json:"deviceModel,omitempty"`
-	Deviceserialnumber  string        `json:"deviceSerialNumber,omitempty"`
-	Devicetags          []string      `json:"deviceTags,omitempty"`
-	Timeprocessing      string        `json:"timeProcessing,omitempty"`
-	Timezone            string        `json:"timezone,omitempty"`
-	Version             string        `json:"version,omitempty"`
-}
-
-//Additional structures passed by Tidepool
-//inside the measurement structure.
-//This code does not use them
-
-//Payload - not used
-type Payload struct {
-	Logindices []int `json:"logIndices"`
-}
-
-//Annotations - not used
-type Annotations struct {
-	Code string `json:"code"`
-}
-
-//Private - not used
-type Private struct {
-	Os string `json:"os"`
-}
-
-//Client - not used
-type Client struct {
-	Name    string  `json:"name"`
-	Private Private `json:"private"`
-	Version string  `json:"version"`
-}
-
-//This is the structure passed to the PDF generator
-//Date, time and value
-type Smbg struct {
-	smbgDate  string
-	smbgTime  string
-	smbgValue string
+	Status  int
+	Id      string
+	Code    string
+	Message string
 }
 
-
-
-
-// Simple error checking - not too friendly
+//Simple error checking - not too friendly
 func check(e error, msg string) {
 	if e != nil {
 		log.Fatal(msg, e)
 	}
 }
 
-
 //Set up routing and start the web server
 func main() {
+	desktopMode := flag.Bool("desktop", false, "Run on this computer only: a random local port, the browser opened and files kept in the user data folder")
+	flag.Parse()
+
+	//Commands instead of the server
+	switch flag.Arg(0) {
+	case "install-service":
+		check(installService(flag.Args()[1:]), "Error installing the service: ")
+		return
+	case "update":
+		check(selfUpdate(flag.Args()[1:]), "Error updating: ")
+		return
+	}
+
+	if *desktopMode {
+		useDataDir()
+	}
 
-    http.Handle("/", http.HandlerFunc(home))     //Serve the home page
-	http.Handle("/opts", http.HandlerFunc(send)) //Run the Tidepool api and gen the pdf of the results
+	http.Handle("/", http.HandlerFunc(home))                             //Serve the home page
+	http.Handle("/opts", http.HandlerFunc(send))                         //Run the Tidepool api and gen the pdf of the results
+	http.Handle("/logout", http.HandlerFunc(logout))                     //Clear the session, cached token and files
+	http.Handle("/api/v1/report", http.HandlerFunc(apiReport))           //The same report for scripts - format by parameter or Accept header
+	http.Handle("/api/v1/estimate", http.HandlerFunc(apiEstimate))       //How big that report would be
+	http.Handle("/api/v1/span", http.HandlerFunc(apiSpan))               //How many records of a type and the days they're on
+	http.Handle("/download/", http.HandlerFunc(download))                //One-time links to finished reports
+	http.Handle("/admin", http.HandlerFunc(admin))                       //Global settings - needs TIDEPOOLREPORT_ADMIN_PASSWORD set
+	http.Handle("/prefs", http.HandlerFunc(preferences))                 //The user's own preferences
+	http.Handle("/prefs/export", http.HandlerFunc(exportPreferences))    //Preferences as a portable json file
+	http.Handle("/prefs/import", http.HandlerFunc(importPreferences))    //And back again
+	http.Handle("/export", http.HandlerFunc(exportProfile))              //Everything kept for the user as a zip
+	http.Handle("/export/csv", http.HandlerFunc(exportCSV))              //A report's readings as CSV - the api with format=csv
+	http.Handle("/import", http.HandlerFunc(importProfile))              //And back again on another server
+	http.Handle("/prefs/testnotify", http.HandlerFunc(testNotification)) //Try the user's notification channels
+	http.Handle("/prefs/checkalerts", http.HandlerFunc(checkAlertsNow))  //Run the user's daily check now
+	http.Handle("/logbook", http.HandlerFunc(logbook))                   //A blank logbook to print
+	http.Handle("/archive/year", http.HandlerFunc(yearInReview))         //The year in review from the user's archive
+	http.Handle("/reviews", http.HandlerFunc(reviewPage))                //Reports kept for the care team and their comments
+	http.Handle("/reviews/report", http.HandlerFunc(reviewReport))       //A kept report with the comments
+	http.Handle("/reviews/comment", http.HandlerFunc(addReviewComment))  //A clinician's comment on one
+	http.Handle("/reviews/finalize", http.HandlerFunc(finalizeReview))   //Lock the one reviewed at the visit
+	http.Handle("/reviews/version", http.HandlerFunc(newReviewVersion))  //A draft copy of a final one
+	http.Handle("/reviews/versions", http.HandlerFunc(reviewVersions))   //A report's versions compared
+	http.Handle("/desktop/alive", http.HandlerFunc(desktopAlive))        //Pages still open - desktop mode only
+
+	go dailyAlerts() //Daily checks for the profiles that turned them on
 
 	//Serve statics like css and js - see the static folder.
-    //Took me a lot of time to get this straight...
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	//Took me a lot of time to get this straight...
+	http.Handle("/static/", http.StripPrefix("/static/", staticFiles()))
+
+	if *desktopMode {
+		runDesktop()
+		return
+	}
 
 	log.Println("Listening... Go to localhost:3000")
-	
-    err := http.ListenAndServe(":3000", nil) //Start a server instance and Listen on port 3000
+
+	err := http.ListenAndServe(":3000", nil) //Start a server instance and Listen on port 3000
 	check(err, "Error on server start")      //Oops...
 }
 
-//Render the home screen with options form
+//Run - start the web server as main does, for the command in cmd/tidepoolreport
+func Run() {
+	main()
+}
+
+//Render the home screen with options form.
+//The form defaults come from the session profile's preferences.
+//The session starts here, not at the first submission - a double click on
+//a first visit's form would otherwise start two and build the report twice.
 func home(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.ParseFiles("templates/TidepoolMain.html")
+	var pr Preferences
+	if sess := appSessions.get(w, r); sess.profile != "" {
+		pr = prefs.get(sess.profile)
+	}
+	tmpl, err := parseTemplate("templates/TidepoolMain.html")
 	check(err, "Can't parse main template.")
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, pr)
 }
 
 /*
    1. Receive the request from the browser with the form data.
    2. Parse the form
    3. Access Tidepool for authorization sending the users id (Email)
-      and password with a POST request
+   and password with a POST request
    4. Retrieve the auth token from the response header.
    5. Retrieve the userid from the response body.
    6. Make a GET call to retrieve the user data.
@@ -158,103 +150,72 @@ func send(w http.ResponseWriter, r *http.Request) {
 	//Get the form values from the response
 	r.ParseForm()
 
-	/*
-	   The first step is to get authorization from Tidepool
-	   using our Tidepool user id (Email) and password
-	*/
-	//Create a POST request to the Tidepool authorization api
-	req, err := http.NewRequest("POST", "https://int-api.tidepool.org/auth/login", nil)
-	check(err, "Error creating the auth request")
-
-	//Use basic uid/pwd authentication
-	req.SetBasicAuth(r.PostFormValue("useremail"), r.PostFormValue("password"))
-
-	//Send the request
-	resp, err := http.DefaultClient.Do(req)
-	check(err, "Error sending the auth request")
-	defer resp.Body.Close()
-
-	//Not OK response?
-	if resp.StatusCode != 200 {
-		check(nil, "Authorization Call: Bad request response"+resp.Status)
-	}
-
-	//Get the Tidepool token header from the response headers
-	var token = resp.Header.Get("x-tidepool-session-token")
+	sess := appSessions.get(w, r)
 
-	//Get the Tidepool user account id from the json response body
-	//1. Read the response body
-	bytes, err := ioutil.ReadAll(resp.Body)
-	check(err, "Error reading the auth response body")
-
-	//2. Decode the json string into a map
-	var result map[string]interface{}
-	json.Unmarshal([]byte(bytes), &result) //Unmarshal into the result map
-
-	//3. Get the user id from the body map
-	var userid = fmt.Sprintf("%v", result["userid"])
-
-	/*
-	   At this point we have the credentials we need to request the users data
-	   We'll setup and make a GET request to the data api.
-	*/
-	
-
-	//The url contains the Tidepool internal userid for the login.
-    //The url is asking for finger stick measurements - ?type=smbg.
-	var url string = "https://int-api.tidepool.org/data/" + userid + "?type=" + r.PostFormValue("datatype")
-
-	//Add the start and/or end dates to the query string.
-	var queryString string = checkDateRanges(r.PostFormValue("startdate"), r.PostFormValue("enddate"))
-	if queryString != "" {
-		url = url + queryString
+	//Just say how big the report would be
+	if r.PostFormValue("estimate") == "on" {
+		showEstimate(w, r)
+		return
 	}
 
-	//Instance a GET request
-	req, err = http.NewRequest("GET", url, nil)
-	check(err, "Error creating data request")
-
-	//Set the headers - token and content type
-	req.Header.Set("x-tidepool-session-token", token)
-	req.Header.Set("content-type", "application/json")
-
-	//Execute the request
-	resp, err = http.DefaultClient.Do(req)
-	check(err, "Error executing data request")
+	//The format from the form, otherwise whatever the browser prefers
+	rd, ok := negotiateRenderer(r)
+	if !ok {
+		DisplayMessageScreen(w, "Sorry, that report format is not available.")
+		return
+	}
 
-	defer resp.Body.Close()
+	//The workspace holds this request's data and report files
+	ws, err := NewWorkspace()
+	if err != nil {
+		DisplayMessageScreen(w, "Unable to create a work folder: "+err.Error())
+		return
+	}
+	defer ws.Close()
+	ws.session = sess //Finished reports go behind a download link
+
+	//Sign in, get the data and build the report.
+	//A repeat of a submission still running waits for that one's report.
+	rep, cfg, key, rerr, owner := reportJobs.run(jobKey(sess, r), func() (*Report, Config, string, *requestError) {
+		return reportForRequest(r, ws)
+	})
+	if key != "" {
+		sess.accountKey = key
+	}
+	//Only a signed in report binds the session to a profile - see profileFor
+	if profile := profileFor(r); rerr == nil && profile != "" {
+		sess.profile = profile
+		if r.PostFormValue("rememberprefs") == "on" {
+			rememberFormChoices(sess.profile, r)
+		}
+	}
+	appSessions.save(sess)
+	if rerr != nil {
+		showRequestError(w, r, ws, rerr) //Handle tidepool things like 403 error
+		return
+	}
 
-	//Check the http respose code - want 200 OK
-	if resp.StatusCode != 200 {
-		check(nil, "Data API call: Unexpected response status =  "+resp.Status)
+	//Email it as a PDF instead when asked - see tidepoolEmail.go
+	if to := strings.TrimSpace(r.PostFormValue("emailto")); to != "" {
+		if err := emailReport(ws, cfg, rep, to); err != nil {
+			log.Println("Error emailing the report", err)
+			DisplayMessageScreen(w, "Sorry, the report couldn't be emailed: "+err.Error())
+			return
+		}
+		DisplayMessageScreen(w, "The report for "+rep.Range()+" was emailed to "+to+".")
+		if owner {
+			postProcess(rep, "pdf")
+		}
+		return
 	}
 
-	//Get the body of the response - contains the requested test results
-	//data is read as byte type
-	data, err := ioutil.ReadAll(resp.Body)
-	check(err, "Error getting the data file from response body.")
-
-	//Write it to a file
-	err = ioutil.WriteFile("tidepool.json", data, 0775)
-	check(err, "Error saving the result data file")
-
-    
-    //Extract the result data
-    err, s := decodeTidepoolData("tidepool.json")
-    if err != nil{
-        _ = CheckTidepoolErrorResponse(w,"tidepool.json") //Handle tidepool things like 403 error
-        return
-    }
-    
-    //Empty result set?
-    if len(s) == 0 {
-        log.Println("No results were returned from Tidepool.")
-    }
-
-    CreatePDF(w, s)
-
-	//Display the pdf in the browser
-	ShowPDF(w, r, "tidepool.pdf")
+	//Send it in the chosen format. A repeated submission shares the report
+	//so only the one that built it runs the post processors.
+	w.Header().Set("Vary", "Accept")
+	rd.render(w, r, ws, cfg, rep)
+	if owner {
+		postProcess(rep, rd.format)
+	}
 }
 
 /*
@@ -284,60 +245,56 @@ func checkDateRanges(sdate string, edate string) string {
 	return qs
 }
 
-//Extract the result fields into s slice of smbg structs
-func decodeTidepoolData(filename string) (error, []Smbg){
-	var smbgs []Smbg //Slice of smbg structures
-	var psmbg Smbg //An smbg struct object
-
-	//Load the result set
-    file, err := ioutil.ReadFile(filename)
-	check(err, "Error loading result json file")
-
-	//Tidepool smbg struct 
-    result := tpMeasurement{}
-    
-	//Extract the measurement records
-    err = json.Unmarshal([]byte(file), &result)
-    if err != nil{
-        return errors.New("Tidepool appears to have returned an error response"), nil
-    }
-    
-	//Scan the json and construct the smbg array to pass to the pdf writer.
-	//All we pass is date, time and value in a structure of strings
-	for i := range result {
-		//The smbg type is the measurement we want. A few others show up...
-        if result[i].Type != "smbg" {
-			continue
-		} 
-
-		//Break out the measurement date & time
-		var measdt string = result[i].Devicetime //Example: 2021-03-17T08:33:00
-		var measDate string = measdt[:10]        //Date string
-		var measTime string = measdt[11:19]      //Time string
-
-		//The test result arrives as a float representing Mmols/L. We want mg/dl
-		//Conversion is Mmol/L * 18 = mg/dl. We want an integer string
-		var measvals string = strconv.Itoa(int(result[i].Value * 18)) //To mg/dl -> integer -> string
-
-		//Fill out the smbg structure
-		psmbg.smbgDate = measDate
-		psmbg.smbgTime = measTime
-		psmbg.smbgValue = measvals
-
-		//Append it to the smbg slice
-		smbgs = append(smbgs, psmbg)
-        
+//Load the saved Tidepool result set - see decodeRecords
+func loadRecords(filename string, strict bool) (tpMeasurement, int, error) {
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeRecords(file, strict)
+}
+
+//BuildReport - build the report from the saved Tidepool data and any
+//notes.json saved beside it. The errors match ErrBadDateRange, ErrNoData
+//or, when the file is not a result set, ErrTidepoolUnavailable - see
+//tidepoolErrors.go. A file that can't be read gives the *os.PathError.
+func BuildReport(datafile string, opts ReportOptions) (*Report, error) {
+	data, err := ioutil.ReadFile(datafile)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := ioutil.ReadFile(filepath.Join(filepath.Dir(datafile), "notes.json"))
+	if err != nil {
+		notes = nil
 	}
-    return nil, smbgs
-    
+	return BuildReportFromData(data, notes, opts)
 }
 
+//Extract the result fields into s slice of smbg structs.
+//Values are converted by their own units - readings in units that can't be
+//converted are a DecodeError rather than a wrong number.
+func decodeTidepoolData(filename string) (error, []Smbg) {
+	result, _, err := loadRecords(filename, false)
+	if err != nil {
+		return err, nil
+	}
+	var problems []string
+	for i := range result {
+		if p := unitsProblem(i, result[i].Type, result[i].ID, result[i].Units); p != "" && result[i].Type == "smbg" {
+			problems = append(problems, p)
+		}
+	}
+	if problems != nil {
+		return &DecodeError{Problems: problems}, nil
+	}
+	return nil, smbgsFrom(result)
+}
 
 //Load and Render the HTML to the browser.
 //Called by the router events in main().
 func render(w http.ResponseWriter, filename string, data interface{}) {
 	//Load and parse the html file
-	tmpl, err := template.ParseFiles(filename)
+	tmpl, err := parseTemplate(filename)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Sorry, something went wrong", http.StatusInternalServerError)
@@ -349,4 +306,3 @@ func render(w http.ResponseWriter, filename string, data interface{}) {
 		http.Error(w, "Sorry, something went wrong", http.StatusInternalServerError)
 	}
 }
-
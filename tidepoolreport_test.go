@@ -0,0 +1,101 @@
+//go:build !js
+// +build !js
+
+package tidepoolreport
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//A demo report with someone else's email mustn't open their profile
+func TestDemoReportBindsNoProfile(t *testing.T) {
+	saved := prefs
+	prefs = &prefsStore{filename: filepath.Join(t.TempDir(), "prefs.json")}
+	defer func() { prefs = saved }()
+	prefs.put("victim@example.com", Preferences{Units: MmolL, Format: "pdf"})
+
+	form := url.Values{
+		"demo":          {"on"},
+		"useremail":     {"Victim@example.com"},
+		"rememberprefs": {"on"},
+		"format":        {"html"},
+		"datatype":      {"cbg"},
+		"sincelast":     {"on"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/opts", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	send(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("demo report status %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("no session cookie")
+	}
+
+	sess := appSessions.load(cookies[0].Value)
+	if sess == nil || sess.profile != "" {
+		t.Fatalf("demo session bound to profile %+v", sess)
+	}
+	if pr := prefs.get("victim@example.com"); pr.Format != "pdf" {
+		t.Errorf("demo report changed the profile's preferences: %+v", pr)
+	}
+
+	//None of the profile's endpoints answer for the session
+	for _, ep := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/prefs/export", exportPreferences},
+		{"/export", exportProfile},
+		{"/archive/year", yearInReview},
+		{"/reviews", reviewPage},
+	} {
+		r := httptest.NewRequest(http.MethodGet, ep.path, nil)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		ep.handler(w, r)
+		if strings.Contains(w.Body.String(), "victim@example.com") || strings.Contains(w.Header().Get("Content-Disposition"), "attachment") {
+			t.Errorf("%s answered for the demo session: %s", ep.path, w.Body.String())
+		}
+	}
+}
+
+//The profile of a demo request is none, of a signed in one the email
+func TestProfileFor(t *testing.T) {
+	for _, c := range []struct {
+		form url.Values
+		want string
+	}{
+		{url.Values{"useremail": {"A@Example.com"}}, "a@example.com"},
+		{url.Values{"useremail": {"a@example.com"}, "demo": {"on"}}, ""},
+		{url.Values{"tidepooluserid": {"abc123"}, "restrictedtoken": {"t"}}, "abc123"},
+		{url.Values{"tidepooluserid": {"abc123"}, "restrictedtoken": {"t"}, "demo": {"on"}}, ""},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/opts", strings.NewReader(c.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if got := profileFor(r); got != c.want {
+			t.Errorf("profileFor(%v) = %q, want %q", c.form, got, c.want)
+		}
+	}
+}
+
+//A missing data file is an error for the caller, not the end of the program
+func TestBuildReportMissingFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "tidepool.json")
+	opts := ReportOptions{StartDate: "2026-01-01", EndDate: "2026-01-07"}
+	if _, err := BuildReport(missing, opts); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("BuildReport: %v", err)
+	}
+	if _, err := BuildReportFromChunks([]string{missing}, opts); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("BuildReportFromChunks: %v", err)
+	}
+}
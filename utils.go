@@ -1,11 +1,13 @@
+//go:build !js
+// +build !js
+
 package tidepoolreport
 
 import (
 	"encoding/json"
-	"html/template"
+    "errors"
 	"io/ioutil"
 	"net/http"
-    "errors"
 )
 
 
@@ -22,7 +24,7 @@ func CheckTidepoolErrorResponse(w http.ResponseWriter, filename string) (err err
         return errors.New("Unable to decode assumed Tidepool error response.")
     }
     
-    tmpl, err := template.ParseFiles("templates/ErrorMessageScreen.html")
+    tmpl, err := parseTemplate("templates/ErrorMessageScreen.html")
     check(err, "Failed to parse the error message template.")
     
     err =  tmpl.Execute(w, tpe)
@@ -35,7 +37,7 @@ func CheckTidepoolErrorResponse(w http.ResponseWriter, filename string) (err err
 //Param is a single string. 
 func DisplayMessageScreen(w http.ResponseWriter, msg string){
             
-        tmpl, err := template.ParseFiles("templates/ErrorMessageScreen.html")
+        tmpl, err := parseTemplate("templates/ErrorMessageScreen.html")
         check(err, "Failed to parse the error message template.")
         
         err =  tmpl.Execute(w, msg)
@@ -0,0 +1,19 @@
+//go:build js && wasm
+// +build js,wasm
+
+/*
+   The report engine as WebAssembly for static/wasm/index.html.
+
+       GOOS=js GOARCH=wasm go build -o static/wasm/tidepoolreport.wasm ./wasm
+       cp "$(go env GOROOT)/misc/wasm/wasm_exec.js" static/wasm/
+
+   wasm_exec.js is in lib/wasm rather than misc/wasm from Go 1.24.
+*/
+package main
+
+import tidepoolreport "github.com/edrobinson/TidepoolReport"
+
+func main() {
+	tidepoolreport.ExportJS()
+	select {} //Keep running so the page can call in
+}